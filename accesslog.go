@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Access log file, optionally rotated by size. Safe for concurrent use.
+type AccessLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // Rotate once the file would grow beyond this, 0 disables rotation
+	keep    int   // Number of rotated files kept
+	file    *os.File
+	size    int64
+	broken  bool // Writes failed and are going to stderr
+}
+
+// Opens (or creates) the access log at the given path.
+func OpenAccessLog(path string, maxSize int64, keep int) (*AccessLog, error) {
+	l := &AccessLog{path: path, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *AccessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Reopens the log file, for use after it was moved by logrotate.
+func (l *AccessLog) Reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if err := l.open(); err != nil {
+		log.Printf("Error reopening access log %s\n", l.path)
+		log.Println(err.Error())
+		return
+	}
+
+	l.broken = false
+	log.Println("Reopened access log", l.path)
+}
+
+// Shifts path.N-1 to path.N and so on down to path to path.1, dropping anything
+// beyond the number of files we keep.
+func (l *AccessLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.keep > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(l.path)
+	}
+
+	return l.open()
+}
+
+// Writes a line to the log, falling back to stderr (with a single warning) if
+// the file can't be written.
+func (l *AccessLog) Write(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.broken {
+		var err error
+		if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize {
+			err = l.rotate()
+		}
+		if err == nil {
+			var n int
+			n, err = l.file.Write(line)
+			l.size += int64(n)
+		}
+		if err == nil {
+			return
+		}
+
+		l.broken = true
+		log.Printf("Warning: cannot write access log %s, logging to stderr until reopened\n", l.path)
+		log.Println(err.Error())
+	}
+
+	os.Stderr.Write(line)
+}
+
+// Records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Allows http.ResponseController to reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware writing every request to the access log in the combined log format.
+func (app *App) AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		size := "-"
+		if sw.size > 0 {
+			size = fmt.Sprint(sw.size)
+		}
+
+		line := fmt.Sprintf("%s - - [%s] %q %d %s %q %q\n",
+			host,
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto,
+			status,
+			size,
+			orDash(r.Referer()),
+			orDash(r.UserAgent()),
+		)
+		app.AccessLog.Write([]byte(line))
+	})
+}
+
+// Replaces empty log fields with a dash.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Event as returned by the JSON API, with URLs for its media
+type apiEvent struct {
+	*Event
+	VideoURL  string        `json:"video_url"`            // Empty for snapshots, which have no video
+	PublicURL string        `json:"public_url,omitempty"` // Link to the event's public page, only while it's public
+	ImageURL  string        `json:"image_url"`
+	Snippet   template.HTML `json:"snippet,omitempty"` // Matching text, for searches
+	Media     []apiMedia    `json:"media"`
+	Labels    []*Label      `json:"labels"` // Found by object detection, most confident first
+}
+
+// Media as returned by the JSON API, with its URL
+type apiMedia struct {
+	*Media
+	URL string `json:"url"`
+}
+
+// Wraps an event for the JSON API.
+func (app *App) apiEvent(event *Event) apiEvent {
+	media, err := app.EventMedia(event.Id)
+	if err != nil {
+		panic(err)
+	}
+
+	wrapped := apiEvent{
+		Event:    event,
+		ImageURL: app.URL(app.MediaURL(event.Image)),
+		Media:    make([]apiMedia, 0, len(media)),
+	}
+	if event.Video != "" {
+		wrapped.VideoURL = app.URL(app.MediaURL(event.Video))
+	}
+	if event.Public {
+		wrapped.PublicURL = app.PublicURL(event.PublicPath())
+	}
+	for _, m := range media {
+		wrapped.Media = append(wrapped.Media, apiMedia{Media: m, URL: app.URL(app.MediaURL(m.Path))})
+	}
+	if wrapped.Labels, err = app.EventLabels(event.Id); err != nil {
+		panic(err)
+	}
+
+	return wrapped
+}
+
+// Writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Machine readable codes of JSON error responses
+const (
+	ErrBadRequest   = "bad_request"
+	ErrMissingField = "missing_field"
+	ErrInvalidField = "invalid_field"
+	ErrTooLarge     = "file_too_large"
+	ErrContentType  = "bad_content_type"
+	ErrTimeout      = "timeout"
+	ErrUnauthorized = "unauthorized"
+	ErrTokenUnknown = "token_unknown"
+	ErrTokenUsed    = "token_used"
+	ErrTokenExpired = "token_expired"
+	ErrForbidden    = "forbidden"
+	ErrNotFound     = "not_found"
+	ErrConflict     = "conflict"
+	ErrRejected     = "rejected"
+	ErrRateLimited  = "rate_limited"
+	ErrInternal     = "internal"
+	ErrUpstream     = "upstream_error"
+	ErrUnavailable  = "unavailable"
+)
+
+// Code of errors that don't name one, by status
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusRequestTimeout:        ErrTimeout,
+	http.StatusConflict:              ErrConflict,
+	http.StatusUnprocessableEntity:   ErrRejected,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusUnsupportedMediaType:  ErrContentType,
+	http.StatusTooManyRequests:       ErrRateLimited,
+	http.StatusInternalServerError:   ErrInternal,
+	http.StatusBadGateway:            ErrUpstream,
+	http.StatusServiceUnavailable:    ErrUnavailable,
+}
+
+// Error of a JSON error response, {"error": {...}}
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`  // Parameter or form field at fault
+	Schema  string `json:"schema,omitempty"` // Rule of the OpenAPI document broken
+}
+
+// Writes a JSON error response with the given status code and the code that
+// goes with it.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = ErrBadRequest
+		if status >= 500 {
+			code = ErrInternal
+		}
+	}
+	writeAPIError(w, status, apiError{Code: code, Message: message})
+}
+
+// Writes a 400 for a missing (ErrMissingField) or unacceptable (ErrInvalidField)
+// parameter or form field.
+func writeFieldError(w http.ResponseWriter, code, field, message string) {
+	writeAPIError(w, http.StatusBadRequest, apiError{Code: code, Message: message, Field: field})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err apiError) {
+	writeJSON(w, status, map[string]apiError{"error": err})
+}
+
+// Looks up the event named by the :id parameter, writing a 404 and returning nil
+// when there is no such event.
+func (app *App) apiLookupEvent(w http.ResponseWriter, p httprouter.Params) *Event {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "event not found")
+		return nil
+	}
+
+	event, err := app.FindEvent(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "event not found")
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	return event
+}
+
+// Lists the most recent events, newest first. The number of events is controlled
+// with the limit parameter (default 20, at most 100). With the search parameter
+// the best matches are listed instead, each with a highlighted snippet.
+func (app *App) APIListEventsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			writeFieldError(w, ErrInvalidField, "limit", "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	var sinceID int64
+	if v := r.URL.Query().Get("since_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeFieldError(w, ErrInvalidField, "since_id", "since_id must be an event id")
+			return
+		}
+		sinceID = n
+	}
+
+	var cameraID int64
+	if v := r.URL.Query().Get("camera"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "camera", "camera must be a camera id")
+			return
+		}
+		if _, err := app.FindCamera(id); err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "camera not found")
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		cameraID = id
+	}
+
+	var minScore float64
+	if v := r.URL.Query().Get("min_score"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			writeFieldError(w, ErrInvalidField, "min_score", "min_score must be between 0 and 1")
+			return
+		}
+		minScore = f
+	}
+	label := strings.TrimSpace(r.URL.Query().Get("label"))
+	filter := eventFilter{CameraId: cameraID, MinScore: minScore, Label: label}
+
+	var beforeID int64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "cursor", "invalid cursor")
+			return
+		}
+		beforeID = id
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("search"))
+	if beforeID > 0 && (search != "" || sinceID > 0) {
+		writeFieldError(w, ErrInvalidField, "cursor", "cursor can't be combined with search or since_id")
+		return
+	}
+
+	if app.NotModified(w, r, app.EventsETag()) {
+		return
+	}
+
+	events := make([]apiEvent, 0)
+	if search != "" {
+		results, err := app.SearchEvents(search, filter, sinceID, limit)
+		if err != nil {
+			panic(err)
+		}
+		for _, result := range results {
+			event := app.apiEvent(result.Event)
+			event.Snippet = result.Snippet
+			events = append(events, event)
+		}
+	} else if sinceID > 0 {
+		for _, event := range app.EventsSince(filter, sinceID, limit) {
+			events = append(events, app.apiEvent(event))
+		}
+	} else {
+		if beforeID == 0 {
+			beforeID = math.MaxInt64
+		}
+		page := app.EventsBefore(filter, beforeID, limit)
+		for _, event := range page {
+			events = append(events, app.apiEvent(event))
+		}
+
+		// A full page may have more after it
+		if len(page) == limit {
+			cursor := encodeCursor(page[len(page)-1].Id)
+			next := url.Values{"cursor": {cursor}, "limit": {strconv.Itoa(limit)}}
+			if cameraID > 0 {
+				next.Set("camera", strconv.FormatInt(cameraID, 10))
+			}
+			if minScore > 0 {
+				next.Set("min_score", strconv.FormatFloat(minScore, 'f', -1, 64))
+			}
+			if label != "" {
+				next.Set("label", label)
+			}
+			w.Header().Set("X-Next-Cursor", cursor)
+			w.Header().Set("Link", "<"+app.URL(r.URL.Path)+"?"+next.Encode()+`>; rel="next"`)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+// Encodes the id of the last event on a page as an opaque cursor.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("before:" + strconv.FormatInt(id, 10)))
+}
+
+// Decodes a cursor from encodeCursor back into the event id.
+func decodeCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	v := strings.TrimPrefix(string(raw), "before:")
+	if v == string(raw) {
+		return 0, errors.New("malformed cursor")
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("malformed cursor")
+	}
+	return id, nil
+}
+
+// Narrows down the events listed, zero values don't filter
+type eventFilter struct {
+	CameraId int64
+	MinScore float64 // Events that weren't scored never match
+	Label    string  // Found by object detection
+	Since    time.Time
+	Until    time.Time // Exclusive
+}
+
+// SQL condition matching the filter and its arguments, columns are qualified
+// with table unless it's empty.
+func (f eventFilter) where(table string) (string, []interface{}) {
+	if table != "" {
+		table += "."
+	}
+	var since, until interface{}
+	if !f.Since.IsZero() {
+		since = f.Since.UTC()
+	}
+	if !f.Until.IsZero() {
+		until = f.Until.UTC()
+	}
+	cond := `(? = 0 OR ` + table + `camera_id = ?) AND (? = 0 OR ` + table + `score >= ?) AND
+	(? = '' OR EXISTS (SELECT 1 FROM event_labels WHERE event_id = ` + table + `id AND label = ?)) AND
+	(? IS NULL OR ` + table + `time >= ?) AND (? IS NULL OR ` + table + `time < ?)`
+	return cond, []interface{}{f.CameraId, f.CameraId, f.MinScore, f.MinScore, f.Label, f.Label, since, since, until, until}
+}
+
+// Retrieves the most recent events, newest first.
+func (app *App) RecentEvents(limit int) []*Event {
+	return app.EventsBefore(eventFilter{}, math.MaxInt64, limit)
+}
+
+// Retrieves the events created before beforeID that match the filter, newest
+// first. Pages continue from the last id seen, so events arriving in the
+// meantime don't shift them.
+func (app *App) EventsBefore(filter eventFilter, beforeID int64, limit int) []*Event {
+	cond, args := filter.where("")
+	sql_events := `
+	SELECT ` + eventColumns + ` FROM events
+	WHERE id < ? AND ` + cond + `
+	ORDER BY id DESC LIMIT ?`
+	args = append([]interface{}{beforeID}, args...)
+	return app.queryEvents(sql_events, append(args, limit)...)
+}
+
+// Retrieves the events created after sinceID that match the filter, newest
+// first. When there are more than limit it's the oldest of them, so polling
+// again with the highest id returned catches up without skipping any. Ids are
+// never reused, deletions don't affect this.
+func (app *App) EventsSince(filter eventFilter, sinceID int64, limit int) []*Event {
+	cond, args := filter.where("")
+	sql_events := `
+	SELECT * FROM (
+		SELECT ` + eventColumns + ` FROM events
+		WHERE id > ? AND ` + cond + `
+		ORDER BY id LIMIT ?
+	) ORDER BY id DESC`
+	args = append([]interface{}{sinceID}, args...)
+	return app.queryEvents(sql_events, append(args, limit)...)
+}
+
+// Runs a query selecting eventColumns and scans every row.
+func (app *App) queryEvents(query string, args ...interface{}) []*Event {
+	rows, err := app.DB.Query(query, args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	events := make([]*Event, 0)
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			panic(err)
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return events
+}
+
+// Returns a single event.
+func (app *App) APIEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Deletes an event and its media. Protected events are refused with a 409.
+func (app *App) APIDeleteEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	err := app.DeleteEvent(event.Id, actorOf(r), r.RemoteAddr)
+	if err == errProtected {
+		writeJSONError(w, http.StatusConflict, "event is protected, unprotect it before deleting")
+		return
+	} else if err == errEvidence {
+		writeJSONError(w, http.StatusConflict, "event is kept as evidence, an admin has to release it before deleting")
+		return
+	} else if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "event not found")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	app.Log(r).Printf("Deleted event %d (%s)\n", event.Id, event.Name)
+	app.SecurityRequest(r, SecurityDelete, syslogNotice, "event %d (%s) deleted by %s", event.Id, event.Name, actorOf(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Renames an event to the name parameter.
+func (app *App) APIRenameEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		writeFieldError(w, ErrMissingField, "name", "name is required")
+		return
+	}
+	if err := app.RenameEvent(event.Id, name, actorOf(r), r.RemoteAddr); err != nil {
+		panic(err)
+	}
+
+	event.Name = name
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Replaces an event's notes with the notes parameter, empty notes clear them.
+func (app *App) APINotesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	notes := strings.TrimSpace(r.FormValue("notes"))
+	if err := app.SetNotes(event.Id, notes); err != nil {
+		panic(err)
+	}
+
+	event.Notes = notes
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Protects an event from deletion (protected=true) or lifts it (protected=false).
+func (app *App) APIProtectEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	protected, err := strconv.ParseBool(r.FormValue("protected"))
+	if err != nil {
+		writeFieldError(w, ErrInvalidField, "protected", "protected must be true or false")
+		return
+	}
+	if err := app.SetProtected(event.Id, protected, actorOf(r), r.RemoteAddr); err != nil {
+		panic(err)
+	}
+
+	event.Protected = protected
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Sets an event's expiry from the expiry parameter: a duration from now (720h),
+// an RFC 3339 timestamp, or empty (or null) to go back to the retention limits.
+func (app *App) APIExpiryHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	expiresAt, err := parseExpiry(r.FormValue("expiry"), time.Now())
+	if err != nil {
+		writeFieldError(w, ErrInvalidField, "expiry", err.Error())
+		return
+	}
+	if err := app.SetExpiry(event.Id, expiresAt, actorOf(r), r.RemoteAddr); err != nil {
+		panic(err)
+	}
+
+	event.ExpiresAt = expiresAt
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Parses an expiry given as a duration from now or a timestamp, nil for none.
+// Expiries that already passed are refused.
+func parseExpiry(value string, now time.Time) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "null" {
+		return nil, nil
+	}
+
+	var expiresAt time.Time
+	if d, err := time.ParseDuration(value); err == nil {
+		expiresAt = now.Add(d)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		expiresAt = t
+	} else {
+		return nil, errors.New("expiry must be a duration (720h) or an RFC 3339 timestamp")
+	}
+
+	if !expiresAt.After(now) {
+		return nil, errors.New("expiry is in the past")
+	}
+	expiresAt = expiresAt.UTC().Truncate(time.Second)
+	return &expiresAt, nil
+}
+
+// Queues a failed event for conversion again. Conversion needs the original video,
+// which is only kept around when the previous attempt failed.
+func (app *App) APIRetranscodeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	if app.FFmpeg == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "ffmpeg is unavailable")
+		return
+	}
+	if event.Status != StatusFailed {
+		writeJSONError(w, http.StatusConflict, "only failed events can be retranscoded, event is "+event.Status)
+		return
+	}
+	if event.EvidenceAt != nil {
+		writeJSONError(w, http.StatusConflict, "event is kept as evidence, its video can't be replaced")
+		return
+	}
+	if _, err := os.Stat(event.Video); os.IsNotExist(err) {
+		writeJSONError(w, http.StatusConflict, "original video "+app.MediaURL(event.Video)+" no longer exists, nothing to retranscode")
+		return
+	}
+
+	if err := app.SetEventStatus(event.Id, StatusPending, ""); err != nil {
+		panic(err)
+	}
+	if app.Transcodes.Queue(transcodeJob{Id: event.Id, RequestID: RequestID(r.Context())}) {
+		app.Log(r).Println("Queued event", event.Id, "for conversion again")
+	}
+
+	event.Status = StatusPending
+	event.LastError = ""
+	writeJSON(w, http.StatusAccepted, app.apiEvent(event))
+}
+
+// Largest file a JSON upload may carry, once decoded
+const jsonUploadMax = 5 << 20
+
+// Largest request body the API reads, a JSON upload of both files at the limit
+// with room to spare for the base64 overhead
+const maxAPIBody = 16 << 20
+
+// Body of a JSON upload
+type jsonUpload struct {
+	Name     string          `json:"name"`
+	Camera   string          `json:"camera"`
+	Video    string          `json:"video_b64"`
+	Image    string          `json:"image_b64"`
+	Notify   *bool           `json:"notify"`
+	Metadata json.RawMessage `json:"metadata"`
+	External string          `json:"external_id"`
+	Location string          `json:"location"`
+	Lat      *float64        `json:"latitude"`
+	Lon      *float64        `json:"longitude"`
+}
+
+// Extensions of the media types uploads are sniffed as
+var uploadExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"video/avi":       ".avi",
+	"application/ogg": ".ogv",
+}
+
+// Creates an event from a JSON document carrying its files base64 encoded, for
+// clients that can't send multipart forms. The event goes through the same
+// storage, conversion and notifications as one posted to /event/new. Without
+// an image a frame of the video is used instead.
+func (app *App) APICreateEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	logger := app.Log(r)
+	uploadsActive.Add(1)
+	defer uploadsActive.Add(-1)
+
+	var body jsonUpload
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	// The image can be left out as long as there's ffmpeg to take one
+	images := 0
+	if body.Image != "" || app.FFmpeg != "" {
+		images = 1
+	}
+	if part := missingUploadPart(body.Name, body.Camera, len(body.Video), images); part != "" {
+		field := map[string]string{"name": "name", "video": "video_b64", "image": "image_b64"}[part]
+		writeFieldError(w, ErrMissingField, field, field+" is required")
+		return
+	}
+
+	upload := eventUpload{
+		Name:       body.Name,
+		Camera:     uploadCamera(r, body.Camera),
+		Notify:     wantsNotification(r) && (body.Notify == nil || *body.Notify),
+		Meta:       body.Metadata,
+		ExternalID: strings.TrimSpace(body.External),
+		Location:   location{Text: strings.TrimSpace(body.Location), Latitude: body.Lat, Longitude: body.Lon},
+	}
+	if !checkExternalID(w, upload) || !checkLocation(w, upload) {
+		return
+	}
+	handedOver := false
+	defer func() {
+		if handedOver {
+			return
+		}
+		for _, file := range append(upload.Videos, upload.Images...) {
+			os.Remove(file.Path)
+		}
+	}()
+
+	// Files are named after the time they were received, with the extension of
+	// what they turn out to be
+	stamp := time.Now().UTC().Format("20060102-150405.000000")
+	video, _, ok := app.stageBase64(w, r, body.Video, "video_b64", stamp)
+	if !ok {
+		return
+	}
+	upload.Videos = append(upload.Videos, video)
+
+	if body.Image != "" {
+		image, kind, ok := app.stageBase64(w, r, body.Image, "image_b64", stamp)
+		if !ok {
+			return
+		}
+		upload.Images = append(upload.Images, image)
+		if !strings.HasPrefix(kind, "image/") {
+			writeFieldError(w, ErrInvalidField, "image_b64", "image_b64 isn't an image")
+			return
+		}
+	} else if err := app.stageFrame(&upload, stamp); err != nil {
+		logger.Println("Error taking an image from the uploaded video")
+		logger.Println(err.Error())
+		writeFieldError(w, ErrInvalidField, "video_b64", "no image could be taken from video_b64, send image_b64 along")
+		return
+	}
+
+	// StoreEvent takes care of the staged files from here
+	handedOver = true
+	created, err := app.StoreEvent(logger, RequestID(r.Context()), upload)
+	app.writeStored(w, r, created, err)
+}
+
+// Decodes a base64 encoded file of a JSON upload into the staging directory,
+// named stamp with the extension of its sniffed type, which is returned along.
+// Writes the error response and returns false when it isn't valid base64 or is
+// too large.
+func (app *App) stageBase64(w http.ResponseWriter, r *http.Request, encoded, field, stamp string) (stagedFile, string, bool) {
+	tooLarge := apiError{Code: ErrTooLarge, Field: field, Message: fmt.Sprintf("%s may be at most %d bytes decoded", field, jsonUploadMax)}
+	if base64.StdEncoding.DecodedLen(len(encoded)) > jsonUploadMax+2 {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, tooLarge)
+		return stagedFile{}, "", false
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		writeFieldError(w, ErrInvalidField, field, field+" isn't valid base64")
+		return stagedFile{}, "", false
+	}
+	if len(data) > jsonUploadMax {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, tooLarge)
+		return stagedFile{}, "", false
+	}
+
+	path, err := app.StageUpload(bytes.NewReader(data))
+	if err != nil {
+		app.Log(r).Println("Error receiving upload, discarding it")
+		app.Log(r).Println(err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "error receiving "+field)
+		return stagedFile{}, "", false
+	}
+	kind := http.DetectContentType(data)
+
+	return stagedFile{Path: path, Name: uploadName(stamp, kind)}, kind, true
+}
+
+// Names a file received without a name after stamp, with the extension of its
+// sniffed content type.
+func uploadName(stamp, kind string) string {
+	ext, ok := uploadExtensions[kind]
+	if !ok {
+		ext = ".bin"
+	}
+	return stamp + ext
+}
+
+// Stages a frame of an upload's first video as its image, for uploads that
+// came without one.
+func (app *App) stageFrame(upload *eventUpload, stamp string) error {
+	path, err := app.StageUpload(strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	upload.Images = append(upload.Images, stagedFile{Path: path, Name: stamp + ".jpg"})
+
+	return app.videoFrame(upload.Videos[0].Path, path)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Multipart upload of the given fields and files (form field to contents),
+// every file named after its field.
+func multipartUpload(t *testing.T, fields map[string]string, files map[string]io.Reader) (io.Reader, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for field, value := range fields {
+		if err := form.WriteField(field, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for field, r := range files {
+		part, err := form.CreateFormFile(field, field+".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(part, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, form.FormDataContentType()
+}
+
+// Decodes a JSON error response, failing on anything but the envelope.
+func decodeAPIError(t *testing.T, resp *http.Response) apiError {
+	t.Helper()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("error response is %s, expected application/json", ct)
+	}
+	var body struct {
+		Error *apiError `json:"error"`
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		t.Fatalf("error response isn't the envelope: %s", err)
+	}
+	if body.Error == nil || body.Error.Message == "" {
+		t.Fatalf("error response lacks the error or its message: %+v", body.Error)
+	}
+	return *body.Error
+}
+
+// Every kind of error answers with the envelope, its status and its code, and
+// names the field at fault where there is one.
+func TestAPIErrorShapes(t *testing.T) {
+	config := testConfig(t)
+	config.apiKey = "camera-key"
+	server := newTestServer(t, newTestAppWith(t, config))
+
+	upload := func(fields map[string]string, files map[string]io.Reader) *http.Request {
+		body, contentType := multipartUpload(t, fields, files)
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/event/new", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Api-Key", "camera-key")
+		return req
+	}
+	file := func(s string) io.Reader { return strings.NewReader(s) }
+
+	tests := []struct {
+		name   string
+		req    func() *http.Request
+		status int
+		code   string
+		field  string
+	}{
+		{"missing name", func() *http.Request {
+			return upload(nil, map[string]io.Reader{"video": file("video"), "image": file("image")})
+		}, http.StatusBadRequest, ErrMissingField, "name"},
+		{"missing video", func() *http.Request {
+			return upload(map[string]string{"name": "Front door"}, map[string]io.Reader{"image": file("image")})
+		}, http.StatusBadRequest, ErrMissingField, "video"},
+		{"missing image", func() *http.Request {
+			return upload(map[string]string{"name": "Front door"}, map[string]io.Reader{"video": file("video")})
+		}, http.StatusBadRequest, ErrMissingField, "image"},
+		{"missing API field", func() *http.Request {
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/events", strings.NewReader(`{"name": "Front door"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Api-Key", "camera-key")
+			return req
+		}, http.StatusBadRequest, ErrMissingField, "video_b64"},
+		{"unknown parameter", func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/events?colour=red", nil)
+			return req
+		}, http.StatusBadRequest, ErrInvalidField, "colour"},
+		{"upload too large", func() *http.Request {
+			video := io.LimitReader(zeros{}, maxUploadSize+1)
+			return upload(map[string]string{"name": "Front door"}, map[string]io.Reader{"video": video, "image": file("image")})
+		}, http.StatusRequestEntityTooLarge, ErrTooLarge, ""},
+		{"API body too large", func() *http.Request {
+			body := io.MultiReader(strings.NewReader(`{"name": "`), io.LimitReader(zeros{}, maxAPIBody), strings.NewReader(`"}`))
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/events", body)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Api-Key", "camera-key")
+			return req
+		}, http.StatusRequestEntityTooLarge, ErrTooLarge, ""},
+		{"bad content type", func() *http.Request {
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/event/new", strings.NewReader(`{"name": "Front door"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Api-Key", "camera-key")
+			return req
+		}, http.StatusUnsupportedMediaType, ErrContentType, ""},
+		{"not found", func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/events/404", nil)
+			return req
+		}, http.StatusNotFound, ErrNotFound, ""},
+		{"unauthorized", func() *http.Request {
+			req := upload(map[string]string{"name": "Front door"}, map[string]io.Reader{"video": file("video"), "image": file("image")})
+			req.Header.Set("X-Api-Key", "wrong")
+			return req
+		}, http.StatusUnauthorized, ErrUnauthorized, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.DefaultClient.Do(test.req())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Errorf("status %d, expected %d", resp.StatusCode, test.status)
+			}
+			apiErr := decodeAPIError(t, resp)
+			if apiErr.Code != test.code || apiErr.Field != test.field {
+				t.Errorf("error %+v, expected code %s and field %q", apiErr, test.code, test.field)
+			}
+		})
+	}
+}
+
+// Nothing answers 429 yet, it gets its code all the same.
+func TestAPIErrorRateLimited(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSONError(w, http.StatusTooManyRequests, "slow down")
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status %d, expected %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if apiErr := decodeAPIError(t, resp); apiErr.Code != ErrRateLimited || apiErr.Message != "slow down" {
+		t.Errorf("error %+v, expected code %s", apiErr, ErrRateLimited)
+	}
+}
+
+// Endless zeros, for bodies over the limits.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
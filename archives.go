@@ -0,0 +1,493 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Archive states
+const (
+	ArchivePending  = "pending"
+	ArchiveBuilding = "building"
+	ArchiveReady    = "ready"
+	ArchiveFailed   = "failed"
+)
+
+// Most events a single archive may hold
+const archiveMax = 1000
+
+// How long a finished archive is kept for download
+const archiveTTL = 24 * time.Hour
+
+// Directory in the data directory archives are built in. The dot keeps it out
+// of the data directory's media.
+const archiveDirName = ".archives"
+
+// Zip of the files of several events, built in the background and kept for a
+// day for download. Archives are written with zip64 where needed, so they may
+// go past 4 GiB and 65535 files.
+type Archive struct {
+	Id         int64      `json:"id"`
+	Status     string     `json:"status"`
+	Events     []int64    `json:"event_ids"`
+	BytesTotal int64      `json:"bytes_total"` // Size of the files going in
+	BytesDone  int64      `json:"bytes_done"`  // How much of them is written so far
+	Size       int64      `json:"size"`        // Size of the zip once ready
+	Error      string     `json:"error,omitempty"`
+	Created    time.Time  `json:"created_at"`
+	Expires    *time.Time `json:"expires_at"` // Set once it's finished
+	Download   string     `json:"download_url,omitempty"`
+	Path       string     `json:"-"`
+}
+
+func CreateArchiveTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS archives(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		status TEXT NOT NULL,
+		events TEXT NOT NULL,
+		bytes_total INTEGER NOT NULL DEFAULT 0,
+		bytes_done INTEGER NOT NULL DEFAULT 0,
+		size INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		path TEXT NOT NULL DEFAULT '',
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Directory archives are built in.
+func (app *App) archiveDir() string {
+	return filepath.Join(app.Config.dirs.data, archiveDirName)
+}
+
+// Retrieves an archive.
+func (app *App) FindArchive(id int64) (*Archive, error) {
+	sql_archive := `
+	SELECT id, status, events, bytes_total, bytes_done, size, error, path, created, expires
+	FROM archives WHERE id = ?`
+	a := new(Archive)
+	var events string
+	var expires sql.NullTime
+	err := app.DB.QueryRow(sql_archive, id).Scan(&a.Id, &a.Status, &events, &a.BytesTotal, &a.BytesDone, &a.Size, &a.Error, &a.Path, &a.Created, &expires)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(events), &a.Events); err != nil {
+		return nil, err
+	}
+	if expires.Valid {
+		a.Expires = &expires.Time
+	}
+	if a.Status == ArchiveReady {
+		a.Download = fmt.Sprintf("/api/archives/%d/download", a.Id)
+	}
+	return a, nil
+}
+
+// Stores an archive of the events to be built and wakes up the builder. The
+// total is what their files add up to now, for progress.
+func (app *App) QueueArchive(ids []int64) (int64, error) {
+	events, err := json.Marshal(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	var archive int64
+	err = app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var total int64
+		sql_total := `SELECT COALESCE(SUM(size), 0) FROM media WHERE event_id = ? AND kind IN (?, ?)`
+		for _, id := range ids {
+			var size int64
+			if err := tx.QueryRow(sql_total, id, MediaVideo, MediaImage).Scan(&size); err != nil {
+				return err
+			}
+			total += size
+		}
+		res, err := tx.Exec(`INSERT INTO archives(status, events, bytes_total) VALUES(?, ?, ?)`, ArchivePending, string(events), total)
+		if err != nil {
+			return err
+		}
+		if archive, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case app.Archives <- struct{}{}:
+	default:
+	}
+
+	return archive, nil
+}
+
+// Builds queued archives one at a time, whenever one is queued, and removes
+// those that expired. Archives a restart interrupted are started over.
+func (app *App) ArchiveBuilder() {
+	if err := app.restartArchives(); err != nil {
+		log.Println("Error requeueing interrupted archives")
+		log.Println(err.Error())
+	}
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if !app.ReadOnly.Load() {
+			app.expireArchives()
+			app.buildPendingArchives()
+		}
+
+		select {
+		case <-app.Archives:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Puts archives that were being built back in the queue, removing what they
+// got to.
+func (app *App) restartArchives() error {
+	rows, err := app.DB.Query(`SELECT path FROM archives WHERE status = ? AND path != ''`, ArchiveBuilding)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	for _, path := range paths {
+		os.Remove(path)
+	}
+
+	sql_restart := `UPDATE archives SET status = ?, bytes_done = 0, path = '' WHERE status = ?`
+	return app.retryBusy(func() error {
+		_, err := app.DB.Exec(sql_restart, ArchivePending, ArchiveBuilding)
+		return err
+	})
+}
+
+// Builds every pending archive, oldest first.
+func (app *App) buildPendingArchives() {
+	for {
+		var id int64
+		err := app.DB.QueryRow(`SELECT id FROM archives WHERE status = ? ORDER BY id LIMIT 1`, ArchivePending).Scan(&id)
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			log.Println("Error looking up archives to build")
+			log.Println(err.Error())
+			return
+		}
+
+		archive, err := app.FindArchive(id)
+		if err == nil {
+			err = app.buildArchive(archive)
+		}
+		if err != nil {
+			log.Printf("Error building archive %d\n", id)
+			log.Println(err.Error())
+		}
+		if err := app.finishArchive(id, err); err != nil {
+			log.Printf("Error storing the outcome of archive %d\n", id)
+			log.Println(err.Error())
+			return
+		}
+	}
+}
+
+// Writes the zip of an archive, the video and image of its events stored
+// as they are since they are compressed already. Events deleted in the
+// meantime are left out.
+func (app *App) buildArchive(archive *Archive) error {
+	if err := os.MkdirAll(app.archiveDir(), 0775); err != nil {
+		return err
+	}
+	dst := filepath.Join(app.archiveDir(), fmt.Sprintf("archive-%d.zip", archive.Id))
+	err := app.retryBusy(func() error {
+		_, err := app.DB.Exec(`UPDATE archives SET status = ?, path = ? WHERE id = ?`, ArchiveBuilding, dst, archive.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.sealedOutput(dst, func(path string) error {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		progress := &archiveProgress{app: app, id: archive.Id, reported: time.Now()}
+		zw := zip.NewWriter(f)
+		for _, id := range archive.Events {
+			if err := app.archiveEvent(zw, id, progress); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		progress.report()
+		return f.Close()
+	})
+}
+
+// Adds the files of an event to a zip, named after the event's id.
+func (app *App) archiveEvent(zw *zip.Writer, id int64, progress io.Writer) error {
+	media, err := app.EventMedia(id)
+	if err != nil {
+		return err
+	}
+	for _, m := range media {
+		if m.Kind != MediaVideo && m.Kind != MediaImage {
+			continue
+		}
+		src, err := app.openMedia(m.Path)
+		if os.IsNotExist(err) {
+			log.Printf("Leaving %s out of an archive, it's missing\n", m.Path)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		header := &zip.FileHeader{
+			Name:     fmt.Sprintf("%d-%s", id, filepath.Base(m.Path)),
+			Method:   zip.Store,
+			Modified: m.Created,
+		}
+		w, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(w, io.TeeReader(src, progress))
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counts the bytes of the files going into an archive, storing the count every
+// few seconds.
+type archiveProgress struct {
+	app      *App
+	id       int64
+	done     int64
+	reported time.Time
+}
+
+func (p *archiveProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.reported) >= 2*time.Second {
+		p.report()
+	}
+	return len(b), nil
+}
+
+// Stores the count, progress is only informative so errors are ignored.
+func (p *archiveProgress) report() {
+	p.reported = time.Now()
+	p.app.DB.Exec(`UPDATE archives SET bytes_done = ? WHERE id = ?`, p.done, p.id)
+}
+
+// Marks an archive ready, or failed with the error, starting the time it's
+// kept for.
+func (app *App) finishArchive(id int64, buildErr error) error {
+	expires := time.Now().UTC().Add(archiveTTL)
+	return app.retryBusy(func() error {
+		if buildErr != nil {
+			var path string
+			app.DB.QueryRow(`SELECT path FROM archives WHERE id = ?`, id).Scan(&path)
+			if path != "" {
+				os.Remove(path)
+			}
+			_, err := app.DB.Exec(`UPDATE archives SET status = ?, error = ?, path = '', expires = ? WHERE id = ?`, ArchiveFailed, buildErr.Error(), expires, id)
+			return err
+		}
+
+		var size int64
+		var path string
+		if err := app.DB.QueryRow(`SELECT path FROM archives WHERE id = ?`, id).Scan(&path); err != nil {
+			return err
+		}
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+		_, err := app.DB.Exec(`UPDATE archives SET status = ?, size = ?, expires = ? WHERE id = ?`, ArchiveReady, size, expires, id)
+		return err
+	})
+}
+
+// Removes archives past their expiry along with their zip.
+func (app *App) expireArchives() {
+	rows, err := app.DB.Query(`SELECT id, path FROM archives WHERE expires <= ?`, time.Now().UTC())
+	if err != nil {
+		log.Println("Error looking up expired archives")
+		log.Println(err.Error())
+		return
+	}
+	expired := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			break
+		}
+		expired[id] = path
+	}
+	rows.Close()
+
+	for id, path := range expired {
+		if path != "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing expired archive %s\n", path)
+				log.Println(err.Error())
+				continue
+			}
+		}
+		err := app.retryBusy(func() error {
+			_, err := app.DB.Exec(`DELETE FROM archives WHERE id = ?`, id)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error deleting expired archive %d\n", id)
+			log.Println(err.Error())
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("Removed %d expired archives\n", len(expired))
+	}
+}
+
+// Disk space archives take up, the finished ones and what's written of those
+// being built.
+func (app *App) ArchiveBytes() (int64, error) {
+	sql_bytes := `
+	SELECT COALESCE(SUM(CASE status WHEN ? THEN size ELSE bytes_done END), 0)
+	FROM archives WHERE status IN (?, ?)`
+	var size int64
+	err := app.DB.QueryRow(sql_bytes, ArchiveReady, ArchiveReady, ArchiveBuilding).Scan(&size)
+	return size, err
+}
+
+// Looks up the archive of the id parameter, writing a 404 and returning nil
+// when there's no such archive.
+func (app *App) apiLookupArchive(w http.ResponseWriter, p httprouter.Params) *Archive {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "archive not found")
+		return nil
+	}
+
+	archive, err := app.FindArchive(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "archive not found")
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	return archive
+}
+
+// Queues a zip of the events in the ids field to be built. Nothing is queued
+// if any of the events doesn't exist.
+func (app *App) APICreateArchiveHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Ids []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(body.Ids) == 0 {
+		writeFieldError(w, ErrMissingField, "ids", "ids is required")
+		return
+	}
+	if len(body.Ids) > archiveMax {
+		writeFieldError(w, ErrInvalidField, "ids", fmt.Sprintf("at most %d events can be archived at once", archiveMax))
+		return
+	}
+
+	for _, id := range body.Ids {
+		if _, err := app.FindEvent(id); err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "event "+strconv.FormatInt(id, 10)+" not found")
+			return
+		} else if err != nil {
+			panic(err)
+		}
+	}
+
+	id, err := app.QueueArchive(body.Ids)
+	if err != nil {
+		panic(err)
+	}
+	archive, err := app.FindArchive(id)
+	if err != nil {
+		panic(err)
+	}
+	app.Log(r).Printf("Queued archive %d of %d events\n", id, len(body.Ids))
+	w.Header().Set("Location", app.URL(fmt.Sprintf("/api/archives/%d", id)))
+	writeJSON(w, http.StatusAccepted, archive)
+}
+
+// Returns an archive with how far it got.
+func (app *App) APIArchiveHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	archive := app.apiLookupArchive(w, p)
+	if archive == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, archive)
+}
+
+// Downloads the zip of a ready archive, with Range support so interrupted
+// downloads can be resumed.
+func (app *App) APIDownloadArchiveHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	archive := app.apiLookupArchive(w, p)
+	if archive == nil {
+		return
+	}
+	if archive.Status != ArchiveReady {
+		writeJSONError(w, http.StatusConflict, "archive is "+archive.Status)
+		return
+	}
+
+	w = app.throttle(w, r)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fmt.Sprintf("seccam-%d.zip", archive.Id)))
+	app.serveMedia(w, r, archive.Path)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Actors recorded for changes made by the server itself
+const (
+	ActorRetention = "retention sweep"
+	ActorQuota     = "storage quota"
+	ActorMigration = "migrate-data"
+)
+
+// Anything we can run a statement with, a database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Audit log entry struct
+type AuditEntry struct {
+	Id         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	EventId    *int64    `json:"event_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Detail     string    `json:"detail"`
+}
+
+// Create the audit table in our database.
+func CreateAuditTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS audit(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		event_id INTEGER,
+		remote_addr TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Records an action in the audit log. Pass the transaction making the change so
+// the entry is only kept if the change is, eventID may be 0 for actions not
+// about a single event.
+func Audit(tx execer, actor, action string, eventID int64, remoteAddr, detail string) error {
+	var id interface{}
+	if eventID != 0 {
+		id = eventID
+	}
+
+	sql_audit := `INSERT INTO audit(actor, action, event_id, remote_addr, detail) VALUES (?, ?, ?, ?, ?)`
+	_, err := tx.Exec(sql_audit, actor, action, id, remoteAddr, detail)
+	return err
+}
+
+// Names whoever made the request for the audit log: the signed in user, the
+// API key holder or anonymous when no users exist.
+func actorOf(r *http.Request) string {
+	if user := CurrentUser(r.Context()); user != nil {
+		return user.Username
+	}
+	if r.Header.Get("X-Api-Key") != "" || r.FormValue("api_key") != "" {
+		return "api-key"
+	}
+	if requestUploadToken(r) != "" {
+		return "upload-token"
+	}
+	return "anonymous"
+}
+
+// Retrieves a page of the audit log, newest first.
+func (app *App) GetAudit(limit, offset int) []*AuditEntry {
+	sql_audit := `SELECT id, time, actor, action, event_id, remote_addr, detail FROM audit ORDER BY id DESC LIMIT ? OFFSET ?`
+	rows, err := app.DB.Query(sql_audit, limit, offset)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		entry := new(AuditEntry)
+		var eventID sql.NullInt64
+		err := rows.Scan(&entry.Id, &entry.Time, &entry.Actor, &entry.Action, &eventID, &entry.RemoteAddr, &entry.Detail)
+		if err != nil {
+			panic(err)
+		}
+		if eventID.Valid {
+			entry.EventId = &eventID.Int64
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return entries
+}
+
+// Returns a page of the audit log. Pages are selected with page (from 1) and
+// per_page (default 50, at most 500).
+func (app *App) AuditHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	page, perPage := 1, 50
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeFieldError(w, ErrInvalidField, "page", "page must be a positive number")
+			return
+		}
+		page = n
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeFieldError(w, ErrInvalidField, "per_page", "per_page must be between 1 and 500")
+			return
+		}
+		perPage = n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"page":     page,
+		"per_page": perPage,
+		"entries":  app.GetAudit(perPage, (page-1)*perPage),
+	})
+}
+
+// Dumps the audit log, newest first:
+//
+//	audit [--limit=N]
+func (app *App) AuditCommand(args []string) error {
+	cmd := flag.NewFlagSet("audit", flag.ExitOnError)
+	limit := cmd.Int("limit", 100, "Number of entries to print, 0 for all")
+	cmd.Parse(args)
+
+	n := *limit
+	if n <= 0 {
+		n = -1
+	}
+	for _, entry := range app.GetAudit(n, 0) {
+		eventID := "-"
+		if entry.EventId != nil {
+			eventID = strconv.FormatInt(*entry.EventId, 10)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.Actor, entry.Action, eventID, orDash(entry.RemoteAddr), entry.Detail)
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/battleroid/seccam-web/signature"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Name of the session cookie
+const sessionCookie = "seccam_session"
+
+const userKey contextKey = iota + 100
+
+// Returns the user the request was made by, if any.
+func CurrentUser(ctx context.Context) *User {
+	user, _ := ctx.Value(userKey).(*User)
+	return user
+}
+
+// Hashes a session token for storage, so a leaked database holds no usable sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Starts a session for the user, returning its token.
+func (app *App) CreateSession(user *User) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	sql_session := `INSERT INTO sessions(token, user_id, expires) VALUES (?, ?, ?)`
+	_, err := app.DB.Exec(sql_session, hashToken(token), user.Id, time.Now().Add(app.Config.sessionTTL).UTC())
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Looks up the user of an unexpired session.
+func (app *App) SessionUser(token string) (*User, error) {
+	user := new(User)
+	sql_session := `
+	SELECT users.id, users.username, users.role, users.created
+	FROM sessions JOIN users ON users.id = sessions.user_id
+	WHERE sessions.token = ? AND sessions.expires > ?`
+	err := app.DB.QueryRow(sql_session, hashToken(token), time.Now().UTC()).Scan(&user.Id, &user.Username, &user.Role, &user.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Works out who made the request: a signed in user or the holder of the admin
+// token (who acts as an admin named "admin-token").
+func (app *App) authenticate(r *http.Request) *User {
+	if app.Config.adminToken != "" {
+		if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(app.Config.adminToken)) == 1 {
+				return &User{Username: "admin-token", Role: RoleAdmin}
+			}
+		}
+	}
+
+	// WebDAV clients and calendar apps can't sign in through the login page,
+	// they send the username and password with every request
+	if username, password, ok := r.BasicAuth(); ok && basicAuthRoute(r) {
+		user, err := app.CheckPassword(username, password)
+		if err != nil {
+			app.Log(r).Printf("Failed basic auth login for %q from %s\n", username, r.RemoteAddr)
+			return nil
+		}
+		return user
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	user, err := app.SessionUser(cookie.Value)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	return user
+}
+
+// Routes reachable without signing in. Camera uploads are guarded by the API key
+// instead, shared links by their signature.
+func publicRoute(r *http.Request) bool {
+	switch {
+	case r.URL.Path == "/login", r.URL.Path == "/logout", r.URL.Path == "/healthz", r.URL.Path == "/event/new":
+		return true
+	case strings.HasPrefix(r.URL.Path, "/login/oidc"):
+		return true
+	case r.URL.Path == "/api/events" && r.Method == http.MethodPost, r.URL.Path == "/api/fetch":
+		return true
+	case strings.HasPrefix(r.URL.Path, "/shared/"), strings.HasPrefix(r.URL.Path, "/p/"), strings.HasPrefix(r.URL.Path, "/ack/"):
+		return true
+	}
+	return false
+}
+
+// Whether the request is for the WebDAV share.
+func davRoute(r *http.Request) bool {
+	return r.URL.Path == "/dav" || strings.HasPrefix(r.URL.Path, "/dav/")
+}
+
+// Whether the route is used by clients signing in with HTTP basic auth.
+func basicAuthRoute(r *http.Request) bool {
+	return davRoute(r) || r.URL.Path == "/events.ics"
+}
+
+// Whether the request only reads, browsing the WebDAV share included. GraphQL
+// queries are posted too, its mutations check the role themselves.
+func readOnlyRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/api/graphql" {
+		return true
+	}
+	return davRoute(r) && davReadMethods[r.Method]
+}
+
+// Responds to a request that needs a signed in user: a 401 for the API, a
+// redirect to the login page for browsers.
+func (app *App) unauthenticated(w http.ResponseWriter, r *http.Request) {
+	if basicAuthRoute(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="seccam", charset="UTF-8"`)
+		writeJSONError(w, http.StatusUnauthorized, "sign in required")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/admin/") || r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusUnauthorized, "sign in required")
+		return
+	}
+	http.Redirect(w, r, app.URL("/login")+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+}
+
+// Middleware identifying the user behind every request and enforcing roles.
+// Signing in is only required once users exist, viewers may only make GET
+// requests while admins can do everything.
+func (app *App) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.authenticate(r)
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+			noteActor(r, user.Username)
+		}
+
+		if publicRoute(r) || !app.HasUsers() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if user == nil {
+			app.unauthenticated(w, r)
+			return
+		}
+		if user.Role != RoleAdmin && !readOnlyRequest(r) {
+			app.Log(r).Printf("Denied %s %s to %s %s\n", r.Method, r.URL.Path, user.Role, user.Username)
+			writeJSONError(w, http.StatusForbidden, "your account may not make changes")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wraps a handler so it's only reachable by admins, either signed in or using the
+// admin token ("Authorization: Bearer <token>").
+func (app *App) RequireAdmin(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := CurrentUser(r.Context())
+		if user == nil {
+			app.Log(r).Printf("Rejected admin request to %s from %s\n", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "sign in as an admin or use the admin token")
+			return
+		}
+		if user.Role != RoleAdmin {
+			app.Log(r).Printf("Denied %s %s to %s %s\n", r.Method, r.URL.Path, user.Role, user.Username)
+			writeJSONError(w, http.StatusForbidden, "admins only")
+			return
+		}
+
+		// Forward the changes admins make, once we know they went through
+		if app.Syslog == nil || readOnlyRequest(r) {
+			next(w, r, p)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r, p)
+		if sw.status < http.StatusBadRequest {
+			app.SecurityRequest(r, SecurityAdmin, syslogNotice, "%s %s by %s", r.Method, r.URL.Path, user.Username)
+		}
+	}
+}
+
+// Wraps a camera facing handler so it requires either a request signed with the
+// upload secret, a single use upload token or the API key, passed in the
+// X-Api-Key header or api_key form field. Without a secret or key configured
+// it is open to requests without a token.
+func (app *App) RequireAPIKey(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Signed requests are checked before the body is read
+		if r.Header.Get(signature.SignatureHeader) != "" {
+			if app.Config.uploadSecret == "" {
+				writeJSONError(w, http.StatusUnauthorized, "signed uploads are not enabled")
+				return
+			}
+			err := signature.Verify(app.sentRequest(r), []byte(app.Config.uploadSecret), time.Now(), app.Config.uploadSkew)
+			if err != nil {
+				app.Log(r).Printf("Rejected signed upload from %s\n", r.RemoteAddr)
+				app.Log(r).Println(err.Error())
+				writeJSONError(w, http.StatusUnauthorized, "invalid request signature")
+				return
+			}
+
+			next(w, r, p)
+			return
+		}
+
+		// Upload tokens are used up whatever becomes of the upload
+		if token := requestUploadToken(r); token != "" {
+			if r = app.useUploadToken(w, r, token); r != nil {
+				next(w, r, p)
+			}
+			return
+		}
+
+		// Otherwise fall back to the API key, unsigned uploads are refused when only
+		// signing is set up
+		if app.Config.apiKey != "" {
+			key := r.Header.Get("X-Api-Key")
+			if key == "" {
+				key = r.FormValue("api_key")
+			}
+			if subtle.ConstantTimeCompare([]byte(key), []byte(app.Config.apiKey)) != 1 {
+				app.Log(r).Printf("Rejected upload with invalid API key from %s\n", r.RemoteAddr)
+				writeJSONError(w, http.StatusUnauthorized, "invalid or missing API key")
+				return
+			}
+		} else if app.Config.uploadSecret != "" {
+			app.Log(r).Printf("Rejected unsigned upload from %s\n", r.RemoteAddr)
+			writeJSONError(w, http.StatusUnauthorized, "missing request signature")
+			return
+		}
+
+		next(w, r, p)
+	}
+}
+
+// Renders the login page.
+func (app *App) LoginPageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	app.renderLogin(w, r, http.StatusOK, "")
+}
+
+func (app *App) renderLogin(w http.ResponseWriter, r *http.Request, status int, message string) {
+	context := struct {
+		Next    string
+		Message string
+		SSO     bool
+	}{
+		Next:    r.FormValue("next"),
+		Message: message,
+		SSO:     app.OIDCEnabled(),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	t := app.Template(r, "login")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
+
+// Signs a user in, starting a session and redirecting to where they came from.
+func (app *App) LoginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	username := r.FormValue("username")
+	user, err := app.CheckPassword(username, r.FormValue("password"))
+	if err != nil {
+		app.Log(r).Printf("Failed login for %q from %s\n", username, r.RemoteAddr)
+		noteActor(r, username)
+		app.renderLogin(w, r, http.StatusUnauthorized, "Wrong username or password.")
+		return
+	}
+
+	app.startSession(w, r, user)
+	app.Log(r).Printf("%s %s signed in\n", user.Role, user.Username)
+
+	http.Redirect(w, r, app.URL(localRedirect(r.FormValue("next"))), http.StatusSeeOther)
+}
+
+// Starts a session for the user and hands them its cookie.
+func (app *App) startSession(w http.ResponseWriter, r *http.Request, user *User) {
+	token, err := app.CreateSession(user)
+	if err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     app.URL("/"),
+		MaxAge:   int(app.Config.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Signs the user out, ending their session.
+func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if _, err := app.DB.Exec(`DELETE FROM sessions WHERE token = ?`, hashToken(cookie.Value)); err != nil {
+			panic(err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: app.URL("/"), MaxAge: -1})
+	http.Redirect(w, r, app.URL("/login"), http.StatusSeeOther)
+}
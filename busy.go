@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Whether err is sqlite reporting the database busy, or a table locked, because
+// of another connection.
+func isBusy(err error) bool {
+	var sqliteErr sqliteError
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqliteBusy || sqliteErr.Code == sqliteLocked
+}
+
+// Runs fn, and again after a growing, jittered delay while sqlite reports the
+// database busy, up to -db-busy-retries times. fn has to be safe to repeat,
+// such as a whole transaction.
+func (app *App) retryBusy(fn func() error) error {
+	delay := 50 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !isBusy(err) || attempt >= app.Config.busyRetries {
+			return err
+		}
+		dbBusyRetries.Add(1)
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
+
+// Counts a request failed because the database stayed busy and asks the client
+// to come back in a few seconds, for a 503. The delay is jittered so clients
+// retrying together spread out.
+func busyRetryAfter(w http.ResponseWriter) {
+	dbBusyFailures.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(1+rand.Intn(5)))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long results are served from memory when nothing clears them sooner,
+// which covers changes made outside the usual write paths such as the command
+// line tools
+const queryCacheTTL = time.Minute
+
+// Most results held at once, every search of the index is its own entry
+const queryCacheMaxEntries = 256
+
+type queryCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Recently computed listings and stats, keyed by everything they were
+// computed from and cleared whenever events change. Safe for concurrent use.
+type queryCache struct {
+	mu         sync.Mutex
+	entries    map[string]queryCacheEntry
+	generation uint64 // Bumped by Clear, so results computed before it aren't stored
+}
+
+func newQueryCache() *queryCache {
+	return &queryCache{entries: make(map[string]queryCacheEntry)}
+}
+
+// Returns the result stored under key, computing and storing it if there's
+// none or it expired. Results computed while the cache was cleared are
+// returned but not stored, they may predate the change that cleared it.
+func (c *queryCache) Load(key string, compute func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		cacheHits.Add(1)
+		return entry.value, nil
+	}
+	cacheMisses.Add(1)
+
+	value, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return value, nil
+	}
+	if len(c.entries) >= queryCacheMaxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= queryCacheMaxEntries {
+			c.entries = make(map[string]queryCacheEntry)
+		}
+	}
+	c.entries[key] = queryCacheEntry{value: value, expires: now.Add(queryCacheTTL)}
+	return value, nil
+}
+
+// Drops every result, events changed.
+func (c *queryCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]queryCacheEntry)
+	c.generation++
+}
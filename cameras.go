@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Camera information struct
+type Camera struct {
+	Id      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created_at"`
+	Live    bool      `json:"-"` // Whether it has a stream for the live view
+
+	// Notification channels alerted about its events, nil for every one
+	Channels []string `json:"notify_channels"`
+
+	// Names its events uploaded without a name, see expandNameTemplate
+	NameTemplate string `json:"name_template"`
+}
+
+// Template of cameras that don't have one of their own
+const defaultNameTemplate = "{camera} #{seq}"
+
+// Longest name template a camera may have
+const nameTemplateMax = 200
+
+// Create the cameras table in our database. Cameras are added the first time
+// they upload an event.
+func CreateCameraTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS cameras(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the id of the camera with the given name, adding it if it's new. An
+// empty name is no camera and returns 0.
+func (app *App) CameraID(name string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, nil
+	}
+
+	// Not INSERT OR IGNORE, that would use up an id every time
+	var id int64
+	err := app.retryBusy(func() error {
+		sql_camera := `INSERT INTO cameras(name) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM cameras WHERE name = ?)`
+		if _, err := app.DB.Exec(sql_camera, name, name); err != nil {
+			return err
+		}
+		return app.DB.QueryRow(`SELECT id FROM cameras WHERE name = ?`, name).Scan(&id)
+	})
+	return id, err
+}
+
+// Looks up a single camera, returning sql.ErrNoRows if there is no such camera.
+func (app *App) FindCamera(id int64) (*Camera, error) {
+	camera := new(Camera)
+	var channels, template sql.NullString
+	sql_camera := `SELECT id, name, created, stream_url IS NOT NULL, notify_channels, name_template FROM cameras WHERE id = ?`
+	err := app.DB.QueryRow(sql_camera, id).Scan(&camera.Id, &camera.Name, &camera.Created, &camera.Live, &channels, &template)
+	if err != nil {
+		return nil, err
+	}
+	camera.Channels = splitChannels(channels)
+	camera.NameTemplate = nameTemplate(template)
+
+	return camera, nil
+}
+
+// Name of the camera an event came from, empty when it's unknown.
+func (app *App) cameraName(event *Event) string {
+	if event.CameraId == 0 {
+		return ""
+	}
+	camera, err := app.FindCamera(event.CameraId)
+	if err != nil {
+		return ""
+	}
+	return camera.Name
+}
+
+// Retrieves every camera by name.
+func (app *App) GetCameras() []*Camera {
+	rows, err := app.DB.Query(`SELECT id, name, created, stream_url IS NOT NULL, notify_channels, name_template FROM cameras ORDER BY name`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	cameras := make([]*Camera, 0)
+	for rows.Next() {
+		camera := new(Camera)
+		var channels, template sql.NullString
+		if err := rows.Scan(&camera.Id, &camera.Name, &camera.Created, &camera.Live, &channels, &template); err != nil {
+			panic(err)
+		}
+		camera.Channels = splitChannels(channels)
+		camera.NameTemplate = nameTemplate(template)
+		cameras = append(cameras, camera)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return cameras
+}
+
+// Renders the index for a single camera
+func (app *App) CameraHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such camera.")
+		return
+	}
+
+	camera, err := app.FindCamera(id)
+	if err == sql.ErrNoRows {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such camera.")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	app.renderIndex(w, r, camera)
+}
+
+// Channels stored in notify_channels, comma separated. NULL is every channel
+// and is returned as nil, an empty string is none.
+func splitChannels(stored sql.NullString) []string {
+	if !stored.Valid {
+		return nil
+	}
+	channels := make([]string, 0)
+	for _, channel := range strings.Split(stored.String, ",") {
+		if channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Channels actually alerted about a camera's events: those it routes to that
+// are enabled, or every enabled one if it doesn't route.
+func (app *App) effectiveChannels(camera *Camera) []string {
+	effective := make([]string, 0)
+	for _, notifier := range app.Notifiers {
+		if camera == nil || camera.Channels == nil || hasChannel(camera.Channels, notifier.Channel()) {
+			effective = append(effective, notifier.Channel())
+		}
+	}
+	return effective
+}
+
+// Routes a camera's alerts to the given channels, nil for every channel.
+func (app *App) SetCameraChannels(id int64, channels []string, actor, remoteAddr string) error {
+	var stored interface{}
+	detail := "every channel"
+	if channels != nil {
+		stored = strings.Join(channels, ",")
+		detail = strings.Join(channels, ", ")
+		if len(channels) == 0 {
+			detail = "no channel"
+		}
+	}
+	return app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`UPDATE cameras SET notify_channels = ? WHERE id = ?`, stored, id); err != nil {
+			return err
+		}
+		if err := Audit(tx, actor, "route camera alerts", 0, remoteAddr, fmt.Sprintf("camera %d to %s", id, detail)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// Template stored in name_template, NULL being the default.
+func nameTemplate(stored sql.NullString) string {
+	if !stored.Valid {
+		return defaultNameTemplate
+	}
+	return stored.String
+}
+
+// Names an event after a template, {camera} standing for the name of its
+// camera and {seq} for its number among the camera's events named this way.
+func expandNameTemplate(template, camera string, seq int64) string {
+	return strings.NewReplacer("{camera}", camera, "{seq}", strconv.FormatInt(seq, 10)).Replace(template)
+}
+
+// Names the next event of a camera uploaded without a name, counting up the
+// camera's sequence. It's bumped and read in one transaction, so concurrent
+// uploads each get a number of their own.
+func (app *App) NextEventName(cameraID int64) (string, error) {
+	var camera string
+	var template sql.NullString
+	var seq int64
+	err := app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`UPDATE cameras SET name_seq = name_seq + 1 WHERE id = ?`, cameraID); err != nil {
+			return err
+		}
+		sql_camera := `SELECT name, name_template, name_seq FROM cameras WHERE id = ?`
+		if err := tx.QueryRow(sql_camera, cameraID).Scan(&camera, &template, &seq); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return "", err
+	}
+	return expandNameTemplate(nameTemplate(template), camera, seq), nil
+}
+
+// Sets the template naming a camera's events uploaded without a name, empty
+// for the default.
+func (app *App) SetCameraNameTemplate(id int64, template, actor, remoteAddr string) error {
+	var stored interface{}
+	detail := "default"
+	if template != "" {
+		stored = template
+		detail = template
+	}
+	return app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`UPDATE cameras SET name_template = ? WHERE id = ?`, stored, id); err != nil {
+			return err
+		}
+		if err := Audit(tx, actor, "camera name template", 0, remoteAddr, fmt.Sprintf("camera %d to %s", id, detail)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// Camera as the API returns it, with the channels its alerts go to
+type apiCamera struct {
+	*Camera
+	Effective []string `json:"effective_channels"`
+}
+
+// Changes the notification channels or name template of a camera, whichever
+// are given. notify_channels lists the channels comma separated, none alerts
+// no one and an empty value goes back to every channel. An empty
+// name_template goes back to the default.
+func (app *App) APICameraHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "camera not found")
+		return
+	}
+	camera, err := app.FindCamera(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "camera not found")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	r.ParseForm()
+	_, setChannels := r.PostForm["notify_channels"]
+	_, setTemplate := r.PostForm["name_template"]
+	if !setChannels && !setTemplate {
+		writeFieldError(w, ErrMissingField, "notify_channels", "notify_channels or name_template is required")
+		return
+	}
+
+	var channels []string
+	switch value := strings.TrimSpace(r.PostFormValue("notify_channels")); value {
+	case "":
+	case "none":
+		channels = make([]string, 0)
+	default:
+		enabled := app.effectiveChannels(nil)
+		for _, channel := range strings.Split(value, ",") {
+			channel = strings.TrimSpace(channel)
+			if !hasChannel(enabled, channel) {
+				writeFieldError(w, ErrInvalidField, "notify_channels", fmt.Sprintf("%q isn't an enabled channel, expected some of %s", channel, strings.Join(enabled, ", ")))
+				return
+			}
+			if !hasChannel(channels, channel) {
+				channels = append(channels, channel)
+			}
+		}
+	}
+
+	// Names have to tell events apart, so templates need the sequence number
+	template := strings.TrimSpace(r.PostFormValue("name_template"))
+	if len(template) > nameTemplateMax {
+		writeFieldError(w, ErrInvalidField, "name_template", fmt.Sprintf("name_template may be at most %d bytes", nameTemplateMax))
+		return
+	}
+	if template != "" && !strings.Contains(template, "{seq}") {
+		writeFieldError(w, ErrInvalidField, "name_template", "name_template has to contain {seq}")
+		return
+	}
+
+	if setChannels {
+		if err := app.SetCameraChannels(camera.Id, channels, actorOf(r), r.RemoteAddr); err != nil {
+			panic(err)
+		}
+		camera.Channels = channels
+	}
+	effective := app.effectiveChannels(camera)
+	if setChannels {
+		app.Log(r).Printf("Camera %s now %s\n", camera.Name, describeChannels(effective, channels != nil))
+	}
+	if setTemplate {
+		if err := app.SetCameraNameTemplate(camera.Id, template, actorOf(r), r.RemoteAddr); err != nil {
+			panic(err)
+		}
+		camera.NameTemplate = nameTemplate(sql.NullString{String: template, Valid: template != ""})
+		app.Log(r).Printf("Camera %s now names events %q\n", camera.Name, camera.NameTemplate)
+	}
+
+	writeJSON(w, http.StatusOK, apiCamera{camera, effective})
+}
+
+// Whether channel is one of channels.
+func hasChannel(channels []string, channel string) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
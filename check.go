@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Actor recorded for events the consistency check deletes
+const ActorCheck = "consistency check"
+
+// Kinds of inconsistency between the database and the data directory
+const (
+	IssueMissing  = "missing"       // Media row whose file is gone
+	IssueOrphan   = "orphan"        // File nothing refers to
+	IssueSize     = "size_mismatch" // File whose size differs from its media row
+	IssueSkipped  = "skipped"       // Orphan too recent to be sure about
+	checkBatch    = 500
+	orphanMinAge  = time.Hour // Younger files may be conversions in progress
+	checkFixedRow = "row deleted"
+)
+
+// Inconsistency found by the check, Fixed says what was done about it
+type checkIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	EventId  int64  `json:"event_id,omitempty"`
+	MediaId  int64  `json:"media_id,omitempty"`
+	Expected int64  `json:"expected_size,omitempty"`
+	Actual   int64  `json:"actual_size,omitempty"`
+	Fixed    string `json:"fixed,omitempty"`
+}
+
+// Totals of a check, the last line of its output
+type checkSummary struct {
+	Kind           string `json:"kind"`
+	Media          int    `json:"media_checked"`
+	Files          int    `json:"files_checked"`
+	Missing        int    `json:"missing"`
+	Orphans        int    `json:"orphans"`
+	SizeMismatches int    `json:"size_mismatches"`
+	Fixed          int    `json:"fixed"`
+	Summary        string `json:"summary"`
+}
+
+// What the check repairs, nothing by default
+type checkOptions struct {
+	fixRows    bool   // Delete media rows whose files are gone, and events left without media
+	quarantine string // Move orphan files into this directory unless empty
+}
+
+// Cross-references the media table with the data directory, passing every
+// inconsistency to report as it's found. Media rows are read in batches and
+// files looked up one at a time, so neither is held in memory as a whole.
+func (app *App) CheckConsistency(opts checkOptions, report func(checkIssue) error) (checkSummary, error) {
+	summary := checkSummary{Kind: "summary"}
+
+	// Media rows whose files are missing or the wrong size
+	var lastID int64
+	emptied := make(map[int64]bool)
+	for {
+		sql_media := `SELECT id, event_id, path, size, hash FROM media WHERE id > ? ORDER BY id LIMIT ?`
+		rows, err := app.DB.Query(sql_media, lastID, checkBatch)
+		if err != nil {
+			return summary, err
+		}
+		batch := make([]*Media, 0, checkBatch)
+		for rows.Next() {
+			m := new(Media)
+			if err := rows.Scan(&m.Id, &m.EventId, &m.Path, &m.Size, &m.Hash); err != nil {
+				rows.Close()
+				return summary, err
+			}
+			batch = append(batch, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return summary, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		lastID = batch[len(batch)-1].Id
+
+		for _, m := range batch {
+			summary.Media++
+			info, err := os.Stat(m.Path)
+			switch {
+			case os.IsNotExist(err):
+				summary.Missing++
+				issue := checkIssue{Kind: IssueMissing, Path: m.Path, EventId: m.EventId, MediaId: m.Id}
+				if opts.fixRows {
+					if _, err := app.DB.Exec(`DELETE FROM media WHERE id = ?`, m.Id); err != nil {
+						return summary, err
+					}
+					if err := setEventSize(app.DB, m.EventId); err != nil {
+						return summary, err
+					}
+					issue.Fixed = checkFixedRow
+					summary.Fixed++
+					emptied[m.EventId] = true
+				}
+				if err := report(issue); err != nil {
+					return summary, err
+				}
+			case err != nil:
+				return summary, err
+			case m.Hash != "" && info.Size() != m.Size:
+				// Sizes are only known once the media has been hashed
+				summary.SizeMismatches++
+				issue := checkIssue{Kind: IssueSize, Path: m.Path, EventId: m.EventId, MediaId: m.Id, Expected: m.Size, Actual: info.Size()}
+				if err := report(issue); err != nil {
+					return summary, err
+				}
+			}
+		}
+	}
+
+	// Events whose media are all gone go too
+	for id := range emptied {
+		var left int
+		if err := app.DB.QueryRow(`SELECT COUNT(*) FROM media WHERE event_id = ?`, id).Scan(&left); err != nil {
+			return summary, err
+		}
+		if left > 0 {
+			continue
+		}
+		if err := app.deleteEmptyEvent(id); err != nil && err != sql.ErrNoRows && err != errProtected && err != errEvidence {
+			return summary, err
+		}
+	}
+
+	// Files nothing refers to
+	quarantine, _ := filepath.Abs(opts.quarantine)
+	sql_referenced := `
+	SELECT EXISTS (SELECT 1 FROM media WHERE path = ?)
+		OR EXISTS (SELECT 1 FROM events WHERE video = ? OR image = ?)
+		OR EXISTS (SELECT 1 FROM timelapses WHERE video = ?)
+		OR EXISTS (SELECT 1 FROM trash WHERE path = ?)`
+	err := filepath.WalkDir(app.Config.dirs.data, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, _ := filepath.Abs(path); opts.quarantine != "" && abs == quarantine {
+				return filepath.SkipDir
+			}
+			// Archives are tracked in their own table and expire by themselves
+			if path == app.archiveDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		summary.Files++
+
+		var referenced bool
+		if err := app.DB.QueryRow(sql_referenced, path, path, path, path, path).Scan(&referenced); err != nil {
+			return err
+		}
+		if referenced {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		issue := checkIssue{Kind: IssueOrphan, Path: path, Actual: info.Size()}
+		if time.Since(info.ModTime()) < orphanMinAge {
+			issue.Kind = IssueSkipped
+			return report(issue)
+		}
+		summary.Orphans++
+		if opts.quarantine != "" {
+			dst, err := quarantineFile(path, opts.quarantine)
+			if err != nil {
+				return err
+			}
+			issue.Fixed = "moved to " + dst
+			summary.Fixed++
+		}
+		return report(issue)
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	summary.Summary = fmt.Sprintf("Checked %d media rows and %d files: %d missing, %d orphaned, %d with the wrong size, %d fixed.",
+		summary.Media, summary.Files, summary.Missing, summary.Orphans, summary.SizeMismatches, summary.Fixed)
+
+	return summary, nil
+}
+
+// Deletes an event left without any media by the check, auditing it.
+func (app *App) deleteEmptyEvent(id int64) error {
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	event, paths, err := deleteEvent(tx, id, ActorCheck, "")
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	app.removeEventFiles(event, paths)
+
+	return nil
+}
+
+// Moves a file into the quarantine directory, keeping its name unless that's
+// taken. Returns where it ended up.
+func quarantineFile(path, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%d-%s", i, filepath.Base(path)))
+	}
+
+	return dst, os.Rename(path, dst)
+}
+
+// Writes every issue as a line of JSON to w, followed by the summary.
+func (app *App) writeCheck(w io.Writer, opts checkOptions, flush func()) (checkSummary, error) {
+	enc := json.NewEncoder(w)
+	summary, err := app.CheckConsistency(opts, func(issue checkIssue) error {
+		err := enc.Encode(issue)
+		flush()
+		return err
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	return summary, enc.Encode(summary)
+}
+
+// Checks the database against the data directory, printing every issue as a
+// line of JSON and a summary to stderr:
+//
+//	check [--fix-rows] [--quarantine=DIR]
+func (app *App) CheckCommand(args []string) error {
+	cmd := flag.NewFlagSet("check", flag.ExitOnError)
+	fixRows := cmd.Bool("fix-rows", false, "Delete media rows whose files are missing, and events left without media")
+	quarantine := cmd.String("quarantine", "", "Move files nothing refers to into this directory")
+	cmd.Parse(args)
+
+	summary, err := app.writeCheck(os.Stdout, checkOptions{fixRows: *fixRows, quarantine: *quarantine}, func() {})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, summary.Summary)
+
+	return nil
+}
+
+// Streams a consistency check as lines of JSON, the summary last. Fixes are
+// only made by POST: fix_rows=true deletes dangling rows, quarantine=true moves
+// orphan files into the quarantine directory next to the data directory.
+func (app *App) CheckHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var opts checkOptions
+	if r.Method == http.MethodPost {
+		opts.fixRows, _ = strconv.ParseBool(r.FormValue("fix_rows"))
+		if quarantine, _ := strconv.ParseBool(r.FormValue("quarantine")); quarantine {
+			opts.quarantine = app.QuarantineDir()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	streamResponse(w)
+	flusher, _ := w.(http.Flusher)
+	summary, err := app.writeCheck(w, opts, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		// Too late for an error status, end with an error line instead
+		app.Log(r).Println("Error checking consistency")
+		app.Log(r).Println(err.Error())
+		json.NewEncoder(w).Encode(map[string]string{"kind": "error", "error": err.Error()})
+		return
+	}
+	app.Log(r).Println(summary.Summary)
+}
+
+// Directory orphan files are moved to from /admin/check, next to the data
+// directory.
+func (app *App) QuarantineDir() string {
+	data := filepath.Clean(app.Config.dirs.data)
+	return filepath.Join(filepath.Dir(data), filepath.Base(data)+"-quarantine")
+}
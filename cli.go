@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Runs a command given after the flags instead of starting the server.
+func (app *App) RunCommand(args []string) {
+	var err error
+	switch args[0] {
+	case "timelapse":
+		err = app.TimelapseCommand(args[1:])
+	case "user":
+		err = app.UserCommand(args[1:])
+	case "audit":
+		err = app.AuditCommand(args[1:])
+	case "check":
+		err = app.CheckCommand(args[1:])
+	case "camera":
+		err = app.CameraCommand(args[1:])
+	case "media":
+		err = app.MediaCommand(args[1:])
+	case "migrate-data":
+		err = app.MigrateDataCommand(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q, expected timelapse, user, audit, check, camera, media or migrate-data", args[0])
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Generates a single timelapse:
+//
+//	timelapse [--date=YYYY-MM-DD]
+func (app *App) TimelapseCommand(args []string) error {
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	cmd := flag.NewFlagSet("timelapse", flag.ExitOnError)
+	date := cmd.String("date", yesterday, "Day to generate a timelapse for (YYYY-MM-DD)")
+	cmd.Parse(args)
+
+	day, err := time.Parse("2006-01-02", *date)
+	if err != nil {
+		return err
+	}
+
+	return app.CreateTimelapse(day)
+}
+
+// Manages the database file itself, run before the database is opened:
+//
+//	db encrypt
+//
+// encrypt converts a plaintext database to one encrypted with -db-key, in
+// place, keeping a copy of the plaintext one next to it.
+func DBCommand(config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected db encrypt")
+	}
+	switch args[0] {
+	case "encrypt":
+		if err := EncryptDB(config.db, config.dbKey); err != nil {
+			return err
+		}
+		log.Printf("Encrypted %s, start with the same -db-key from now on\n", config.db)
+		return nil
+	default:
+		return fmt.Errorf("unknown db action %q, expected encrypt", args[0])
+	}
+}
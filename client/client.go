@@ -0,0 +1,320 @@
+// Package client uploads events to and reads events from seccam-web.
+//
+//	c := client.New("http://seccam:8000", apiKey)
+//	id, err := c.UploadEvent(ctx, "Front door", video, image, client.Camera("front"))
+//
+// Uploads are streamed, the video and image are read while the request is
+// being sent rather than buffered first. Signed uploads need the body's length
+// up front and aren't supported, use the signature package for those.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a seccam-web server.
+type Client struct {
+	BaseURL string // e.g. http://seccam:8000, without a trailing slash
+	APIKey  string // Sent with uploads when the server has -api-key set
+
+	// Sent as a bearer token with API reads, needed once the server has users.
+	// The server's -admin-token works.
+	Token string
+
+	HTTPClient *http.Client // http.DefaultClient if nil
+}
+
+// Event as returned by the JSON API.
+type Event struct {
+	Id         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Time       time.Time `json:"time"`
+	Status     string    `json:"status"`
+	LastError  string    `json:"last_error"`
+	Suppressed bool      `json:"notify_suppressed"`
+	Protected  bool      `json:"protected"`
+	Notes      string    `json:"notes"`
+	CameraId   int64     `json:"camera_id"`
+	ExternalId string    `json:"external_id"`
+	VideoURL   string    `json:"video_url"`
+	ImageURL   string    `json:"image_url"`
+	Snippet    string    `json:"snippet"`
+}
+
+// Error is returned for responses other than the expected status.
+type Error struct {
+	StatusCode int
+	Code       string // Machine readable code of the server's error, e.g. "not_found"
+	Message    string // The server's error, if it sent one
+	Field      string // Parameter or form field at fault, if any
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("seccam: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("seccam: %d %s", e.StatusCode, e.Message)
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL, apiKey string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), APIKey: apiKey}
+}
+
+// UploadOption changes how an event is uploaded.
+type UploadOption func(*upload)
+
+type upload struct {
+	camera     string
+	externalID string
+	notify     bool
+	videoName  string
+	imageName  string
+	extraFiles []file
+}
+
+type file struct {
+	field string
+	name  string
+	r     io.Reader
+}
+
+// Camera names the camera the event comes from.
+func Camera(name string) UploadOption {
+	return func(u *upload) { u.camera = name }
+}
+
+// ExternalID gives the event the camera's own ID for the recording, which needs
+// Camera. Uploading an ID the camera already used stores nothing and returns
+// the existing event's id, so uploads can be retried safely.
+func ExternalID(id string) UploadOption {
+	return func(u *upload) { u.externalID = id }
+}
+
+// Quiet records the event without sending any alerts.
+func Quiet() UploadOption {
+	return func(u *upload) { u.notify = false }
+}
+
+// Filenames sets the file names the video and image are stored under, the
+// defaults are video.mp4 and image.jpg.
+func Filenames(video, image string) UploadOption {
+	return func(u *upload) { u.videoName, u.imageName = video, image }
+}
+
+// ExtraVideo attaches another video to the event.
+func ExtraVideo(name string, r io.Reader) UploadOption {
+	return func(u *upload) { u.extraFiles = append(u.extraFiles, file{"video", name, r}) }
+}
+
+// ExtraImage attaches another image to the event.
+func ExtraImage(name string, r io.Reader) UploadOption {
+	return func(u *upload) { u.extraFiles = append(u.extraFiles, file{"image", name, r}) }
+}
+
+// UploadEvent uploads a new event and returns its id. Cancelling ctx aborts the
+// upload.
+func (c *Client) UploadEvent(ctx context.Context, name string, video, image io.Reader, opts ...UploadOption) (int64, error) {
+	u := upload{notify: true, videoName: "video.mp4", imageName: "image.jpg"}
+	for _, opt := range opts {
+		opt(&u)
+	}
+
+	// The server expects the main video and image first
+	files := append([]file{{"video", u.videoName, video}, {"image", u.imageName, image}}, u.extraFiles...)
+	fields := map[string]string{"name": name, "notify": strconv.FormatBool(u.notify)}
+	if u.camera != "" {
+		fields["camera"] = u.camera
+	}
+	if u.externalID != "" {
+		fields["external_id"] = u.externalID
+	}
+
+	// Write the body as it's sent
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeForm(form, fields, files))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/event/new", pr)
+	if err != nil {
+		pr.Close()
+		return 0, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if c.APIKey != "" {
+		req.Header.Set("X-Api-Key", c.APIKey)
+	}
+
+	var event Event
+	if _, err := c.do(req, &event, http.StatusAccepted, http.StatusOK); err != nil {
+		pr.CloseWithError(err)
+		return 0, err
+	}
+
+	return event.Id, nil
+}
+
+// Writes the fields and then the files to form.
+func writeForm(form *multipart.Writer, fields map[string]string, files []file) error {
+	for field, value := range fields {
+		if err := form.WriteField(field, value); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		part, err := form.CreateFormFile(f.field, f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, f.r); err != nil {
+			return err
+		}
+	}
+
+	return form.Close()
+}
+
+// ListOptions filters ListEvents, the zero value lists the 20 most recent events.
+type ListOptions struct {
+	Limit   int
+	Search  string
+	SinceID int64
+	Camera  int64
+	Cursor  string // From a previous page's next cursor
+}
+
+// ListEvents lists events, newest first. The returned cursor fetches the next
+// page and is empty when there are no more.
+func (c *Client) ListEvents(ctx context.Context, opts ListOptions) ([]*Event, string, error) {
+	query := url.Values{}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Search != "" {
+		query.Set("search", opts.Search)
+	}
+	if opts.SinceID > 0 {
+		query.Set("since_id", strconv.FormatInt(opts.SinceID, 10))
+	}
+	if opts.Camera > 0 {
+		query.Set("camera", strconv.FormatInt(opts.Camera, 10))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+
+	target := c.BaseURL + "/api/events"
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := c.apiRequest(ctx, target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	events := make([]*Event, 0)
+	header, err := c.do(req, &events, http.StatusOK)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return events, header.Get("X-Next-Cursor"), nil
+}
+
+// GetEvent fetches a single event.
+func (c *Client) GetEvent(ctx context.Context, id int64) (*Event, error) {
+	req, err := c.apiRequest(ctx, c.BaseURL+"/api/events/"+strconv.FormatInt(id, 10))
+	if err != nil {
+		return nil, err
+	}
+
+	event := new(Event)
+	if _, err := c.do(req, event, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// GetExternalEvent fetches the event a camera uploaded with the given
+// ExternalID.
+func (c *Client) GetExternalEvent(ctx context.Context, camera, externalID string) (*Event, error) {
+	req, err := c.apiRequest(ctx, c.BaseURL+"/api/events/by-external/"+url.PathEscape(camera)+"/"+url.PathEscape(externalID))
+	if err != nil {
+		return nil, err
+	}
+
+	event := new(Event)
+	if _, err := c.do(req, event, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// Builds a GET request for the JSON API.
+func (c *Client) apiRequest(ctx context.Context, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return req, nil
+}
+
+// Sends req and decodes the JSON response into v, which must have one of the
+// given statuses. The response headers are returned.
+func (c *Client) do(req *http.Request, v interface{}, statuses ...int) (http.Header, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	expected := false
+	for _, status := range statuses {
+		expected = expected || resp.StatusCode == status
+	}
+	if !expected {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+				Field   string `json:"field"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil {
+			apiErr.Code = body.Error.Code
+			apiErr.Message = body.Error.Message
+			apiErr.Field = body.Error.Field
+		}
+		return nil, apiErr
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, errors.New("seccam: invalid response: " + err.Error())
+	}
+
+	return resp.Header, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/battleroid/seccam-web/client"
+)
+
+// Client for a test server running the real handlers, with -api-key set.
+func newTestClient(t *testing.T) (*App, *client.Client) {
+	t.Helper()
+	config := testConfig(t)
+	config.apiKey = "camera-key"
+	app := newTestAppWith(t, config)
+	server := newTestServer(t, app)
+	return app, client.New(server.URL+"/", config.apiKey)
+}
+
+func TestClientUploadAndGet(t *testing.T) {
+	app, c := newTestClient(t)
+	ctx := context.Background()
+
+	id, err := c.UploadEvent(ctx, "Front door", strings.NewReader("the video"), strings.NewReader("the image"),
+		client.Camera("front"), client.Filenames("door.avi", "door.jpg"), client.Quiet(),
+		client.ExtraImage("door-2.jpg", strings.NewReader("another image")))
+	if err != nil {
+		t.Fatalf("UploadEvent: %s", err)
+	}
+
+	event, err := c.GetEvent(ctx, id)
+	if err != nil {
+		t.Fatalf("GetEvent: %s", err)
+	}
+	if event.Id != id || event.Name != "Front door" || !event.Suppressed || event.CameraId == 0 {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if !strings.HasSuffix(event.VideoURL, "/door.avi") || !strings.HasSuffix(event.ImageURL, "/door.jpg") {
+		t.Errorf("unexpected media URLs %s and %s", event.VideoURL, event.ImageURL)
+	}
+
+	// The streamed files arrived whole
+	stored := app.GetEvent(id)
+	for path, want := range map[string]string{stored.Video: "the video", stored.Image: "the image"} {
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%s holds %q (%v), expected %q", path, data, err, want)
+		}
+	}
+	media, err := app.EventMedia(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 3 {
+		t.Errorf("event has %d files, expected 3", len(media))
+	}
+}
+
+// An external ID uploaded again returns the event it was stored as.
+func TestClientUploadExternalID(t *testing.T) {
+	_, c := newTestClient(t)
+	ctx := context.Background()
+
+	upload := func() int64 {
+		id, err := c.UploadEvent(ctx, "Porch", strings.NewReader("video"), strings.NewReader("image"),
+			client.Camera("porch"), client.ExternalID("rec-17"))
+		if err != nil {
+			t.Fatalf("UploadEvent: %s", err)
+		}
+		return id
+	}
+	first, second := upload(), upload()
+	if first != second {
+		t.Errorf("the repeated upload got event %d, expected %d", second, first)
+	}
+
+	event, err := c.GetExternalEvent(ctx, "porch", "rec-17")
+	if err != nil {
+		t.Fatalf("GetExternalEvent: %s", err)
+	}
+	if event.Id != first || event.ExternalId != "rec-17" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestClientListEvents(t *testing.T) {
+	_, c := newTestClient(t)
+	ctx := context.Background()
+
+	var ids []int64
+	for _, name := range []string{"one", "two", "three"} {
+		id, err := c.UploadEvent(ctx, name, strings.NewReader("video"), strings.NewReader("image"))
+		if err != nil {
+			t.Fatalf("UploadEvent: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Newest first, two at a time
+	var listed []int64
+	opts := client.ListOptions{Limit: 2}
+	for page := 0; page < 3; page++ {
+		events, cursor, err := c.ListEvents(ctx, opts)
+		if err != nil {
+			t.Fatalf("ListEvents: %s", err)
+		}
+		for _, event := range events {
+			listed = append(listed, event.Id)
+		}
+		if cursor == "" {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	if len(listed) != 3 || listed[0] != ids[2] || listed[1] != ids[1] || listed[2] != ids[0] {
+		t.Errorf("listed %v, expected %v newest first", listed, ids)
+	}
+
+	events, _, err := c.ListEvents(ctx, client.ListOptions{Search: "two"})
+	if err != nil {
+		t.Fatalf("ListEvents: %s", err)
+	}
+	if len(events) != 1 || events[0].Id != ids[1] {
+		t.Errorf("search found %d events, expected event %d", len(events), ids[1])
+	}
+}
+
+// The server's errors come back as *client.Error with the envelope's parts.
+func TestClientErrors(t *testing.T) {
+	_, c := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := c.GetEvent(ctx, 404)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != ErrNotFound {
+		t.Errorf("GetEvent of a missing event = %v, expected a 404 %s", err, ErrNotFound)
+	}
+
+	c.APIKey = "wrong"
+	_, err = c.UploadEvent(ctx, "Front door", strings.NewReader("video"), strings.NewReader("image"))
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != ErrUnauthorized {
+		t.Errorf("UploadEvent with the wrong key = %v, expected a 401 %s", err, ErrUnauthorized)
+	}
+
+	c.APIKey = "camera-key"
+	_, err = c.UploadEvent(ctx, "", strings.NewReader("video"), strings.NewReader("image"))
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != ErrMissingField || apiErr.Field != "name" {
+		t.Errorf("UploadEvent without a name = %v, expected a 400 %s for name", err, ErrMissingField)
+	}
+}
+
+// Reader that never ends, handing out a little at a time until closed.
+type endlessReader struct {
+	closed chan struct{}
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, io.EOF
+	case <-time.After(10 * time.Millisecond):
+		return copy(p, "frame"), nil
+	}
+}
+
+// Cancelling the context aborts an upload that is still being sent.
+func TestClientUploadCancel(t *testing.T) {
+	app, c := newTestClient(t)
+	video := &endlessReader{closed: make(chan struct{})}
+	defer close(video.closed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.UploadEvent(ctx, "Front door", video, strings.NewReader("image"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("UploadEvent = %v, expected the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cancelled upload took %s to return", elapsed)
+	}
+	if count := eventCount(t, app); count != 0 {
+		t.Errorf("%d events stored", count)
+	}
+}
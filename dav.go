@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/webdav"
+)
+
+// Methods the WebDAV share answers, anything else would change it
+var davReadMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// Methods WebDAV clients write with, refused with a 403 rather than a 405 so
+// clients know the share is read-only
+var davWriteMethods = []string{
+	http.MethodPost, http.MethodPut, http.MethodDelete,
+	"PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// Layout of the share's directories: /YYYY/MM/DD, with the events' media in the
+// days. Events are filed by their UTC time.
+var davLevels = []string{"%Y", "%Y-%m", "%Y-%m-%d"}
+
+// Read-only view of the events' media as a WebDAV file system. Files are named
+// after their event rather than the names they have in the data directory, and
+// only media attached to an event is listed so nothing being staged or
+// converted shows up.
+type davFS struct {
+	app *App
+}
+
+func (fs davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+func (fs davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	if !validDAVPath(parts) {
+		return nil, os.ErrNotExist
+	}
+
+	// Directories
+	if len(parts) < len(davLevels) {
+		children, err := fs.app.davDirs(parts)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > 0 && len(children) == 0 {
+			return nil, os.ErrNotExist
+		}
+		return &davDir{info: davDirInfo(parts, children), children: children}, nil
+	}
+
+	// A day's files, or one of them
+	files, err := fs.app.davFiles(strings.Join(parts[:len(davLevels)], "-"))
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == len(davLevels) {
+		if len(files) == 0 {
+			return nil, os.ErrNotExist
+		}
+		children := make([]os.FileInfo, len(files))
+		for i, file := range files {
+			children[i] = file.info
+		}
+		return &davDir{info: davDirInfo(parts, children), children: children}, nil
+	}
+
+	for _, file := range files {
+		if file.info.Name() == parts[len(parts)-1] {
+			f, err := fs.app.openMedia(file.path)
+			if err != nil {
+				return nil, err
+			}
+			return davFile{ReadSeekCloser: f, info: file.info}, nil
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Whether the path could be one of ours: a year, month and day of digits and at
+// most a file name after them.
+func validDAVPath(parts []string) bool {
+	if len(parts) > len(davLevels)+1 {
+		return false
+	}
+	widths := []int{4, 2, 2}
+	for i, part := range parts {
+		if i == len(widths) {
+			break
+		}
+		if _, err := strconv.Atoi(part); err != nil || len(part) != widths[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lists the subdirectories of a year, month or the root, each dated by the
+// newest event in it.
+func (app *App) davDirs(parts []string) ([]os.FileInfo, error) {
+	level := davLevels[len(parts)]
+	sql_dirs := `SELECT strftime(?, time), MAX(time) FROM events GROUP BY 1 ORDER BY 1`
+	args := []interface{}{level}
+	if len(parts) > 0 {
+		sql_dirs = `
+		SELECT strftime(?, time), MAX(time) FROM events
+		WHERE strftime(?, time) = ? GROUP BY 1 ORDER BY 1`
+		args = append(args, davLevels[len(parts)-1], strings.Join(parts, "-"))
+	}
+
+	rows, err := app.DB.Query(sql_dirs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dirs := make([]os.FileInfo, 0)
+	for rows.Next() {
+		var name, newest string
+		if err := rows.Scan(&name, &newest); err != nil {
+			return nil, err
+		}
+		modTime, _ := time.Parse("2006-01-02 15:04:05", newest)
+		dirs = append(dirs, davInfo{name: path.Base(strings.ReplaceAll(name, "-", "/")), modTime: modTime, dir: true})
+	}
+
+	return dirs, rows.Err()
+}
+
+// File in the share and where it is in the data directory.
+type davEntry struct {
+	info davInfo
+	path string
+}
+
+// Lists the media of a day's events (date as YYYY-MM-DD), named
+// <event id>-<event name> with the file's extension. Further files of the same
+// type get the media id appended. Files missing from the data directory are
+// left out, sizes are those of the files decrypted.
+func (app *App) davFiles(date string) ([]davEntry, error) {
+	sql_files := `
+	SELECT events.id, events.name, media.id, media.path
+	FROM media JOIN events ON events.id = media.event_id
+	WHERE date(events.time) = ?
+	ORDER BY events.id, media.kind = 'image', media.id`
+	rows, err := app.DB.Query(sql_files, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]davEntry, 0)
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var eventID, mediaID int64
+		var name, mediaPath string
+		if err := rows.Scan(&eventID, &name, &mediaID, &mediaPath); err != nil {
+			return nil, err
+		}
+
+		base := strconv.FormatInt(eventID, 10) + "-" + davName(name)
+		ext := strings.ToLower(filepath.Ext(mediaPath))
+		if seen[base+ext] {
+			base += "-" + strconv.FormatInt(mediaID, 10)
+		}
+		seen[base+ext] = true
+
+		stat, err := os.Stat(mediaPath)
+		if err != nil {
+			continue
+		}
+		size, err := app.mediaSize(mediaPath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, davEntry{
+			info: davInfo{name: base + ext, size: size, modTime: stat.ModTime()},
+			path: mediaPath,
+		})
+	}
+
+	return files, rows.Err()
+}
+
+// Makes an event name safe to use as a file name.
+func davName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		return "event"
+	}
+
+	return name
+}
+
+// Info for a directory, dated by its newest entry.
+func davDirInfo(parts []string, children []os.FileInfo) davInfo {
+	info := davInfo{name: "/", dir: true}
+	if len(parts) > 0 {
+		info.name = parts[len(parts)-1]
+	}
+	for _, child := range children {
+		if child.ModTime().After(info.modTime) {
+			info.modTime = child.ModTime()
+		}
+	}
+
+	return info
+}
+
+// File info of the share's files and directories.
+type davInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi davInfo) Name() string       { return fi.name }
+func (fi davInfo) Size() int64        { return fi.size }
+func (fi davInfo) ModTime() time.Time { return fi.modTime }
+func (fi davInfo) IsDir() bool        { return fi.dir }
+func (fi davInfo) Sys() interface{}   { return nil }
+
+func (fi davInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// Media file opened through the share, under its name in the share and
+// decrypted if it's encrypted.
+type davFile struct {
+	io.ReadSeekCloser
+	info davInfo
+}
+
+func (f davFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Directory opened through the share.
+type davDir struct {
+	info     davInfo
+	children []os.FileInfo
+	read     int
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.read:]
+	if count <= 0 {
+		d.read = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.read += count
+
+	return rest[:count], nil
+}
+
+// Returns the handler serving the read-only WebDAV share of the media at /dav,
+// for backing it up with a WebDAV client.
+func (app *App) DAVHandler() httprouter.Handle {
+	dav := &webdav.Handler{
+		Prefix:     app.URL("/dav"),
+		FileSystem: davFS{app},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				app.Log(r).Printf("Error serving WebDAV %s %s\n", r.Method, r.URL.Path)
+				app.Log(r).Println(err.Error())
+			}
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !davReadMethods[r.Method] {
+			writeJSONError(w, http.StatusForbidden, "the WebDAV share is read-only")
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			mediaHeaders(w, r, r.URL.Path, "")
+			streamResponse(w)
+		}
+
+		// The hrefs in listings need the path the client used
+		r.URL.Path = app.URL(r.URL.Path)
+		dav.ServeHTTP(w, r)
+	}
+}
+
+// Registers the WebDAV share for every method clients use.
+func (app *App) DAVRoutes() {
+	handler := app.DAVHandler()
+	for method := range davReadMethods {
+		app.Router.Handle(method, "/dav", handler)
+		app.Router.Handle(method, "/dav/*filepath", handler)
+	}
+	for _, method := range davWriteMethods {
+		app.Router.Handle(method, "/dav", handler)
+		app.Router.Handle(method, "/dav/*filepath", handler)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// With a media key the share lists and serves the media decrypted, sized as
+// it is decrypted rather than as it is on disk.
+func TestDAVEncryptedMedia(t *testing.T) {
+	app := newTestApp(t)
+	keyFile := filepath.Join(t.TempDir(), "media.key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadMediaKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.MediaKey = key
+	server := newTestServer(t, app)
+
+	created, err := app.StoreEvent(app.Logger, "", stageTestUpload(t, app, "front door"))
+	if err != nil {
+		t.Fatalf("StoreEvent: %s", err)
+	}
+	if data, _ := os.ReadFile(created.Video); strings.Contains(string(data), "video of front door") {
+		t.Fatal("the video isn't encrypted on disk")
+	}
+
+	day := created.Time.UTC().Format("2006/01/02")
+	want := "video of front door"
+	name := strconv.FormatInt(created.Id, 10) + "-front door.avi"
+
+	files, err := app.davFiles(created.Time.UTC().Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := false
+	for _, file := range files {
+		if file.info.Name() != name {
+			continue
+		}
+		listed = true
+		if file.info.Size() != int64(len(want)) {
+			t.Errorf("%s is listed at %d bytes, expected %d", name, file.info.Size(), len(want))
+		}
+	}
+	if !listed {
+		t.Errorf("%s isn't listed", name)
+	}
+
+	resp, err := http.Get(server.URL + "/dav/" + day + "/" + strings.ReplaceAll(name, " ", "%20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("GET answered %d with %q, expected %q", resp.StatusCode, body, want)
+	}
+	if resp.ContentLength != int64(len(want)) {
+		t.Errorf("Content-Length %d, expected %d", resp.ContentLength, len(want))
+	}
+}
@@ -0,0 +1,134 @@
+//go:build sqlcipher
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+// Whether this build can open encrypted databases, only with the sqlcipher tag
+const dbEncryption = true
+
+// Error types of the driver in use
+type sqliteError = sqlite3.Error
+
+var (
+	sqliteBusy   = sqlite3.ErrBusy
+	sqliteLocked = sqlite3.ErrLocked
+)
+
+// Quotes s as an SQL string literal, PRAGMA key and ATTACH ... KEY don't take
+// bound parameters.
+func quoteSQL(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Opens the database at path, decrypting it with key if one is given. The key
+// goes in the DSN so the driver runs PRAGMA key on every new connection, not
+// just the first.
+func openDB(path, key string) (*sql.DB, error) {
+	if key == "" {
+		return sql.Open("sqlite3", path)
+	}
+	return sql.Open("sqlite3", path+"?_pragma_key="+url.QueryEscape(quoteSQL(key)))
+}
+
+// Encrypts the plaintext database at path with key, in place. A copy of the
+// plaintext database is kept next to it first, named after the time, then an
+// encrypted copy is exported beside it and swapped in.
+func EncryptDB(path, key string) error {
+	if key == "" {
+		return errors.New("-db-key is required to encrypt the database")
+	}
+	encrypted, err := sqlite3.IsEncrypted(path)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		return fmt.Errorf("%s is already encrypted", path)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// ATTACH only holds for the connection it ran on
+	db.SetMaxOpenConns(1)
+
+	// Fold the WAL back in, so the database file alone is the whole database
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return err
+	}
+	backup := path + ".plain-" + time.Now().UTC().Format("20060102-150405")
+	if err := copyDB(path, backup); err != nil {
+		return fmt.Errorf("backing up the database: %w", err)
+	}
+	log.Printf("Backed up the plaintext database to %s\n", backup)
+
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	tmp := path + ".encrypting"
+	os.Remove(tmp)
+	if _, err := db.Exec(`ATTACH DATABASE ` + quoteSQL(tmp) + ` AS encrypted KEY ` + quoteSQL(key)); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`SELECT sqlcipher_export('encrypted')`); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// sqlcipher_export leaves the schema version behind, migrations go by it
+	if _, err := db.Exec(fmt.Sprintf(`PRAGMA encrypted.user_version = %d`, version)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := db.Exec(`DETACH DATABASE encrypted`); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	db.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+	return nil
+}
+
+// Copies the database file at src to a new file at dst.
+func copyDB(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,36 @@
+//go:build !sqlcipher
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Whether this build can open encrypted databases, only with the sqlcipher tag
+const dbEncryption = false
+
+var errNoSQLCipher = errors.New("encrypted databases need a build with the sqlcipher tag")
+
+// Error types of the driver in use
+type sqliteError = sqlite3.Error
+
+var (
+	sqliteBusy   = sqlite3.ErrBusy
+	sqliteLocked = sqlite3.ErrLocked
+)
+
+// Opens the database at path, this build can't decrypt one.
+func openDB(path, key string) (*sql.DB, error) {
+	if key != "" {
+		return nil, errNoSQLCipher
+	}
+	return sql.Open("sqlite3", path)
+}
+
+// Encrypting needs SQLCipher.
+func EncryptDB(path, key string) error {
+	return errNoSQLCipher
+}
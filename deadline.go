@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Timeouts of every request but uploads, which get -upload-timeout instead,
+// and responses streamed for as long as the client keeps reading
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = time.Minute
+	serverWriteTimeout      = 2 * time.Minute
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// Time left after -upload-timeout to store the event and respond, or to say
+// the upload took too long
+const uploadGrace = 30 * time.Second
+
+// Routes receiving uploads, or fetching them from the camera, by method
+var uploadRoutes = map[string]string{
+	"/event/new":  http.MethodPost,
+	"/api/events": http.MethodPost,
+	"/api/fetch":  http.MethodPost,
+}
+
+// Gives uploads -upload-timeout to arrive instead of the server's read
+// timeout, which slow camera uplinks would break. Other requests keep the
+// server's timeouts. It has to come before anything reading the body, such as
+// the API validation.
+func (app *App) UploadDeadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uploadRoutes[r.URL.Path] != r.Method {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var read, write time.Time // None without -upload-timeout
+		if app.Config.uploadTimeout > 0 {
+			read = time.Now().Add(app.Config.uploadTimeout)
+			write = read.Add(uploadGrace)
+		}
+		controller := http.NewResponseController(w)
+		if err := controller.SetReadDeadline(read); err != nil {
+			app.Log(r).Println("Error extending the read deadline of an upload")
+			app.Log(r).Println(err.Error())
+		}
+		if err := controller.SetWriteDeadline(write); err != nil {
+			app.Log(r).Println("Error extending the write deadline of an upload")
+			app.Log(r).Println(err.Error())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Lifts the server's timeouts for a response that takes as long as the client
+// needs to read it, such as a large video or the live view. The read deadline
+// goes too: once it passes the server takes the client for gone and cancels
+// the request.
+func streamResponse(w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+}
+
+// Whether err is a read or write deadline passing.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Responds to an upload that didn't arrive before -upload-timeout.
+func writeUploadTimeout(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	writeJSONError(w, http.StatusRequestTimeout, "the upload took longer than the server allows, see -upload-timeout")
+}
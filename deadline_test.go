@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test server with the real middleware and timeouts far shorter than the
+// server's, and -upload-timeout between them.
+func newDeadlineServer(t *testing.T, config *Config) (*App, *httptest.Server) {
+	t.Helper()
+	config.uploadTimeout = time.Second
+	app := newTestAppWith(t, config)
+	app.Routes()
+	server := httptest.NewUnstartedServer(app.Handler())
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close)
+	return app, server
+}
+
+// Reader handing out its contents a piece at a time, waiting before each.
+type trickleReader struct {
+	r     io.Reader
+	piece int
+	wait  time.Duration
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	time.Sleep(r.wait)
+	if len(p) > r.piece {
+		p = p[:r.piece]
+	}
+	return r.r.Read(p)
+}
+
+// An upload arriving slower than the server's read timeout still gets
+// -upload-timeout to finish.
+func TestUploadDeadlineSlowUpload(t *testing.T) {
+	app, server := newDeadlineServer(t, testConfig(t))
+	body, contentType := multipartUpload(t, map[string]string{"name": "Front door"},
+		map[string]io.Reader{"video": strings.NewReader("video"), "image": strings.NewReader("image")})
+	data, _ := io.ReadAll(body)
+
+	// About 600ms over the 200ms read timeout
+	slow := &trickleReader{r: bytes.NewReader(data), piece: len(data)/6 + 1, wait: 100 * time.Millisecond}
+	resp, err := http.Post(server.URL+"/event/new", contentType, slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("status %d, expected %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if count := eventCount(t, app); count != 1 {
+		t.Errorf("%d events stored, expected 1", count)
+	}
+}
+
+// An upload stalling past -upload-timeout is answered 408 and whatever of it
+// arrived is gone.
+func TestUploadDeadlineStalledUpload(t *testing.T) {
+	config := testConfig(t)
+	app, server := newDeadlineServer(t, config)
+	body, contentType := multipartUpload(t, map[string]string{"name": "Front door"},
+		map[string]io.Reader{"video": strings.NewReader(strings.Repeat("video", 1000)), "image": strings.NewReader("image")})
+	data, _ := io.ReadAll(body)
+
+	// The client sends half of it and stops, so it's written by hand
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /event/new HTTP/1.1\r\nHost: camera\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", contentType, len(data))
+	conn.Write(data[:len(data)/2])
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("answered after %s, before -upload-timeout", elapsed)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status %d, expected %d", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	if apiErr := decodeAPIError(t, resp); apiErr.Code != ErrTimeout {
+		t.Errorf("error %+v, expected code %s", apiErr, ErrTimeout)
+	}
+
+	if count := eventCount(t, app); count != 0 {
+		t.Errorf("%d events stored", count)
+	}
+	for _, dir := range []string{config.dirs.staging, config.dirs.data} {
+		if files := dirFiles(t, dir); len(files) != 0 {
+			t.Errorf("%s holds %v", dir, files)
+		}
+	}
+}
+
+// A fetch from a camera slower than the server's timeouts still gets
+// -upload-timeout, rather than being cancelled when the read timeout passes
+// or failing to answer after the write timeout.
+func TestUploadDeadlineSlowFetch(t *testing.T) {
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		if strings.HasSuffix(r.URL.Path, ".jpg") {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("\xff\xd8\xff\xe0 image"))
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("video"))
+	}))
+	defer camera.Close()
+
+	config := testConfig(t)
+	allow, err := parseFetchAllowlist("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.fetchAllow, config.fetchTimeout, config.fetchMaxSize = allow, 5*time.Second, 1<<20
+	app, server := newDeadlineServer(t, config)
+	app.Fetcher = newFetchClient(config)
+
+	body := fmt.Sprintf(`{"name": "Front door", "video_url": %q, "image_url": %q}`, camera.URL+"/clip.mp4", camera.URL+"/clip.jpg")
+	resp, err := http.Post(server.URL+"/api/fetch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		data, _ := io.ReadAll(resp.Body)
+		t.Errorf("status %d (%s), expected %d", resp.StatusCode, data, http.StatusAccepted)
+	}
+	if count := eventCount(t, app); count != 1 {
+		t.Errorf("%d events stored, expected 1", count)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+)
+
+// Counters published on the debug listener
+var (
+	uploadsActive   = expvar.NewInt("uploads_active")
+	panicsRecovered = expvar.NewInt("panics_recovered")
+	smsSuppressed   = expvar.NewInt("sms_suppressed")
+	dbBusyRetries   = expvar.NewInt("db_busy_retries")  // Statements retried because the database was busy
+	dbBusyFailures  = expvar.NewInt("db_busy_failures") // Requests that got a 503 because it stayed busy
+	cacheHits       = expvar.NewInt("cache_hits")       // Listings, stats and heatmaps served from memory
+	cacheMisses     = expvar.NewInt("cache_misses")     // Those that had to be queried
+
+	// Uploads turned down by -pre-accept-url or -pre-accept-on-error, and the
+	// times the service couldn't be asked
+	preAcceptRejected = expvar.NewInt("preaccept_rejected")
+	preAcceptErrors   = expvar.NewInt("preaccept_errors")
+
+	// Security events -syslog-addr didn't get, because the queue was full or
+	// sending failed
+	syslogDropped = expvar.NewInt("syslog_dropped")
+	syslogErrors  = expvar.NewInt("syslog_errors")
+)
+
+// Starts the debug listener serving pprof and expvar. It has its own mux so none
+// of this is reachable through the public router. Addresses without a host are
+// bound to localhost.
+func (app *App) ListenDebug(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid -debug-listen %q: %s", addr, err)
+	}
+	if host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+
+	expvar.Publish("transcode_queue", expvar.Func(func() interface{} {
+		return app.Transcodes.Len()
+	}))
+	expvar.Publish("transcode_oldest_queued_seconds", expvar.Func(func() interface{} {
+		return app.Transcodes.Oldest().Seconds()
+	}))
+	expvar.Publish("transcodes_active", expvar.Func(func() interface{} {
+		return app.Transcodes.Active()
+	}))
+	expvar.Publish("deliveries_pending", expvar.Func(func() interface{} {
+		return app.PendingDeliveries()
+	}))
+	expvar.Publish("disk_free_bytes", expvar.Func(func() interface{} {
+		free, _, _ := DiskUsage(app.Config.dirs.data)
+		return free
+	}))
+	expvar.Publish("disk_total_bytes", expvar.Func(func() interface{} {
+		_, total, _ := DiskUsage(app.Config.dirs.data)
+		return total
+	}))
+	expvar.Publish("storage_bytes", expvar.Func(func() interface{} {
+		var size int64
+		app.DB.QueryRow(`SELECT COALESCE(SUM(size_bytes), 0) FROM events`).Scan(&size)
+		return size
+	}))
+	expvar.Publish("trash_bytes", expvar.Func(func() interface{} {
+		usage, _ := app.TrashUsage()
+		return usage.Bytes
+	}))
+	expvar.Publish("archive_bytes", expvar.Func(func() interface{} {
+		size, _ := app.ArchiveBytes()
+		return size
+	}))
+	expvar.Publish("db_open_connections", expvar.Func(func() interface{} {
+		return app.DB.Stats().OpenConnections
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", app.MetricsHandler)
+
+	log.Println("Debug listener on", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// Histogram of observed values, published in expvar and in the Prometheus
+// text format by /metrics. Each bucket counts the values up to its bound.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // Per bucket, the last for values above every bound
+	sum    float64
+	count  uint64
+}
+
+// Histograms served by /metrics
+var histograms []*histogram
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+	expvar.Publish(name, h)
+	histograms = append(histograms, h)
+	return h
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.buckets) && v > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Cumulative counts per bucket bound, for expvar.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]uint64, len(h.buckets)+1)
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		bound := "+Inf"
+		if i < len(h.buckets) {
+			bound = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+		}
+		buckets[bound] = cumulative
+	}
+	data, _ := json.Marshal(map[string]interface{}{"buckets": buckets, "sum": h.sum, "count": h.count})
+	return string(data)
+}
+
+// Writes the histogram in the Prometheus text format, its name prefixed with
+// seccam_.
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name := "seccam_" + h.name
+	fmt.Fprintf(w, "# HELP %s %s.\n# TYPE %s histogram\n", name, h.help, name)
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		bound := "+Inf"
+		if i < len(h.buckets) {
+			bound = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// Serves the histograms, the cache counters and the state of the conversion
+// queue in the Prometheus text format.
+func (app *App) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, h := range histograms {
+		h.writeTo(w)
+	}
+	counters := []struct {
+		name, help string
+		value      *expvar.Int
+	}{
+		{"cache_hits_total", "Index listings, stats and heatmaps served from memory", cacheHits},
+		{"cache_misses_total", "Index listings, stats and heatmaps that had to be queried", cacheMisses},
+		{"preaccept_rejected_total", "Uploads turned down before being stored", preAcceptRejected},
+		{"preaccept_errors_total", "Times the pre-accept service couldn't be asked", preAcceptErrors},
+		{"syslog_dropped_total", "Security events dropped because the syslog queue was full", syslogDropped},
+		{"syslog_errors_total", "Security events the syslog server couldn't be sent", syslogErrors},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP seccam_%s %s.\n# TYPE seccam_%s counter\nseccam_%s %d\n", c.name, c.help, c.name, c.name, c.value.Value())
+	}
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"transcode_queue", "Videos waiting to be converted", float64(app.Transcodes.Len())},
+		{"transcode_oldest_queued_seconds", "How long the video queued first has waited to be converted", app.Transcodes.Oldest().Seconds()},
+		{"transcodes_active", "Conversions running", float64(app.Transcodes.Active())},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP seccam_%s %s.\n# TYPE seccam_%s gauge\nseccam_%s %g\n", g.name, g.help, g.name, g.name, g.value)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Notification channels going through the delivery queue
+const (
+	ChannelWebhook = "webhook"
+	ChannelSNS     = "sns"
+	ChannelDetect  = "detect" // Object detection, retried like a delivery
+
+	ChannelEscalation = "escalation" // Webhooks of -escalate stages
+	ChannelDiscord    = "discord"
+	ChannelMatrix     = "matrix"
+	ChannelNtfy       = "ntfy"
+	ChannelSMS        = "sms" // Event alerts through Twilio
+	ChannelSlack      = "slack"
+	ChannelEmail      = "email"
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // Gave up after deliveryAttempts
+)
+
+// Attempts made at a delivery before giving up. Retries back off exponentially
+// from deliveryBackoff, so the last one happens a good hour after the first.
+const (
+	deliveryAttempts = 8
+	deliveryBackoff  = 30 * time.Second
+)
+
+// Outcome of delivery attempts per channel, e.g. sns_sent and sns_failed
+var deliveryStats = expvar.NewMap("deliveries")
+
+// Delivery information struct
+type Delivery struct {
+	Id       int64              `json:"id"`
+	EventId  int64              `json:"event_id"`
+	Channel  string             `json:"channel"`
+	Status   string             `json:"status"`
+	Attempts []*DeliveryAttempt `json:"attempts"`
+	Next     *time.Time         `json:"next_attempt_at"` // Nil once delivered or failed
+	Created  time.Time          `json:"created_at"`
+}
+
+// Single try at a delivery. StatusCode is 0 when no response was received,
+// Error says why.
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+}
+
+// Create the delivery tables in our database. Notifications are stored before
+// they're sent so retries survive restarts.
+func CreateDeliveryTables(db *sql.DB) {
+	sql_deliveries := `
+	CREATE TABLE IF NOT EXISTS deliveries(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		next_attempt TIMESTAMP,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	sql_attempts := `
+	CREATE TABLE IF NOT EXISTS delivery_attempts(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id INTEGER NOT NULL,
+		time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		status_code INTEGER NOT NULL,
+		error TEXT NOT NULL
+	)`
+	sql_index := `CREATE INDEX IF NOT EXISTS delivery_attempts_delivery ON delivery_attempts(delivery_id)`
+
+	for _, stmt := range []string{sql_deliveries, sql_attempts, sql_index} {
+		if _, err := db.Exec(stmt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Stores a notification for delivery over the channel and wakes up the sender.
+func (app *App) queueDelivery(channel string, eventID int64, payload []byte) (int64, error) {
+	sql_delivery := `INSERT INTO deliveries(event_id, channel, payload, status, next_attempt) VALUES (?, ?, ?, ?, ?)`
+	res, err := app.DB.Exec(sql_delivery, eventID, channel, string(payload), DeliveryPending, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case app.Deliveries <- struct{}{}:
+	default:
+	}
+
+	return res.LastInsertId()
+}
+
+// Sends queued notifications whenever one is queued, and every few seconds for
+// the retries that have come due.
+func (app *App) DeliverySender() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		app.sendDueDeliveries()
+
+		select {
+		case <-app.Deliveries:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends every delivery whose next attempt has come, oldest first.
+func (app *App) sendDueDeliveries() {
+	sql_due := `
+	SELECT id, channel, payload FROM deliveries
+	WHERE status = ? AND next_attempt <= ?
+	ORDER BY id LIMIT 50`
+	rows, err := app.DB.Query(sql_due, DeliveryPending, time.Now().UTC())
+	if err != nil {
+		log.Println("Error looking up deliveries")
+		log.Println(err.Error())
+		return
+	}
+
+	type due struct {
+		id      int64
+		channel string
+		payload string
+	}
+	var deliveries []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.channel, &d.payload); err != nil {
+			log.Println("Error looking up deliveries")
+			log.Println(err.Error())
+			rows.Close()
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+
+	for _, d := range deliveries {
+		if err := app.attemptDelivery(d.id, d.channel, []byte(d.payload)); err != nil {
+			log.Printf("Error recording delivery %d\n", d.id)
+			log.Println(err.Error())
+		}
+	}
+}
+
+// Sends a delivery's payload over its channel, returning the status code of the
+// response if there was one.
+func (app *App) deliver(id int64, channel string, payload []byte) (int, error) {
+	switch channel {
+	case ChannelWebhook:
+		if app.Config.webhookURL == "" {
+			return 0, fmt.Errorf("webhooks are no longer enabled")
+		}
+		return app.postWebhook(id, payload)
+	case ChannelDetect:
+		if app.Config.detectURL == "" {
+			return 0, fmt.Errorf("detection is no longer enabled")
+		}
+		return app.detect(payload)
+	case ChannelEscalation:
+		return app.postEscalation(id, payload)
+	}
+	// Exports go over a channel named after their target
+	if exporter := app.exporter(channel); exporter != nil {
+		return app.runExport(exporter, payload)
+	}
+
+	return app.sendNotification(id, channel, payload)
+}
+
+// Makes one attempt at a delivery, recording its outcome and scheduling the
+// next attempt on failure. Rate limited attempts are retried when the receiver
+// asked and don't count towards giving up.
+func (app *App) attemptDelivery(id int64, channel string, payload []byte) error {
+	status, err := app.deliver(id, channel, payload)
+	var limited *rateLimitedError
+	errors.As(err, &limited)
+	message := ""
+	if err != nil {
+		message = err.Error()
+		deliveryStats.Add(channel+"_failed", 1)
+	} else {
+		deliveryStats.Add(channel+"_sent", 1)
+	}
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sql_attempt := `INSERT INTO delivery_attempts(delivery_id, status_code, error) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(sql_attempt, id, status, message); err != nil {
+		return err
+	}
+	var attempts int
+	sql_attempts := `SELECT COUNT(*) FROM delivery_attempts WHERE delivery_id = ? AND status_code != 429`
+	if err := tx.QueryRow(sql_attempts, id).Scan(&attempts); err != nil {
+		return err
+	}
+
+	sql_delivery := `UPDATE deliveries SET status = ?, next_attempt = ? WHERE id = ?`
+	switch {
+	case message == "":
+		_, err = tx.Exec(sql_delivery, DeliveryDelivered, nil, id)
+	case limited != nil:
+		log.Printf("Delivery %d over %s was rate limited, retrying in %s\n", id, channel, limited.after)
+		_, err = tx.Exec(sql_delivery, DeliveryPending, time.Now().Add(limited.after).UTC(), id)
+	case attempts >= deliveryAttempts:
+		log.Printf("Giving up on delivery %d over %s after %d attempts: %s\n", id, channel, attempts, message)
+		deliveryStats.Add(channel+"_given_up", 1)
+		_, err = tx.Exec(sql_delivery, DeliveryFailed, nil, id)
+	default:
+		log.Printf("Delivery %d over %s failed, retrying: %s\n", id, channel, message)
+		next := time.Now().Add(deliveryBackoff << (attempts - 1)).UTC()
+		_, err = tx.Exec(sql_delivery, DeliveryPending, next, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Number of deliveries waiting to be sent or retried.
+func (app *App) PendingDeliveries() int {
+	var count int
+	if err := app.DB.QueryRow(`SELECT COUNT(*) FROM deliveries WHERE status = ?`, DeliveryPending).Scan(&count); err != nil {
+		panic(err)
+	}
+	return count
+}
+
+// Retrieves the most recent deliveries with their attempts, newest first.
+func (app *App) GetDeliveries(limit int) []*Delivery {
+	sql_deliveries := `
+	SELECT id, event_id, channel, status, next_attempt, created FROM deliveries
+	ORDER BY id DESC LIMIT ?`
+	rows, err := app.DB.Query(sql_deliveries, limit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]*Delivery, 0)
+	byID := make(map[int64]*Delivery)
+	for rows.Next() {
+		delivery := &Delivery{Attempts: make([]*DeliveryAttempt, 0)}
+		var next sql.NullTime
+		if err := rows.Scan(&delivery.Id, &delivery.EventId, &delivery.Channel, &delivery.Status, &next, &delivery.Created); err != nil {
+			panic(err)
+		}
+		if next.Valid {
+			delivery.Next = &next.Time
+		}
+		deliveries = append(deliveries, delivery)
+		byID[delivery.Id] = delivery
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+	if len(deliveries) == 0 {
+		return deliveries
+	}
+
+	sql_attempts := `
+	SELECT delivery_id, time, status_code, error FROM delivery_attempts
+	WHERE delivery_id BETWEEN ? AND ? ORDER BY id`
+	rows, err = app.DB.Query(sql_attempts, deliveries[len(deliveries)-1].Id, deliveries[0].Id)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deliveryID int64
+		attempt := new(DeliveryAttempt)
+		if err := rows.Scan(&deliveryID, &attempt.Time, &attempt.StatusCode, &attempt.Error); err != nil {
+			panic(err)
+		}
+		if delivery, ok := byID[deliveryID]; ok {
+			delivery.Attempts = append(delivery.Attempts, attempt)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return deliveries
+}
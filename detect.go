@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Object found in an event's image by the detection service
+type Label struct {
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Confidence as a rounded percentage, for display.
+func (l *Label) Percent() int {
+	return int(math.Round(l.Confidence * 100))
+}
+
+// Payload of a queued detection, the image is read when it's sent
+type detectJob struct {
+	EventId int64 `json:"event_id"`
+}
+
+// Response of a DeepStack style detection service (DeepStack, CodeProject.AI)
+type detectResponse struct {
+	Success     bool    `json:"success"`
+	Error       string  `json:"error"`
+	Predictions []Label `json:"predictions"`
+}
+
+// Create the labels table in our database.
+func CreateLabelTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS event_labels(
+		event_id INTEGER NOT NULL,
+		label TEXT NOT NULL,
+		confidence REAL NOT NULL,
+		PRIMARY KEY (event_id, label)
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Queues an event's image for object detection. Going through the delivery
+// queue means failures are retried like any other delivery.
+func (app *App) QueueDetection(event *Event) (int64, error) {
+	payload, err := json.Marshal(detectJob{EventId: event.Id})
+	if err != nil {
+		return 0, err
+	}
+
+	return app.queueDelivery(ChannelDetect, event.Id, payload)
+}
+
+// Sends a queued event's image to -detect-url and stores the labels found with
+// at least -detect-min-confidence. Events deleted in the meantime are skipped.
+func (app *App) detect(payload []byte) (int, error) {
+	var job detectJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return 0, err
+	}
+	event, err := app.FindEvent(job.EventId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	body, contentType, err := app.detectBody(event.Image)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.detectTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.Config.detectURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "seccam-web")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return resp.StatusCode, fmt.Errorf("detector responded %s", resp.Status)
+	}
+
+	var result detectResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return resp.StatusCode, fmt.Errorf("unreadable detector response: %v", err)
+	}
+	if !result.Success {
+		return resp.StatusCode, fmt.Errorf("detector failed: %s", result.Error)
+	}
+
+	// Only the most confident sighting of each label is kept
+	best := make(map[string]float64)
+	for _, p := range result.Predictions {
+		if p.Label != "" && p.Confidence >= app.Config.detectMin && p.Confidence > best[p.Label] {
+			best[p.Label] = p.Confidence
+		}
+	}
+	if err := app.SetEventLabels(event.Id, best); err != nil {
+		return resp.StatusCode, err
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Builds the multipart body detection services expect, the image in an image
+// field.
+func (app *App) detectBody(path string) (io.Reader, string, error) {
+	f, err := app.openMedia(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("image", filepath.Base(path))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return &buf, mw.FormDataContentType(), nil
+}
+
+// Replaces the labels of an event.
+func (app *App) SetEventLabels(id int64, labels map[string]float64) error {
+	defer app.Cache.Clear()
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM event_labels WHERE event_id = ?`, id); err != nil {
+		return err
+	}
+	for label, confidence := range labels {
+		sql_label := `INSERT INTO event_labels(event_id, label, confidence) VALUES (?, ?, ?)`
+		if _, err := tx.Exec(sql_label, id, label, confidence); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Retrieves the labels of an event, most confident first.
+func (app *App) EventLabels(id int64) ([]*Label, error) {
+	sql_labels := `SELECT label, confidence FROM event_labels WHERE event_id = ? ORDER BY confidence DESC`
+	rows, err := app.DB.Query(sql_labels, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := make([]*Label, 0)
+	for rows.Next() {
+		label := new(Label)
+		if err := rows.Scan(&label.Label, &label.Confidence); err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+
+	return labels, rows.Err()
+}
+
+// Whether alerts about new events wait for object detection to find one of
+// -notify-labels.
+func (app *App) notifyAfterLabels() bool {
+	return app.Config.detectURL != "" && len(app.Config.notifyLabels) > 0
+}
+
+// Alerts about a new event. With -notify-labels that happens in the background
+// once detection has found one of them, or straight away when detection doesn't
+// finish within -notify-label-wait.
+func (app *App) alertEvent(logger *Logger, event *Event, camera string) {
+	if !app.notifyAfterLabels() {
+		app.NotifyEvent(logger, event, camera)
+		return
+	}
+	go app.alertOnLabels(logger, event, camera)
+}
+
+// Waits for an event's detection and alerts if one of -notify-labels was found.
+func (app *App) alertOnLabels(logger *Logger, event *Event, camera string) {
+	detected, err := app.waitForDetection(event.Id, app.Config.labelWait)
+	if err != nil {
+		logger.Printf("Error waiting for object detection of event %d, notifying regardless\n", event.Id)
+		logger.Println(err.Error())
+		app.NotifyEvent(logger, event, camera)
+		return
+	}
+	if !detected {
+		logger.Printf("No object detection of event %d within %s, notifying regardless\n", event.Id, app.Config.labelWait)
+		app.NotifyEvent(logger, event, camera)
+		return
+	}
+
+	labels, err := app.EventLabels(event.Id)
+	if err != nil {
+		logger.Printf("Error looking up the labels of event %d, notifying regardless\n", event.Id)
+		logger.Println(err.Error())
+		app.NotifyEvent(logger, event, camera)
+		return
+	}
+	for _, label := range labels {
+		for _, wanted := range app.Config.notifyLabels {
+			if label.Label == wanted {
+				app.NotifyEvent(logger, event, camera)
+				return
+			}
+		}
+	}
+	logger.Printf("Not notifying about event %d, none of %s were detected\n", event.Id, strings.Join(app.Config.notifyLabels, ", "))
+}
+
+// Waits up to timeout for an event's detection to succeed. Returns false when
+// it doesn't, or was given up on.
+func (app *App) waitForDetection(id int64, timeout time.Duration) (bool, error) {
+	sql_status := `SELECT status FROM deliveries WHERE event_id = ? AND channel = ? ORDER BY id DESC LIMIT 1`
+	deadline := time.Now().Add(timeout)
+	for {
+		var status string
+		if err := app.DB.QueryRow(sql_status, id, ChannelDetect).Scan(&status); err != nil {
+			return false, err
+		}
+		switch {
+		case status == DeliveryDelivered:
+			return true, nil
+		case status == DeliveryFailed, time.Now().After(deadline):
+			return false, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Parses a comma separated list of labels, ignoring empty ones.
+func parseLabels(s string) []string {
+	labels := make([]string, 0)
+	for _, label := range strings.Split(s, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
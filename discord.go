@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Largest image attached to a Discord message, the limit for webhooks without
+// a boosted server
+const discordMaxImage = 8 << 20
+
+// Delivery Discord asked to be retried later with a 429
+type rateLimitedError struct {
+	after time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retrying in %s", e.after)
+}
+
+// Queued Discord message about an event. The image is read when it's sent,
+// the embed is posted as is.
+type discordMessage struct {
+	Image string       `json:"image"`
+	Embed discordEmbed `json:"embed"`
+}
+
+// Embed shown for an event in Discord
+type discordEmbed struct {
+	Title     string              `json:"title"`
+	URL       string              `json:"url,omitempty"` // Only absolute links work, with -base-url
+	Timestamp time.Time           `json:"timestamp"`
+	Fields    []discordEmbedField `json:"fields,omitempty"`
+	Image     *discordEmbedImage  `json:"image,omitempty"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+// Notifier posting alerts to a Discord webhook
+type discordNotifier struct {
+	notifierBase
+	webhook string
+}
+
+// Builds the Discord message about an event.
+func (n discordNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	message := discordMessage{
+		Image: event.Image,
+		Embed: discordEmbed{Title: event.Name, Timestamp: event.Time},
+	}
+	if app.Config.baseURL != "" {
+		message.Embed.URL = app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id))
+	}
+	if camera != "" {
+		message.Embed.Fields = append(message.Embed.Fields, discordEmbedField{Name: app.T("alert.camera"), Value: camera, Inline: true})
+	}
+	if where := event.Where(); where != "" {
+		if link := event.MapURL(); link != "" {
+			where = fmt.Sprintf("[%s](%s)", where, link)
+		}
+		message.Embed.Fields = append(message.Embed.Fields, discordEmbedField{Name: app.T("alert.location"), Value: where, Inline: true})
+	}
+	return json.Marshal(message)
+}
+
+// Posts a queued message to the Discord webhook with the event's image
+// attached, so it shows inline without the server being reachable. A 429
+// returns a rateLimitedError with the wait Discord asked for.
+func (n discordNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	var message discordMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	name := "snapshot" + filepath.Ext(message.Image)
+	image, err := app.readAlertImage(message.Image, discordMaxImage)
+	if err != nil {
+		return 0, err
+	}
+	if image != nil {
+		message.Embed.Image = &discordEmbedImage{URL: "attachment://" + name}
+	}
+
+	content := map[string]interface{}{"embeds": []discordEmbed{message.Embed}}
+	if image != nil {
+		content["attachments"] = []map[string]interface{}{{"id": 0, "filename": name}}
+	}
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return 0, err
+	}
+	if err := form.WriteField("payload_json", string(contentJSON)); err != nil {
+		return 0, err
+	}
+	if image != nil {
+		part, err := form.CreateFormFile("files[0]", name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := part.Write(image); err != nil {
+			return 0, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.webhook, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("User-Agent", "seccam-web")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return resp.StatusCode, &rateLimitedError{after: discordRetryAfter(resp)}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("discord responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Reads the image to attach to an alert, nil when it's larger than max or gone,
+// the alert is sent without it then.
+func (app *App) readAlertImage(path string, max int) ([]byte, error) {
+	f, err := app.openMedia(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	image, err := io.ReadAll(io.LimitReader(f, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > max {
+		return nil, nil
+	}
+	return image, nil
+}
+
+// How long a 429 from Discord says to wait, from retry_after in the body (in
+// seconds) or the Retry-After header, a second if neither says.
+func discordRetryAfter(resp *http.Response) time.Duration {
+	var limited struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&limited) == nil && limited.RetryAfter > 0 {
+		return time.Duration(limited.RetryAfter * float64(time.Second))
+	}
+	if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return time.Second
+}
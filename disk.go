@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Free space below which the disk alert fires, either a percentage of the
+// filesystem or a number of bytes
+type diskThreshold struct {
+	percent float64
+	bytes   uint64
+}
+
+// Byte size suffixes accepted in -disk-alert-threshold and -storage-quota
+var sizeSuffixes = []struct {
+	suffix string
+	size   uint64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// Parses a threshold like "10%", "5GB" or "1048576".
+func ParseDiskThreshold(value string) (diskThreshold, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return diskThreshold{}, fmt.Errorf("invalid disk threshold %q, expected a percentage between 0 and 100", value)
+		}
+		return diskThreshold{percent: percent}, nil
+	}
+
+	n, err := parseSize(s)
+	if err != nil || n == 0 {
+		return diskThreshold{}, fmt.Errorf("invalid disk threshold %q, expected a percentage (10%%) or size (5GB)", value)
+	}
+
+	return diskThreshold{bytes: n}, nil
+}
+
+// Parses a size like "5GB" or "1048576" into bytes.
+func parseSize(value string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	size := uint64(1)
+	for _, unit := range sizeSuffixes {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, size = strings.TrimSuffix(s, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes or a size like 5GB", value)
+	}
+	return n * size, nil
+}
+
+// Whether free space is below the threshold.
+func (t diskThreshold) below(free, total uint64) bool {
+	if t.percent > 0 {
+		return float64(free) < float64(total)*t.percent/100
+	}
+	return free < t.bytes
+}
+
+// Returns the free (available to us) and total bytes of the filesystem holding
+// the given path.
+func DiskUsage(path string) (uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+
+	return fs.Bavail * uint64(fs.Bsize), fs.Blocks * uint64(fs.Bsize), nil
+}
+
+// Formats a byte count for humans.
+func formatBytes(n uint64) string {
+	for _, unit := range sizeSuffixes {
+		if n >= unit.size && unit.size > 1 {
+			return fmt.Sprintf("%.1f %s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// Checks the data directory's free space every minute, sending an alert when it
+// drops below the threshold and another once it recovers.
+func (app *App) DiskMonitor(threshold diskThreshold) {
+	low := false
+	for ; ; time.Sleep(time.Minute) {
+		free, total, err := DiskUsage(app.Config.dirs.data)
+		if err != nil {
+			log.Printf("Error checking free space of %s\n", app.Config.dirs.data)
+			log.Println(err.Error())
+			continue
+		}
+
+		below := threshold.below(free, total)
+		if below == low {
+			continue
+		}
+		low = below
+
+		message := fmt.Sprintf("Seccam disk space is low: %s free of %s.", formatBytes(free), formatBytes(total))
+		if !low {
+			message = fmt.Sprintf("Seccam disk space recovered: %s free of %s.", formatBytes(free), formatBytes(total))
+		}
+		log.Println(message)
+		app.SendText(app.Logger, message)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Target name of Dropbox exports
+const ExportDropbox = "dropbox"
+
+// Dropbox's content API, files are uploaded through it
+const dropboxContentURL = "https://content.dropboxapi.com/2"
+
+// Files up to this size are uploaded in one call, larger ones in an upload
+// session of chunks this size
+const dropboxChunk = 8 << 20
+
+// Exports events to Dropbox with an access token
+type dropboxExporter struct {
+	token  string
+	path   string // Folder template, see folder
+	client *http.Client
+
+	mu      sync.Mutex
+	checked time.Time // When Dropbox was last called
+	err     error     // Why the last call failed, nil if it worked or was rate limited
+}
+
+func newDropboxExporter(config *Config) *dropboxExporter {
+	return &dropboxExporter{
+		token:  config.dropboxToken,
+		path:   config.dropboxPath,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Checks a -dropbox-path template, which has to be absolute.
+func checkDropboxPath(template string) error {
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("%q has to start with /", template)
+	}
+	return nil
+}
+
+func (d *dropboxExporter) Name() string {
+	return ExportDropbox
+}
+
+func (d *dropboxExporter) Title() string {
+	return "Dropbox"
+}
+
+// Returns when Dropbox was last called and the error it gave, if any.
+func (d *dropboxExporter) Status() (time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.checked, d.err
+}
+
+func (d *dropboxExporter) record(err error) {
+	var limited *rateLimitedError
+	if errors.As(err, &limited) {
+		err = nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.checked = time.Now()
+	d.err = err
+}
+
+// Folder an event's files go in, -dropbox-path with {camera}, {date} (local,
+// YYYY-MM-DD) and {id} filled in. Slashes in the camera name are replaced, so
+// it stays a single folder.
+func (d *dropboxExporter) folder(event *Event, camera string) string {
+	if camera == "" {
+		camera = "unknown"
+	}
+	folder := strings.NewReplacer(
+		"{camera}", strings.ReplaceAll(camera, "/", "-"),
+		"{date}", event.Time.Local().Format("2006-01-02"),
+		"{id}", strconv.FormatInt(event.Id, 10),
+	).Replace(d.path)
+	return path.Clean(folder)
+}
+
+// Uploads a file of an event into its folder, named after the event's id and
+// the file.
+func (d *dropboxExporter) Export(ctx context.Context, app *App, event *Event, media *Media) (remoteRef, error) {
+	dst := path.Join(d.folder(event, app.cameraName(event)), fmt.Sprintf("%d-%s", event.Id, filepath.Base(media.Path)))
+	uploaded, err := d.upload(ctx, app, media.Path, dst)
+	d.record(err)
+	if err != nil {
+		return remoteRef{}, err
+	}
+	link := url.URL{Scheme: "https", Host: "www.dropbox.com", Path: "/preview" + uploaded.Path}
+	return remoteRef{Id: uploaded.Id, Path: uploaded.Path, URL: link.String()}, nil
+}
+
+// Metadata Dropbox returns for an uploaded file
+type dropboxFile struct {
+	Id   string `json:"id"`
+	Path string `json:"path_display"`
+}
+
+// Uploads a file to dst, in a single call if it's small enough and in an
+// upload session otherwise. Files already at dst are kept, the upload is
+// renamed instead.
+func (d *dropboxExporter) upload(ctx context.Context, app *App, src, dst string) (*dropboxFile, error) {
+	f, err := app.openMedia(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	commit := map[string]interface{}{"path": dst, "mode": "add", "autorename": true, "mute": true}
+	var file dropboxFile
+	if size <= dropboxChunk {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		return &file, d.call(ctx, "/files/upload", commit, bytes.NewReader(data), &file)
+	}
+
+	// Larger files go in chunks, the last one along with the commit
+	buf := make([]byte, dropboxChunk)
+	var session struct {
+		Id string `json:"session_id"`
+	}
+	n, err := io.ReadFull(f, buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.call(ctx, "/files/upload_session/start", map[string]interface{}{"close": false}, bytes.NewReader(buf[:n]), &session); err != nil {
+		return nil, err
+	}
+	offset := int64(n)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		cursor := map[string]interface{}{"session_id": session.Id, "offset": offset}
+		if offset+int64(n) >= size {
+			return &file, d.call(ctx, "/files/upload_session/finish", map[string]interface{}{"cursor": cursor, "commit": commit}, bytes.NewReader(buf[:n]), &file)
+		}
+		if err := d.call(ctx, "/files/upload_session/append_v2", map[string]interface{}{"cursor": cursor, "close": false}, bytes.NewReader(buf[:n]), nil); err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+	}
+}
+
+// Calls an endpoint of the content API with arg in the Dropbox-API-Arg header
+// and body as the content, decoding the response into result. A 429 or 503
+// returns a rateLimitedError with the wait Dropbox asked for.
+func (d *dropboxExporter) call(ctx context.Context, endpoint string, arg interface{}, body io.Reader, result interface{}) error {
+	header, err := dropboxArg(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxContentURL+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	req.Header.Set("Dropbox-API-Arg", header)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", "seccam-web")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		after := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			after = time.Duration(seconds) * time.Second
+		}
+		return &rateLimitedError{after: after}
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Summary string `json:"error_summary"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &failure) != nil || failure.Summary == "" {
+			failure.Summary = strings.TrimSpace(string(data))
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			log.Println("ERROR: the Dropbox access token has expired or was revoked, exports fail until -dropbox-token is renewed")
+		}
+		return fmt.Errorf("dropbox responded %s: %s", resp.Status, failure.Summary)
+	}
+
+	if result == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(result)
+}
+
+// Encodes the argument of a content API call as JSON for the Dropbox-API-Arg
+// header, which only takes ASCII: anything else is escaped.
+func dropboxArg(arg interface{}) (string, error) {
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+	var header strings.Builder
+	for _, r := range string(data) {
+		switch {
+		case r < utf8.RuneSelf:
+			header.WriteRune(r)
+		case r > 0xffff:
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(&header, "\\u%04x\\u%04x", r1, r2)
+		default:
+			fmt.Fprintf(&header, "\\u%04x", r)
+		}
+	}
+	return header.String(), nil
+}
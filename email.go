@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Largest image attached to an alert email
+const emailMaxImage = 10 << 20
+
+// SMTP server mail is sent through
+type smtpServer struct {
+	host     string // With the port, 465 by default with tls and 587 without
+	user     string
+	password string
+	tls      bool // Implicit TLS, otherwise STARTTLS when the server offers it
+}
+
+// Sends a message, signing in when there's a user. Go's PLAIN auth refuses to
+// send the password unencrypted except to localhost.
+func (s smtpServer) send(from string, to []string, msg []byte) error {
+	addr := s.host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if s.tls {
+			addr = net.JoinHostPort(addr, "465")
+		} else {
+			addr = net.JoinHostPort(addr, "587")
+		}
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if s.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !s.tls {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.user != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.user, s.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Writes the headers of a message up to its body, which the returned writer
+// holds the parts of.
+func writeMailHeaders(msg *bytes.Buffer, from string, to []string, subject, multipartType string) *multipart.Writer {
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := "seccam.local"
+	if _, d, ok := strings.Cut(from, "@"); ok {
+		domain = d
+	}
+	fmt.Fprintf(msg, "From: %s\r\n", from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	parts := multipart.NewWriter(msg)
+	fmt.Fprintf(msg, "Content-Type: %s; boundary=%s\r\n\r\n", multipartType, parts.Boundary())
+	return parts
+}
+
+// Adds a base64 encoded part to a message.
+func writeMailPart(parts *multipart.Writer, header textproto.MIMEHeader, data []byte) {
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, _ := parts.CreatePart(header)
+	writeBase64(part, data)
+}
+
+// Builds a message with a plain text body and optionally an attachment.
+func buildMail(from string, to []string, subject, body, attachmentName string, attachment []byte) []byte {
+	var msg bytes.Buffer
+	parts := writeMailHeaders(&msg, from, to, subject, "multipart/mixed")
+	writeMailPart(parts, textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}}, []byte(body))
+	if attachment != nil {
+		contentType := mime.TypeByExtension(filepath.Ext(attachmentName))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		writeMailPart(parts, textproto.MIMEHeader{
+			"Content-Type":        {contentType},
+			"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", attachmentName)},
+		}, attachment)
+	}
+	parts.Close()
+
+	return msg.Bytes()
+}
+
+// Builds a message with an HTML body showing the inline images by their
+// Content-ID (cid:<key> in the HTML), all JPEGs.
+func buildHTMLMail(from string, to []string, subject, html string, inline map[string][]byte) []byte {
+	var msg bytes.Buffer
+	parts := writeMailHeaders(&msg, from, to, subject, "multipart/related")
+	writeMailPart(parts, textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}}, []byte(html))
+	for cid, image := range inline {
+		writeMailPart(parts, textproto.MIMEHeader{
+			"Content-Type":        {"image/jpeg"},
+			"Content-ID":          {"<" + cid + ">"},
+			"Content-Disposition": {fmt.Sprintf("inline; filename=%q", cid+".jpg")},
+		}, image)
+	}
+	parts.Close()
+
+	return msg.Bytes()
+}
+
+// Writes data base64 encoded in lines of 76 characters, as mail wants.
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
+
+// Queued alert email. The image is read and attached when it's sent.
+type emailMessage struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Image   string `json:"image"`
+}
+
+// Notifier emailing alerts with the event's image attached
+type emailNotifier struct {
+	notifierBase
+	smtp smtpServer
+	from string
+	to   []string
+}
+
+// Builds the email about an event.
+func (n emailNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	body := app.T("alert.event_captured", event.Name, app.FormatTime(event.Time))
+	if camera != "" {
+		body += app.T("alert.by", camera)
+	}
+	if where := event.Where(); where != "" {
+		body += app.T("alert.near", where)
+	}
+	body += ".\r\n"
+	if link := app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id)); link != "" {
+		body += "\r\n" + link + "\r\n"
+	}
+	return json.Marshal(emailMessage{Subject: app.T("alert.title", event.Name), Body: body, Image: event.Image})
+}
+
+// Sends a queued email.
+func (n emailNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	var message emailMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, err
+	}
+	image, err := app.readAlertImage(message.Image, emailMaxImage)
+	if err != nil {
+		return 0, err
+	}
+
+	msg := buildMail(n.from, n.to, message.Subject, message.Body, "snapshot"+filepath.Ext(message.Image), image)
+	if err := n.smtp.send(n.from, n.to, msg); err != nil {
+		var smtpErr *textproto.Error
+		if errors.As(err, &smtpErr) {
+			return smtpErr.Code, err
+		}
+		return 0, err
+	}
+	return 250, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Kinds of contacts an alert can be escalated to
+const (
+	EscalateSMS     = "sms"     // Text message to a number, through Twilio
+	EscalateWebhook = "webhook" // JSON posted to a URL, signed like webhooks
+)
+
+// How long the acknowledgement links in alerts work for
+const ackTokenTTL = 7 * 24 * time.Hour
+
+// Actor of acknowledgements through a link from an alert
+const ActorAckLink = "ack link"
+
+// Stage of -escalate: who is alerted once an alert has gone unacknowledged for
+// After
+type escalationStage struct {
+	After  time.Duration
+	Kind   string
+	Target string // Phone number or URL
+}
+
+// Queued escalation webhook, where it goes and what is posted
+type escalationDelivery struct {
+	URL  string          `json:"url"`
+	Body json.RawMessage `json:"body"`
+}
+
+// Body of the escalation webhooks sent
+type escalationPayload struct {
+	Type   string   `json:"type"`
+	Stage  int      `json:"stage"`   // 1 for the first stage
+	URL    string   `json:"url"`     // Event page, absolute with -base-url set
+	AckURL string   `json:"ack_url"` // Acknowledges the alert, stopping further stages
+	Event  apiEvent `json:"event"`
+}
+
+// Parses comma separated stages such as 10m=sms:+15551234567, each alerting the
+// contact once an alert has gone that long without acknowledgement. The delays
+// count from the first alert and have to grow from stage to stage.
+func parseEscalation(s string) ([]escalationStage, error) {
+	var stages []escalationStage
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		delay, contact, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not delay=kind:target", entry)
+		}
+		after, err := time.ParseDuration(delay)
+		if err != nil || after <= 0 {
+			return nil, fmt.Errorf("invalid delay %q, expected a duration such as 10m", delay)
+		}
+		if len(stages) > 0 && after <= stages[len(stages)-1].After {
+			return nil, fmt.Errorf("stage after %s has to come later than the one before", after)
+		}
+
+		kind, target, _ := strings.Cut(contact, ":")
+		switch {
+		case target == "":
+			return nil, fmt.Errorf("%q has no target", entry)
+		case kind == EscalateSMS:
+		case kind == EscalateWebhook:
+			if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("invalid webhook URL %q", target)
+			}
+		default:
+			return nil, fmt.Errorf("unknown kind %q, expected sms or webhook", kind)
+		}
+		stages = append(stages, escalationStage{After: after, Kind: kind, Target: target})
+	}
+	return stages, nil
+}
+
+// Path of the link acknowledging the alert about an event without signing in.
+func (app *App) AckLink(id int64) string {
+	return "/ack/" + app.signToken("ack", id, time.Now().Add(ackTokenTTL))
+}
+
+// Records that an event's alert went out, starting its escalation.
+func (app *App) markAlerted(id int64) error {
+	return app.retryBusy(func() error {
+		_, err := app.DB.Exec(`UPDATE events SET alerted_at = ? WHERE id = ? AND alerted_at IS NULL`, time.Now().UTC(), id)
+		return err
+	})
+}
+
+// Records that someone acknowledged the alert about an event, which stops its
+// escalation. Returns false for events that were already acknowledged, and
+// sql.ErrNoRows if there is no such event.
+func (app *App) AckEvent(id int64, actor, remoteAddr string) (bool, error) {
+	acked := false
+	err := app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(`UPDATE events SET acked_at = ?, acked_by = ? WHERE id = ? AND acked_at IS NULL`, time.Now().UTC().Truncate(time.Second), actor, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// Already acknowledged, or no such event
+			var exists int
+			return tx.QueryRow(`SELECT 1 FROM events WHERE id = ?`, id).Scan(&exists)
+		}
+
+		if err := Audit(tx, actor, "ack", id, remoteAddr, ""); err != nil {
+			return err
+		}
+		acked = true
+		return tx.Commit()
+	})
+	return acked, err
+}
+
+// Sends the stages of -escalate as they come due, checking every 30 seconds,
+// except in maintenance mode.
+func (app *App) EscalationScheduler() {
+	for ; ; time.Sleep(30 * time.Second) {
+		if app.ReadOnly.Load() {
+			continue
+		}
+		if err := app.escalateDue(); err != nil {
+			log.Println("Error escalating alerts")
+			log.Println(err.Error())
+		}
+	}
+}
+
+// Sends the next stage of every unacknowledged alert it has come due for. An
+// alert goes up at most one stage at a time. Alerts older than the last stage
+// by more than an hour, left over from a long downtime or from before the stages
+// were changed, aren't escalated any more.
+func (app *App) escalateDue() error {
+	stages := app.Config.escalation
+	now := time.Now()
+	oldest := now.Add(-stages[len(stages)-1].After - time.Hour).UTC()
+
+	sql_due := `
+	SELECT id, alerted_at, escalation_stage FROM events
+	WHERE acked_at IS NULL AND alerted_at > ? AND escalation_stage < ?`
+	rows, err := app.DB.Query(sql_due, oldest, len(stages))
+	if err != nil {
+		return err
+	}
+	type due struct {
+		id    int64
+		stage int
+	}
+	var pending []due
+	for rows.Next() {
+		var id int64
+		var alerted time.Time
+		var stage int
+		if err := rows.Scan(&id, &alerted, &stage); err != nil {
+			rows.Close()
+			return err
+		}
+		if !now.Before(alerted.Add(stages[stage].After)) {
+			pending = append(pending, due{id, stage})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range pending {
+		// Only one sender gets to move an alert up, and not once it's acknowledged
+		sql_claim := `UPDATE events SET escalation_stage = ? WHERE id = ? AND escalation_stage = ? AND acked_at IS NULL`
+		res, err := app.DB.Exec(sql_claim, d.stage+1, d.id, d.stage)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			continue
+		}
+
+		event, err := app.FindEvent(d.id)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		app.escalate(event, d.stage)
+	}
+
+	return nil
+}
+
+// Alerts the contact of a stage about an unacknowledged event.
+func (app *App) escalate(event *Event, stage int) {
+	contact := app.Config.escalation[stage]
+	log.Printf("Escalating the alert about event %d to stage %d, %s %s\n", event.Id, stage+1, contact.Kind, contact.Target)
+
+	switch contact.Kind {
+	case EscalateSMS:
+		message := app.T("alert.escalated", app.FormatTime(event.Time), contact.After)
+		if where := event.Where(); where != "" {
+			message = app.T("alert.escalated_near", app.FormatTime(event.Time), where, contact.After)
+		}
+		mediaURL := ""
+		if app.Config.baseURL != "" {
+			message += " " + app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id))
+			message += " " + app.T("alert.acknowledge") + " " + app.AbsoluteURL(app.AckLink(event.Id))
+			mediaURL = app.AbsoluteURL(app.MediaURL(event.Image))
+		}
+		if err := app.sendMessageTo(app.Logger, contact.Target, message, mediaURL); err != nil {
+			log.Printf("Error sending SMS to %s\n", contact.Target)
+			log.Println(err.Error())
+		}
+	case EscalateWebhook:
+		body, err := json.Marshal(escalationPayload{
+			Type:   "event.escalated",
+			Stage:  stage + 1,
+			URL:    app.PublicURL(fmt.Sprintf("/event/%d", event.Id)),
+			AckURL: app.PublicURL(app.AckLink(event.Id)),
+			Event:  app.apiEvent(event),
+		})
+		if err == nil {
+			var payload []byte
+			payload, err = json.Marshal(escalationDelivery{URL: contact.Target, Body: body})
+			if err == nil {
+				_, err = app.queueDelivery(ChannelEscalation, event.Id, payload)
+			}
+		}
+		if err != nil {
+			log.Printf("Error queueing escalation webhook to %s\n", contact.Target)
+			log.Println(err.Error())
+		}
+	}
+}
+
+// Posts a queued escalation webhook.
+func (app *App) postEscalation(id int64, payload []byte) (int, error) {
+	var delivery escalationDelivery
+	if err := json.Unmarshal(payload, &delivery); err != nil {
+		return 0, err
+	}
+	return app.postJSON(delivery.URL, id, delivery.Body)
+}
+
+// Acknowledges the alert about an event, returning it with who acknowledged
+// it. Acknowledging it again changes nothing.
+func (app *App) APIAckHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	acked, err := app.AckEvent(event.Id, actorOf(r), r.RemoteAddr)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "event not found")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	if acked {
+		app.Log(r).Printf("%s acknowledged event %d\n", actorOf(r), event.Id)
+	}
+
+	if event, err = app.FindEvent(event.Id); err != nil {
+		panic(err)
+	}
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Renders the page of an acknowledgement link from an alert, and acknowledges
+// the alert when it's posted to. The link works without signing in until it
+// expires.
+func (app *App) AckPageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := app.verifyToken("ack", p.ByName("token"))
+	if err == errShareExpired {
+		app.RenderError(w, r, http.StatusGone, "This link has expired.")
+		return
+	} else if err != nil {
+		app.RenderError(w, r, http.StatusForbidden, "This link is invalid.")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if app.ReadOnly.Load() {
+			app.RenderError(w, r, http.StatusServiceUnavailable, "The server is in maintenance mode, try again later.")
+			return
+		}
+		acked, err := app.AckEvent(id, ActorAckLink, r.RemoteAddr)
+		if err != nil && err != sql.ErrNoRows {
+			panic(err)
+		}
+		if acked {
+			app.Log(r).Printf("Event %d acknowledged through its link\n", id)
+		}
+	}
+
+	event, err := app.FindEvent(id)
+	if err == sql.ErrNoRows {
+		app.RenderError(w, r, http.StatusNotFound, "The event no longer exists.")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	context := struct {
+		*Event
+		Base string
+	}{
+		Event: event,
+		Base:  "/ack/" + p.ByName("token"),
+	}
+	t := app.Template(r, "ack")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Builds an ETag for event listings from the highest event id, the number of
+// events and the slugs of public events, so new events, deletions and
+// publishing all change it. Other edits to existing events (renames, notes,
+// conversions finishing) do not. Anything else the response depends on is
+// passed as extra. The state of the events is kept in memory until they change.
+func (app *App) EventsETag(extra ...string) string {
+	state, err := app.Cache.Load("etag", func() (interface{}, error) {
+		var maxID, count int64
+		var published string // Public pages are badged, and slugs change on every publish
+		sql_state := `SELECT COALESCE(MAX(id), 0), COUNT(*), COALESCE(GROUP_CONCAT(public_slug), '') FROM events`
+		if err := app.DB.QueryRow(sql_state).Scan(&maxID, &count, &published); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%d-%d-%s", maxID, count, published), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	sum := sha256.Sum256([]byte(state.(string) + "\x00" + strings.Join(extra, "\x00")))
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// Sets the ETag header and answers 304 with an empty body when the request's
+// If-None-Match already has it, returning whether it did.
+func (app *App) NotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		// Weak comparison, the W/ prefix doesn't matter
+		if match == "*" || strings.TrimPrefix(match, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Returned when trying to delete a protected event
+var errProtected = errors.New("event is protected")
+
+// Deletes an event and its media. The row and audit entry are removed and written
+// in one transaction, retried while the database is busy, the files only once
+// that has committed.
+func (app *App) DeleteEvent(id int64, actor, remoteAddr string) error {
+	var event *Event
+	var paths []string
+	err := app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if event, paths, err = deleteEvent(tx, id, actor, remoteAddr); err != nil {
+			return err
+		}
+		if app.trashes(actor) {
+			if err := trashFiles(tx, event, paths, actor); err != nil {
+				return err
+			}
+			paths = nil
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	app.removeEventFiles(event, paths)
+
+	return nil
+}
+
+// Removes an event's rows within tx and audits it, returning the event and the
+// paths of its files for removal once tx has committed.
+func deleteEvent(tx *sql.Tx, id int64, actor, remoteAddr string) (*Event, []string, error) {
+	event, err := scanEvent(tx.QueryRow(`SELECT `+eventColumns+` FROM events WHERE id = ?`, id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if event.Protected {
+		return nil, nil, errProtected
+	}
+	if event.EvidenceAt != nil {
+		return nil, nil, errEvidence
+	}
+
+	// Every attached file goes, along with the main ones in case they weren't
+	// attached
+	paths := []string{event.Video, event.Image}
+	rows, err := tx.Query(`SELECT path FROM media WHERE event_id = ?`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM media WHERE event_id = ?`, id); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM event_labels WHERE event_id = ?`, id); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM exports WHERE event_id = ?`, id); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM events WHERE id = ?`, id); err != nil {
+		return nil, nil, err
+	}
+	if err := Audit(tx, actor, "delete", id, remoteAddr, event.Name); err != nil {
+		return nil, nil, err
+	}
+
+	return event, paths, nil
+}
+
+// Removes the files of a deleted event, its cached thumbnails and the cached
+// listings it was in, then runs its deleted hooks.
+func (app *App) removeEventFiles(event *Event, paths []string) {
+	app.Cache.Clear()
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	if app.Thumbs != nil {
+		app.Thumbs.Remove(event.Id)
+	}
+	app.RunHooks(app.Logger, HookDeleted, event, app.cameraName(event))
+}
+
+// Renames an event.
+func (app *App) RenameEvent(id int64, name, actor, remoteAddr string) error {
+	defer app.Cache.Clear()
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old string
+	if err := tx.QueryRow(`SELECT name FROM events WHERE id = ?`, id).Scan(&old); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE events SET name = ? WHERE id = ?`, name, id); err != nil {
+		return err
+	}
+	if err := Audit(tx, actor, "rename", id, remoteAddr, fmt.Sprintf("%s -> %s", old, name)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replaces an event's notes, empty notes clear them.
+func (app *App) SetNotes(id int64, notes string) error {
+	defer app.Cache.Clear()
+	res, err := app.DB.Exec(`UPDATE events SET notes = ? WHERE id = ?`, notes, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Protects an event from deletion, or lifts the protection.
+func (app *App) SetProtected(id int64, protected bool, actor, remoteAddr string) error {
+	defer app.Cache.Clear()
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE events SET protected = ? WHERE id = ?`, protected, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	action := "protect"
+	if !protected {
+		action = "unprotect"
+	}
+	if err := Audit(tx, actor, action, id, remoteAddr, ""); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Sets when an event expires, overriding the retention limits. A nil expiry
+// puts the event back under the retention limits.
+func (app *App) SetExpiry(id int64, expiresAt *time.Time, actor, remoteAddr string) error {
+	defer app.Cache.Clear()
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var value interface{}
+	detail := "retention limits"
+	if expiresAt != nil {
+		value = expiresAt.UTC()
+		detail = expiresAt.UTC().Format(time.RFC3339)
+	}
+	res, err := tx.Exec(`UPDATE events SET expires_at = ? WHERE id = ?`, value, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := Audit(tx, actor, "expiry", id, remoteAddr, detail); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Subdirectory of the data directory the files of evidence events are kept in
+const evidenceDirName = "evidence"
+
+// Returned when trying to delete an event kept as evidence
+var errEvidence = errors.New("event is kept as evidence")
+
+// Returned when trying to keep an event as evidence while its video is being
+// converted, which would replace the file, or when the event changed while its
+// files were being moved
+var errConverting = errors.New("event is being converted")
+
+// Directory the files of evidence events are kept in.
+func (app *App) evidenceDir() string {
+	return filepath.Join(app.Config.dirs.data, evidenceDirName)
+}
+
+// Keeps an event as evidence or releases it. Evidence events are never deleted,
+// by hand or by retention, the storage quota or the consistency check, and
+// their files are kept in the evidence directory. The change is audited with
+// the SHA-256 of every file, the chain of custody. Returns the event as it is
+// now.
+func (app *App) SetEvidence(id int64, evidence bool, actor, remoteAddr string) (*Event, error) {
+	defer app.Cache.Clear()
+	event, err := app.FindEvent(id)
+	if err != nil {
+		return nil, err
+	}
+	if (event.EvidenceAt != nil) == evidence {
+		return event, nil
+	}
+	if evidence && (event.Status == StatusPending || event.Status == StatusProcessing) {
+		return nil, errConverting
+	}
+	media, err := app.EventMedia(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Clean(app.Config.dirs.data)
+	if evidence {
+		dir = app.evidenceDir()
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+
+	// Move the files first, each to a name of its own, and back again if
+	// anything after fails
+	moved := make(map[string]string)
+	undo := func() {
+		for from, to := range moved {
+			os.Rename(to, from)
+		}
+	}
+	paths := []string{event.Video, event.Image}
+	for _, m := range media {
+		paths = append(paths, m.Path)
+	}
+	for _, path := range paths {
+		if _, ok := moved[path]; ok || path == "" || filepath.Dir(path) == dir {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		dst, err := reservePath(filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		if err := os.Rename(path, dst); err != nil {
+			os.Remove(dst)
+			undo()
+			return nil, err
+		}
+		moved[path] = dst
+	}
+	movedPath := func(path string) string {
+		if to, ok := moved[path]; ok {
+			return to
+		}
+		return path
+	}
+
+	// Hash every file where it is now for the audit log
+	custody := make([]string, 0, len(media))
+	for _, m := range media {
+		path := movedPath(m.Path)
+		size, hash, err := hashFile(path)
+		if os.IsNotExist(err) {
+			custody = append(custody, fmt.Sprintf("%s %s missing", m.Kind, app.dataRelative(path)))
+			continue
+		} else if err != nil {
+			undo()
+			return nil, err
+		}
+		if m.Hash != "" && m.Hash != hash {
+			app.Logger.Printf("WARNING: %s of event %d changed since it was hashed, was sha256:%s\n", path, id, m.Hash)
+		}
+		m.Size, m.Hash = size, hash
+		custody = append(custody, fmt.Sprintf("%s %s sha256:%s", m.Kind, app.dataRelative(path), hash))
+	}
+
+	var evidenceAt interface{}
+	action := "release evidence"
+	if evidence {
+		evidenceAt = time.Now().UTC()
+		action = "evidence"
+	}
+	err = app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// A conversion or another request may have got to the event since it was
+		// looked up, the files moved would then no longer be the event's
+		var status, video, image string
+		var current sql.NullTime
+		sql_current := `SELECT status, evidence_at, video, image FROM events WHERE id = ?`
+		if err := tx.QueryRow(sql_current, id).Scan(&status, &current, &video, &image); err != nil {
+			return err
+		}
+		if status != event.Status || current.Valid != (event.EvidenceAt != nil) || video != event.Video || image != event.Image {
+			return errConverting
+		}
+
+		sql_event := `UPDATE events SET evidence_at = ?, video = ?, image = ? WHERE id = ?`
+		if _, err := tx.Exec(sql_event, evidenceAt, movedPath(event.Video), movedPath(event.Image), id); err != nil {
+			return err
+		}
+		for _, m := range media {
+			sql_media := `UPDATE media SET path = ?, size = ?, hash = ? WHERE id = ?`
+			if _, err := tx.Exec(sql_media, movedPath(m.Path), m.Size, m.Hash, m.Id); err != nil {
+				return err
+			}
+		}
+		if err := Audit(tx, actor, action, id, remoteAddr, strings.Join(custody, ", ")); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		undo()
+		return nil, err
+	}
+
+	return app.FindEvent(id)
+}
+
+// Path relative to the data directory, for the audit log.
+func (app *App) dataRelative(path string) string {
+	if rel, err := filepath.Rel(app.Config.dirs.data, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// Retrieves every evidence event, those kept longest first.
+func (app *App) GetEvidence() []*Event {
+	rows, err := app.DB.Query(`SELECT ` + eventColumns + ` FROM events WHERE evidence_at IS NOT NULL ORDER BY evidence_at, id`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	events := make([]*Event, 0)
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			panic(err)
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return events
+}
+
+// Keeps an event as evidence (evidence=true) or releases it (evidence=false).
+func (app *App) APIEvidenceEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	evidence, err := strconv.ParseBool(r.FormValue("evidence"))
+	if err != nil {
+		writeFieldError(w, ErrInvalidField, "evidence", "evidence must be true or false")
+		return
+	}
+	event, err = app.SetEvidence(event.Id, evidence, actorOf(r), r.RemoteAddr)
+	if err == errConverting {
+		writeJSONError(w, http.StatusConflict, "the event's video is being converted, try again once it's done")
+		return
+	} else if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "event not found")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if evidence {
+		app.Log(r).Printf("Keeping event %d (%s) as evidence\n", event.Id, event.Name)
+	} else {
+		app.Log(r).Printf("Released event %d (%s) from evidence\n", event.Id, event.Name)
+	}
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Lists every evidence event with its files and their hashes.
+func (app *App) APIEvidenceHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	events := app.GetEvidence()
+	wrapped := make([]apiEvent, 0, len(events))
+	for _, event := range events {
+		wrapped = append(wrapped, app.apiEvent(event))
+	}
+
+	writeJSON(w, http.StatusOK, wrapped)
+}
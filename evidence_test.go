@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Event stored without conversion, so it's done at once.
+func storeTestEvent(t *testing.T, app *App, name string) *Event {
+	t.Helper()
+	app.FFmpeg = ""
+	created, err := app.StoreEvent(app.Logger, "", stageTestUpload(t, app, name))
+	if err != nil {
+		t.Fatalf("StoreEvent: %s", err)
+	}
+	return created
+}
+
+// Keeping an event as evidence moves its files aside, releasing it moves them
+// back.
+func TestSetEvidence(t *testing.T) {
+	app := newTestApp(t)
+	created := storeTestEvent(t, app, "front door")
+
+	kept, err := app.SetEvidence(created.Id, true, "admin", "")
+	if err != nil {
+		t.Fatalf("SetEvidence: %s", err)
+	}
+	if kept.EvidenceAt == nil || filepath.Dir(kept.Video) != app.evidenceDir() || filepath.Dir(kept.Image) != app.evidenceDir() {
+		t.Errorf("kept event is at %s and %s, evidence since %v", kept.Video, kept.Image, kept.EvidenceAt)
+	}
+	if data, err := os.ReadFile(kept.Video); err != nil || string(data) != "video of front door" {
+		t.Errorf("%s holds %q (%v)", kept.Video, data, err)
+	}
+
+	released, err := app.SetEvidence(created.Id, false, "admin", "")
+	if err != nil {
+		t.Fatalf("SetEvidence: %s", err)
+	}
+	if released.EvidenceAt != nil || filepath.Dir(released.Video) != app.Config.dirs.data {
+		t.Errorf("released event is at %s, evidence since %v", released.Video, released.EvidenceAt)
+	}
+	if files := dirFiles(t, app.evidenceDir()); len(files) != 0 {
+		t.Errorf("evidence directory still holds %v", files)
+	}
+}
+
+// An event that changes while its files are being moved, here by a conversion
+// starting, isn't kept and gets its files back.
+func TestSetEvidenceEventChanged(t *testing.T) {
+	app := newTestApp(t)
+	created := storeTestEvent(t, app, "front door")
+
+	// The image becomes a pipe, so hashing it waits until the test closes it
+	if err := os.Remove(created.Image); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(created.Image, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pipe, err := os.OpenFile(created.Image, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := app.SetEvidence(created.Id, true, "admin", "")
+		done <- err
+	}()
+
+	// Once the files are moved the event was looked up, it changes then
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(created.Image); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the files weren't moved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := app.SetEventStatus(created.Id, StatusProcessing, ""); err != nil {
+		t.Fatal(err)
+	}
+	pipe.Close()
+
+	if err := <-done; err != errConverting {
+		t.Errorf("SetEvidence = %v, expected %v", err, errConverting)
+	}
+	event, err := app.FindEvent(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.EvidenceAt != nil || event.Video != created.Video || event.Image != created.Image {
+		t.Errorf("event is at %s and %s, evidence since %v", event.Video, event.Image, event.EvidenceAt)
+	}
+	for _, path := range []string{created.Video, created.Image} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s wasn't moved back: %s", path, err)
+		}
+	}
+	if files := dirFiles(t, app.evidenceDir()); len(files) != 0 {
+		t.Errorf("evidence directory still holds %v", files)
+	}
+}
@@ -0,0 +1,119 @@
+// Uploads an event to seccam-web over gRPC:
+//
+//	grpc-client -addr seccam:9090 -token <token> [-ca ca.pem] -name "Front door" clip.avi still.png
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/battleroid/seccam-web/seccampb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const chunkSize = 64 * 1024
+
+func main() {
+	addr := flag.String("addr", "localhost:9090", "Address of the gRPC listener")
+	token := flag.String("token", "", "Camera token")
+	ca := flag.String("ca", "", "CA certificate to verify the server with, plaintext if empty")
+	name := flag.String("name", "", "Event name")
+	quiet := flag.Bool("quiet", false, "Don't send an SMS for this event")
+	flag.Parse()
+
+	if flag.NArg() != 2 || *name == "" {
+		fmt.Fprintln(os.Stderr, "usage: grpc-client -token <token> -name <name> <video> <image>")
+		os.Exit(2)
+	}
+	video, image := flag.Arg(0), flag.Arg(1)
+
+	creds := insecure.NewCredentials()
+	if *ca != "" {
+		var err error
+		creds, err = credentials.NewClientTLSFromFile(*ca, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	client := seccampb.NewSeccamClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+
+	stream, err := client.CreateEvent(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// A failed upload ends the stream early, the reason comes with CloseAndRecv
+	check := func(err error) {
+		if err == io.EOF {
+			_, err = stream.CloseAndRecv()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Video, then metadata, then the image
+	err = sendFile(video, func(chunk []byte) error {
+		return stream.Send(&seccampb.CreateEventRequest{Part: &seccampb.CreateEventRequest_VideoChunk{VideoChunk: chunk}})
+	})
+	check(err)
+	err = stream.Send(&seccampb.CreateEventRequest{Part: &seccampb.CreateEventRequest_Metadata{Metadata: &seccampb.EventMetadata{
+		Name:                 *name,
+		VideoFilename:        filepath.Base(video),
+		ImageFilename:        filepath.Base(image),
+		SuppressNotification: *quiet,
+	}}})
+	check(err)
+	err = sendFile(image, func(chunk []byte) error {
+		return stream.Send(&seccampb.CreateEventRequest{Part: &seccampb.CreateEventRequest_ImageChunk{ImageChunk: chunk}})
+	})
+	check(err)
+
+	event, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Created event %d (%s), status %s\n", event.Id, event.Name, event.Status)
+}
+
+// Reads the file in chunks, passing each to send.
+func sendFile(path string, send func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := send(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	jpegMagic = []byte{0xFF, 0xD8}
+	pngMagic  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+)
+
+// Rewrites the image at the given path without its EXIF/XMP metadata. JPEGs have
+// their APP1 segments dropped and PNGs their text/eXIf chunks, the image data
+// itself is copied untouched. Unknown formats are left alone.
+func StripMetadata(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Pick the stripper based on the file's magic bytes
+	var stripped []byte
+	switch {
+	case bytes.HasPrefix(data, jpegMagic):
+		stripped, err = stripJPEG(data)
+	case bytes.HasPrefix(data, pngMagic):
+		stripped, err = stripPNG(data)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file next to the original and swap it in
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".strip-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(stripped); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0775); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Copies every JPEG segment except APP1 (EXIF & XMP). Everything from the start
+// of scan onwards is entropy coded data and is copied as-is.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(jpegMagic)
+
+	i := len(jpegMagic)
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, errors.New("corrupt jpeg: bad segment marker")
+		}
+		marker := data[i+1]
+
+		// Start of scan, the rest of the file is image data
+		if marker == 0xDA {
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+
+		// Segment length includes the two length bytes but not the marker
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("corrupt jpeg: bad segment length")
+		}
+
+		if marker != 0xE1 {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+// Copies every PNG chunk except those that can carry metadata: eXIf and the
+// text chunks (XMP is stored in an iTXt chunk).
+func stripPNG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngMagic)
+
+	i := len(pngMagic)
+	for {
+		// Chunk is length (4), type (4), data (length), crc (4)
+		if i+8 > len(data) {
+			return nil, errors.New("corrupt png: truncated chunk header")
+		}
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		kind := string(data[i+4 : i+8])
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("corrupt png: bad chunk length")
+		}
+
+		switch kind {
+		case "eXIf", "tEXt", "iTXt", "zTXt":
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+
+		if kind == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+}
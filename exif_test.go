@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Small image with some detail, so decoding it proves the image data survived
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+// JPEG with an APP1 segment carrying a fake EXIF serial number right after SOI.
+func jpegWithEXIF(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("Exif\x00\x00SERIAL-1234567")
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(payload)+2))
+	app1 = append(app1, payload...)
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+// PNG with a tEXt chunk carrying a fake serial number right before IEND.
+func pngWithText(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("Serial\x00SERIAL-1234567")
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	data := buf.Bytes()
+	iend := len(data) - 12
+	out := append([]byte{}, data[:iend]...)
+	out = append(out, chunk...)
+	return append(out, data[iend:]...)
+}
+
+func writeTemp(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStripMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"snapshot.jpg", jpegWithEXIF(t)},
+		{"snapshot.png", pngWithText(t)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTemp(t, test.name, test.data)
+			if err := StripMetadata(path); err != nil {
+				t.Fatalf("StripMetadata: %s", err)
+			}
+
+			stripped, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stripped, []byte("SERIAL-1234567")) {
+				t.Error("metadata is still there")
+			}
+			if len(stripped) >= len(test.data) {
+				t.Errorf("stripped image is %d bytes, the original %d", len(stripped), len(test.data))
+			}
+			img, _, err := image.Decode(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf("stripped image doesn't decode: %s", err)
+			}
+			if img.Bounds() != testImage().Bounds() {
+				t.Errorf("stripped image is %s, expected %s", img.Bounds(), testImage().Bounds())
+			}
+		})
+	}
+}
+
+// Images without metadata come out the same.
+func TestStripMetadataClean(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTemp(t, "clean.jpg", buf.Bytes())
+	if err := StripMetadata(path); err != nil {
+		t.Fatalf("StripMetadata: %s", err)
+	}
+	stripped, _ := os.ReadFile(path)
+	if !bytes.Equal(stripped, buf.Bytes()) {
+		t.Error("image without metadata was changed")
+	}
+}
+
+// Corrupt images fail and are left as they are, for the upload to store as-is.
+// Formats we don't know are left alone.
+func TestStripMetadataCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"truncated.jpg", jpegWithEXIF(t)[:10], true},
+		{"garbage.jpg", append([]byte{0xFF, 0xD8}, []byte("not a jpeg at all")...), true},
+		{"truncated.png", pngWithText(t)[:20], true},
+		{"unknown.gif", []byte("GIF89a"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTemp(t, test.name, test.data)
+			if err := StripMetadata(path); (err != nil) != test.wantErr {
+				t.Errorf("StripMetadata = %v, expected an error: %t", err, test.wantErr)
+			}
+			data, _ := os.ReadFile(path)
+			if !bytes.Equal(data, test.data) {
+				t.Error("image was changed")
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+				t.Errorf("temporary files left behind: %d entries", len(entries))
+			}
+		})
+	}
+}
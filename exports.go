@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Place events can be copied to, for an offsite copy. Exports go through the
+// delivery queue, so they are retried and survive restarts. Export copies a
+// single file of an event and returns where it ended up, a rateLimitedError
+// has it retried once the target allows. Status returns when the target was
+// last used and the error it gave, if any.
+type Exporter interface {
+	Name() string  // Target it's picked with, e.g. gdrive
+	Title() string // Name of the target for display
+	Export(ctx context.Context, app *App, event *Event, media *Media) (remoteRef, error)
+	Status() (time.Time, error)
+}
+
+// Where an exported file ended up
+type remoteRef struct {
+	Id   string // ID the target gave the copy
+	Path string // Path of the copy, for targets with paths
+	URL  string
+}
+
+// Export states
+const (
+	ExportPending = "pending"
+	ExportDone    = "done"
+	ExportFailed  = "failed" // The last attempt failed, the delivery may still retry it
+)
+
+// Most events a single bulk export may queue
+const exportBulkMax = 100
+
+// Longest a single file may take to export
+const exportTimeout = 30 * time.Minute
+
+// File of an event being copied to an export target
+type Export struct {
+	Id       int64      `json:"id"`
+	EventId  int64      `json:"event_id"`
+	Target   string     `json:"target"`
+	Kind     string     `json:"kind"` // Media kind of the file, video or image
+	Path     string     `json:"path"` // File exported, as the event has it
+	Status   string     `json:"status"`
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`       // Why the last attempt failed
+	FileId   string     `json:"file_id,omitempty"`     // ID the target gave the copy
+	Remote   string     `json:"remote_path,omitempty"` // Where the copy is, for targets with paths
+	URL      string     `json:"url,omitempty"`         // Link to the copy
+	Created  time.Time  `json:"created_at"`
+	Updated  *time.Time `json:"updated_at,omitempty"` // When it was last attempted
+}
+
+// Exports of an event to one target, for the event page
+type exportStatus struct {
+	Target   string
+	Title    string
+	Status   string // failed if any file failed, pending if any is left, done otherwise
+	Attempts int    // Most attempts any file took
+	Error    string
+	Files    []*Export
+}
+
+// State of an export target's credentials, reported by /healthz
+type exportHealth struct {
+	Checked *time.Time `json:"checked,omitempty"` // When the credentials were last used
+	OK      bool       `json:"ok"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func newExportHealth(checked time.Time, err error) *exportHealth {
+	health := &exportHealth{OK: err == nil}
+	if !checked.IsZero() {
+		health.Checked = &checked
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// Queued export of an event
+type exportJob struct {
+	EventId int64 `json:"event_id"`
+}
+
+// Export queued by the API
+type queuedExport struct {
+	EventId    int64  `json:"event_id"`
+	Target     string `json:"target"`
+	DeliveryId int64  `json:"delivery_id"` // Listed by GET /admin/webhooks
+}
+
+// Builds the export targets that are set up. Each is named after its kind,
+// which is also the channel of its deliveries.
+func buildExporters(config *Config) ([]Exporter, error) {
+	var exporters []Exporter
+	if config.gdriveRefresh != "" {
+		if config.gdriveClientID == "" || config.gdriveSecret == "" {
+			return nil, fmt.Errorf("-gdrive-refresh-token needs -gdrive-client-id and -gdrive-client-secret")
+		}
+		exporters = append(exporters, newGDriveExporter(config))
+	}
+	if config.dropboxToken != "" {
+		if err := checkDropboxPath(config.dropboxPath); err != nil {
+			return nil, fmt.Errorf("invalid -dropbox-path: %s", err)
+		}
+		exporters = append(exporters, newDropboxExporter(config))
+	}
+	return exporters, nil
+}
+
+// Returns the export target of a name, nil if it isn't set up.
+func (app *App) exporter(name string) Exporter {
+	for _, exporter := range app.Exporters {
+		if exporter.Name() == name {
+			return exporter
+		}
+	}
+	return nil
+}
+
+// Create the table recording the files exported.
+func CreateExportTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS exports(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		path TEXT NOT NULL,
+		file_id TEXT NOT NULL,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS exports_event ON exports(event_id, target)`); err != nil {
+		panic(err)
+	}
+}
+
+// Retrieves the files of an event exported or being exported, oldest first.
+func (app *App) EventExports(id int64) ([]*Export, error) {
+	sql_exports := `
+	SELECT id, event_id, target, kind, path, status, attempts, error, file_id, remote_path, url, created, updated
+	FROM exports WHERE event_id = ? ORDER BY id`
+	rows, err := app.DB.Query(sql_exports, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := make([]*Export, 0)
+	for rows.Next() {
+		e := new(Export)
+		var remote, link sql.NullString
+		var updated sql.NullTime
+		if err := rows.Scan(&e.Id, &e.EventId, &e.Target, &e.Kind, &e.Path, &e.Status, &e.Attempts, &e.Error, &e.FileId, &remote, &link, &e.Created, &updated); err != nil {
+			return nil, err
+		}
+		e.Remote, e.URL = remote.String, link.String
+		if updated.Valid {
+			e.Updated = &updated.Time
+		}
+		exports = append(exports, e)
+	}
+
+	return exports, rows.Err()
+}
+
+// Groups the exports of an event by target, in the order they were first
+// queued.
+func (app *App) exportStatuses(exports []*Export) []*exportStatus {
+	var statuses []*exportStatus
+	byTarget := make(map[string]*exportStatus)
+	for _, e := range exports {
+		s := byTarget[e.Target]
+		if s == nil {
+			s = &exportStatus{Target: e.Target, Title: e.Target, Status: ExportDone}
+			if exporter := app.exporter(e.Target); exporter != nil {
+				s.Title = exporter.Title()
+			}
+			byTarget[e.Target] = s
+			statuses = append(statuses, s)
+		}
+		s.Files = append(s.Files, e)
+		if e.Attempts > s.Attempts {
+			s.Attempts = e.Attempts
+		}
+		switch {
+		case e.Status == ExportFailed:
+			s.Status, s.Error = ExportFailed, e.Error
+		case e.Status == ExportPending && s.Status == ExportDone:
+			s.Status = ExportPending
+		}
+	}
+	return statuses
+}
+
+// Adds the videos and images of an event not yet tracked for a target as
+// pending, and puts failed ones back to pending so they're tried again.
+func (app *App) prepareExports(target string, id int64) error {
+	media, err := app.EventMedia(id)
+	if err != nil {
+		return err
+	}
+	return app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		sql_add := `
+		INSERT INTO exports(event_id, target, kind, path, file_id, status, attempts)
+		SELECT ?, ?, ?, ?, '', ?, 0
+		WHERE NOT EXISTS (SELECT 1 FROM exports WHERE event_id = ? AND target = ? AND path = ?)`
+		for _, m := range media {
+			if m.Kind != MediaVideo && m.Kind != MediaImage {
+				continue
+			}
+			if _, err := tx.Exec(sql_add, id, target, m.Kind, m.Path, ExportPending, id, target, m.Path); err != nil {
+				return err
+			}
+		}
+		sql_retry := `UPDATE exports SET status = ? WHERE event_id = ? AND target = ? AND status = ?`
+		if _, err := tx.Exec(sql_retry, ExportPending, id, target, ExportFailed); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// Records the outcome of an attempt at exporting a file. Rate limited attempts
+// don't count, the file stays pending.
+func (app *App) recordExport(id int64, ref remoteRef, err error) error {
+	now := time.Now().UTC()
+	sql_export := `UPDATE exports SET status = ?, attempts = attempts + 1, error = '', file_id = ?, remote_path = ?, url = ?, updated = ? WHERE id = ?`
+	args := []interface{}{ExportDone, ref.Id, nullString(ref.Path), nullString(ref.URL), now, id}
+	var limited *rateLimitedError
+	if errors.As(err, &limited) {
+		sql_export = `UPDATE exports SET error = ?, updated = ? WHERE id = ?`
+		args = []interface{}{err.Error(), now, id}
+	} else if err != nil {
+		sql_export = `UPDATE exports SET status = ?, attempts = attempts + 1, error = ?, updated = ? WHERE id = ?`
+		args = []interface{}{ExportFailed, err.Error(), now, id}
+	}
+	return app.retryBusy(func() error {
+		_, err := app.DB.Exec(sql_export, args...)
+		return err
+	})
+}
+
+// Null for an empty string, for optional text columns.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Exports the files of a queued event that aren't done yet one at a time,
+// stopping at the first that fails so the delivery is retried.
+func (app *App) runExport(exporter Exporter, payload []byte) (int, error) {
+	var job exportJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return 0, err
+	}
+	event, err := app.FindEvent(job.EventId)
+	if err != nil {
+		return 0, fmt.Errorf("finding event %d: %w", job.EventId, err)
+	}
+	// Exports queued before their files were tracked have none yet
+	if err := app.prepareExports(exporter.Name(), event.Id); err != nil {
+		return 0, err
+	}
+	exports, err := app.EventExports(event.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range exports {
+		if e.Target != exporter.Name() || e.Status == ExportDone {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		ref, err := exporter.Export(ctx, app, event, &Media{EventId: event.Id, Kind: e.Kind, Path: e.Path})
+		cancel()
+		if err := app.recordExport(e.Id, ref, err); err != nil {
+			return 0, err
+		}
+		var limited *rateLimitedError
+		if errors.As(err, &limited) {
+			return http.StatusTooManyRequests, err
+		} else if err != nil {
+			return 0, fmt.Errorf("exporting %s: %w", filepath.Base(e.Path), err)
+		}
+		where := ref.Path
+		if where == "" {
+			where = ref.Id
+		}
+		log.Printf("Exported %s of event %d to %s as %s\n", filepath.Base(e.Path), event.Id, exporter.Title(), where)
+	}
+
+	return http.StatusOK, nil
+}
+
+// Queues the export of an event to a target. Going through the delivery queue
+// means failures are retried like any other delivery.
+func (app *App) QueueExport(target string, id int64) (int64, error) {
+	if err := app.prepareExports(target, id); err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(exportJob{EventId: id})
+	if err != nil {
+		return 0, err
+	}
+	return app.queueDelivery(target, id, payload)
+}
+
+// Checks the target parameter of an export, writing the error response and
+// returning false when nothing can be exported there.
+func (app *App) checkExportTarget(w http.ResponseWriter, target string) bool {
+	if target == "" {
+		writeFieldError(w, ErrMissingField, "target", "target is required")
+		return false
+	}
+	if app.exporter(target) != nil {
+		return true
+	}
+	if len(app.Exporters) == 0 {
+		writeFieldError(w, ErrInvalidField, "target", "no export targets are set up")
+		return false
+	}
+	names := make([]string, 0, len(app.Exporters))
+	for _, exporter := range app.Exporters {
+		names = append(names, exporter.Name())
+	}
+	writeFieldError(w, ErrInvalidField, "target", target+" exports are not set up, target must be one of "+strings.Join(names, ", "))
+	return false
+}
+
+// Lists the files of an event exported or being exported, with their status.
+func (app *App) APIEventExportsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+	exports, err := app.EventExports(event.Id)
+	if err != nil {
+		panic(err)
+	}
+	writeJSON(w, http.StatusOK, exports)
+}
+
+// Queues the export of an event's video and image to the target parameter.
+func (app *App) APIExportEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	target := r.URL.Query().Get("target")
+	if !app.checkExportTarget(w, target) {
+		return
+	}
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	delivery, err := app.QueueExport(target, event.Id)
+	if err != nil {
+		panic(err)
+	}
+	app.Log(r).Printf("Queued event %d for export to %s\n", event.Id, target)
+	writeJSON(w, http.StatusAccepted, queuedExport{EventId: event.Id, Target: target, DeliveryId: delivery})
+}
+
+// Queues the export of several events to the target parameter, their ids
+// given as {"ids": [...]}. Nothing is queued if any of them doesn't exist.
+func (app *App) APIExportEventsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	target := r.URL.Query().Get("target")
+	if !app.checkExportTarget(w, target) {
+		return
+	}
+	var body struct {
+		Ids []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(body.Ids) == 0 {
+		writeFieldError(w, ErrMissingField, "ids", "ids is required")
+		return
+	}
+	if len(body.Ids) > exportBulkMax {
+		writeFieldError(w, ErrInvalidField, "ids", fmt.Sprintf("at most %d events can be exported at once", exportBulkMax))
+		return
+	}
+
+	for _, id := range body.Ids {
+		if _, err := app.FindEvent(id); err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "event "+strconv.FormatInt(id, 10)+" not found")
+			return
+		} else if err != nil {
+			panic(err)
+		}
+	}
+
+	queued := make([]queuedExport, 0, len(body.Ids))
+	for _, id := range body.Ids {
+		delivery, err := app.QueueExport(target, id)
+		if err != nil {
+			panic(err)
+		}
+		queued = append(queued, queuedExport{EventId: id, Target: target, DeliveryId: delivery})
+	}
+	app.Log(r).Printf("Queued %d events for export to %s\n", len(queued), target)
+	writeJSON(w, http.StatusAccepted, queued)
+}
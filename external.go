@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Longest external ID a camera may give an event
+const externalIDMax = 200
+
+// Upload repeating an external ID its camera already used, StoreEvent returns
+// the existing event along with it
+var errDuplicateUpload = errors.New("external id already uploaded")
+
+// Checks the external ID of an upload, which only means something along with
+// the camera it's unique for. Writes the error response and returns false when
+// it can't be used.
+func checkExternalID(w http.ResponseWriter, upload eventUpload) bool {
+	switch {
+	case upload.ExternalID == "":
+		return true
+	case len(upload.ExternalID) > externalIDMax:
+		writeFieldError(w, ErrInvalidField, "external_id", fmt.Sprintf("external_id may be at most %d bytes", externalIDMax))
+		return false
+	case strings.TrimSpace(upload.Camera) == "":
+		writeFieldError(w, ErrMissingField, "camera", "camera is required with external_id")
+		return false
+	}
+	return true
+}
+
+// Looks up the event a camera uploaded with the given external ID, returning
+// sql.ErrNoRows if there is none.
+func (app *App) FindExternalEvent(camera, externalID string) (*Event, error) {
+	sql_row := `
+	SELECT ` + eventColumns + ` FROM events
+	WHERE external_id = ? AND camera_id = (SELECT id FROM cameras WHERE name = ?)`
+	return scanEvent(app.DB.QueryRow(sql_row, externalID, strings.TrimSpace(camera)))
+}
+
+// Looks up an event by the camera it came from and the external ID the camera
+// gave it.
+func (app *App) APIExternalEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event, err := app.FindExternalEvent(p.ByName("camera"), p.ByName("external_id"))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "event not found")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Refused connection to a host that isn't on -fetch-allow
+var errFetchForbidden = errors.New("not on the fetch allowlist")
+
+// Hosts and networks media may be fetched from
+type fetchAllowlist struct {
+	hosts []string
+	nets  []*net.IPNet
+}
+
+// Parses a comma separated list of host names, IP addresses and CIDR networks.
+func parseFetchAllowlist(s string) (fetchAllowlist, error) {
+	var allow fetchAllowlist
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return allow, err
+			}
+			allow.nets = append(allow.nets, network)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allow.nets = append(allow.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			allow.hosts = append(allow.hosts, strings.ToLower(entry))
+		}
+	}
+	return allow, nil
+}
+
+// Whether the host, as named in a URL, or the address it resolved to is allowed.
+func (a fetchAllowlist) allows(host string, ip net.IP) bool {
+	for _, allowed := range a.hosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	for _, network := range a.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client fetching media from cameras. It only connects to addresses the
+// allowlist permits, checked once the host is resolved so DNS can't point it
+// anywhere else, ignores proxies and follows at most -fetch-max-redirects
+// redirects, each checked the same way.
+func newFetchClient(config *Config) *http.Client {
+	allow := config.fetchAllow
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				if allow.allows(host, ip) {
+					return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				}
+			}
+			return nil, fmt.Errorf("%s %w", host, errFetchForbidden)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.fetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > config.fetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", config.fetchRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// Body of a fetch request
+type fetchUpload struct {
+	Name     string          `json:"name"`
+	Camera   string          `json:"camera"`
+	Video    string          `json:"video_url"`
+	Image    string          `json:"image_url"`
+	Notify   *bool           `json:"notify"`
+	Metadata json.RawMessage `json:"metadata"`
+	External string          `json:"external_id"`
+	Location string          `json:"location"`
+	Lat      *float64        `json:"latitude"`
+	Lon      *float64        `json:"longitude"`
+}
+
+// Creates an event from media the server downloads itself, for cameras that
+// only serve their clips over HTTP. Only hosts on -fetch-allow are fetched
+// from. The event then goes through the same storage, conversion and
+// notifications as one posted to /event/new, without an image a frame of the
+// video is used instead.
+func (app *App) APIFetchEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	logger := app.Log(r)
+	if app.Fetcher == nil {
+		writeJSONError(w, http.StatusForbidden, "fetching media is disabled, see -fetch-allow")
+		return
+	}
+	uploadsActive.Add(1)
+	defer uploadsActive.Add(-1)
+
+	var body fetchUpload
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	// The image can be left out as long as there's ffmpeg to take one
+	images := 0
+	if body.Image != "" || app.FFmpeg != "" {
+		images = 1
+	}
+	if part := missingUploadPart(body.Name, body.Camera, len(body.Video), images); part != "" {
+		field := map[string]string{"name": "name", "video": "video_url", "image": "image_url"}[part]
+		writeFieldError(w, ErrMissingField, field, field+" is required")
+		return
+	}
+
+	upload := eventUpload{
+		Name:       body.Name,
+		Camera:     uploadCamera(r, body.Camera),
+		Notify:     wantsNotification(r) && (body.Notify == nil || *body.Notify),
+		Meta:       body.Metadata,
+		ExternalID: strings.TrimSpace(body.External),
+		Location:   location{Text: strings.TrimSpace(body.Location), Latitude: body.Lat, Longitude: body.Lon},
+	}
+	if !checkExternalID(w, upload) || !checkLocation(w, upload) {
+		return
+	}
+	handedOver := false
+	defer func() {
+		if handedOver {
+			return
+		}
+		for _, file := range append(upload.Videos, upload.Images...) {
+			os.Remove(file.Path)
+		}
+	}()
+
+	stamp := time.Now().UTC().Format("20060102-150405.000000")
+	video, ok := app.fetchMedia(w, r, body.Video, "video_url", "video", stamp)
+	if !ok {
+		return
+	}
+	upload.Videos = append(upload.Videos, video)
+
+	if body.Image != "" {
+		image, ok := app.fetchMedia(w, r, body.Image, "image_url", "image", stamp)
+		if !ok {
+			return
+		}
+		upload.Images = append(upload.Images, image)
+	} else if err := app.stageFrame(&upload, stamp); err != nil {
+		logger.Println("Error taking an image from the fetched video")
+		logger.Println(err.Error())
+		writeFieldError(w, ErrInvalidField, "video_url", "no image could be taken from the video, send image_url along")
+		return
+	}
+
+	// StoreEvent takes care of the staged files from here
+	handedOver = true
+	created, err := app.StoreEvent(logger, RequestID(r.Context()), upload)
+	app.writeStored(w, r, created, err)
+}
+
+// Downloads the file at rawURL into the staging directory, named stamp with the
+// extension of its sniffed type. It has to be served as the kind of media
+// expected ("video" or "image") or as untyped bytes, and images have to sniff as
+// one too. Writes the error response and returns false when the URL can't be
+// fetched or doesn't hold acceptable media.
+func (app *App) fetchMedia(w http.ResponseWriter, r *http.Request, rawURL, field, kind, stamp string) (stagedFile, bool) {
+	logger := app.Log(r)
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		writeFieldError(w, ErrInvalidField, field, field+" must be an http or https URL")
+		return stagedFile{}, false
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		writeFieldError(w, ErrInvalidField, field, field+" must be an http or https URL")
+		return stagedFile{}, false
+	}
+	resp, err := app.Fetcher.Do(req)
+	if errors.Is(err, errFetchForbidden) {
+		writeAPIError(w, http.StatusForbidden, apiError{Code: ErrForbidden, Field: field, Message: field + " isn't on a host allowed by -fetch-allow"})
+		return stagedFile{}, false
+	} else if err != nil {
+		logger.Printf("Error fetching %s\n", target.Redacted())
+		logger.Println(err.Error())
+		writeAPIError(w, http.StatusBadGateway, apiError{Code: ErrUpstream, Field: field, Message: "error fetching " + field})
+		return stagedFile{}, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		writeAPIError(w, http.StatusBadGateway, apiError{Code: ErrUpstream, Field: field, Message: fmt.Sprintf("%s responded %s", field, resp.Status)})
+		return stagedFile{}, false
+	}
+	served, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if served != "" && served != "application/octet-stream" && !strings.HasPrefix(served, kind+"/") {
+		writeAPIError(w, http.StatusUnsupportedMediaType, apiError{Code: ErrContentType, Field: field, Message: fmt.Sprintf("%s is served as %s, not as %s", field, served, kind)})
+		return stagedFile{}, false
+	}
+	tooLarge := apiError{Code: ErrTooLarge, Field: field, Message: fmt.Sprintf("%s may be at most %d bytes", field, app.Config.fetchMaxSize)}
+	if resp.ContentLength > app.Config.fetchMaxSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, tooLarge)
+		return stagedFile{}, false
+	}
+
+	// The length isn't always known up front, so reading stops just past the limit
+	path, err := app.StageUpload(io.LimitReader(resp.Body, app.Config.fetchMaxSize+1))
+	if err != nil {
+		logger.Printf("Error fetching %s\n", target.Redacted())
+		logger.Println(err.Error())
+		writeAPIError(w, http.StatusBadGateway, apiError{Code: ErrUpstream, Field: field, Message: "error fetching " + field})
+		return stagedFile{}, false
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > app.Config.fetchMaxSize {
+		os.Remove(path)
+		writeAPIError(w, http.StatusRequestEntityTooLarge, tooLarge)
+		return stagedFile{}, false
+	}
+
+	sniffed := http.DetectContentType(readHead(path))
+	if kind == "image" && !strings.HasPrefix(sniffed, "image/") {
+		os.Remove(path)
+		writeFieldError(w, ErrInvalidField, field, field+" isn't an image")
+		return stagedFile{}, false
+	}
+
+	return stagedFile{Path: path, Name: uploadName(stamp, sniffed)}, true
+}
+
+// Returns the first 512 bytes of a file, all content sniffing looks at.
+func readHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
+}
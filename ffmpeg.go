@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Video codec information struct
+type videoCodec struct {
+	name    string
+	encoder string   // ffmpeg encoder name
+	ext     string   // Extension of the container the codec is stored in
+	crf     int      // Quality used for this transcode
+	maxCRF  int      // Highest (worst) CRF the encoder accepts
+	crfArgs []string // Extra encoder arguments for constant quality
+	args    []string // Extra encoder arguments
+	bitrate string   // Target bitrate replacing the CRF when set, e.g. 1M
+	twoPass bool     // Whether the bitrate is reached in two passes
+}
+
+// Supported video codecs, the CRF values are each encoder's rough equivalent of
+// the CRF 21 used for h264.
+var videoCodecs = map[string]videoCodec{
+	"h264": {encoder: "libx264", ext: ".mp4", crf: 21, maxCRF: 51},
+	"vp9":  {encoder: "libvpx-vp9", ext: ".webm", crf: 32, maxCRF: 63, crfArgs: []string{"-b:v", "0"}, args: []string{"-row-mt", "1"}},
+	"av1":  {encoder: "libaom-av1", ext: ".webm", crf: 30, maxCRF: 63, crfArgs: []string{"-b:v", "0"}, args: []string{"-cpu-used", "6", "-row-mt", "1"}},
+}
+
+// Looks up the named codec, a negative crf keeps the codec's default quality.
+func LookupCodec(name string, crf int) (videoCodec, error) {
+	codec, ok := videoCodecs[name]
+	if !ok {
+		return codec, fmt.Errorf("unknown video codec %q, expected h264, vp9 or av1", name)
+	}
+	codec.name = name
+
+	if crf > codec.maxCRF {
+		return codec, fmt.Errorf("crf %d out of range for %s, expected 0-%d", crf, name, codec.maxCRF)
+	} else if crf >= 0 {
+		codec.crf = crf
+	}
+
+	return codec, nil
+}
+
+// Targets a bitrate instead of a quality, in two passes if asked to. The bitrate
+// is a number with an optional k or M suffix, like ffmpeg takes.
+func (codec videoCodec) WithBitrate(bitrate string, twoPass bool) (videoCodec, error) {
+	if !validBitrate.MatchString(bitrate) {
+		return codec, fmt.Errorf("invalid bitrate %q, expected something like 800k or 1.5M", bitrate)
+	}
+	codec.bitrate = bitrate
+	codec.twoPass = twoPass
+
+	return codec, nil
+}
+
+var validBitrate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kM]?$`)
+
+// Rate control arguments of the encoder, either the CRF or the target bitrate.
+func (codec videoCodec) rateArgs() []string {
+	if codec.bitrate != "" {
+		return []string{"-b:v", codec.bitrate}
+	}
+	return append([]string{"-crf", strconv.Itoa(codec.crf)}, codec.crfArgs...)
+}
+
+// Checks that ffmpeg was built with the given encoder.
+func CheckEncoder(ffmpeg, encoder string) error {
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return err
+	}
+
+	// Encoder lines look like " V....D libx264   libx264 H.264 / AVC ..."
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == encoder {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("encoder %s is not compiled into %s", encoder, ffmpeg)
+}
+
+// Resolves the ffmpeg executable and the ffprobe next to it (or on PATH when
+// ffmpeg is given as a bare name). Missing executables are returned empty.
+func FindFFmpeg(ffmpegPath string) (string, string) {
+	ffprobePath := "ffprobe"
+	if strings.ContainsRune(ffmpegPath, filepath.Separator) {
+		ffprobePath = filepath.Join(filepath.Dir(ffmpegPath), "ffprobe")
+	}
+
+	ffmpeg, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		ffmpeg = ""
+	}
+	ffprobe, err := exec.LookPath(ffprobePath)
+	if err != nil {
+		ffprobe = ""
+	}
+
+	return ffmpeg, ffprobe
+}
+
+// Re-encodes the video at src into a browser friendly video at dst using the
+// configured codec. When the overlay
+// is enabled the given name and time are burned into the bottom left corner.
+// With -strip-audio the sound is left out.
+// ffmpeg is killed if ctx is cancelled.
+func (app *App) Transcode(ctx context.Context, logger *Logger, src, dst, name string, at time.Time) error {
+	filters := []string{"scale=w=320:h=240"}
+
+	// Only draw the overlay if we can actually find the font
+	if app.Config.overlay {
+		if _, err := os.Stat(app.Config.fontFile); err != nil {
+			logger.Printf("Warning: font %s unavailable, transcoding %s without overlay\n", app.Config.fontFile, src)
+			logger.Println(err.Error())
+		} else {
+			filters = append(filters, drawtextFilter(app.Config.fontFile, name+" "+at.UTC().Format("2006-01-02 15:04:05 MST")))
+		}
+	}
+
+	video := []string{"-c:v", app.Codec.encoder}
+	video = append(video, app.Codec.rateArgs()...)
+	video = append(video, app.Codec.args...)
+	video = append(video, "-vf", strings.Join(filters, ","))
+
+	if app.Codec.twoPass {
+		return app.transcodeTwoPass(ctx, src, dst, video)
+	}
+
+	args := append([]string{"-i", src}, video...)
+	if app.Config.stripAudio {
+		args = append(args, "-an")
+	}
+	args = append(args, "-y", dst)
+
+	cmd := exec.CommandContext(ctx, app.FFmpeg, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return ffmpegError(err, out)
+	}
+
+	return nil
+}
+
+// Encodes src to dst in two passes with the given video arguments, the first
+// only analyses the video. Its log is kept in a temporary directory that's
+// removed however the passes end.
+func (app *App) transcodeTwoPass(ctx context.Context, src, dst string, video []string) error {
+	dir, err := os.MkdirTemp("", "seccam-pass-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	passlog := filepath.Join(dir, "ffmpeg2pass")
+
+	first := append([]string{"-i", src}, video...)
+	first = append(first, "-pass", "1", "-passlogfile", passlog, "-an", "-f", "null", "-y", os.DevNull)
+	cmd := exec.CommandContext(ctx, app.FFmpeg, first...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("first pass: %w", ffmpegError(err, out))
+	}
+
+	second := append([]string{"-i", src}, video...)
+	second = append(second, "-pass", "2", "-passlogfile", passlog)
+	if app.Config.stripAudio {
+		second = append(second, "-an")
+	}
+	second = append(second, "-y", dst)
+	cmd = exec.CommandContext(ctx, app.FFmpeg, second...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("second pass: %w", ffmpegError(err, out))
+	}
+
+	return nil
+}
+
+// Returns the duration of a video in seconds, as ffprobe reads it.
+func (app *App) probeDuration(ctx context.Context, path string) (float64, error) {
+	if app.FFprobe == "" {
+		return 0, fmt.Errorf("ffprobe not found")
+	}
+
+	cmd := exec.CommandContext(ctx, app.FFprobe,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected duration %q from ffprobe", strings.TrimSpace(string(out)))
+	}
+	return duration, nil
+}
+
+// Whether a video has a sound track, as ffprobe reads it.
+func (app *App) probeAudio(ctx context.Context, path string) (bool, error) {
+	if app.FFprobe == "" {
+		return false, fmt.Errorf("ffprobe not found")
+	}
+
+	cmd := exec.CommandContext(ctx, app.FFprobe,
+		"-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+		path,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// Adds the last line ffmpeg printed (usually the reason it failed) to its error.
+func ffmpegError(err error, output []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Errorf("%v: %s", err, last)
+	}
+
+	return err
+}
+
+// Builds a drawtext filter for the given font and text. Values are escaped for
+// the option parser first and then again for the filtergraph parser, see the
+// "Quoting and escaping" section of ffmpeg-filters(1).
+func drawtextFilter(fontFile, text string) string {
+	opts := []string{
+		"fontfile=" + escapeFilterValue(fontFile, ":"),
+		"text=" + escapeFilterValue(text, ":"),
+		"expansion=none",
+		"fontcolor=white",
+		"fontsize=12",
+		"box=1",
+		"boxcolor=black@0.5",
+		"boxborderw=4",
+		"x=8",
+		"y=h-th-8",
+	}
+
+	return escapeFilterValue("drawtext="+strings.Join(opts, ":"), ",;[]")
+}
+
+// Backslash escapes quotes, backslashes and any of the special characters.
+func escapeFilterValue(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || r == '\'' || strings.ContainsRune(special, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
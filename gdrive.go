@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target name of Google Drive exports
+const ExportGDrive = "gdrive"
+
+// Google's OAuth token endpoint and Drive's upload endpoint
+const (
+	gdriveTokenURL  = "https://oauth2.googleapis.com/token"
+	gdriveUploadURL = "https://www.googleapis.com/upload/drive/v3/files"
+)
+
+// Size of the chunks files are uploaded to Drive in, a multiple of the 256 KiB
+// Drive expects
+const gdriveChunk = 8 << 20
+
+// Times an interrupted chunk is resumed before the export is retried later
+const gdriveResumes = 3
+
+// Exports events to Google Drive with an OAuth client and a refresh token
+type gdriveExporter struct {
+	clientID string
+	secret   string
+	refresh  string
+	folder   string
+	client   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expires   time.Time
+	refreshed time.Time // When the access token was last refreshed, or tried to be
+	err       error     // Why the last refresh failed, nil if it worked
+}
+
+func newGDriveExporter(config *Config) *gdriveExporter {
+	return &gdriveExporter{
+		clientID: config.gdriveClientID,
+		secret:   config.gdriveSecret,
+		refresh:  config.gdriveRefresh,
+		folder:   config.gdriveFolder,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (g *gdriveExporter) Name() string {
+	return ExportGDrive
+}
+
+func (g *gdriveExporter) Title() string {
+	return "Google Drive"
+}
+
+// Returns when the access token was last refreshed and the error it gave, if
+// any.
+func (g *gdriveExporter) Status() (time.Time, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.refreshed, g.err
+}
+
+// Returns an access token, refreshing it a minute before it expires.
+func (g *gdriveExporter) accessToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+
+	form := url.Values{
+		"client_id":     {g.clientID},
+		"client_secret": {g.secret},
+		"refresh_token": {g.refresh},
+		"grant_type":    {"refresh_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gdriveTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := g.client.Do(req)
+	g.refreshed = time.Now()
+	if err != nil {
+		g.err = fmt.Errorf("refreshing the access token: %w", err)
+		return "", g.err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		g.err = fmt.Errorf("refreshing the access token: google responded %s: %s %s", resp.Status, body.Error, body.Description)
+		if body.Error == "invalid_grant" || body.Error == "invalid_client" {
+			log.Println("ERROR: the Google Drive refresh token or client was revoked or expired, exports fail until -gdrive-refresh-token is renewed")
+		}
+		return "", g.err
+	}
+
+	g.token = body.AccessToken
+	g.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	g.err = nil
+	return g.token, nil
+}
+
+// Uploads a file of an event to Drive with a resumable upload. Chunks that
+// are interrupted are resumed from where Drive says it got to.
+func (g *gdriveExporter) Export(ctx context.Context, app *App, event *Event, media *Media) (remoteRef, error) {
+	f, err := app.openMedia(media.Path)
+	if err != nil {
+		return remoteRef{}, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return remoteRef{}, err
+	}
+
+	session, err := g.startUpload(ctx, event, media.Path, size)
+	if err != nil {
+		return remoteRef{}, err
+	}
+	fileID, err := g.upload(ctx, f, session, size)
+	if err != nil {
+		return remoteRef{}, err
+	}
+	return remoteRef{Id: fileID, URL: "https://drive.google.com/file/d/" + fileID + "/view"}, nil
+}
+
+// Uploads a file to a resumable upload session in chunks, returning the ID
+// Drive gave it.
+func (g *gdriveExporter) upload(ctx context.Context, f io.ReadSeeker, session string, size int64) (string, error) {
+	buf := make([]byte, gdriveChunk)
+	var offset int64
+	for resumes := 0; ; {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			return "", err
+		}
+
+		token, err := g.accessToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if size > 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size))
+		}
+		resp, err := g.client.Do(req)
+		if err != nil {
+			// Ask Drive how much it got, and carry on from there
+			if resumes++; resumes > gdriveResumes || ctx.Err() != nil {
+				return "", err
+			}
+			if offset, err = g.uploadStatus(ctx, session, token, size); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated:
+			var file struct {
+				Id string `json:"id"`
+			}
+			err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&file)
+			resp.Body.Close()
+			if err != nil || file.Id == "" {
+				return "", fmt.Errorf("drive gave no file ID")
+			}
+			return file.Id, nil
+		case http.StatusPermanentRedirect:
+			// Chunk taken, Drive says up to where
+			offset = gdriveRangeEnd(resp)
+			resp.Body.Close()
+		default:
+			err := gdriveError(resp)
+			resp.Body.Close()
+			return "", err
+		}
+	}
+}
+
+// Starts a resumable upload into the folder, returning its session URL.
+func (g *gdriveExporter) startUpload(ctx context.Context, event *Event, path string, size int64) (string, error) {
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	metadata := map[string]interface{}{
+		"name":        fmt.Sprintf("%d-%s", event.Id, filepath.Base(path)),
+		"description": fmt.Sprintf("%s, captured at %s", event.Name, event.Time),
+	}
+	if g.folder != "" {
+		metadata["parents"] = []string{g.folder}
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gdriveUploadURL+"?uploadType=resumable&supportsAllDrives=true&fields=id", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("User-Agent", "seccam-web")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", gdriveError(resp)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("drive gave no upload session")
+	}
+	return session, nil
+}
+
+// Asks Drive how much of an interrupted upload it has, returning the offset
+// to carry on from.
+func (g *gdriveExporter) uploadStatus(ctx context.Context, session, token string, size int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		return 0, gdriveError(resp)
+	}
+	return gdriveRangeEnd(resp), nil
+}
+
+// Offset after the bytes Drive has of an upload, from the Range header of a
+// 308. No header means it has none.
+func gdriveRangeEnd(resp *http.Response) int64 {
+	_, end, ok := strings.Cut(resp.Header.Get("Range"), "-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n + 1
+}
+
+// Error of a failed Drive request, a rateLimitedError for a 429 so it's retried
+// once Drive allows.
+func gdriveError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		after := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			after = time.Duration(seconds) * time.Second
+		}
+		return &rateLimitedError{after: after}
+	}
+	if body.Error.Message != "" {
+		return fmt.Errorf("drive responded %s: %s", resp.Status, body.Error.Message)
+	}
+	return fmt.Errorf("drive responded %s", resp.Status)
+}
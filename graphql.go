@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Limits of a single GraphQL request. Every event listed costs one, as does
+// every camera, camera lookup and label list, and the stats cost
+// graphqlStatsCost as they go over every event. A request stops resolving
+// once it has cost graphqlMaxCost.
+const (
+	graphqlMaxCost   = 1000
+	graphqlStatsCost = 100
+	graphqlMaxDepth  = 6
+	graphqlMaxLength = 8 << 10
+	graphqlMaxFirst  = 100
+)
+
+var errGraphQLCost = fmt.Errorf("the query asks for too much, a request may cost at most %d (one per event, camera and label list, %d for the stats)", graphqlMaxCost, graphqlStatsCost)
+
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	# Events newest first, after continues from the endCursor of a page
+	events(first: Int = 20, after: String, since: Time, until: Time, camera: ID, label: String, minScore: Float): EventConnection!
+	event(id: ID!): Event
+	cameras: [Camera!]!
+	camera(id: ID!): Camera
+	stats: Stats!
+}
+
+type Mutation {
+	renameEvent(id: ID!, name: String!): Event!
+	protectEvent(id: ID!, protected: Boolean!): Event!
+	deleteEvent(id: ID!): Boolean!
+}
+
+type EventConnection {
+	nodes: [Event!]!
+	endCursor: String
+	hasNextPage: Boolean!
+}
+
+type Event {
+	id: ID!
+	name: String!
+	time: Time!
+	status: String!
+	protected: Boolean!
+	notes: String!
+	score: Float
+	sizeBytes: Float
+	location: String
+	expiresAt: Time
+	imageUrl: String!
+	videoUrl: String
+	camera: Camera
+	labels: [Label!]!
+}
+
+type Label {
+	label: String!
+	confidence: Float!
+}
+
+type Camera {
+	id: ID!
+	name: String!
+	createdAt: Time!
+	live: Boolean!
+	events(first: Int = 20, after: String, since: Time, until: Time, label: String, minScore: Float): EventConnection!
+}
+
+type Stats {
+	events: Int!
+	bytes: Float!
+	unsized: Int!
+	trashEvents: Int!
+	trashBytes: Float!
+	archiveBytes: Float!
+	quotaBytes: Float!
+	diskFreeBytes: Float!
+	diskTotalBytes: Float!
+	cameras: [CameraUsage!]!
+}
+
+type CameraUsage {
+	camera: Camera
+	name: String!
+	events: Int!
+	bytes: Float!
+}
+`
+
+// Parses the GraphQL schema with its resolvers, it's embedded so this only
+// fails on a broken build.
+func newGraphQLSchema(app *App) *graphql.Schema {
+	return graphql.MustParseSchema(graphqlSchema, &graphqlResolver{app},
+		graphql.MaxDepth(graphqlMaxDepth),
+		graphql.MaxQueryLength(graphqlMaxLength),
+		graphql.PanicHandler(graphqlPanics{app}),
+	)
+}
+
+// What a GraphQL request has left to spend and who made it
+type graphqlRequest struct {
+	budget     atomic.Int64
+	actor      string
+	remoteAddr string
+}
+
+type graphqlRequestKey struct{}
+
+// Spends cost from the request's budget, failing once it's used up.
+func graphqlCharge(ctx context.Context, cost int64) error {
+	req, ok := ctx.Value(graphqlRequestKey{}).(*graphqlRequest)
+	if !ok || req.budget.Add(-cost) < 0 {
+		return errGraphQLCost
+	}
+	return nil
+}
+
+// Turns resolvers panicking on database errors into an error naming the
+// request, like the rest of the API.
+type graphqlPanics struct {
+	app *App
+}
+
+func (h graphqlPanics) MakePanicError(ctx context.Context, value interface{}) *gqlerrors.QueryError {
+	logger := h.app.Logger.With(RequestID(ctx))
+	logger.Println("Error resolving a GraphQL query")
+	logger.Println(value)
+	return gqlerrors.Errorf("error resolving the query, request %s", RequestID(ctx))
+}
+
+// Runs a GraphQL query or mutation, see graphqlSchema. Viewers may query, only
+// admins may run mutations, and not in maintenance mode.
+func (app *App) APIGraphQLHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	req := &graphqlRequest{actor: actorOf(r), remoteAddr: r.RemoteAddr}
+	req.budget.Store(graphqlMaxCost)
+	ctx := context.WithValue(r.Context(), graphqlRequestKey{}, req)
+	writeJSON(w, http.StatusOK, app.GraphQL.Exec(ctx, body.Query, body.OperationName, body.Variables))
+}
+
+type graphqlResolver struct {
+	app *App
+}
+
+// Arguments of the events lists
+type graphqlEventsArgs struct {
+	First    int32
+	After    *string
+	Since    *graphql.Time
+	Until    *graphql.Time
+	Camera   *graphql.ID
+	Label    *string
+	MinScore *float64
+}
+
+func (q *graphqlResolver) Events(ctx context.Context, args graphqlEventsArgs) (*graphqlEventConnection, error) {
+	return q.app.graphqlEvents(ctx, args)
+}
+
+func (q *graphqlResolver) Event(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlEvent, error) {
+	if err := graphqlCharge(ctx, 1); err != nil {
+		return nil, err
+	}
+	id, err := graphqlID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	event, err := q.app.FindEvent(id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &graphqlEvent{q.app, event}, nil
+}
+
+func (q *graphqlResolver) Cameras(ctx context.Context) ([]*graphqlCamera, error) {
+	cameras := q.app.GetCameras()
+	if err := graphqlCharge(ctx, int64(len(cameras))); err != nil {
+		return nil, err
+	}
+	resolved := make([]*graphqlCamera, 0, len(cameras))
+	for _, camera := range cameras {
+		resolved = append(resolved, &graphqlCamera{q.app, camera})
+	}
+	return resolved, nil
+}
+
+func (q *graphqlResolver) Camera(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlCamera, error) {
+	id, err := graphqlID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	return q.app.graphqlCamera(ctx, id)
+}
+
+func (q *graphqlResolver) Stats(ctx context.Context) (*graphqlStats, error) {
+	if err := graphqlCharge(ctx, graphqlStatsCost); err != nil {
+		return nil, err
+	}
+	stats, err := q.app.StorageStats()
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlStats{q.app, stats}, nil
+}
+
+func (q *graphqlResolver) RenameEvent(ctx context.Context, args struct {
+	ID   graphql.ID
+	Name string
+}) (*graphqlEvent, error) {
+	event, req, err := q.app.graphqlChange(ctx, args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if args.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if err := q.app.RenameEvent(event.Id, args.Name, req.actor, req.remoteAddr); err != nil {
+		return nil, err
+	}
+	event.Name = args.Name
+	return &graphqlEvent{q.app, event}, nil
+}
+
+func (q *graphqlResolver) ProtectEvent(ctx context.Context, args struct {
+	ID        graphql.ID
+	Protected bool
+}) (*graphqlEvent, error) {
+	event, req, err := q.app.graphqlChange(ctx, args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.app.SetProtected(event.Id, args.Protected, req.actor, req.remoteAddr); err != nil {
+		return nil, err
+	}
+	event.Protected = args.Protected
+	return &graphqlEvent{q.app, event}, nil
+}
+
+func (q *graphqlResolver) DeleteEvent(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	event, req, err := q.app.graphqlChange(ctx, args.ID)
+	if err != nil {
+		return false, err
+	}
+	err = q.app.DeleteEvent(event.Id, req.actor, req.remoteAddr)
+	if err == errProtected {
+		return false, errors.New("the event is protected, unprotect it first")
+	} else if err == errEvidence {
+		return false, errors.New("the event is kept as evidence, an admin has to release it first")
+	} else if err == sql.ErrNoRows {
+		return false, errors.New("event not found")
+	} else if err != nil {
+		return false, err
+	}
+	q.app.Security(securityEvent{
+		kind:       SecurityDelete,
+		severity:   syslogNotice,
+		requestID:  RequestID(ctx),
+		actor:      req.actor,
+		remoteAddr: req.remoteAddr,
+		message:    fmt.Sprintf("event %d (%s) deleted by %s", event.Id, event.Name, req.actor),
+	})
+	return true, nil
+}
+
+// Checks a mutation may run, the same as Writable and AuthMiddleware do for
+// the rest of the API, and looks up the event it changes.
+func (app *App) graphqlChange(ctx context.Context, id graphql.ID) (*Event, *graphqlRequest, error) {
+	if app.ReadOnly.Load() {
+		return nil, nil, errors.New("server is in maintenance mode, changes are not accepted right now")
+	}
+	if user := CurrentUser(ctx); app.HasUsers() && (user == nil || user.Role != RoleAdmin) {
+		return nil, nil, errors.New("your account may not make changes")
+	}
+	req := ctx.Value(graphqlRequestKey{}).(*graphqlRequest)
+
+	eventID, err := graphqlID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	event, err := app.FindEvent(eventID)
+	if err == sql.ErrNoRows {
+		return nil, nil, errors.New("event not found")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return event, req, nil
+}
+
+// Lists a page of events, paid for up front by the number asked for.
+func (app *App) graphqlEvents(ctx context.Context, args graphqlEventsArgs) (*graphqlEventConnection, error) {
+	if args.First < 1 || args.First > graphqlMaxFirst {
+		return nil, fmt.Errorf("first must be between 1 and %d", graphqlMaxFirst)
+	}
+	if err := graphqlCharge(ctx, int64(args.First)); err != nil {
+		return nil, err
+	}
+
+	var filter eventFilter
+	before := int64(math.MaxInt64)
+	if args.After != nil {
+		id, err := decodeCursor(*args.After)
+		if err != nil {
+			return nil, errors.New("after must be the endCursor of a page")
+		}
+		before = id
+	}
+	if args.Since != nil {
+		filter.Since = args.Since.Time
+	}
+	if args.Until != nil {
+		filter.Until = args.Until.Time
+	}
+	if args.Camera != nil {
+		id, err := graphqlID(*args.Camera)
+		if err != nil {
+			return nil, err
+		}
+		filter.CameraId = id
+	}
+	if args.Label != nil {
+		filter.Label = *args.Label
+	}
+	if args.MinScore != nil {
+		filter.MinScore = *args.MinScore
+	}
+
+	// One more than asked for tells whether there's another page
+	events := app.EventsBefore(filter, before, int(args.First)+1)
+	page := &graphqlEventConnection{nodes: make([]*graphqlEvent, 0, len(events)), hasNextPage: len(events) > int(args.First)}
+	if page.hasNextPage {
+		events = events[:args.First]
+	}
+	for _, event := range events {
+		page.nodes = append(page.nodes, &graphqlEvent{app, event})
+	}
+	if len(events) > 0 {
+		cursor := encodeCursor(events[len(events)-1].Id)
+		page.endCursor = &cursor
+	}
+	return page, nil
+}
+
+// Looks up a camera, nil if there's no such camera.
+func (app *App) graphqlCamera(ctx context.Context, id int64) (*graphqlCamera, error) {
+	if err := graphqlCharge(ctx, 1); err != nil {
+		return nil, err
+	}
+	camera, err := app.FindCamera(id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &graphqlCamera{app, camera}, nil
+}
+
+// Parses an ID argument, they're the same numbers as in the rest of the API.
+func graphqlID(id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%q isn't an ID", string(id))
+	}
+	return n, nil
+}
+
+type graphqlEventConnection struct {
+	nodes       []*graphqlEvent
+	endCursor   *string
+	hasNextPage bool
+}
+
+func (c *graphqlEventConnection) Nodes() []*graphqlEvent {
+	return c.nodes
+}
+
+func (c *graphqlEventConnection) EndCursor() *string {
+	return c.endCursor
+}
+
+func (c *graphqlEventConnection) HasNextPage() bool {
+	return c.hasNextPage
+}
+
+type graphqlEvent struct {
+	app   *App
+	event *Event
+}
+
+func (e *graphqlEvent) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(e.event.Id, 10))
+}
+
+func (e *graphqlEvent) Name() string {
+	return e.event.Name
+}
+
+func (e *graphqlEvent) Time() graphql.Time {
+	return graphql.Time{Time: e.event.Time}
+}
+
+func (e *graphqlEvent) Status() string {
+	return e.event.Status
+}
+
+func (e *graphqlEvent) Protected() bool {
+	return e.event.Protected
+}
+
+func (e *graphqlEvent) Notes() string {
+	return e.event.Notes
+}
+
+func (e *graphqlEvent) Score() *float64 {
+	return e.event.Score
+}
+
+// Sizes are floats, GraphQL's Int only has 32 bits.
+func (e *graphqlEvent) SizeBytes() *float64 {
+	if e.event.Size == nil {
+		return nil
+	}
+	size := float64(*e.event.Size)
+	return &size
+}
+
+func (e *graphqlEvent) Location() *string {
+	if e.event.Location == "" {
+		return nil
+	}
+	return &e.event.Location
+}
+
+func (e *graphqlEvent) ExpiresAt() *graphql.Time {
+	if e.event.ExpiresAt == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *e.event.ExpiresAt}
+}
+
+func (e *graphqlEvent) ImageURL() string {
+	return e.app.URL(e.app.MediaURL(e.event.Image))
+}
+
+func (e *graphqlEvent) VideoURL() *string {
+	if e.event.Video == "" {
+		return nil
+	}
+	url := e.app.URL(e.app.MediaURL(e.event.Video))
+	return &url
+}
+
+func (e *graphqlEvent) Camera(ctx context.Context) (*graphqlCamera, error) {
+	if e.event.CameraId == 0 {
+		return nil, nil
+	}
+	return e.app.graphqlCamera(ctx, e.event.CameraId)
+}
+
+func (e *graphqlEvent) Labels(ctx context.Context) ([]*graphqlLabel, error) {
+	if err := graphqlCharge(ctx, 1); err != nil {
+		return nil, err
+	}
+	labels, err := e.app.EventLabels(e.event.Id)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]*graphqlLabel, 0, len(labels))
+	for _, label := range labels {
+		resolved = append(resolved, &graphqlLabel{label})
+	}
+	return resolved, nil
+}
+
+type graphqlLabel struct {
+	label *Label
+}
+
+func (l *graphqlLabel) Label() string {
+	return l.label.Label
+}
+
+func (l *graphqlLabel) Confidence() float64 {
+	return l.label.Confidence
+}
+
+type graphqlCamera struct {
+	app    *App
+	camera *Camera
+}
+
+func (c *graphqlCamera) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(c.camera.Id, 10))
+}
+
+func (c *graphqlCamera) Name() string {
+	return c.camera.Name
+}
+
+func (c *graphqlCamera) CreatedAt() graphql.Time {
+	return graphql.Time{Time: c.camera.Created}
+}
+
+func (c *graphqlCamera) Live() bool {
+	return c.camera.Live
+}
+
+func (c *graphqlCamera) Events(ctx context.Context, args graphqlEventsArgs) (*graphqlEventConnection, error) {
+	id := graphql.ID(strconv.FormatInt(c.camera.Id, 10))
+	args.Camera = &id
+	return c.app.graphqlEvents(ctx, args)
+}
+
+type graphqlStats struct {
+	app   *App
+	stats storageStats
+}
+
+func (s *graphqlStats) Events() int32 {
+	return int32(s.stats.Events)
+}
+
+func (s *graphqlStats) Bytes() float64 {
+	return float64(s.stats.Bytes)
+}
+
+func (s *graphqlStats) Unsized() int32 {
+	return int32(s.stats.Unsized)
+}
+
+func (s *graphqlStats) TrashEvents() int32 {
+	return int32(s.stats.Trashed)
+}
+
+func (s *graphqlStats) TrashBytes() float64 {
+	return float64(s.stats.Trash)
+}
+
+func (s *graphqlStats) ArchiveBytes() float64 {
+	return float64(s.stats.Archives)
+}
+
+func (s *graphqlStats) QuotaBytes() float64 {
+	return float64(s.stats.Quota)
+}
+
+func (s *graphqlStats) DiskFreeBytes() float64 {
+	return float64(s.stats.DiskFree)
+}
+
+func (s *graphqlStats) DiskTotalBytes() float64 {
+	return float64(s.stats.DiskTotal)
+}
+
+func (s *graphqlStats) Cameras() []*graphqlCameraUsage {
+	usage := make([]*graphqlCameraUsage, 0, len(s.stats.Cameras))
+	for _, camera := range s.stats.Cameras {
+		usage = append(usage, &graphqlCameraUsage{s.app, camera})
+	}
+	return usage
+}
+
+type graphqlCameraUsage struct {
+	app   *App
+	usage *cameraUsage
+}
+
+func (u *graphqlCameraUsage) Camera(ctx context.Context) (*graphqlCamera, error) {
+	if u.usage.CameraId == 0 {
+		return nil, nil
+	}
+	return u.app.graphqlCamera(ctx, u.usage.CameraId)
+}
+
+func (u *graphqlCameraUsage) Name() string {
+	return u.usage.Name
+}
+
+func (u *graphqlCameraUsage) Events() int32 {
+	return int32(u.usage.Events)
+}
+
+func (u *graphqlCameraUsage) Bytes() float64 {
+	return float64(u.usage.Bytes)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/battleroid/seccam-web/seccampb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const cameraKey contextKey = iota + 200
+
+// gRPC ingestion service, backed by the same store as the web interface
+type grpcServer struct {
+	seccampb.UnimplementedSeccamServer
+	app    *App
+	tokens map[string]string // Camera name to token
+}
+
+// Reads the camera tokens file. Every line holds a camera name and its token
+// separated by whitespace, blank lines and lines starting with # are skipped.
+func LoadCameraTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a camera name and token", path, n)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no camera tokens", path)
+	}
+
+	return tokens, nil
+}
+
+// Starts the gRPC listener. Cameras authenticate with the tokens from
+// -grpc-tokens, traffic is encrypted when -grpc-cert and -grpc-key are given.
+func (app *App) ListenGRPC(addr string) {
+	if app.Config.grpcTokens == "" {
+		log.Fatal("-grpc-listen requires -grpc-tokens")
+	}
+	tokens, err := LoadCameraTokens(app.Config.grpcTokens)
+	if err != nil {
+		log.Fatalf("Error loading camera tokens: %s", err)
+	}
+	srv := &grpcServer{app: app, tokens: tokens}
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(srv.unaryInterceptor),
+		grpc.StreamInterceptor(srv.streamInterceptor),
+	}
+	if app.Config.grpcCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(app.Config.grpcCert, app.Config.grpcKey)
+		if err != nil {
+			log.Fatalf("Error loading gRPC certificate: %s", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	} else {
+		log.Println("WARNING: no -grpc-cert given, gRPC traffic (camera tokens included) is unencrypted")
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := grpc.NewServer(opts...)
+	seccampb.RegisterSeccamServer(server, srv)
+
+	log.Println("gRPC listener on", addr)
+	log.Fatal(server.Serve(lis))
+}
+
+// Checks the call's bearer token and tags its context with a request ID and the
+// camera it belongs to.
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	id := ""
+	if v := md.Get("x-request-id"); len(v) > 0 && validRequestID(v[0]) {
+		id = v[0]
+	} else {
+		id = newRequestID()
+	}
+	ctx = context.WithValue(ctx, requestIDKey, id)
+
+	var token string
+	if v := md.Get("authorization"); len(v) > 0 {
+		token = strings.TrimPrefix(v[0], "Bearer ")
+	}
+
+	// Compare against every token so the time taken doesn't give away a match
+	camera := ""
+	for name, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			camera = name
+		}
+	}
+	if camera == "" {
+		s.app.Logger.With(id).Println("Rejected gRPC call with invalid camera token")
+		remoteAddr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr.String()
+		}
+		s.app.Security(securityEvent{
+			kind:       SecurityAuthFailure,
+			severity:   syslogWarning,
+			requestID:  id,
+			remoteAddr: remoteAddr,
+			message:    "gRPC call with an invalid or missing camera token",
+		})
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing camera token")
+	}
+
+	return context.WithValue(ctx, cameraKey, camera), nil
+}
+
+// Turns a panic in a call into an Internal error, the gRPC counterpart of
+// RecoverMiddleware.
+func (s *grpcServer) recover(ctx context.Context, method string, err *error) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	panicsRecovered.Add(1)
+	logger := s.app.Logger.With(RequestID(ctx))
+	logger.Printf("Panic serving %s: %v\n", method, p)
+	logger.Println(string(debug.Stack()))
+	*err = status.Error(codes.Internal, "internal server error, request "+RequestID(ctx))
+}
+
+func (s *grpcServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, err = s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.recover(ctx, info.FullMethod, &err)
+
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	defer s.recover(ctx, info.FullMethod, &err)
+
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// Server stream with a replaced context
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// Converts an event for the gRPC API.
+func (app *App) protoEvent(event *Event) *seccampb.Event {
+	converted := &seccampb.Event{
+		Id:               event.Id,
+		Name:             event.Name,
+		Time:             timestamppb.New(event.Time),
+		Video:            event.Video,
+		Image:            event.Image,
+		Status:           event.Status,
+		LastError:        event.LastError,
+		NotifySuppressed: event.Suppressed,
+		Protected:        event.Protected,
+		ImageUrl:         app.URL(app.MediaURL(event.Image)),
+		Notes:            event.Notes,
+	}
+	if event.Video != "" {
+		converted.VideoUrl = app.URL(app.MediaURL(event.Video))
+	}
+	return converted
+}
+
+// Receives an event: video chunks, the metadata and then image chunks. Both files
+// are staged as they arrive and handed to StoreEvent like an HTTP upload.
+func (s *grpcServer) CreateEvent(stream seccampb.Seccam_CreateEventServer) error {
+	app := s.app
+	ctx := stream.Context()
+	logger := app.Logger.With(RequestID(ctx))
+	if app.ReadOnly.Load() {
+		return status.Error(codes.Unavailable, "in maintenance mode, try again later")
+	}
+	uploadsActive.Add(1)
+	defer uploadsActive.Add(-1)
+
+	camera, _ := ctx.Value(cameraKey).(string)
+	logger.Printf("Receiving event from camera %s\n", camera)
+	events := &eventStream{stream: stream}
+
+	// Anything staged is removed unless StoreEvent takes it over
+	var staged []string
+	defer func() {
+		for _, path := range staged {
+			os.Remove(path)
+		}
+	}()
+
+	// Files are staged up to a byte past the limit, so going over it shows
+	video, err := app.StageUpload(io.LimitReader(events.chunks(func(msg *seccampb.CreateEventRequest) ([]byte, bool) {
+		part, ok := msg.Part.(*seccampb.CreateEventRequest_VideoChunk)
+		if !ok {
+			return nil, false
+		}
+		return part.VideoChunk, true
+	}), maxUploadSize+1))
+	if err != nil {
+		logger.Println("Error receiving video, discarding it")
+		logger.Println(err.Error())
+		return status.Error(codes.Aborted, "error receiving video")
+	}
+	staged = append(staged, video)
+	if stagedTooLarge(video) {
+		logger.Printf("Video from camera %s is over %d bytes, discarding it\n", camera, maxUploadSize)
+		return status.Errorf(codes.ResourceExhausted, "video may be at most %d bytes", maxUploadSize)
+	}
+
+	msg, err := events.peek()
+	if err != nil {
+		return err
+	}
+	meta := msg.GetMetadata()
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "expected metadata after the video")
+	}
+	events.pending = nil
+	if !validFilename(meta.VideoFilename) || !validFilename(meta.ImageFilename) {
+		return status.Error(codes.InvalidArgument, "video_filename and image_filename are required")
+	}
+
+	image, err := app.StageUpload(io.LimitReader(events.chunks(func(msg *seccampb.CreateEventRequest) ([]byte, bool) {
+		part, ok := msg.Part.(*seccampb.CreateEventRequest_ImageChunk)
+		if !ok {
+			return nil, false
+		}
+		return part.ImageChunk, true
+	}), maxUploadSize+1))
+	if err != nil {
+		logger.Println("Error receiving image, discarding it")
+		logger.Println(err.Error())
+		return status.Error(codes.Aborted, "error receiving image")
+	}
+	staged = append(staged, image)
+	if stagedTooLarge(image) {
+		logger.Printf("Image from camera %s is over %d bytes, discarding it\n", camera, maxUploadSize)
+		return status.Errorf(codes.ResourceExhausted, "image may be at most %d bytes", maxUploadSize)
+	}
+
+	if msg, err := events.peek(); err != nil {
+		return err
+	} else if msg != nil {
+		return status.Error(codes.InvalidArgument, "unexpected message after the image")
+	}
+
+	upload := eventUpload{
+		Name:   meta.Name,
+		Camera: camera,
+		Videos: []stagedFile{{Path: video, Name: meta.VideoFilename}},
+		Images: []stagedFile{{Path: image, Name: meta.ImageFilename}},
+		Notify: !meta.SuppressNotification,
+	}
+	staged = nil
+	created, err := app.StoreEvent(logger, RequestID(ctx), upload)
+	var rejected *rejectedError
+	if errors.As(err, &rejected) {
+		return status.Error(codes.FailedPrecondition, rejected.Error())
+	} else if isBusy(err) {
+		dbBusyFailures.Add(1)
+		return status.Error(codes.Unavailable, "the database is busy, try again later")
+	} else if err != nil {
+		return status.Error(codes.Internal, "error storing event")
+	}
+
+	return stream.SendAndClose(app.protoEvent(created))
+}
+
+// Whether a file staged through a reader limited to maxUploadSize+1 bytes went
+// past maxUploadSize.
+func stagedTooLarge(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > maxUploadSize
+}
+
+// Returns a single event.
+func (s *grpcServer) GetEvent(ctx context.Context, req *seccampb.GetEventRequest) (*seccampb.Event, error) {
+	event, err := s.app.FindEvent(req.Id)
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "event not found")
+	} else if err != nil {
+		panic(err)
+	}
+
+	return s.app.protoEvent(event), nil
+}
+
+// Lists the most recent events, newest first.
+func (s *grpcServer) ListEvents(ctx context.Context, req *seccampb.ListEventsRequest) (*seccampb.ListEventsResponse, error) {
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = 20
+	} else if limit < 1 || limit > 100 {
+		return nil, status.Error(codes.InvalidArgument, "limit must be between 1 and 100")
+	}
+
+	resp := &seccampb.ListEventsResponse{}
+	for _, event := range s.app.RecentEvents(limit) {
+		resp.Events = append(resp.Events, s.app.protoEvent(event))
+	}
+
+	return resp, nil
+}
+
+// CreateEvent stream that can look one message ahead
+type eventStream struct {
+	stream  seccampb.Seccam_CreateEventServer
+	pending *seccampb.CreateEventRequest
+	eof     bool
+}
+
+// Returns the next message without consuming it, nil at the end of the stream.
+func (s *eventStream) peek() (*seccampb.CreateEventRequest, error) {
+	if s.pending == nil && !s.eof {
+		msg, err := s.stream.Recv()
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return nil, err
+		} else {
+			s.pending = msg
+		}
+	}
+
+	return s.pending, nil
+}
+
+// Returns a reader over the run of consecutive messages chunk accepts, ending at
+// the first message it doesn't.
+func (s *eventStream) chunks(chunk func(*seccampb.CreateEventRequest) ([]byte, bool)) io.Reader {
+	return &chunkReader{stream: s, chunk: chunk}
+}
+
+type chunkReader struct {
+	stream *eventStream
+	chunk  func(*seccampb.CreateEventRequest) ([]byte, bool)
+	buf    []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msg, err := r.stream.peek()
+		if err != nil {
+			return 0, err
+		}
+		if msg == nil {
+			return 0, io.EOF
+		}
+		data, ok := r.chunk(msg)
+		if !ok {
+			return 0, io.EOF
+		}
+		r.stream.pending = nil
+		r.buf = data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Reports whether the application is healthy along with the state of its optional
+// dependencies. Responds 503 if the database can't be reached.
+func (app *App) HealthHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	health := struct {
+		Status    string         `json:"status"`
+		Version   string         `json:"version"`
+		Database  bool           `json:"database"`
+		FFmpeg    bool           `json:"ffmpeg"`
+		FFprobe   bool           `json:"ffprobe"`
+		ReadOnly  bool           `json:"read_only"`
+		DiskFree  uint64         `json:"disk_free_bytes"`
+		DiskTotal uint64         `json:"disk_total_bytes"`
+		DryRun    bool           `json:"notify_dry_run"`
+		Queue     int            `json:"transcode_queue"`
+		Oldest    float64        `json:"transcode_oldest_queued_seconds"` // 0 when nothing is queued
+		Active    int64          `json:"transcodes_active"`
+		Notify    []notifierInfo `json:"notifications"`
+		Twilio    struct {
+			Checked *time.Time `json:"checked,omitempty"`
+			OK      bool       `json:"ok"`
+			Error   string     `json:"error,omitempty"`
+		} `json:"twilio"`
+		Exports map[string]*exportHealth `json:"exports,omitempty"` // Per target
+	}{
+		Status:   "ok",
+		Version:  version,
+		Database: app.DB.Ping() == nil,
+		FFmpeg:   app.FFmpeg != "",
+		FFprobe:  app.FFprobe != "",
+		ReadOnly: app.ReadOnly.Load(),
+		DryRun:   app.Config.notifyDryRun,
+		Queue:    app.Transcodes.Len(),
+		Oldest:   app.Transcodes.Oldest().Seconds(),
+		Active:   app.Transcodes.Active(),
+		Notify:   app.NotifierInfo(),
+	}
+	health.DiskFree, health.DiskTotal, _ = DiskUsage(app.Config.dirs.data)
+
+	// Twilio is only known to work once a check or message went through
+	if checked, err := app.Twilio.get(); !checked.IsZero() {
+		health.Twilio.Checked = &checked
+		health.Twilio.OK = err == nil
+		if err != nil {
+			health.Twilio.Error = err.Error()
+		}
+	}
+
+	// Exports fail from the moment their credentials stop working
+	for _, exporter := range app.Exporters {
+		if health.Exports == nil {
+			health.Exports = make(map[string]*exportHealth)
+		}
+		health.Exports[exporter.Name()] = newExportHealth(exporter.Status())
+	}
+
+	status := http.StatusOK
+	if !health.Database {
+		health.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
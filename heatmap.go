@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Longest the heatmap goes back, in days
+const heatmapMaxDays = 3660
+
+// Events on a day of the heatmap
+type heatmapDay struct {
+	Date  string `json:"date"` // Local date, 2006-01-02
+	Count int    `json:"count"`
+}
+
+// Counts the events of each of the last days local days, today included and
+// oldest first, of a single camera unless cameraID is 0. Days without events
+// are included with a count of 0.
+func (app *App) Heatmap(days int, cameraID int64) ([]heatmapDay, error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	start := today.AddDate(0, 0, -(days - 1))
+
+	sql_heatmap := `
+	SELECT date(time, 'localtime') AS day, COUNT(*) FROM events
+	WHERE time >= ? AND (? = 0 OR camera_id = ?)
+	GROUP BY day`
+	rows, err := app.DB.Query(sql_heatmap, start.UTC(), cameraID, cameraID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day sql.NullString
+		var count int
+		if err := rows.Scan(&day, &count); err != nil {
+			return nil, err
+		}
+		counts[day.String] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	heatmap := make([]heatmapDay, 0, days)
+	for day := start; !day.After(today); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		heatmap = append(heatmap, heatmapDay{Date: date, Count: counts[date]})
+	}
+	return heatmap, nil
+}
+
+// Returns the number of events per day for an activity heatmap, served from
+// memory until events change so it can be fetched on every page load.
+func (app *App) APIHeatmapHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	days, cameraID := 365, int64(0)
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > heatmapMaxDays {
+			writeFieldError(w, ErrInvalidField, "days", "days must be between 1 and "+strconv.Itoa(heatmapMaxDays))
+			return
+		}
+		days = n
+	}
+	if v := r.URL.Query().Get("camera"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "camera", "camera must be a camera id")
+			return
+		}
+		if _, err := app.FindCamera(id); err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "camera not found")
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		cameraID = id
+	}
+
+	heatmap, err := app.Cache.Load(fmt.Sprintf("heatmap:%d:%d", days, cameraID), func() (interface{}, error) {
+		return app.Heatmap(days, cameraID)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	writeJSON(w, http.StatusOK, heatmap)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stages of an event's life hooks run at, named after the executables in
+// -hooks-dir
+const (
+	HookCreated    = "created"    // Stored, its video may still be waiting for conversion
+	HookTranscoded = "transcoded" // Video converted
+	HookDeleted    = "deleted"    // Removed along with its files
+	HookNotified   = "notified"   // An alert about it was delivered
+)
+
+var hookStages = []string{HookCreated, HookTranscoded, HookDeleted, HookNotified}
+
+// Outcome of hook runs per stage, e.g. created_ok, created_failed,
+// created_killed and the total run time in created_ms
+var hookStats = expvar.NewMap("hooks")
+
+// Executables to run at a stage: those of -hooks-dir named after it, with
+// or without an extension, in name order, and -hook for new events. The
+// directory is read every time, so hooks can be added and removed without a
+// restart.
+func (app *App) hooksFor(stage string) []string {
+	var hooks []string
+	if stage == HookCreated && app.Config.hookPath != "" {
+		hooks = append(hooks, app.Config.hookPath)
+	}
+	if app.Config.hooksDir == "" {
+		return hooks
+	}
+
+	entries, err := os.ReadDir(app.Config.hooksDir)
+	if err != nil {
+		log.Printf("Error reading -hooks-dir %s\n", app.Config.hooksDir)
+		log.Println(err.Error())
+		return hooks
+	}
+	var found []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.TrimSuffix(name, filepath.Ext(name)) != stage {
+			continue
+		}
+		path := filepath.Join(app.Config.hooksDir, name)
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		found = append(found, path)
+	}
+	sort.Strings(found)
+	return append(hooks, found...)
+}
+
+// Runs every hook of a stage for an event in the background, at most
+// -hook-concurrency at a time across stages. The event is passed in SECCAM_*
+// environment variables along with env, the hook's output ends up in our log.
+// Failures are only logged, the event stands either way.
+func (app *App) RunHooks(logger *Logger, stage string, event *Event, camera string, env ...string) {
+	if app.Hooks == nil {
+		return
+	}
+	for _, path := range app.hooksFor(stage) {
+		go app.runHook(logger, path, stage, event, camera, env)
+	}
+}
+
+// Runs a single hook, killing it after -hook-timeout.
+func (app *App) runHook(logger *Logger, path, stage string, event *Event, camera string, env []string) {
+	app.Hooks <- struct{}{}
+	defer func() { <-app.Hooks }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.hookTimeout)
+	defer cancel()
+
+	// Snapshots have no video, the variable is left empty for them
+	video := ""
+	if event.Video != "" {
+		video = absPath(event.Video)
+	}
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(),
+		"SECCAM_HOOK="+stage,
+		"SECCAM_EVENT_ID="+strconv.FormatInt(event.Id, 10),
+		"SECCAM_EVENT_NAME="+event.Name,
+		"SECCAM_EVENT_TIME="+event.Time.UTC().Format(time.RFC3339),
+		"SECCAM_CAMERA="+camera,
+		"SECCAM_CAMERA_ID="+strconv.FormatInt(event.CameraId, 10),
+		"SECCAM_VIDEO="+video,
+		"SECCAM_IMAGE="+absPath(event.Image),
+		"SECCAM_LOCATION="+event.Location,
+		"SECCAM_LATITUDE="+formatCoordinate(event.Latitude),
+		"SECCAM_LONGITUDE="+formatCoordinate(event.Longitude),
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.WaitDelay = time.Second
+
+	name := filepath.Base(path)
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	took := time.Since(start)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		logger.Printf("Hook %s: %s\n", name, scanner.Text())
+	}
+	hookStats.Add(stage+"_ms", took.Milliseconds())
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		hookStats.Add(stage+"_killed", 1)
+		logger.Printf("Error running hook %s for event %d, killed after %s\n", name, event.Id, app.Config.hookTimeout)
+	case errors.As(err, &exitErr):
+		hookStats.Add(stage+"_failed", 1)
+		logger.Printf("Error running hook %s for event %d, exited with %d after %s\n", name, event.Id, exitErr.ExitCode(), took.Round(time.Millisecond))
+	case err != nil:
+		hookStats.Add(stage+"_failed", 1)
+		logger.Printf("Error running hook %s for event %d\n", name, event.Id)
+		logger.Println(err.Error())
+	default:
+		hookStats.Add(stage+"_ok", 1)
+		logger.Printf("Ran hook %s for event %d, exited with 0 after %s\n", name, event.Id, took.Round(time.Millisecond))
+	}
+}
+
+// Runs the notified hooks for the event of a delivery that went out.
+func (app *App) notifiedHooks(delivery int64, channel string) {
+	if app.Hooks == nil {
+		return
+	}
+	var id int64
+	if err := app.DB.QueryRow(`SELECT event_id FROM deliveries WHERE id = ?`, delivery).Scan(&id); err != nil {
+		return
+	}
+	event, err := app.FindEvent(id)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Printf("Error finding event %d for its notified hooks\n", id)
+		log.Println(err.Error())
+		return
+	}
+	app.RunHooks(app.Logger, HookNotified, event, app.cameraName(event), "SECCAM_CHANNEL="+channel)
+}
+
+// Lists the hooks found in -hooks-dir at startup, warning about files that
+// won't run.
+func checkHooksDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var found []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stage := strings.TrimSuffix(name, filepath.Ext(name))
+		known := false
+		for _, s := range hookStages {
+			known = known || s == stage
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		switch {
+		case !known:
+			log.Printf("WARNING: %s in -hooks-dir is not named after a stage (%s), it won't run\n", name, strings.Join(hookStages, ", "))
+		case err != nil || !info.Mode().IsRegular():
+			log.Printf("WARNING: %s in -hooks-dir is not a file, it won't run\n", name)
+		case info.Mode().Perm()&0111 == 0:
+			log.Printf("WARNING: %s in -hooks-dir is not executable, it won't run\n", name)
+		default:
+			found = append(found, name)
+		}
+	}
+	if len(found) > 0 {
+		log.Printf("Running hooks from %s: %s\n", dir, strings.Join(found, ", "))
+	}
+	return nil
+}
+
+// Returns the absolute form of a path, or the path itself if it can't be
+// resolved.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Language every catalog falls back to, it has to have a catalog
+const fallbackLanguage = "en"
+
+// Key of the time layout in a catalog, in Go's reference time
+const dateFormatKey = "date_format"
+
+// Strings of the web interface and notifications per language, read from
+// <tmpl>/lang/<language>.json at startup. Every catalog is a flat JSON object
+// of keys to strings, formatted with fmt when given arguments so translations
+// can reorder them with %[1]s.
+type catalogs struct {
+	strings map[string]map[string]string // By language, then key
+	missing sync.Map                     // Language and key of strings already logged as missing
+}
+
+// Reads the catalogs in dir, there has to be one for English.
+func LoadCatalogs(dir string) (*catalogs, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &catalogs{strings: make(map[string]map[string]string)}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		c.strings[strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))] = catalog
+	}
+	if c.strings[fallbackLanguage] == nil {
+		return nil, fmt.Errorf("no catalog for %s in %s", fallbackLanguage, dir)
+	}
+	return c, nil
+}
+
+// Languages with a catalog, sorted.
+func (c *catalogs) Languages() []string {
+	languages := make([]string, 0, len(c.strings))
+	for language := range c.strings {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Returns the string of key in language, formatted with args if there are
+// any. Keys missing from the language come from English, those missing from
+// English too are returned as they are. Either is logged once per key.
+func (c *catalogs) T(language, key string, args ...interface{}) string {
+	s, ok := c.strings[language][key]
+	if !ok {
+		if _, logged := c.missing.LoadOrStore(language+"\x00"+key, true); !logged {
+			log.Printf("WARNING: the %s catalog has no %q\n", language, key)
+		}
+		if s, ok = c.strings[fallbackLanguage][key]; !ok {
+			s = key
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(s, args...)
+	}
+	return s
+}
+
+// Formats a time in local time, the way the language writes dates.
+func (c *catalogs) Date(language string, t time.Time) string {
+	return t.Local().Format(c.T(language, dateFormatKey))
+}
+
+// The language with a catalog that matches a tag such as es or es-MX, empty
+// if there's none.
+func (c *catalogs) match(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if _, ok := c.strings[tag]; ok {
+		return tag
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	if _, ok := c.strings[primary]; ok {
+		return primary
+	}
+	return ""
+}
+
+// Picks the language of a page from the Accept-Language header, the most
+// preferred one with a catalog, falling back to -language.
+func (app *App) Language(r *http.Request) string {
+	best, bestQ := app.Config.language, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			} else {
+				q = 0
+			}
+		}
+		if language := app.Catalogs.match(tag); language != "" && q > bestQ {
+			best, bestQ = language, q
+		}
+	}
+	return best
+}
+
+// Returns a template in the language of the request.
+func (app *App) Template(r *http.Request, name string) *template.Template {
+	return app.Templates[app.Language(r)][name]
+}
+
+// Returns the string of key in -language, for notifications.
+func (app *App) T(key string, args ...interface{}) string {
+	return app.Catalogs.T(app.Config.language, key, args...)
+}
+
+// Formats a time the way -language writes dates, for notifications.
+func (app *App) FormatTime(t time.Time) string {
+	return app.Catalogs.Date(app.Config.language, t)
+}
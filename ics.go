@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Length of the calendar entries, events have no end of their own
+const icsDuration = "PT1M"
+
+// Escapes text for an iCalendar property value (RFC 5545 section 3.3.11).
+func icsEscape(text string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(text)
+}
+
+// Writes a content line folded to 75 octets as RFC 5545 section 3.1 requires,
+// without splitting UTF-8 sequences.
+func icsLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// Returns the absolute URL of a route for the request: below the base URL when
+// it's set, otherwise on the host the request was made to.
+func (app *App) requestURL(r *http.Request, path string) string {
+	if app.Config.baseURL != "" {
+		return app.AbsoluteURL(path)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + app.URL(path)
+}
+
+// Retrieves the events since the given time, newest first.
+func (app *App) EventsAfter(since time.Time) []*Event {
+	sql_events := `
+	SELECT ` + eventColumns + ` FROM events
+	WHERE time >= ?
+	ORDER BY id DESC`
+	return app.queryEvents(sql_events, since.UTC().Format("2006-01-02 15:04:05"))
+}
+
+// Serves the events of the last -ics-window as an iCalendar feed, for
+// subscribing to from calendar apps.
+func (app *App) CalendarHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	cameras := make(map[int64]string)
+	for _, camera := range app.GetCameras() {
+		cameras[camera.Id] = camera.Name
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	now := time.Now().UTC().Format("20060102T150405Z")
+
+	var b strings.Builder
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//seccam-web//events//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "X-WR-CALNAME:seccam")
+	for _, event := range app.EventsAfter(time.Now().Add(-app.Config.icsWindow)) {
+		summary := event.Name
+		if name, ok := cameras[event.CameraId]; ok {
+			summary = name + ": " + event.Name
+		}
+
+		icsLine(&b, "BEGIN:VEVENT")
+		icsLine(&b, fmt.Sprintf("UID:event-%d@%s", event.Id, host))
+		icsLine(&b, "DTSTAMP:"+now)
+		icsLine(&b, "DTSTART:"+event.Time.UTC().Format("20060102T150405Z"))
+		icsLine(&b, "DURATION:"+icsDuration)
+		icsLine(&b, "SUMMARY:"+icsEscape(summary))
+		icsLine(&b, "DESCRIPTION:"+icsEscape(app.requestURL(r, fmt.Sprintf("/event/%d", event.Id))))
+		icsLine(&b, "END:VEVENT")
+	}
+	icsLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="events.ics"`)
+	w.Write([]byte(b.String()))
+}
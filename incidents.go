@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Most events grouped into incidents at once, those past it are left out
+const incidentMaxEvents = 5000
+
+// Longest range incidents are listed over
+const incidentMaxRange = 31 * 24 * time.Hour
+
+// Events of a camera that follow each other within -incident-window, seen as
+// one thing happening
+type Incident struct {
+	CameraId  int64     `json:"camera_id,omitempty"`
+	Camera    string    `json:"camera,omitempty"`
+	Start     time.Time `json:"start"` // Time of the first event
+	End       time.Time `json:"end"`   // Time of the last event
+	Count     int       `json:"count"`
+	EventIds  []int64   `json:"event_ids"` // Oldest first
+	EventId   int64     `json:"event_id"`  // The event standing for the rest, the highest scored or else the first
+	Thumbnail string    `json:"thumbnail_url"`
+	Events    []*Event  `json:"-"`
+	best      *Event
+}
+
+// Duration of the incident, zero for a single event.
+func (i *Incident) Duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// Groups events into incidents. An event joins the incident of its camera if
+// it comes within window of that incident's last event, so a chain of events
+// each close to the one before makes a single incident however long it runs.
+// Events are taken oldest first, incidents come out newest first.
+func clusterIncidents(events []*Event, window time.Duration) []*Incident {
+	incidents := make([]*Incident, 0)
+	open := make(map[int64]*Incident)
+	for _, event := range events {
+		incident := open[event.CameraId]
+		if incident == nil || event.Time.Sub(incident.End) > window {
+			incident = &Incident{CameraId: event.CameraId, Start: event.Time, EventId: event.Id, best: event}
+			open[event.CameraId] = incident
+			incidents = append(incidents, incident)
+		} else if event.Score != nil && (incident.best.Score == nil || *event.Score > *incident.best.Score) {
+			incident.EventId, incident.best = event.Id, event
+		}
+		incident.End = event.Time
+		incident.Count++
+		incident.EventIds = append(incident.EventIds, event.Id)
+		incident.Events = append(incident.Events, event)
+	}
+
+	sort.SliceStable(incidents, func(i, j int) bool {
+		return incidents[i].Start.After(incidents[j].Start)
+	})
+	return incidents
+}
+
+// Groups the events from since up to until into incidents, of a single camera
+// unless cameraID is 0. Incidents running over either end are cut off there.
+// Also returns whether there were more events than incidentMaxEvents, the
+// latest of which were left out.
+func (app *App) Incidents(since, until time.Time, cameraID int64) ([]*Incident, bool) {
+	sql_events := `
+	SELECT ` + eventColumns + ` FROM events
+	WHERE time >= ? AND time < ? AND (? = 0 OR camera_id = ?)
+	ORDER BY time, id LIMIT ?`
+	events := app.queryEvents(sql_events, since.UTC(), until.UTC(), cameraID, cameraID, incidentMaxEvents+1)
+	truncated := len(events) > incidentMaxEvents
+	if truncated {
+		events = events[:incidentMaxEvents]
+	}
+
+	cameras := make(map[int64]string)
+	for _, camera := range app.GetCameras() {
+		cameras[camera.Id] = camera.Name
+	}
+	incidents := clusterIncidents(events, app.Config.incidentWindow)
+	for _, incident := range incidents {
+		incident.Camera = cameras[incident.CameraId]
+		incident.Thumbnail = app.URL("/thumb/" + strconv.FormatInt(incident.EventId, 10))
+	}
+	return incidents, truncated
+}
+
+// Lists the incidents between since and until, the last day by default.
+func (app *App) APIIncidentsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	query := r.URL.Query()
+	until := time.Now()
+	if v := query.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "until", "until must be an RFC 3339 timestamp")
+			return
+		}
+		until = t
+	}
+	since := until.Add(-24 * time.Hour)
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "since", "since must be an RFC 3339 timestamp")
+			return
+		}
+		since = t
+	}
+	if !since.Before(until) {
+		writeFieldError(w, ErrInvalidField, "since", "since must be before until")
+		return
+	}
+	if until.Sub(since) > incidentMaxRange {
+		writeFieldError(w, ErrInvalidField, "since", "since and until can be at most 31 days apart")
+		return
+	}
+
+	var cameraID int64
+	if v := query.Get("camera"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			writeFieldError(w, ErrInvalidField, "camera", "camera must be a camera id")
+			return
+		}
+		cameraID = id
+	}
+
+	incidents, truncated := app.Incidents(since, until, cameraID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"since":          since.UTC(),
+		"until":          until.UTC(),
+		"window_seconds": int64(app.Config.incidentWindow / time.Second),
+		"truncated":      truncated,
+		"incidents":      incidents,
+	})
+}
+
+// Renders the incidents of a local day, today unless date (2006-01-02) says
+// otherwise, and of a single camera with camera.
+func (app *App) IncidentsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if v := r.FormValue("date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			app.RenderError(w, r, http.StatusBadRequest, "The date has to look like 2006-01-02.")
+			return
+		}
+		day = t
+	}
+
+	var camera *Camera
+	if v := r.FormValue("camera"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			camera, err = app.FindCamera(id)
+		}
+		if err != nil {
+			app.RenderError(w, r, http.StatusNotFound, "There is no such camera.")
+			return
+		}
+	}
+	var cameraID int64
+	if camera != nil {
+		cameraID = camera.Id
+	}
+
+	w.Header().Set("Vary", "Accept-Language")
+	extra := []string{day.Format("2006-01-02"), strconv.FormatInt(cameraID, 10), app.Language(r)}
+	if user := CurrentUser(r.Context()); user != nil {
+		extra = append(extra, user.Username, user.Role)
+	}
+	if app.NotModified(w, r, app.EventsETag(extra...)) {
+		return
+	}
+
+	next := day.AddDate(0, 0, 1)
+	incidents, truncated := app.Incidents(day, next, cameraID)
+	context := struct {
+		Date      string
+		Prev      string
+		Next      string // Empty for today, there's nothing after it yet
+		Camera    *Camera
+		Cameras   []*Camera
+		Incidents []*Incident
+		Window    time.Duration
+		Truncated bool
+		User      *User
+	}{
+		Date:      day.Format("2006-01-02"),
+		Prev:      day.AddDate(0, 0, -1).Format("2006-01-02"),
+		Camera:    camera,
+		Cameras:   app.GetCameras(),
+		Incidents: incidents,
+		Window:    app.Config.incidentWindow,
+		Truncated: truncated,
+		User:      CurrentUser(r.Context()),
+	}
+	if next.Before(now) {
+		context.Next = next.Format("2006-01-02")
+	}
+	t := app.Template(r, "incidents")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Event of a camera at a number of seconds past a fixed time, scored unless
+// score is negative.
+type incidentEvent struct {
+	id     int64
+	camera int64
+	at     int
+	score  float64
+}
+
+func TestClusterIncidents(t *testing.T) {
+	window := 2 * time.Minute
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		events []incidentEvent
+		groups [][]int64 // Event ids of each incident, newest incident first
+		chosen []int64   // The event standing for each incident
+	}{
+		{"single event", []incidentEvent{{1, 1, 0, -1}},
+			[][]int64{{1}}, []int64{1}},
+		{"chain longer than the window", []incidentEvent{{1, 1, 0, -1}, {2, 1, 100, -1}, {3, 1, 200, -1}, {4, 1, 300, -1}},
+			[][]int64{{1, 2, 3, 4}}, []int64{1}},
+		// A gap of exactly the window still joins, a second more doesn't
+		{"adjacent at the window", []incidentEvent{{1, 1, 0, -1}, {2, 1, 120, -1}},
+			[][]int64{{1, 2}}, []int64{1}},
+		{"adjacent past the window", []incidentEvent{{1, 1, 0, -1}, {2, 1, 121, -1}},
+			[][]int64{{2}, {1}}, []int64{2, 1}},
+		{"back to back", []incidentEvent{{1, 1, 0, -1}, {2, 1, 60, -1}, {3, 1, 181, -1}, {4, 1, 240, -1}},
+			[][]int64{{3, 4}, {1, 2}}, []int64{3, 1}},
+		// Two cameras at the same time make an incident each, neither cutting
+		// the other's short
+		{"overlapping cameras", []incidentEvent{{1, 1, 0, -1}, {2, 2, 30, -1}, {3, 1, 90, -1}, {4, 2, 150, -1}, {5, 1, 200, -1}},
+			[][]int64{{2, 4}, {1, 3, 5}}, []int64{2, 1}},
+		{"overlap ending apart", []incidentEvent{{1, 1, 0, -1}, {2, 2, 10, -1}, {3, 2, 100, -1}, {4, 1, 300, -1}},
+			[][]int64{{4}, {2, 3}, {1}}, []int64{4, 2, 1}},
+		{"same time, two cameras", []incidentEvent{{1, 1, 0, -1}, {2, 2, 0, -1}},
+			[][]int64{{1}, {2}}, []int64{1, 2}},
+		{"highest score stands for it", []incidentEvent{{1, 1, 0, -1}, {2, 1, 30, 0.4}, {3, 1, 60, 0.9}, {4, 1, 90, 0.5}},
+			[][]int64{{1, 2, 3, 4}}, []int64{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var events []*Event
+			for _, e := range test.events {
+				event := &Event{Id: e.id, CameraId: e.camera, Time: base.Add(time.Duration(e.at) * time.Second)}
+				if e.score >= 0 {
+					score := e.score
+					event.Score = &score
+				}
+				events = append(events, event)
+			}
+
+			incidents := clusterIncidents(events, window)
+			var groups [][]int64
+			var chosen []int64
+			for _, incident := range incidents {
+				groups = append(groups, incident.EventIds)
+				chosen = append(chosen, incident.EventId)
+				if incident.Count != len(incident.EventIds) {
+					t.Errorf("incident counts %d events, holds %d", incident.Count, len(incident.EventIds))
+				}
+				first, last := incident.Events[0], incident.Events[len(incident.Events)-1]
+				if !incident.Start.Equal(first.Time) || !incident.End.Equal(last.Time) {
+					t.Errorf("incident runs %s to %s, its events %s to %s", incident.Start, incident.End, first.Time, last.Time)
+				}
+			}
+			if !reflect.DeepEqual(groups, test.groups) {
+				t.Errorf("grouped %v, expected %v", groups, test.groups)
+			}
+			if !reflect.DeepEqual(chosen, test.chosen) {
+				t.Errorf("chose %v, expected %v", chosen, test.chosen)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Copy buffer of live streams, a few MJPEG frames of a typical camera
+const liveBuffer = 64 << 10
+
+// Viewers of the cameras' live streams, limited per camera
+type liveViewers struct {
+	mu      sync.Mutex
+	viewers map[int64]int
+	client  *http.Client
+}
+
+func newLiveViewers() *liveViewers {
+	// No overall timeout, streams go on until the viewer leaves
+	transport := &http.Transport{
+		ResponseHeaderTimeout: 10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       time.Minute,
+	}
+	return &liveViewers{viewers: make(map[int64]int), client: &http.Client{Transport: transport}}
+}
+
+// Takes a viewer slot of a camera, false when it already has limit viewers.
+func (l *liveViewers) join(id int64, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.viewers[id] >= limit {
+		return false
+	}
+	l.viewers[id]++
+	return true
+}
+
+// Gives a viewer slot back.
+func (l *liveViewers) leave(id int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.viewers[id]--; l.viewers[id] <= 0 {
+		delete(l.viewers, id)
+	}
+}
+
+// Sets the URL of a camera's MJPEG stream, adding the camera if it's new. An
+// empty URL removes it.
+func (app *App) SetCameraStream(name, url string) error {
+	id, err := app.CameraID(name)
+	if err != nil {
+		return err
+	}
+	var stream interface{}
+	if url != "" {
+		stream = url
+	}
+	_, err = app.DB.Exec(`UPDATE cameras SET stream_url = ? WHERE id = ?`, stream, id)
+	return err
+}
+
+// Proxies a camera's MJPEG stream, so its address and credentials stay on the
+// server. Each camera has at most -live-viewers at a time, to spare it.
+func (app *App) LiveHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such camera.")
+		return
+	}
+	var stream sql.NullString
+	err = app.DB.QueryRow(`SELECT stream_url FROM cameras WHERE id = ?`, id).Scan(&stream)
+	if err == sql.ErrNoRows || (err == nil && !stream.Valid) {
+		app.RenderError(w, r, http.StatusNotFound, "This camera has no live view.")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if !app.Live.join(id, app.Config.liveViewers) {
+		w.Header().Set("Retry-After", "30")
+		app.RenderError(w, r, http.StatusServiceUnavailable, "Too many people are watching this camera, try again later.")
+		return
+	}
+	defer app.Live.leave(id)
+
+	// The stream ends with the request, once the viewer goes away
+	logger := app.Log(r)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, stream.String, nil)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := app.Live.client.Do(req)
+	if err != nil {
+		logger.Printf("Error opening the live stream of camera %d\n", id)
+		logger.Println(err.Error())
+		app.RenderError(w, r, http.StatusBadGateway, "The camera can't be reached.")
+		return
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mediaType != "multipart/x-mixed-replace" {
+		logger.Printf("Camera %d answered its live stream with %s (%s)\n", id, resp.Status, resp.Header.Get("Content-Type"))
+		app.RenderError(w, r, http.StatusBadGateway, "The camera didn't send an MJPEG stream.")
+		return
+	}
+
+	// The boundary comes along in the content type
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	// Every chunk is flushed right away, frames would sit in buffers otherwise
+	streamResponse(w)
+	controller := http.NewResponseController(w)
+	buf := make([]byte, liveBuffer)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if werr := controller.Flush(); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF || r.Context().Err() != nil {
+			return
+		} else if err != nil {
+			logger.Printf("Error reading the live stream of camera %d\n", id)
+			logger.Println(err.Error())
+			return
+		}
+	}
+}
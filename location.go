@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Longest location text a camera or event may have
+const locationMax = 200
+
+// Where a camera is, or an event was captured. Every part is optional, but the
+// coordinates only come together.
+type location struct {
+	Text      string
+	Latitude  *float64
+	Longitude *float64
+}
+
+// Whether nothing of the location is known.
+func (l location) empty() bool {
+	return l.Text == "" && l.Latitude == nil
+}
+
+// Checks the parts of a location, returning the field at fault and why.
+func (l location) check() (string, error) {
+	switch {
+	case len(l.Text) > locationMax:
+		return "location", fmt.Errorf("location may be at most %d bytes", locationMax)
+	case l.Latitude == nil && l.Longitude != nil:
+		return "latitude", errors.New("latitude is required with longitude")
+	case l.Latitude != nil && l.Longitude == nil:
+		return "longitude", errors.New("longitude is required with latitude")
+	case l.Latitude != nil && !(*l.Latitude >= -90 && *l.Latitude <= 90):
+		return "latitude", errors.New("latitude must be between -90 and 90")
+	case l.Longitude != nil && !(*l.Longitude >= -180 && *l.Longitude <= 180):
+		return "longitude", errors.New("longitude must be between -180 and 180")
+	}
+	return "", nil
+}
+
+// Parses a coordinate, nil when s is empty.
+func parseCoordinate(s string) (*float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Formats a coordinate, empty when it's unknown.
+func formatCoordinate(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
+
+// Reads the location of a multipart upload from its location, latitude and
+// longitude fields. Writes the error response and returns false when it's
+// invalid.
+func formLocation(w http.ResponseWriter, r *http.Request, upload *eventUpload) bool {
+	upload.Location.Text = strings.TrimSpace(r.FormValue("location"))
+	for _, field := range []string{"latitude", "longitude"} {
+		coordinate, err := parseCoordinate(r.FormValue(field))
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, field, field+" must be a number")
+			return false
+		}
+		if field == "latitude" {
+			upload.Location.Latitude = coordinate
+		} else {
+			upload.Location.Longitude = coordinate
+		}
+	}
+	return checkLocation(w, *upload)
+}
+
+// Checks the location an upload gave. Writes the error response and returns
+// false when it's invalid.
+func checkLocation(w http.ResponseWriter, upload eventUpload) bool {
+	if field, err := upload.Location.check(); err != nil {
+		writeFieldError(w, ErrInvalidField, field, err.Error())
+		return false
+	}
+	return true
+}
+
+// The location as text followed by its coordinates, empty when unknown.
+func (l location) String() string {
+	if l.Latitude == nil || l.Longitude == nil {
+		return l.Text
+	}
+	coordinates := fmt.Sprintf("%.5f, %.5f", *l.Latitude, *l.Longitude)
+	if l.Text == "" {
+		return coordinates
+	}
+	return l.Text + " (" + coordinates + ")"
+}
+
+// Where the event was captured, empty when unknown.
+func (e *Event) Where() string {
+	return location{Text: e.Location, Latitude: e.Latitude, Longitude: e.Longitude}.String()
+}
+
+// Link to the event's coordinates on OpenStreetMap, empty without them.
+func (e *Event) MapURL() string {
+	if e.Latitude == nil || e.Longitude == nil {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f#map=17/%.5f/%.5f", *e.Latitude, *e.Longitude, *e.Latitude, *e.Longitude)
+}
+
+// Retrieves the location of a camera, events it uploads inherit it.
+func (app *App) CameraLocation(id int64) (location, error) {
+	return scanLocation(app.DB.QueryRow(`SELECT location, latitude, longitude FROM cameras WHERE id = ?`, id))
+}
+
+// Scans the location, latitude and longitude columns of a row.
+func scanLocation(row interface{ Scan(...interface{}) error }) (location, error) {
+	var l location
+	var text sql.NullString
+	var latitude, longitude sql.NullFloat64
+	if err := row.Scan(&text, &latitude, &longitude); err != nil {
+		return l, err
+	}
+	l.Text = text.String
+	if latitude.Valid && longitude.Valid {
+		l.Latitude, l.Longitude = &latitude.Float64, &longitude.Float64
+	}
+	return l, nil
+}
+
+// Sets the location of a camera, adding the camera if it's new. Events it
+// already uploaded keep the location they were captured at.
+func (app *App) SetCameraLocation(name string, l location) error {
+	id, err := app.CameraID(name)
+	if err != nil {
+		return err
+	}
+	var text interface{}
+	if l.Text != "" {
+		text = l.Text
+	}
+	_, err = app.DB.Exec(`UPDATE cameras SET location = ?, latitude = ?, longitude = ? WHERE id = ?`, text, l.Latitude, l.Longitude, id)
+	return err
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp rotated logs are named with, path.2006-01-02T15-04-05.000(.gz)
+const logStamp = "2006-01-02T15-04-05.000"
+
+// Application log file, rotated by size and age. Rotated files are compressed
+// in the background. Safe for concurrent use.
+type LogFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64         // Rotate once the file would grow beyond this, 0 disables
+	maxAge   time.Duration // Rotate once the file has been open this long, 0 disables
+	backups  int           // Number of rotated files kept
+	file     *os.File
+	size     int64
+	opened   time.Time
+	broken   bool          // Writes failed and are going to stderr
+	compress chan struct{} // Wakes the compressor after a rotation
+}
+
+// Opens (or creates) the log file at the given path and starts compressing
+// rotated files. Files left uncompressed by a previous run, say one stopped
+// mid-compression, are compressed too.
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration, backups int) (*LogFile, error) {
+	l := &LogFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		backups:  backups,
+		compress: make(chan struct{}, 1),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	go l.compressor()
+	l.compress <- struct{}{}
+
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// Whether writing n more bytes is due a rotation first.
+func (l *LogFile) due(n int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.maxSize > 0 && l.size+int64(n) > l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(l.opened) >= l.maxAge
+}
+
+// Moves the file aside under the current time and starts a new one, leaving
+// the old one to the compressor.
+func (l *LogFile) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	rotated := l.path + "." + time.Now().UTC().Format(logStamp)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	select {
+	case l.compress <- struct{}{}:
+	default:
+		// Already awake, it picks this one up too
+	}
+
+	return l.open()
+}
+
+// Writes to the log, falling back to stderr (with a single warning) if the file
+// can't be written.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.broken {
+		var err error
+		if l.due(len(p)) {
+			err = l.rotate()
+		}
+		if err == nil {
+			var n int
+			n, err = l.file.Write(p)
+			l.size += int64(n)
+		}
+		if err == nil {
+			return len(p), nil
+		}
+
+		// Logging the warning would come straight back here
+		l.broken = true
+		fmt.Fprintf(os.Stderr, "Warning: cannot write log file %s, logging to stderr until rotated\n%s\n", l.path, err)
+	}
+
+	return os.Stderr.Write(p)
+}
+
+// Rotates the log now unless it's empty, for SIGUSR1. Also how a log that
+// couldn't be written goes back to the file.
+func (l *LogFile) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.file == nil {
+		err = l.open()
+	} else if l.size > 0 {
+		err = l.rotate()
+	}
+	if err != nil {
+		return err
+	}
+
+	l.broken = false
+	return nil
+}
+
+// Compresses rotated files and drops the oldest beyond the number kept, every
+// time it's woken.
+func (l *LogFile) compressor() {
+	for range l.compress {
+		rotated, err := l.rotated()
+		if err != nil {
+			log.Println("Error listing rotated logs")
+			log.Println(err.Error())
+			continue
+		}
+
+		// Newest first
+		for i, path := range rotated {
+			if i >= l.backups {
+				os.Remove(path)
+				continue
+			}
+			if strings.HasSuffix(path, ".gz") {
+				continue
+			}
+			if err := gzipFile(path); err != nil {
+				log.Printf("Error compressing rotated log %s\n", path)
+				log.Println(err.Error())
+			}
+		}
+	}
+}
+
+// Lists the rotated files of the log, newest first.
+func (l *LogFile) rotated() ([]string, error) {
+	dir, base := filepath.Split(l.path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := make([]string, 0)
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(logStamp, strings.TrimSuffix(stamp, ".gz")); err != nil {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(dir, entry.Name()))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	return rotated, nil
+}
+
+// Replaces a file with a gzipped copy, path.gz.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Logger writing to the standard logger, optionally tagging every line with the
+// request it was emitted for
+type Logger struct {
+	requestID string
+}
+
+// Returns a logger tagging its lines with the given request ID.
+func (l *Logger) With(requestID string) *Logger {
+	return &Logger{requestID: requestID}
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.output(fmt.Sprintln(v...))
+}
+
+func (l *Logger) output(s string) {
+	if l.requestID != "" {
+		s = "[" + l.requestID + "] " + s
+	}
+	log.Output(3, s)
+}
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// Returns the ID of the request the context belongs to, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Returns the application logger tagged with the request's ID.
+func (app *App) Log(r *http.Request) *Logger {
+	return app.Logger.With(RequestID(r.Context()))
+}
+
+// Whether an incoming X-Request-Id is safe to reuse in our logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Middleware giving every request an ID, either the one passed in X-Request-Id
+// or a random one. The ID is stored in the request context and echoed back in
+// the X-Request-Id response header.
+func (app *App) RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Renders the error page with the given status and message. The request ID is
+// shown so it can be matched up with the logs.
+func (app *App) RenderError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	context := struct {
+		Status    int
+		Title     string
+		Message   string
+		RequestID string
+	}{
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   message,
+		RequestID: RequestID(r.Context()),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	t := app.Template(r, "error")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
@@ -1,28 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/julienschmidt/httprouter"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/sfreiberg/gotwilio"
 )
 
 // Data directories struct
 type dirs struct {
-	data string
-	tmpl string
+	data    string
+	staging string
+	thumbs  string
+	tmpl    string
 }
 
 // Twilio information struct
@@ -33,35 +44,367 @@ type twilio struct {
 	to    string
 }
 
+// Transcoding information struct
+type transcode struct {
+	ffmpegPath string
+	videoCodec string
+	crf        int
+	bitrate    string
+	twoPass    bool
+	overlay    bool
+	fontFile   string
+	workers    int
+	alertAge   time.Duration // Alert when a video waits longer than this to be converted, disabled if 0
+}
+
+// Access log information struct
+type accessLog struct {
+	accessLogPath    string
+	accessLogMaxSize int64
+	accessLogKeep    int
+}
+
+// Application log information struct
+type logConfig struct {
+	logPath    string
+	logMaxSize int64
+	logMaxAge  time.Duration
+	logBackups int
+}
+
+// OpenID Connect information struct
+type oidcConfig struct {
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+	oidcRoleClaim    string
+	oidcAdminValue   string
+}
+
+// gRPC listener information struct
+type grpcConfig struct {
+	grpcAddr   string
+	grpcCert   string
+	grpcKey    string
+	grpcTokens string
+}
+
+// Event hook information struct
+type hookConfig struct {
+	hookPath    string
+	hooksDir    string // Executables named after the stage they run at
+	hookTimeout time.Duration
+	hookWorkers int
+}
+
+// Webhook information struct
+type webhookConfig struct {
+	webhookURL    string
+	webhookSecret string
+}
+
+// Amazon SNS information struct
+type snsConfig struct {
+	snsTopic     string
+	snsRegion    string
+	snsKeyID     string
+	snsSecretKey string
+}
+
+// Object detection information struct
+type detectConfig struct {
+	detectURL     string
+	detectMin     float64
+	detectTimeout time.Duration
+	notifyLabels  []string      // Alert only about events with one of these
+	labelWait     time.Duration // Longest alerts wait for detection
+}
+
+// Discord notifications information struct
+type discordConfig struct {
+	discordURL string
+}
+
+// Matrix notifications information struct
+type matrixConfig struct {
+	matrixHomeserver string
+	matrixToken      string
+	matrixRoom       string // Room ID such as !abc:example.org
+}
+
+// ntfy notifications information struct
+type ntfyConfig struct {
+	ntfyServer     string
+	ntfyTopic      string
+	ntfyToken      string // Access token, or
+	ntfyUser       string // basic auth for self-hosted servers
+	ntfyPassword   string
+	ntfyPriority   int
+	ntfyThresholds []ntfyThreshold // Priorities by motion score, ascending
+}
+
+// Weekly report information struct
+type reportConfig struct {
+	reportSchedule *reportSchedule // Nil unless -report-schedule is set
+	reportTo       []string        // Recipients, those of the email notifier if empty
+	reportTemplate string
+}
+
+// Escalation of unacknowledged alerts information struct
+type escalationConfig struct {
+	escalation []escalationStage // Contacts alerted in turn until someone acknowledges, in order
+}
+
+// Fetching event media from cameras information struct
+type fetchConfig struct {
+	fetchAllow     fetchAllowlist // Hosts and networks media may be fetched from, disabled when empty
+	fetchTimeout   time.Duration
+	fetchMaxSize   int64
+	fetchRedirects int
+}
+
+// Google Drive exports information struct
+type gdriveConfig struct {
+	gdriveClientID string
+	gdriveSecret   string
+	gdriveRefresh  string // OAuth refresh token of the account exported to
+	gdriveFolder   string // ID of the folder files go in, the root if empty
+}
+
+// Dropbox exports information struct
+type dropboxConfig struct {
+	dropboxToken string
+	dropboxPath  string // Folder template, with {camera}, {date} and {id}
+}
+
 // Configuration information struct
 type Config struct {
-	db   string
-	addr string
+	db             string
+	dbKey          string // SQLCipher key of the database, needs the sqlcipher build tag
+	mediaKeyFile   string // File holding the key media is encrypted with at rest
+	addr           string
+	socketMode     string
+	debugAddr      string
+	adminToken     string
+	apiKey         string
+	uploadSecret   string
+	uploadSkew     time.Duration
+	sessionTTL     time.Duration
+	readOnly       bool
+	baseURL        string
+	pathPrefix     string
+	stopTimeout    time.Duration
+	busyRetries    int
+	csp            string
+	secret         string
+	shareTTL       time.Duration
+	stripExif      bool
+	timelapse      bool
+	timelapseFPS   int
+	retain         time.Duration
+	retainCount    int
+	retainVideo    time.Duration
+	retainImage    time.Duration
+	trashRetain    time.Duration
+	storageQuota   int64
+	diskAlert      string
+	twilioCheck    bool
+	notifyDryRun   bool
+	smsBudget      int
+	icsWindow      time.Duration
+	incidentWindow time.Duration
+	uploadTimeout  time.Duration
+	language       string // Of notifications, and pages unless the browser asks for another
+
+	// Service asked whether to keep each upload, and what to do when it can't be
+	preAcceptURL     string
+	preAcceptTimeout time.Duration
+	preAcceptOnError string
+
+	syslogAddr string // Where security events are forwarded, disabled if empty
+
+	motionScore    bool
+	stripAudio     bool
+	minScore       float64
+	thumbSize      int64
+	thumbFrame     string
+	offlineAfter   time.Duration
+	liveViewers    int
+	mediaRate      int64 // Bytes per second of each media response, unlimited if 0
+	mediaRateTotal int64 // Bytes per second of all media responses together, unlimited if 0
 	twilio
 	dirs
+	transcode
+	accessLog
+	logConfig
+	oidcConfig
+	grpcConfig
+	hookConfig
+	webhookConfig
+	snsConfig
+	detectConfig
+	escalationConfig
+	discordConfig
+	matrixConfig
+	ntfyConfig
+	reportConfig
+	fetchConfig
+	gdriveConfig
+	dropboxConfig
+	notifyURLs []string // Notification channels as Apprise style URLs
 }
 
 // Application context struct
 type App struct {
-	DB        *sql.DB
-	Config    *Config
-	Router    *httprouter.Router
-	Templates map[string]*template.Template
+	DB         *sql.DB
+	Config     *Config
+	Router     *httprouter.Router
+	Templates  map[string]map[string]*template.Template // By language, then name
+	Catalogs   *catalogs
+	FFmpeg     string // Resolved ffmpeg path, empty when unavailable
+	FFprobe    string // Resolved ffprobe path, empty when unavailable
+	Codec      videoCodec
+	Secret     []byte // Key for signing share links
+	AccessLog  *AccessLog
+	Syslog     *syslogForwarder // Nil unless -syslog-addr is set
+	Logger     *Logger
+	Transcodes *transcodePool
+	ReadOnly   atomic.Bool // Maintenance mode, changes are refused
+	OIDC       oidcLogin
+	APISpec    *apiSpec
+	FTS        bool // Whether sqlite has FTS5, search falls back to LIKE without it
+	Twilio     twilioHealth
+	Hooks      chan struct{}      // Slots for running hooks, one per concurrent run
+	Deliveries chan struct{}      // Wakes up the delivery sender
+	Archives   chan struct{}      // Wakes up the archive builder
+	Notifiers  []Notifier         // Alert channels going through the delivery queue
+	Report     *template.Template // Weekly report, nil unless -report-schedule is set
+	Thumbs     *thumbCache
+	MediaKey   *mediaCipher // Nil unless -media-key-file is set
+	WebP       bool         // Whether ffmpeg can encode WebP thumbnails
+	Fetcher    *http.Client // Nil unless -fetch-allow is set
+	Live       *liveViewers
+	MediaRate  *byteBucket // Shared by media responses, nil without -media-rate-limit-total
+	Variants   *variantSet
+	Cache      *queryCache // Index listings, stats and heatmaps, cleared when events change
+	Exporters  []Exporter  // Export targets, see buildExporters
+	GraphQL    *graphql.Schema
 }
 
+// Transcode states of an event
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+)
+
 // Event information struct
 type Event struct {
-	Id    int64
-	Name  string
-	Time  time.Time
-	Video string
-	Image string
+	Id           int64           `json:"id"`
+	Name         string          `json:"name"`
+	Time         time.Time       `json:"time"`
+	Video        string          `json:"video"`
+	Image        string          `json:"image"`
+	Status       string          `json:"status"`
+	LastError    string          `json:"last_error"`
+	Suppressed   bool            `json:"notify_suppressed"`
+	Protected    bool            `json:"protected"`
+	Notes        string          `json:"notes"`
+	CameraId     int64           `json:"camera_id,omitempty"`
+	ExpiresAt    *time.Time      `json:"expires_at"`            // Overrides the retention limits when set
+	Score        *float64        `json:"score"`                 // Motion score of the video, nil until scored
+	Audio        *bool           `json:"audio"`                 // Whether the video has sound, nil until probed
+	Size         *int64          `json:"size_bytes"`            // Total size of its files, nil until backfilled
+	Metadata     json.RawMessage `json:"metadata,omitempty"`    // JSON object sent along with a JSON upload
+	Public       bool            `json:"public"`                // Whether it can be seen without signing in, at its slug
+	VideoExpired bool            `json:"video_expired"`         // Whether the video was deleted under -retain-video
+	ExternalId   string          `json:"external_id,omitempty"` // Recording ID the camera gave it, unique per camera
+	AckedAt      *time.Time      `json:"acked_at"`              // When its alert was acknowledged, nil until then
+	AckedBy      string          `json:"acked_by,omitempty"`    // Who acknowledged its alert
+	Location     string          `json:"location,omitempty"`    // Where it was captured, its camera's location unless the upload gave one
+	Latitude     *float64        `json:"latitude"`              // Coordinates it was captured at, nil when unknown
+	Longitude    *float64        `json:"longitude"`
+	EvidenceAt   *time.Time      `json:"evidence_at"` // When it was kept as evidence, nil unless it is
+	PublicSlug   string          `json:"-"`
+}
+
+// Says whether the event's video has sound, for display. Empty while unknown.
+func (e *Event) Sound() string {
+	switch {
+	case e.Audio == nil:
+		return ""
+	case *e.Audio:
+		return "with sound"
+	default:
+		return "no sound"
+	}
+}
+
+// Columns selected for an Event, in the order scanEvent expects them
+const eventColumns = `id, name, time, video, image, status, last_error, notify_suppressed, protected, notes, camera_id, expires_at, score, audio, size_bytes, metadata, public, public_slug, video_expired, external_id, acked_at, acked_by, location, latitude, longitude, evidence_at`
+
+// Schema changes applied on top of the original events table, in order. The
+// database's user_version records how many have already been applied.
+var migrations = []string{
+	`ALTER TABLE events ADD COLUMN status TEXT NOT NULL DEFAULT 'done'`,
+	`ALTER TABLE events ADD COLUMN last_error TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE events ADD COLUMN notify_suppressed BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN subject TEXT`,
+	`CREATE UNIQUE INDEX users_subject ON users(subject)`,
+	`ALTER TABLE events ADD COLUMN protected BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE events ADD COLUMN notes TEXT NOT NULL DEFAULT ''`,
+	`INSERT INTO media(event_id, kind, path, created) SELECT id, 'video', video, time FROM events`,
+	`INSERT INTO media(event_id, kind, path, created) SELECT id, 'image', image, time FROM events`,
+	`ALTER TABLE events ADD COLUMN camera_id INTEGER NOT NULL DEFAULT 0`,
+	`CREATE INDEX events_camera ON events(camera_id, id)`,
+	`ALTER TABLE events ADD COLUMN expires_at TIMESTAMP`,
+	`ALTER TABLE deliveries ADD COLUMN channel TEXT NOT NULL DEFAULT 'webhook'`,
+	`ALTER TABLE events ADD COLUMN score REAL`,
+	`ALTER TABLE events ADD COLUMN audio BOOLEAN`,
+	`ALTER TABLE events ADD COLUMN size_bytes INTEGER`,
+	`ALTER TABLE events ADD COLUMN metadata TEXT`,
+	`ALTER TABLE cameras ADD COLUMN poll_url TEXT`,
+	`ALTER TABLE cameras ADD COLUMN poll_interval INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE cameras ADD COLUMN poll_threshold REAL NOT NULL DEFAULT 0`,
+	`ALTER TABLE cameras ADD COLUMN last_error TEXT`,
+	`ALTER TABLE cameras ADD COLUMN last_seen TIMESTAMP`,
+	`ALTER TABLE cameras ADD COLUMN stream_url TEXT`,
+	`ALTER TABLE events ADD COLUMN public BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE events ADD COLUMN public_slug TEXT`,
+	`CREATE UNIQUE INDEX events_public_slug ON events(public_slug)`,
+	`ALTER TABLE events ADD COLUMN video_expired BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE events ADD COLUMN external_id TEXT`,
+	`CREATE UNIQUE INDEX events_camera_external_id ON events(camera_id, external_id)`,
+	`ALTER TABLE events ADD COLUMN alerted_at TIMESTAMP`,
+	`ALTER TABLE events ADD COLUMN acked_at TIMESTAMP`,
+	`ALTER TABLE events ADD COLUMN acked_by TEXT`,
+	`ALTER TABLE events ADD COLUMN escalation_stage INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE cameras ADD COLUMN location TEXT`,
+	`ALTER TABLE cameras ADD COLUMN latitude REAL`,
+	`ALTER TABLE cameras ADD COLUMN longitude REAL`,
+	`ALTER TABLE events ADD COLUMN location TEXT`,
+	`ALTER TABLE events ADD COLUMN latitude REAL`,
+	`ALTER TABLE events ADD COLUMN longitude REAL`,
+	`ALTER TABLE exports ADD COLUMN remote_path TEXT`,
+	`ALTER TABLE exports ADD COLUMN status TEXT NOT NULL DEFAULT 'done'`,
+	`ALTER TABLE exports ADD COLUMN attempts INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE exports ADD COLUMN error TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE exports ADD COLUMN url TEXT`,
+	`ALTER TABLE exports ADD COLUMN updated TIMESTAMP`,
+	`UPDATE exports SET url = 'https://drive.google.com/file/d/' || file_id || '/view', updated = created WHERE target = 'gdrive'`,
+	`UPDATE exports SET url = 'https://www.dropbox.com/preview' || remote_path, updated = created WHERE target = 'dropbox'`,
+	`ALTER TABLE cameras ADD COLUMN notify_channels TEXT`,
+	`ALTER TABLE cameras ADD COLUMN name_template TEXT`,
+	`ALTER TABLE cameras ADD COLUMN name_seq INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE events ADD COLUMN evidence_at TIMESTAMP`,
 }
 
 // Initialize our SQLite database.
-func InitDB(path string) *sql.DB {
-	// Attempt to open the database
-	db, err := sql.Open("sqlite3", path)
+func InitDB(path, key string) *sql.DB {
+	// Attempt to open the database, decrypting it with key if given
+	db, err := openDB(path, key)
 	if err != nil {
 		panic(err)
 	}
@@ -71,8 +414,19 @@ func InitDB(path string) *sql.DB {
 		panic("DB nil")
 	}
 
-	// Can we reach the database?
+	// Can we reach and read the database? Connecting doesn't always read it, a
+	// wrong key may only show once something is.
 	err = db.Ping()
+	if err == nil {
+		var tables int
+		err = db.QueryRow(`SELECT count(*) FROM sqlite_master`).Scan(&tables)
+	}
+	if err != nil && strings.Contains(err.Error(), "not a database") {
+		if key != "" {
+			log.Fatalf("Can't read %s with -db-key, the key is wrong or the database isn't encrypted: %s", path, err)
+		}
+		log.Fatalf("Can't read %s, it may be encrypted and need -db-key: %s", path, err)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -99,208 +453,1099 @@ func CreateTable(db *sql.DB) {
 	}
 }
 
+// Apply any migrations the database hasn't seen yet.
+func MigrateTable(db *sql.DB) {
+	var version int
+	err := db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := db.Exec(migrations[i]); err != nil {
+			panic(err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			panic(err)
+		}
+		log.Println("Applied migration", i+1)
+	}
+}
+
 // Creates a new Application context. The context contains configuration information,
 // templating info, our router, and database access. Creation of the data directory is
 // also performed here.
 func New(config *Config) *App {
 	// Create database, tables, templates map and our router
-	db := InitDB(config.db)
+	db := InitDB(config.db, config.dbKey)
 	CreateTable(db)
+	CreateTimelapseTable(db)
+	CreateUserTables(db)
+	CreateAuditTable(db)
+	CreateMediaTable(db)
+	CreateCameraTable(db)
+	CreateDeliveryTables(db)
+	CreateLabelTable(db)
+	CreateUploadTokenTable(db)
+	CreateReportTable(db)
+	CreateExportTable(db)
+	CreateTranscodeTable(db)
+	CreateArchiveTable(db)
+	CreateTrashTable(db)
+	MigrateTable(db)
 	router := httprouter.New()
 
-	// Build our [sparse] map of templates
-	templates := map[string]*template.Template{}
-	templates["index"] = template.Must(template.ParseFiles(filepath.Join(config.dirs.tmpl, "index.html")))
+	// Create App struct
+	app := &App{
+		DB:         db,
+		Config:     config,
+		Router:     router,
+		Transcodes: newTranscodePool(1024),
+		Deliveries: make(chan struct{}, 1),
+		Archives:   make(chan struct{}, 1),
+		Logger:     &Logger{},
+		Live:       newLiveViewers(),
+		Variants:   newVariantSet(),
+		Cache:      newQueryCache(),
+	}
+
+	// Full text search needs sqlite built with FTS5
+	app.FTS = CreateSearchIndex(db)
+	if !app.FTS {
+		log.Println("WARNING: sqlite lacks FTS5, search falls back to slower substring matching")
+	}
+
+	// Load the API description, it is embedded so this only fails on a broken build
+	spec, err := loadAPISpec()
+	if err != nil {
+		panic(err)
+	}
+	app.APISpec = spec
+	app.GraphQL = newGraphQLSchema(app)
+
+	// Load the string catalogs, pages and notifications are written with them
+	app.Catalogs, err = LoadCatalogs(filepath.Join(config.dirs.tmpl, "lang"))
+	if err != nil {
+		log.Fatalf("Error loading the string catalogs: %s", err)
+	}
+	language := app.Catalogs.match(config.language)
+	if language == "" {
+		log.Fatalf("-language %s has no catalog, there are %s", config.language, strings.Join(app.Catalogs.Languages(), ", "))
+	}
+	config.language = language
+
+	// Build our [sparse] map of templates, once for every language
+	app.Templates = map[string]map[string]*template.Template{}
+	for _, language := range app.Catalogs.Languages() {
+		language := language
+		funcs := template.FuncMap{
+			"url": app.URL,
+			"version": func() string {
+				return version
+			},
+			"media": func(path string) string {
+				return app.URL(app.MediaURL(path))
+			},
+			"lang": func() string {
+				return language
+			},
+			"t": func(key string, args ...interface{}) string {
+				return app.Catalogs.T(language, key, args...)
+			},
+			"date": func(t time.Time) string {
+				return app.Catalogs.Date(language, t)
+			},
+		}
+		templates := map[string]*template.Template{}
+		for _, name := range []string{"index", "detail", "shared", "error", "login", "prune", "ack", "incidents"} {
+			templates[name] = template.Must(template.New(name + ".html").Funcs(funcs).ParseFiles(filepath.Join(config.dirs.tmpl, name+".html")))
+		}
+		app.Templates[language] = templates
+	}
 
 	// Create path for storing videos and images
 	if _, err := os.Stat(config.dirs.data); os.IsNotExist(err) {
 		os.Mkdir(config.dirs.data, 0775)
 	}
 
-	// Create App struct
-	app := &App{
-		DB:        db,
-		Config:    config,
-		Router:    router,
-		Templates: templates,
+	// Create path for uploads in progress, clearing out any abandoned ones
+	if _, err := os.Stat(config.dirs.staging); os.IsNotExist(err) {
+		os.Mkdir(config.dirs.staging, 0775)
+	}
+	SweepStaging(config.dirs.staging, time.Hour)
+
+	// Open the thumbnail cache, thumbnails are made as they're requested
+	thumbs, err := newThumbCache(config.dirs.thumbs, config.thumbSize)
+	if err != nil {
+		panic(err)
+	}
+	app.Thumbs = thumbs
+
+	// Start in maintenance mode if asked to
+	app.ReadOnly.Store(config.readOnly)
+	if config.readOnly {
+		log.Println("Starting in maintenance mode, uploads and changes are refused")
+	}
+
+	// Find ffmpeg and ffprobe, everything using them is skipped when missing
+	app.FFmpeg, app.FFprobe = FindFFmpeg(config.ffmpegPath)
+	if app.FFmpeg == "" {
+		log.Println("WARNING: ffmpeg not found, videos will NOT be converted and timelapses are disabled")
+	}
+	if app.FFprobe == "" {
+		log.Println("WARNING: ffprobe not found, videos will not be probed")
+	}
+
+	// Single sign on needs all of its settings
+	if config.oidcIssuer != "" && (config.oidcClientID == "" || config.oidcClientSecret == "" || config.oidcRedirectURL == "") {
+		log.Fatal("-oidc-issuer requires -oidc-client-id, -oidc-client-secret and -oidc-redirect-url")
+	}
+
+	// Links in notifications need an absolute base URL
+	if config.baseURL != "" {
+		u, err := url.Parse(config.baseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -base-url %q, expected something like https://example.com/seccam", config.baseURL)
+		}
+	}
+
+	// Routes are served under the path prefix, which the base URL should include
+	config.pathPrefix, err = normalizePathPrefix(config.pathPrefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.pathPrefix != "" && config.baseURL != "" && !strings.HasSuffix(strings.TrimSuffix(config.baseURL, "/"), config.pathPrefix) {
+		log.Printf("WARNING: -base-url %s doesn't end in -path-prefix %s, links in notifications may not work\n", config.baseURL, config.pathPrefix)
+	}
+
+	// Open the access log, if we can't there's no point in starting
+	if config.accessLogPath != "" {
+		accessLog, err := OpenAccessLog(config.accessLogPath, config.accessLogMaxSize, config.accessLogKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.AccessLog = accessLog
+	}
+
+	// Start forwarding security events, a bad address is fatal but an unreachable
+	// server isn't
+	if config.syslogAddr != "" {
+		forwarder, err := OpenSyslog(config.syslogAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Syslog = forwarder
+	}
+
+	// Without a configured secret share links only last until a restart
+	app.Secret = []byte(config.secret)
+	if config.secret == "" {
+		app.Secret = make([]byte, 32)
+		if _, err := rand.Read(app.Secret); err != nil {
+			panic(err)
+		}
+		log.Println("No -secret given, share links will stop working when restarted")
+	}
+
+	// Refuse to start with a codec we can't encode
+	codec, err := LookupCodec(config.videoCodec, config.crf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.bitrate != "" {
+		if config.crf >= 0 {
+			log.Fatal("-video-bitrate and -crf can't be combined")
+		}
+		if codec, err = codec.WithBitrate(config.bitrate, config.twoPass); err != nil {
+			log.Fatal(err)
+		}
+	} else if config.twoPass {
+		log.Fatal("-two-pass requires -video-bitrate")
+	}
+	if app.FFmpeg != "" {
+		if err := CheckEncoder(app.FFmpeg, codec.encoder); err != nil {
+			log.Fatalf("Cannot use -video-codec %s: %s", codec.name, err)
+		}
+	}
+	app.Codec = codec
+
+	if config.detectMin < 0 || config.detectMin > 1 {
+		log.Fatalf("-detect-min-confidence %g out of range, expected 0-1", config.detectMin)
+	}
+
+	if len(config.notifyLabels) > 0 && config.detectURL == "" {
+		log.Println("WARNING: -notify-labels has no effect without -detect-url, alerting about every event")
+	}
+	if config.preAcceptOnError != PreAcceptOnErrorAccept && config.preAcceptOnError != PreAcceptOnErrorReject {
+		log.Fatalf("-pre-accept-on-error must be %s or %s", PreAcceptOnErrorAccept, PreAcceptOnErrorReject)
+	}
+	if config.preAcceptTimeout <= 0 {
+		log.Fatal("-pre-accept-timeout has to be positive")
+	}
+
+	if config.busyRetries < 0 {
+		log.Fatalf("-db-busy-retries %d can't be negative", config.busyRetries)
+	}
+	if config.liveViewers < 1 {
+		log.Fatal("-live-viewers must be at least 1")
+	}
+	if config.mediaRate < 0 || config.mediaRateTotal < 0 {
+		log.Fatal("-media-rate-limit and -media-rate-limit-total can't be negative")
+	}
+	if config.mediaRateTotal > 0 {
+		app.MediaRate = newByteBucket(config.mediaRateTotal)
+	}
+
+	// Videos only go on their own when they go before the rest of the event
+	if config.retainVideo < 0 || config.retainImage < 0 {
+		log.Fatal("-retain-video and -retain-image can't be negative")
+	}
+	if config.trashRetain < 0 {
+		log.Fatal("-trash-retain can't be negative")
+	}
+	if config.uploadTimeout < 0 {
+		log.Fatal("-upload-timeout can't be negative")
+	}
+	if config.incidentWindow <= 0 {
+		log.Fatal("-incident-window has to be positive")
+	}
+	if retain := app.eventRetain(); config.retainVideo > 0 && retain > 0 && config.retainVideo >= retain {
+		log.Printf("WARNING: -retain-video %s isn't shorter than the %s events are kept, it has no effect\n", config.retainVideo, retain)
+	}
+
+	// Scoring needs ffmpeg, holding notifications back for it needs scoring
+	if config.minScore < 0 || config.minScore > 1 {
+		log.Fatalf("-notify-min-score %g out of range, expected 0-1", config.minScore)
+	}
+	if config.minScore > 0 && !config.motionScore {
+		log.Fatal("-notify-min-score requires -motion-score")
+	}
+	if config.motionScore && app.FFmpeg == "" {
+		log.Println("WARNING: ffmpeg not found, events will not be given a motion score")
+	}
+
+	switch config.thumbFrame {
+	case ThumbFrameFirst, ThumbFrameMiddle, ThumbFrameScene:
+	default:
+		log.Fatalf("Unknown -thumb-frame %q, expected first, middle or scene", config.thumbFrame)
+	}
+
+	// WebP thumbnails are encoded by ffmpeg, JPEG is served without it
+	if app.FFmpeg != "" {
+		if err := CheckEncoder(app.FFmpeg, "libwebp"); err != nil {
+			log.Println("ffmpeg has no WebP encoder, thumbnails are only served as JPEG")
+		} else {
+			app.WebP = true
+		}
 	}
 
 	return app
 }
 
-// Retrieves a single event with the given Id.
-func (app *App) GetEvent(id int64) Event {
-	var err error
+// Registers our few routes on the router.
+func (app *App) Routes() {
+	app.Router.GET("/", app.IndexHandler)
+	app.Router.GET("/healthz", app.HealthHandler)
+	app.Router.GET("/incidents", app.IncidentsHandler)
+	app.Router.GET("/camera/:id", app.CameraHandler)
+	app.Router.GET("/camera/:id/live", app.LiveHandler)
+	app.Router.GET("/event/:id", app.EventHandler)
+	app.Router.GET("/event/:id/share", app.ShareHandler)
+	app.Router.GET("/event/:id/video", app.EventVideoHandler)
+	app.Router.GET("/thumb/:id", app.ThumbHandler)
+	app.Router.GET("/events.ics", app.CalendarHandler)
+	app.Router.GET("/shared/:token", app.SharedHandler)
+	app.Router.GET("/shared/:token/:media", app.SharedMediaHandler)
+	app.Router.GET("/p/:slug", app.PublicHandler)
+	app.Router.GET("/p/:slug/:media", app.PublicMediaHandler)
+	app.Router.POST("/event/new", app.Writable(limitUpload(app.RequireAPIKey(app.NewEventHandler))))
+	app.Router.GET("/login", app.LoginPageHandler)
+	app.Router.POST("/login", app.LoginHandler)
+	app.Router.POST("/logout", app.LogoutHandler)
+	app.Router.GET("/login/oidc", app.OIDCLoginHandler)
+	app.Router.GET("/login/oidc/callback", app.OIDCCallbackHandler)
+	app.APIRoute("GET", "/api/openapi.json", app.OpenAPIHandler)
+	app.APIRoute("GET", "/api/events", app.APIListEventsHandler)
+	app.APIRoute("POST", "/api/events", app.Writable(app.RequireAPIKey(app.APICreateEventHandler)))
+	app.APIRoute("POST", "/api/fetch", app.Writable(app.RequireAPIKey(app.APIFetchEventHandler)))
+	app.APIRoute("POST", "/api/upload-tokens", app.RequireAdmin(app.Writable(app.APICreateUploadTokenHandler)))
+	app.APIRoute("GET", "/api/stats", app.APIStatsHandler)
+	app.APIRoute("GET", "/api/stats/heatmap", app.APIHeatmapHandler)
+	app.APIRoute("GET", "/api/incidents", app.APIIncidentsHandler)
+	app.APIRoute("PUT", "/api/cameras/:id", app.RequireAdmin(app.Writable(app.APICameraHandler)))
+	app.APIRoute("POST", "/api/graphql", app.APIGraphQLHandler)
+	app.APIRoute("GET", "/api/version", app.APIVersionHandler)
+	app.APIRoute("GET", "/api/events/:id", app.APIEventHandler)
+	app.APIRouteShadowed("GET", "/api/events/by-external/:camera/:external_id", "/api/events/:id/:camera/:external_id", app.APIExternalEventHandler)
+	app.APIRoute("POST", "/api/events/:id/retranscode", app.Writable(app.APIRetranscodeHandler))
+	app.APIRoute("DELETE", "/api/events/:id", app.Writable(app.APIDeleteEventHandler))
+	app.APIRoute("PUT", "/api/events/:id/name", app.Writable(app.APIRenameEventHandler))
+	app.APIRoute("PUT", "/api/events/:id/protected", app.Writable(app.APIProtectEventHandler))
+	app.APIRoute("PUT", "/api/events/:id/evidence", app.RequireAdmin(app.Writable(app.APIEvidenceEventHandler)))
+	app.APIRoute("GET", "/api/evidence", app.APIEvidenceHandler)
+	app.APIRoute("POST", "/api/events/:id/publish", app.Writable(app.APIPublishHandler))
+	app.APIRoute("POST", "/api/events/:id/unpublish", app.Writable(app.APIUnpublishHandler))
+	app.APIRoute("POST", "/api/events/:id/ack", app.Writable(app.APIAckHandler))
+	app.APIRoute("PUT", "/api/events/:id/expiry", app.Writable(app.APIExpiryHandler))
+	app.APIRoute("PUT", "/api/events/:id/notes", app.Writable(app.APINotesHandler))
+	app.APIRouteShadowed("GET", "/api/events/:id/exports", "/api/events/:id/:camera", app.APIEventExportsHandler)
+	app.APIRoute("POST", "/api/events/:id/export", app.Writable(app.APIExportEventHandler))
+	app.APIRouteShadowed("POST", "/api/events/export", "/api/events/:id", app.Writable(app.APIExportEventsHandler))
+	app.APIRoute("POST", "/api/archives", app.Writable(app.APICreateArchiveHandler))
+	app.APIRoute("GET", "/api/archives/:id", app.APIArchiveHandler)
+	app.APIRoute("GET", "/api/archives/:id/download", app.APIDownloadArchiveHandler)
+	app.Router.POST("/admin/maintenance", app.RequireAdmin(app.MaintenanceHandler))
+	app.Router.GET("/admin/audit", app.RequireAdmin(app.AuditHandler))
+	app.Router.GET("/admin/prune", app.RequireAdmin(app.PrunePageHandler))
+	app.Router.POST("/admin/prune", app.RequireAdmin(app.Writable(app.PruneHandler)))
+	app.Router.POST("/admin/trash/empty", app.RequireAdmin(app.Writable(app.EmptyTrashHandler)))
+	app.Router.GET("/admin/check", app.RequireAdmin(app.CheckHandler))
+	app.Router.POST("/admin/check", app.RequireAdmin(app.Writable(app.CheckHandler)))
+	app.Router.POST("/admin/test-notification", app.RequireAdmin(app.TestNotificationHandler))
+	app.Router.GET("/admin/webhooks", app.RequireAdmin(app.WebhooksHandler))
+	app.Router.POST("/admin/webhooks/:id/redeliver", app.RequireAdmin(app.Writable(app.RedeliverHandler)))
+	app.Router.GET("/ack/:token", app.AckPageHandler)
+	app.Router.POST("/ack/:token", app.AckPageHandler)
+
+	// Handler for serving files in case we are not behind something else such as nginx
+	app.Router.GET("/data/*filepath", app.DataHandler)
 
-	// Query for row id
-	sql_row := `SELECT * FROM events WHERE id = ?`
-	row := app.DB.QueryRow(sql_row, id)
+	// Read-only WebDAV share of the media for backups
+	app.DAVRoutes()
+}
 
-	// Get event info
-	event := Event{}
-	err = row.Scan(
+// Wraps the router with our middleware.
+func (app *App) Handler() http.Handler {
+	var handler http.Handler = app.RecoverMiddleware(app.AuthMiddleware(app.APIValidationMiddleware(app.Router)))
+	handler = app.UploadDeadlineMiddleware(handler)
+	handler = app.SecurityHeadersMiddleware(handler)
+	handler = app.PathPrefixMiddleware(handler)
+	if app.AccessLog != nil {
+		handler = app.AccessLogMiddleware(handler)
+	}
+	if app.Syslog != nil {
+		handler = app.SyslogMiddleware(handler)
+	}
+	return app.RequestIDMiddleware(handler)
+}
+
+// Joins a server path onto the configured base URL, keeping any path prefix the
+// base URL has. Returns an empty string when no base URL is configured.
+func (app *App) AbsoluteURL(path string) string {
+	if app.Config.baseURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(app.Config.baseURL)
+	if err != nil {
+		panic(err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// Returns the URL a file in the data directory is served at.
+func (app *App) MediaURL(path string) string {
+	rel, err := filepath.Rel(app.Config.dirs.data, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+
+	return "/data/" + filepath.ToSlash(rel)
+}
+
+// Scans a row selected with eventColumns into a new Event.
+func scanEvent(row interface{ Scan(...interface{}) error }) (*Event, error) {
+	event := new(Event)
+	var expiresAt sql.NullTime
+	var score sql.NullFloat64
+	var audio sql.NullBool
+	var size sql.NullInt64
+	var metadata sql.NullString
+	var slug sql.NullString
+	var externalID sql.NullString
+	var ackedAt sql.NullTime
+	var ackedBy sql.NullString
+	var where sql.NullString
+	var latitude, longitude sql.NullFloat64
+	var evidenceAt sql.NullTime
+	err := row.Scan(
 		&event.Id,
 		&event.Name,
 		&event.Time,
 		&event.Video,
 		&event.Image,
+		&event.Status,
+		&event.LastError,
+		&event.Suppressed,
+		&event.Protected,
+		&event.Notes,
+		&event.CameraId,
+		&expiresAt,
+		&score,
+		&audio,
+		&size,
+		&metadata,
+		&event.Public,
+		&slug,
+		&event.VideoExpired,
+		&externalID,
+		&ackedAt,
+		&ackedBy,
+		&where,
+		&latitude,
+		&longitude,
+		&evidenceAt,
 	)
-	if err == sql.ErrNoRows {
-		panic(err)
-	} else if err != nil {
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		event.ExpiresAt = &expiresAt.Time
+	}
+	if score.Valid {
+		event.Score = &score.Float64
+	}
+	if audio.Valid {
+		event.Audio = &audio.Bool
+	}
+	if size.Valid {
+		event.Size = &size.Int64
+	}
+	if metadata.Valid {
+		event.Metadata = json.RawMessage(metadata.String)
+	}
+	event.PublicSlug = slug.String
+	event.ExternalId = externalID.String
+	if ackedAt.Valid {
+		event.AckedAt = &ackedAt.Time
+	}
+	event.AckedBy = ackedBy.String
+	event.Location = where.String
+	if latitude.Valid && longitude.Valid {
+		event.Latitude, event.Longitude = &latitude.Float64, &longitude.Float64
+	}
+	if evidenceAt.Valid {
+		event.EvidenceAt = &evidenceAt.Time
+	}
+
+	return event, nil
+}
+
+// Looks up a single event with the given Id, returning sql.ErrNoRows if there
+// is no such event.
+func (app *App) FindEvent(id int64) (*Event, error) {
+	sql_row := `SELECT ` + eventColumns + ` FROM events WHERE id = ?`
+	return scanEvent(app.DB.QueryRow(sql_row, id))
+}
+
+// Retrieves a single event with the given Id.
+func (app *App) GetEvent(id int64) Event {
+	event, err := app.FindEvent(id)
+	if err != nil {
 		panic(err)
 	}
 
-	return event
+	return *event
+}
+
+// Creates a new event with the given information. The insert and reading back
+// the stored event happen in a single transaction, nothing is stored on error.
+// The transaction is retried while the database is busy.
+func (app *App) CreateEvent(event Event, media []*Media) (*Event, error) {
+	var created *Event
+	err := app.retryBusy(func() (err error) {
+		created, err = app.createEvent(event, media)
+		return err
+	})
+	if err == nil {
+		app.Cache.Clear()
+	}
+	return created, err
 }
 
-// Creates a new event with the given information.
-func (app *App) CreateEvent(event Event) int64 {
-	var err error
+func (app *App) createEvent(event Event, media []*Media) (*Event, error) {
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	// Prepare SQL statement
+	// Execute statement
 	sql_event := `
 	INSERT INTO events(
 		name,
 		video,
-		image
-	) VALUES (?, ?, ?)`
-	stmt, err := app.DB.Prepare(sql_event)
-	if err != nil {
-		panic(err)
+		image,
+		status,
+		notify_suppressed,
+		camera_id,
+		metadata,
+		external_id,
+		location,
+		latitude,
+		longitude
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	var metadata, externalID, where interface{}
+	if len(event.Metadata) > 0 {
+		metadata = string(event.Metadata)
 	}
-	defer stmt.Close()
-
-	// Execute statement
-	res, err := stmt.Exec(event.Name, event.Video, event.Image)
+	if event.ExternalId != "" {
+		externalID = event.ExternalId
+	}
+	if event.Location != "" {
+		where = event.Location
+	}
+	res, err := tx.Exec(sql_event, event.Name, event.Video, event.Image, event.Status, event.Suppressed, event.CameraId, metadata, externalID, where, event.Latitude, event.Longitude)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Get the newly created row id from our last insert
 	rowId, err := res.LastInsertId()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	log.Println("Created new event", event.Name)
+	// Attach every uploaded file
+	for _, m := range media {
+		if err := addMedia(tx, rowId, m.Kind, m.Path); err != nil {
+			return nil, err
+		}
+	}
+	if err := setEventSize(tx, rowId); err != nil {
+		return nil, err
+	}
 
-	return rowId
+	// Read back the stored event (for its time)
+	sql_row := `SELECT ` + eventColumns + ` FROM events WHERE id = ?`
+	created, err := scanEvent(tx.QueryRow(sql_row, rowId))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// Largest upload accepted, the whole request over HTTP and each file over gRPC
+const maxUploadSize = 100 << 20 // 100 MB
+
+// Limits the body of an upload to maxUploadSize before anything reads it, the
+// API key check included. ParseMultipartForm only limits what is kept in memory
+// and spills the rest to disk.
+func limitUpload(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		next(w, r, p)
+	}
 }
 
 // Accepts POST data and creates a new event if the information is acceptable.
-// Will also use ffmpeg (if installed) to convert the video to a more browser
-// friendly container.
+// Will also queue the video for conversion to a more browser friendly container
+// with ffmpeg (if installed).
 func (app *App) NewEventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	var err error
+	logger := app.Log(r)
+	uploadsActive.Add(1)
+	defer uploadsActive.Add(-1)
 
-	// Parse form
-	r.ParseMultipartForm(104857600) // 100 MB
+	// Parse form, the body was limited to maxUploadSize by limitUpload
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, http.ErrNotMultipart), errors.Is(err, http.ErrMissingBoundary):
+			writeJSONError(w, http.StatusUnsupportedMediaType, "uploads must be multipart/form-data")
+		case errors.As(err, &tooLarge):
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads may be at most %d bytes", tooLarge.Limit))
+		case isTimeout(err):
+			logger.Printf("Upload didn't arrive within %s, discarding it\n", app.Config.uploadTimeout)
+			writeUploadTimeout(w)
+		default:
+			writeJSONError(w, http.StatusBadRequest, "unreadable upload: "+err.Error())
+		}
+		return
+	}
 	name := r.FormValue("name")
 
-	// Get video & image files
-	videoFile, vHandler, err := r.FormFile("video")
-	imageFile, iHandler, err := r.FormFile("image")
-	if err != nil {
-		panic(err)
+	// Get video & image files, the fields may be repeated for extra files
+	videos := r.MultipartForm.File["video"]
+	images := r.MultipartForm.File["image"]
+
+	// Something was missing, name it
+	if part := missingUploadPart(name, r.FormValue("camera"), len(videos), len(images)); part != "" {
+		writeFieldError(w, ErrMissingField, part, part+" is required")
+		return
+	}
+
+	// Receive every file into the staging directory first, anything staged is
+	// removed unless it makes it into the data directory
+	upload := eventUpload{
+		Name:       name,
+		Camera:     uploadCamera(r, r.FormValue("camera")),
+		Notify:     wantsNotification(r),
+		ExternalID: strings.TrimSpace(r.FormValue("external_id")),
+	}
+	if !checkExternalID(w, upload) || !formLocation(w, r, &upload) {
+		return
+	}
+	for field, headers := range map[string][]*multipart.FileHeader{"video": videos, "image": images} {
+		for _, header := range headers {
+			if !validFilename(header.Filename) {
+				writeFieldError(w, ErrInvalidField, field, field+" needs a file name")
+				return
+			}
+		}
+	}
+	handedOver := false
+	defer func() {
+		if handedOver {
+			return
+		}
+		for _, file := range append(upload.Videos, upload.Images...) {
+			os.Remove(file.Path)
+		}
+	}()
+	for _, header := range append(videos, images...) {
+		path, err := stageFormFile(app, header)
+		if err != nil {
+			logger.Println("Error receiving upload, discarding it")
+			logger.Println(err.Error())
+			writeJSONError(w, http.StatusBadRequest, "error receiving "+header.Filename)
+			return
+		}
+		file := stagedFile{Path: path, Name: header.Filename}
+		if len(upload.Videos) < len(videos) {
+			upload.Videos = append(upload.Videos, file)
+		} else {
+			upload.Images = append(upload.Images, file)
+		}
+	}
+
+	// StoreEvent takes care of the staged files from here
+	handedOver = true
+	created, err := app.StoreEvent(logger, RequestID(r.Context()), upload)
+	app.writeStored(w, r, created, err)
+}
+
+// Names the part every upload needs that one with the given name, camera and
+// number of videos and images lacks, empty when it has them all. Uploads from
+// a camera may leave out the name, its name template names them.
+func missingUploadPart(name, camera string, videos, images int) string {
+	switch {
+	case name == "" && strings.TrimSpace(camera) == "":
+		return "name"
+	case videos == 0:
+		return "video"
+	case images == 0:
+		return "image"
 	}
+	return ""
+}
 
-	// Create path for new files
-	vPath := filepath.Join(app.Config.dirs.data, vHandler.Filename)
-	iPath := filepath.Join(app.Config.dirs.data, iHandler.Filename)
+// Responds to an upload with the event StoreEvent created, or why it couldn't.
+// A repeated external ID gets the existing event with a 200, an upload
+// -pre-accept-url turned down a 422.
+func (app *App) writeStored(w http.ResponseWriter, r *http.Request, created *Event, err error) {
+	var rejected *rejectedError
+	if err == errDuplicateUpload {
+		writeJSON(w, http.StatusOK, app.apiEvent(created))
+		return
+	} else if errors.As(err, &rejected) {
+		writeJSONError(w, http.StatusUnprocessableEntity, rejected.Error())
+		return
+	} else if isBusy(err) {
+		busyRetryAfter(w)
+		writeJSONError(w, http.StatusServiceUnavailable, "the database is busy, try again later")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error storing event, request "+RequestID(r.Context()))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, app.apiEvent(created))
+}
 
-	// Create new file
-	vDest, err := os.OpenFile(vPath, os.O_WRONLY|os.O_CREATE, 0775)
-	iDest, err := os.OpenFile(iPath, os.O_WRONLY|os.O_CREATE, 0775)
+// Copies a multipart file into the staging directory.
+func stageFormFile(app *App, header *multipart.FileHeader) (string, error) {
+	f, err := header.Open()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	defer f.Close()
 
-	// Defer closing form and destination files
-	defer videoFile.Close()
-	defer imageFile.Close()
-	defer vDest.Close()
-	defer iDest.Close()
+	return app.StageUpload(f)
+}
 
-	// Copy contents from form file to destination
-	io.Copy(vDest, videoFile)
-	io.Copy(iDest, imageFile)
+// Staged file and the name it is stored under
+type stagedFile struct {
+	Path string
+	Name string
+}
 
-	// Re-encode video to something friendly for browsers
-	newVideoPath := strings.TrimSuffix(vPath, filepath.Ext(vPath)) + ".mp4"
-	cmd := exec.Command("ffmpeg", "-i", vPath, "-c:v", "libx264", "-crf", "21", "-vf", "scale=w=320:h=240", "-y", newVideoPath)
+// Staged upload waiting to become an event. The first video and image are the
+// event's main ones, the first image its thumbnail. Snapshots polled from
+// cameras come without a video.
+type eventUpload struct {
+	Name   string
+	Camera string // Name of the camera, added if it's new
+	Videos []stagedFile
+	Images []stagedFile
+	Notify bool
+	Meta   json.RawMessage // Stored as the event's metadata, if any
 
-	// Remove old video (avi) and set new path if successful
-	if err := cmd.Run(); err == nil {
-		os.Remove(vPath)
-		vPath = newVideoPath
-	} else {
-		log.Printf("Error converting %s to %s\n", vPath, newVideoPath)
-		log.Println(err.Error())
+	// Recording ID the camera gave it. An upload repeating one of the camera's
+	// IDs stores nothing and gets the existing event back.
+	ExternalID string
+
+	// Where it was captured, for cameras that move. Its camera's location is
+	// used when it gives none.
+	Location location
+}
+
+// Turns staged uploads into an event: images are stripped, every file is moved
+// into the data directory, the event is stored, queued for conversion, the SMS
+// is sent, the hook run and the webhook and SNS notification queued. The
+// staged files are removed if the event can't be created.
+func (app *App) StoreEvent(logger *Logger, requestID string, upload eventUpload) (*Event, error) {
+	if len(upload.Images) == 0 {
+		return nil, errors.New("an event needs at least one image")
+	}
+	if upload.Name == "" && strings.TrimSpace(upload.Camera) == "" {
+		return nil, errors.New("an event needs a name or a camera")
+	}
+	if upload.ExternalID != "" {
+		existing, err := app.FindExternalEvent(upload.Camera, upload.ExternalID)
+		if err == nil {
+			logger.Printf("Camera %s already uploaded %s as event %d\n", upload.Camera, upload.ExternalID, existing.Id)
+			for _, file := range append(upload.Videos, upload.Images...) {
+				os.Remove(file.Path)
+			}
+			return existing, errDuplicateUpload
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
 	}
 
-	// Create event information
+	var staged []string
+	media := make([]*Media, 0)
+	for _, file := range append(upload.Videos, upload.Images...) {
+		if !validFilename(file.Name) {
+			for _, file := range append(upload.Videos, upload.Images...) {
+				os.Remove(file.Path)
+			}
+			return nil, fmt.Errorf("invalid file name %q", file.Name)
+		}
+	}
+	for _, file := range upload.Videos {
+		staged = append(staged, file.Path)
+		media = append(media, &Media{Kind: MediaVideo, Path: filepath.Join(app.Config.dirs.data, filepath.Base(file.Name))})
+	}
+	for _, file := range upload.Images {
+		staged = append(staged, file.Path)
+		media = append(media, &Media{Kind: MediaImage, Path: filepath.Join(app.Config.dirs.data, filepath.Base(file.Name))})
+	}
+	defer func() {
+		for _, path := range staged {
+			os.Remove(path)
+		}
+	}()
+
+	// Remove EXIF/XMP metadata from the images, keeping the original if it can't be parsed
+	if app.Config.stripExif {
+		for _, file := range upload.Images {
+			if err := StripMetadata(file.Path); err != nil {
+				logger.Printf("Warning: could not strip metadata from %s, storing as-is\n", file.Name)
+				logger.Println(err.Error())
+			}
+		}
+	}
+
+	// Let -pre-accept-url turn the upload down while nothing is stored yet
+	if app.Config.preAcceptURL != "" {
+		if err := app.preAccept(logger, upload); err != nil {
+			app.Security(securityEvent{
+				kind:      SecurityUploadRejected,
+				severity:  syslogNotice,
+				requestID: requestID,
+				actor:     upload.Camera,
+				message:   fmt.Sprintf("upload %s of camera %s: %s", upload.Name, upload.Camera, err),
+			})
+			return nil, err
+		}
+	}
+
+	// Move the complete files into the data directory, encrypting them if asked.
+	// Each goes to a name reserved for it, renaming over the reservation keeps
+	// it ours.
+	for i, m := range media {
+		path, err := reservePath(m.Path)
+		if err != nil {
+			logger.Println("Error reserving a name in the data directory for", filepath.Base(m.Path))
+			logger.Println(err.Error())
+			return nil, err
+		}
+		if filepath.Dir(path) != filepath.Clean(app.Config.dirs.data) {
+			os.Remove(path)
+			return nil, fmt.Errorf("%s is outside the data directory", path)
+		}
+		if err := app.moveMedia(staged[i], path); err != nil {
+			logger.Println("Error moving upload into the data directory")
+			logger.Println(err.Error())
+			os.Remove(path)
+			return nil, err
+		}
+		m.Path = path
+		staged[i] = path
+	}
+
+	cameraID, err := app.CameraID(upload.Camera)
+	if err != nil {
+		logger.Println("Error looking up camera", upload.Camera)
+		logger.Println(err.Error())
+		return nil, err
+	}
+	if upload.Name == "" {
+		if upload.Name, err = app.NextEventName(cameraID); err != nil {
+			logger.Println("Error naming an event of camera", upload.Camera)
+			logger.Println(err.Error())
+			return nil, err
+		}
+	}
+	if upload.Location.empty() && cameraID != 0 {
+		if upload.Location, err = app.CameraLocation(cameraID); err != nil {
+			logger.Println("Error looking up the location of camera", upload.Camera)
+			logger.Println(err.Error())
+			return nil, err
+		}
+	}
+
+	// Create event information, without ffmpeg or a video there is nothing to
+	// convert and we keep the original
 	event := Event{
-		Name:  name,
-		Image: iPath,
-		Video: vPath,
+		Name:       upload.Name,
+		Image:      media[len(upload.Videos)].Path,
+		Status:     StatusPending,
+		Suppressed: !upload.Notify,
+		CameraId:   cameraID,
+		Metadata:   upload.Meta,
+		ExternalId: upload.ExternalID,
+		Location:   upload.Location.Text,
+		Latitude:   upload.Location.Latitude,
+		Longitude:  upload.Location.Longitude,
+	}
+	if len(upload.Videos) > 0 {
+		event.Video = media[0].Path
+	}
+	if app.FFmpeg == "" || event.Video == "" {
+		event.Status = StatusDone
 	}
 
-	// Create new event if fields are not null
-	if event.Name != "" && event.Image != "" && event.Video != "" {
-		rowId := app.CreateEvent(event)
-		event := app.GetEvent(rowId)
-		app.SendSMS(&event)
-		w.WriteHeader(http.StatusAccepted)
-		return
+	// Create new event, once stored the files belong to it
+	created, err := app.CreateEvent(event, media)
+	if err != nil && upload.ExternalID != "" {
+		// The same recording may have been stored by a concurrent upload, the
+		// files it has are its own so ours go
+		if existing, findErr := app.FindExternalEvent(upload.Camera, upload.ExternalID); findErr == nil {
+			logger.Printf("Camera %s already uploaded %s as event %d\n", upload.Camera, upload.ExternalID, existing.Id)
+			return existing, errDuplicateUpload
+		}
+	}
+	if err != nil {
+		logger.Println("Error creating event, removing its files")
+		logger.Println(err.Error())
+		return nil, err
+	}
+	staged = nil
+	logger.Println("Created new event", created.Name)
+
+	// The event stands from here on, conversion and notification failures are
+	// only logged
+	if created.Status == StatusPending {
+		app.Transcodes.Queue(transcodeJob{Id: created.Id, RequestID: requestID})
+	}
+	if !created.Suppressed && !app.notifyAfterScore(created) {
+		app.alertEvent(logger, created, strings.TrimSpace(upload.Camera))
+	}
+	if app.Config.detectURL != "" {
+		if _, err := app.QueueDetection(created); err != nil {
+			logger.Println("Error queueing object detection")
+			logger.Println(err.Error())
+		}
+	}
+	app.RunHooks(logger, HookCreated, created, strings.TrimSpace(upload.Camera))
+	if app.Config.webhookURL != "" {
+		if _, err := app.QueueWebhook(created, false); err != nil {
+			logger.Println("Error queueing webhook")
+			logger.Println(err.Error())
+		}
+	}
+
+	return created, nil
+}
+
+// Alerts about a new event with every notifier configured.
+func (app *App) NotifyEvent(logger *Logger, event *Event, camera string) {
+	if len(app.Config.escalation) > 0 {
+		if err := app.markAlerted(event.Id); err != nil {
+			logger.Printf("Error recording the alert about event %d, it won't be escalated\n", event.Id)
+			logger.Println(err.Error())
+		}
+	}
+	app.queueNotifiers(logger, event, camera)
+}
+
+// Whether the uploader wants to be notified about the event. Notifications are
+// only suppressed by an explicit false in the notify field or X-Seccam-Notify
+// header, anything else (including malformed values) notifies as usual.
+func wantsNotification(r *http.Request) bool {
+	for _, v := range []string{r.FormValue("notify"), r.Header.Get("X-Seccam-Notify")} {
+		if notify, err := strconv.ParseBool(v); err == nil && !notify {
+			return false
+		}
 	}
 
-	// Something was null, return unacceptable
-	w.WriteHeader(http.StatusNotAcceptable)
+	return true
 }
 
-// Renders the index of events
+// Renders the index of events, or the results of the search parameter
 func (app *App) IndexHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// Prepare SQL query
-	sql_index := `SELECT * FROM events ORDER BY id DESC LIMIT 5`
-	rows, err := app.DB.Query(sql_index)
+	app.renderIndex(w, r, nil)
+}
+
+// Renders the index, limited to a single camera's events unless camera is nil.
+func (app *App) renderIndex(w http.ResponseWriter, r *http.Request, camera *Camera) {
+	search := strings.TrimSpace(r.FormValue("search"))
+
+	var cameraID int64
+	timelapses := make([]*Timelapse, 0)
+	if camera != nil {
+		cameraID = camera.Id
+	} else {
+		timelapses = app.GetTimelapses(5)
+	}
+
+	// The page also depends on who is looking, their language, maintenance mode
+	// and timelapses
+	w.Header().Set("Vary", "Accept-Language")
+	extra := []string{strconv.FormatBool(app.ReadOnly.Load()), app.Language(r)}
+	if user := CurrentUser(r.Context()); user != nil {
+		extra = append(extra, user.Username, user.Role)
+	}
+	if len(timelapses) > 0 {
+		extra = append(extra, strconv.FormatInt(timelapses[0].Id, 10))
+	}
+	if camera != nil && camera.Live {
+		extra = append(extra, "live")
+	}
+	if app.NotModified(w, r, app.EventsETag(extra...)) {
+		return
+	}
+
+	// Build array of events, kept in memory until events change
+	listing, err := app.Cache.Load(fmt.Sprintf("index:%d:%s", cameraID, search), func() (interface{}, error) {
+		if search != "" {
+			return app.SearchEvents(search, eventFilter{CameraId: cameraID}, 0, 20)
+		}
+		events := make([]*searchResult, 0)
+		for _, event := range app.EventsBefore(eventFilter{CameraId: cameraID}, math.MaxInt64, 5) {
+			events = append(events, &searchResult{Event: event})
+		}
+		return events, nil
+	})
 	if err != nil {
 		panic(err)
 	}
-	defer rows.Close()
-
-	// Build array of events
-	events := make([]*Event, 0)
-	for rows.Next() {
-		event := new(Event)
-		err := rows.Scan(
-			&event.Id,
-			&event.Name,
-			&event.Time,
-			&event.Video,
-			&event.Image,
-		)
-		if err != nil {
-			panic(err)
-		}
-		events = append(events, event)
+	events := listing.([]*searchResult)
+
+	// Render template with given events and timelapses for context
+	context := struct {
+		Search     string
+		Camera     *Camera
+		Cameras    []*Camera
+		Events     []*searchResult
+		Timelapses []*Timelapse
+		ReadOnly   bool
+		User       *User
+	}{
+		Search:     search,
+		Camera:     camera,
+		Cameras:    app.GetCameras(),
+		Events:     events,
+		Timelapses: timelapses,
+		ReadOnly:   app.ReadOnly.Load(),
+		User:       CurrentUser(r.Context()),
 	}
-	if err = rows.Err(); err != nil {
+	t := app.Template(r, "index")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
+
+// Renders a single event
+func (app *App) EventHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such event.")
+		return
+	}
+
+	event, err := app.FindEvent(id)
+	if err == sql.ErrNoRows {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such event.")
+		return
+	} else if err != nil {
 		panic(err)
 	}
 
-	// Render template with given events for context
-	t := app.Templates["index"]
-	t.ExecuteTemplate(w, t.Name(), events)
+	// Include a fresh share link for the event, notes are only editable by admins
+	user := CurrentUser(r.Context())
+	context := struct {
+		*Event
+		ShareURL     string
+		ShareExpires time.Time
+		Expires      time.Time // Zero when it isn't known
+		VideoExpires time.Time // Zero unless the video goes before the event
+		RetainCount  int
+		Escalating   bool // Whether its alert is escalated until acknowledged
+		CanEdit      bool
+		Media        []*Media
+		Labels       []*Label
+		Exports      []*exportStatus // Per target
+		Nonce        string
+	}{
+		Event:       event,
+		RetainCount: app.Config.retainCount,
+		Escalating:  len(app.Config.escalation) > 0 && !event.Suppressed,
+		CanEdit:     user == nil || user.Role == RoleAdmin,
+		Nonce:       CSPNonce(r.Context()),
+	}
+	context.Expires, _ = app.EffectiveExpiry(event)
+	context.VideoExpires, _ = app.VideoExpiry(event)
+	if context.Media, err = app.EventMedia(event.Id); err != nil {
+		panic(err)
+	}
+	if context.Labels, err = app.EventLabels(event.Id); err != nil {
+		panic(err)
+	}
+	exports, err := app.EventExports(event.Id)
+	if err != nil {
+		panic(err)
+	}
+	context.Exports = app.exportStatuses(exports)
+	context.ShareURL, context.ShareExpires = app.ShareLink(event.Id)
+	context.ShareURL = app.PublicURL(context.ShareURL)
+
+	t := app.Template(r, "detail")
+	t.ExecuteTemplate(w, t.Name(), context)
 }
 
-// Sends an SMS with the relevant Event information, primitive at the moment
-func (app *App) SendSMS(event *Event) {
-	twilio := gotwilio.NewTwilioClient(app.Config.sid, app.Config.token)
-	message := fmt.Sprintf("Motion event captured at %s.", event.Time)
-	_, _, err := twilio.SendSMS(app.Config.twilio.from, app.Config.twilio.to, message, "", "") // TODO: change to MMS
-	if err != nil {
-		log.Printf("Error sending SMS to %s\n", app.Config.twilio.to)
+// Sends a plain SMS, for alerts that aren't about an event.
+func (app *App) SendText(logger *Logger, message string) {
+	if err := app.sendMessage(logger, message, ""); err != nil {
+		logger.Printf("Error sending SMS to %s\n", app.Config.twilio.to)
+		logger.Println(err.Error())
 	}
 }
 
@@ -309,26 +1554,445 @@ func main() {
 
 	// Set config values based off CLI params (or defaults)
 	flag.StringVar(&config.db, "db", "./events.db", "Database filename")
+	flag.StringVar(&config.dbKey, "db-key", "", "Key the database is encrypted with, needs a build with the sqlcipher tag")
 	flag.StringVar(&config.dirs.data, "data", "./data", "Data directory")
-	flag.StringVar(&config.addr, "address", ":8000", "Address and port to listen on")
+	flag.StringVar(&config.dirs.staging, "staging", "./staging", "Directory for uploads in progress, must be on the same filesystem as the data directory")
+	flag.StringVar(&config.mediaKeyFile, "media-key-file", "", "File holding a 32 byte hex key media is encrypted with at rest, disabled if empty")
+	flag.StringVar(&config.dirs.thumbs, "thumbs", "./thumbs", "Directory for cached thumbnails")
+	flag.StringVar(&config.thumbFrame, "thumb-frame", ThumbFrameScene, "How the video frame of thumbnails is picked: first, middle or scene")
+	flag.Int64Var(&config.thumbSize, "thumb-cache-size", 256<<20, "Most bytes of thumbnails kept cached, the least recently used are removed past it")
+	flag.StringVar(&config.addr, "address", ":8000", "Address and port to listen on, or unix:/path/to.sock for a unix socket")
+	flag.StringVar(&config.socketMode, "socket-mode", "0660", "Permissions of the unix socket")
 	flag.StringVar(&config.twilio.sid, "sid", "", "Twilio SID")
+	flag.BoolVar(&config.twilioCheck, "twilio-check", false, "Check the Twilio credentials on startup")
+	flag.BoolVar(&config.notifyDryRun, "notify-dry-run", false, "Log notifications instead of sending them")
+	flag.StringVar(&config.detectURL, "detect-url", "", "Object detection endpoint (DeepStack style) new events' images are sent to, disabled if empty")
+	flag.Float64Var(&config.detectMin, "detect-min-confidence", 0.5, "Lowest confidence (0-1) a detected label is kept with")
+	flag.Func("notify-labels", "Comma separated labels, with -detect-url only alert about events one of them was detected in", func(s string) error {
+		config.notifyLabels = parseLabels(s)
+		return nil
+	})
+	flag.Func("escalate", "Comma separated stages such as 10m=sms:+15551234567 or 30m=webhook:https://example.com/page, alerting each contact in turn while an alert goes unacknowledged that long, disabled if empty", func(s string) error {
+		stages, err := parseEscalation(s)
+		config.escalation = stages
+		return err
+	})
+	flag.DurationVar(&config.labelWait, "notify-label-wait", time.Minute, "Longest alerts wait for object detection with -notify-labels, after that they're sent regardless")
+	flag.DurationVar(&config.detectTimeout, "detect-timeout", 30*time.Second, "Longest a single detection request may take")
+	flag.StringVar(&config.preAcceptURL, "pre-accept-url", "", "Service asked whether to keep every upload before it's stored, disabled if empty")
+	flag.DurationVar(&config.preAcceptTimeout, "pre-accept-timeout", 10*time.Second, "Longest asking -pre-accept-url may take")
+	flag.StringVar(&config.preAcceptOnError, "pre-accept-on-error", PreAcceptOnErrorAccept, "Whether to accept or reject uploads when -pre-accept-url can't be asked")
+	flag.BoolVar(&config.stripAudio, "strip-audio", false, "Leave the sound out of converted videos, only affects new events")
+	flag.BoolVar(&config.motionScore, "motion-score", false, "Score the motion in uploaded videos with ffmpeg's scene detection")
+	flag.Float64Var(&config.minScore, "notify-min-score", 0, "Only notify about events whose motion score (0-1) is at least this, 0 notifies regardless. Needs -motion-score")
+	flag.IntVar(&config.smsBudget, "sms-budget", 0, "Most event alerts sent by SMS per hour, unlimited if 0")
 	flag.StringVar(&config.twilio.token, "token", "", "Twilio auth token")
 	flag.StringVar(&config.twilio.from, "from", "", "From number")
 	flag.StringVar(&config.twilio.to, "to", "", "To number")
 	flag.StringVar(&config.dirs.tmpl, "tmpl", "tmpl", "Template directory")
+	flag.StringVar(&config.baseURL, "base-url", "", "Public URL of this server, used for links in notifications")
+	flag.StringVar(&config.csp, "csp", "", "Content-Security-Policy directives to add, replacing default directives of the same name")
+	flag.StringVar(&config.pathPrefix, "path-prefix", "", "Path the server is reachable under behind a reverse proxy, e.g. /seccam")
+	flag.StringVar(&config.secret, "secret", "", "Secret used to sign share links")
+	flag.DurationVar(&config.shareTTL, "share-ttl", 24*time.Hour, "How long share links stay valid")
+	flag.DurationVar(&config.icsWindow, "ics-window", 30*24*time.Hour, "How far back the calendar feed goes")
+	flag.StringVar(&config.language, "language", "en", "Language of notifications, and of pages unless the browser prefers another with a catalog")
+	flag.DurationVar(&config.incidentWindow, "incident-window", 2*time.Minute, "Events of a camera this close to the one before are grouped into one incident")
+	flag.StringVar(&config.adminToken, "admin-token", "", "Bearer token granting admin access, disabled if empty")
+	flag.StringVar(&config.apiKey, "api-key", "", "API key cameras must upload with, uploads are open if empty")
+	flag.StringVar(&config.uploadSecret, "upload-secret", "", "Secret cameras sign uploads with, see the signature package")
+	flag.DurationVar(&config.uploadSkew, "upload-skew", 5*time.Minute, "How far a signed upload's timestamp may be from the server's clock")
+	flag.DurationVar(&config.sessionTTL, "session-ttl", 30*24*time.Hour, "How long users stay signed in")
+	flag.StringVar(&config.oidcIssuer, "oidc-issuer", "", "OpenID Connect issuer URL, enables single sign on")
+	flag.StringVar(&config.oidcClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&config.oidcClientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&config.oidcRedirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL, ending in /login/oidc/callback")
+	flag.StringVar(&config.oidcRoleClaim, "oidc-role-claim", "groups", "ID token claim deciding the user's role")
+	flag.StringVar(&config.oidcAdminValue, "oidc-admin-value", "admin", "Value of the role claim that makes a user an admin, everyone else is a viewer")
+	flag.BoolVar(&config.readOnly, "read-only", false, "Start in maintenance mode, refusing uploads and changes")
+	flag.StringVar(&config.debugAddr, "debug-listen", "", "Address for a separate pprof/expvar listener, disabled if empty")
+	flag.StringVar(&config.grpcAddr, "grpc-listen", "", "Address for the gRPC ingestion service, disabled if empty")
+	flag.StringVar(&config.grpcCert, "grpc-cert", "", "TLS certificate for the gRPC listener")
+	flag.StringVar(&config.grpcKey, "grpc-key", "", "TLS key for the gRPC listener")
+	flag.StringVar(&config.grpcTokens, "grpc-tokens", "", "File of camera names and tokens allowed to use the gRPC service")
+	flag.StringVar(&config.accessLogPath, "access-log", "", "Access log file")
+	flag.StringVar(&config.syslogAddr, "syslog-addr", "", "Forward security events to this syslog server, udp://host:port, tcp://host:port or unix:///path")
+	flag.Int64Var(&config.accessLogMaxSize, "access-log-max-size", 0, "Rotate the access log once it reaches this many bytes, 0 to never rotate")
+	flag.IntVar(&config.accessLogKeep, "access-log-keep", 5, "Number of rotated access logs kept")
+	flag.StringVar(&config.logPath, "log-file", "", "Write the application log to this file instead of stderr")
+	flag.Int64Var(&config.logMaxSize, "log-max-size", 100<<20, "Rotate the log file once it reaches this many bytes, 0 to never rotate by size")
+	flag.DurationVar(&config.logMaxAge, "log-max-age", 0, "Rotate the log file once it has been written to for this long, 0 to never rotate by age")
+	flag.IntVar(&config.logBackups, "log-max-backups", 5, "Number of rotated, compressed log files kept")
+	flag.BoolVar(&config.stripExif, "strip-exif", true, "Strip EXIF/XMP metadata from uploaded images")
+	flag.BoolVar(&config.overlay, "overlay", false, "Burn the event name and time into transcoded videos")
+	flag.StringVar(&config.fontFile, "font", "/usr/share/fonts/TTF/DejaVuSans.ttf", "Font file used for the video overlay")
+	flag.BoolVar(&config.timelapse, "timelapse", false, "Generate a timelapse of the previous day's events every night")
+	flag.IntVar(&config.timelapseFPS, "timelapse-fps", 10, "Timelapse frame rate")
+	flag.DurationVar(&config.retain, "retain", 0, "Delete unprotected events older than this, kept forever if 0")
+	flag.IntVar(&config.retainCount, "retain-count", 0, "Keep only this many of the most recent events, unlimited if 0")
+	flag.DurationVar(&config.retainVideo, "retain-video", 0, "Delete the videos of unprotected events older than this, keeping their images, kept as long as the event if 0")
+	flag.DurationVar(&config.retainImage, "retain-image", 0, "Delete unprotected events, images and all, older than this, like -retain, kept forever if 0")
+	flag.DurationVar(&config.trashRetain, "trash-retain", 0, "Keep the files of deleted events in the trash this long before removing them, removed at once if 0")
+	flag.Func("storage-quota", "Delete the trash and then the oldest unprotected events once events, trash and archives take up more than this (e.g. 500GB), unlimited if empty", func(s string) error {
+		size, err := parseSize(s)
+		config.storageQuota = int64(size)
+		return err
+	})
+	flag.StringVar(&config.diskAlert, "disk-alert-threshold", "", "Send an alert when free space in the data directory drops below this percentage (10%) or size (5GB), disabled if empty")
+	flag.StringVar(&config.transcode.ffmpegPath, "ffmpeg-path", "ffmpeg", "ffmpeg executable, ffprobe is expected next to it")
+	flag.StringVar(&config.transcode.videoCodec, "video-codec", "h264", "Video codec to convert to (h264, vp9 or av1)")
+	flag.IntVar(&config.transcode.crf, "crf", -1, "Video quality (CRF), defaults to the codec's default")
+	flag.StringVar(&config.transcode.bitrate, "video-bitrate", "", "Target bitrate of converted videos (800k, 1.5M) instead of a quality, can't be combined with -crf")
+	flag.BoolVar(&config.transcode.twoPass, "two-pass", false, "Reach -video-bitrate in two passes, more accurate but twice as slow")
+	flag.IntVar(&config.transcode.workers, "transcode-workers", 1, "Number of videos converted at the same time")
+	flag.DurationVar(&config.transcode.alertAge, "transcode-alert-age", 0, "Send an alert when a video has waited this long to be converted, disabled if 0")
+	flag.StringVar(&config.hookPath, "hook", "", "Executable run for every new event, disabled if empty")
+	flag.StringVar(&config.hooksDir, "hooks-dir", "", "Directory of executables run as events are created, transcoded, deleted and notified about, named after the stage")
+	flag.DurationVar(&config.hookTimeout, "hook-timeout", 30*time.Second, "How long a hook may run before it is killed")
+	flag.IntVar(&config.hookWorkers, "hook-concurrency", 4, "Number of hooks running at the same time, further events wait their turn")
+	flag.StringVar(&config.webhookURL, "webhook-url", "", "URL new events are posted to as JSON, disabled if empty")
+	flag.StringVar(&config.webhookSecret, "webhook-secret", "", "Secret webhooks are signed with, unsigned if empty")
+	flag.StringVar(&config.discordURL, "discord-webhook-url", "", "Discord webhook alerts are posted to with the event's image, disabled if empty")
+	flag.StringVar(&config.matrixHomeserver, "matrix-homeserver", "", "URL of the Matrix homeserver alerts are posted through, disabled if empty")
+	flag.StringVar(&config.matrixToken, "matrix-token", "", "Access token of the Matrix user posting alerts")
+	flag.StringVar(&config.matrixRoom, "matrix-room", "", "ID of the Matrix room alerts are posted to, e.g. !abc:example.org")
+	flag.StringVar(&config.ntfyServer, "ntfy-server", "https://ntfy.sh", "URL of the ntfy server alerts are published to")
+	flag.StringVar(&config.ntfyTopic, "ntfy-topic", "", "ntfy topic alerts are published to, disabled if empty")
+	flag.StringVar(&config.ntfyToken, "ntfy-token", "", "ntfy access token, for topics that need one")
+	flag.StringVar(&config.ntfyUser, "ntfy-user", "", "ntfy user for basic auth on self-hosted servers")
+	flag.StringVar(&config.ntfyPassword, "ntfy-password", "", "Password of -ntfy-user")
+	flag.IntVar(&config.ntfyPriority, "ntfy-priority", 3, "Priority (1-5) of ntfy alerts")
+	flag.Func("ntfy-score-priority", "Comma separated motion score thresholds raising the ntfy priority, e.g. 0.3=4,0.6=5", func(s string) error {
+		thresholds, err := parseNtfyThresholds(s)
+		config.ntfyThresholds = thresholds
+		return err
+	})
+	flag.StringVar(&config.snsTopic, "sns-topic-arn", "", "Amazon SNS topic new events are published to, disabled if empty")
+	flag.StringVar(&config.snsRegion, "sns-region", "", "AWS region of the SNS topic, taken from the topic ARN if empty")
+	flag.StringVar(&config.snsKeyID, "sns-access-key-id", "", "AWS access key ID for SNS, the default AWS credential chain is used if empty")
+	flag.StringVar(&config.snsSecretKey, "sns-secret-access-key", "", "AWS secret access key for SNS")
+	flag.Func("fetch-allow", "Comma separated hosts, addresses and CIDR networks POST /api/fetch may download media from, disabled if empty", func(s string) error {
+		allow, err := parseFetchAllowlist(s)
+		config.fetchAllow = allow
+		return err
+	})
+	flag.DurationVar(&config.fetchTimeout, "fetch-timeout", 30*time.Second, "Longest downloading a single file for POST /api/fetch may take")
+	flag.Int64Var(&config.fetchMaxSize, "fetch-max-size", 50<<20, "Largest file POST /api/fetch downloads, in bytes")
+	flag.IntVar(&config.fetchRedirects, "fetch-max-redirects", 3, "Most redirects POST /api/fetch follows per file")
+	flag.DurationVar(&config.offlineAfter, "camera-offline-after", 10*time.Minute, "Alert when polling a camera's snapshot has failed for this long, never if 0")
+	flag.IntVar(&config.liveViewers, "live-viewers", 2, "Most people watching a camera's live stream at the same time")
+	flag.Int64Var(&config.mediaRate, "media-rate-limit", 0, "Bytes per second each video or image download is sent at, unlimited if 0")
+	flag.Int64Var(&config.mediaRateTotal, "media-rate-limit-total", 0, "Bytes per second all video and image downloads together are sent at, unlimited if 0")
+	flag.DurationVar(&config.uploadTimeout, "upload-timeout", 10*time.Minute, "Longest an upload may take to arrive, other requests get a minute, unlimited if 0")
+	flag.DurationVar(&config.stopTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests and conversions to finish when stopping")
+	flag.IntVar(&config.busyRetries, "db-busy-retries", 3, "How many times a write is retried while the database is busy before the request gets a 503")
+	flag.Func("report-schedule", "Weekday and local time the weekly report is emailed at, e.g. mon 08:00, disabled if empty", func(s string) error {
+		schedule, err := parseReportSchedule(s)
+		config.reportSchedule = &schedule
+		return err
+	})
+	flag.Func("report-to", "Comma separated addresses the weekly report is sent to, those of the first mailto URL if empty", func(s string) error {
+		for _, to := range strings.Split(s, ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				config.reportTo = append(config.reportTo, to)
+			}
+		}
+		return nil
+	})
+	flag.StringVar(&config.reportTemplate, "report-template", "", "HTML template of the weekly report, report.html in the templates directory if empty")
+	flag.StringVar(&config.gdriveClientID, "gdrive-client-id", "", "OAuth client ID events are exported to Google Drive with")
+	flag.StringVar(&config.gdriveSecret, "gdrive-client-secret", "", "OAuth client secret events are exported to Google Drive with")
+	flag.StringVar(&config.gdriveRefresh, "gdrive-refresh-token", "", "OAuth refresh token of the Google Drive account events are exported to, exports disabled if empty")
+	flag.StringVar(&config.gdriveFolder, "gdrive-folder", "", "ID of the Google Drive folder events are exported to, the root if empty")
+	flag.StringVar(&config.dropboxToken, "dropbox-token", "", "Access token of the Dropbox app events are exported with, exports disabled if empty")
+	flag.StringVar(&config.dropboxPath, "dropbox-path", "/seccam/{camera}/{date}/", "Dropbox folder events are exported to, {camera}, {date} and {id} are filled in")
+	flag.Func("notify-urls", "Space separated notification URLs (twilio, discord, slack, mailto, ntfy, matrix or sns), may be repeated", func(s string) error {
+		config.notifyURLs = append(config.notifyURLs, strings.Fields(s)...)
+		return nil
+	})
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	showConfig := flag.Bool("print-config", false, "Print the settings and notification channels in effect, secrets masked, and exit")
 	flag.Parse()
 
-	// Create application with our config
+	if *showVersion {
+		fmt.Println(Build())
+		return
+	}
+
+	// Notification channels are checked before anything is opened
+	notifiers, err := buildNotifiers(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *showConfig {
+		printConfig(notifiers)
+		return
+	}
+
+	// Send our own log to a file if asked, before anything is logged
+	var logFile *LogFile
+	if config.logPath != "" {
+		if config.logMaxSize < 0 || config.logMaxAge < 0 || config.logBackups < 0 {
+			log.Fatal("-log-max-size, -log-max-age and -log-max-backups can't be negative")
+		}
+		var err error
+		logFile, err = OpenLogFile(config.logPath, config.logMaxSize, config.logMaxAge, config.logBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(logFile)
+	}
+
+	log.Println("Running", Build())
+
+	if config.dbKey != "" && !dbEncryption {
+		log.Fatal("-db-key is set but this build can't open encrypted databases, build with -tags sqlcipher")
+	}
+
+	// Encrypting has to happen before the database is opened with the key
+	if flag.Arg(0) == "db" {
+		if err := DBCommand(&config, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Create application with our config, and the notification channels of
+	// the individual flags and -notify-urls, camera list shows them too
 	app := New(&config)
+	app.Notifiers = notifiers
+
+	// Media is encrypted at rest with a key of its own, commands need it too
+	if config.mediaKeyFile != "" {
+		key, err := LoadMediaKey(config.mediaKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.MediaKey = key
+	}
+
+	// Run a command (timelapse, user) and exit
+	if flag.NArg() > 0 {
+		app.RunCommand(flag.Args())
+		return
+	}
+
+	// A moved data directory would look like every file went missing
+	if err := app.checkDataDir(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Sign in is only required once there are users
+	if app.HasUsers() {
+		if config.apiKey == "" && config.uploadSecret == "" {
+			log.Println("WARNING: users exist but no -api-key or -upload-secret is set, uploads are accepted from anyone")
+		}
+	} else {
+		log.Println("No users exist, the web interface is open to everyone")
+	}
+
+	// Make it hard to miss that no alerts will go out
+	if config.notifyDryRun {
+		log.Println("****************************************************************")
+		log.Println("* NOTIFY DRY RUN: alerts are logged and will NOT be sent        *")
+		log.Println("****************************************************************")
+	}
+
+	// Find out about bad Twilio credentials now rather than at the next event
+	if config.twilioCheck {
+		if err := app.CheckTwilio(); err != nil {
+			log.Println("WARNING: Twilio credentials check failed, alerts will not be sent")
+			log.Println(err.Error())
+		} else {
+			log.Println("Twilio credentials OK")
+		}
+	}
+
+	// Background video conversion, picking up where the last run left off
+	if config.transcode.workers < 1 {
+		log.Fatal("-transcode-workers must be at least 1")
+	}
+	app.Transcodes.Start(app, config.transcode.workers)
+	go app.RequeuePending()
+
+	// Size and hash media from before the media table
+	go app.BackfillMedia()
+	go app.BackfillEventSizes()
+
+	// Profiling and counters on their own listener
+	if config.debugAddr != "" {
+		go app.ListenDebug(config.debugAddr)
+	}
+
+	// Camera ingestion over gRPC
+	if config.grpcAddr != "" {
+		go app.ListenGRPC(config.grpcAddr)
+	}
+
+	// Local scripts run for every new event and through its life
+	if config.hookPath != "" {
+		path, err := exec.LookPath(config.hookPath)
+		if err != nil {
+			log.Fatalf("Invalid -hook: %s", err)
+		}
+		config.hookPath = path
+	}
+	if config.hooksDir != "" {
+		if err := checkHooksDir(config.hooksDir); err != nil {
+			log.Fatalf("Invalid -hooks-dir: %s", err)
+		}
+	}
+	if config.hookPath != "" || config.hooksDir != "" {
+		if config.hookWorkers < 1 {
+			log.Fatal("-hook-concurrency must be at least 1")
+		}
+		app.Hooks = make(chan struct{}, config.hookWorkers)
+	}
+
+	// Notification channels
+	if len(config.ntfyThresholds) > 0 && !config.motionScore {
+		log.Println("WARNING: -ntfy-score-priority has no effect without -motion-score")
+	}
+	if len(notifiers) > 0 && config.baseURL == "" {
+		log.Println("WARNING: no -base-url given, alerts won't link to events or carry their image")
+	}
+	for _, n := range notifiers {
+		log.Printf("Alerting over %s to %s\n", n.Channel(), n.Target())
+	}
+
+	// Fetching media for cameras that can't upload, from allowed hosts only
+	if len(config.fetchAllow.hosts) > 0 || len(config.fetchAllow.nets) > 0 {
+		app.Fetcher = newFetchClient(&config)
+	}
+
+	// Exporting events to Google Drive and Dropbox on request
+	if app.Exporters, err = buildExporters(&config); err != nil {
+		log.Fatal(err)
+	}
+	for _, exporter := range app.Exporters {
+		log.Printf("Exporting to %s on request\n", exporter.Title())
+	}
+
+	// Webhooks and notifications, including retries left over from the last run
+	if config.webhookURL != "" || len(app.Notifiers) > 0 || config.detectURL != "" || len(config.escalation) > 0 || len(app.Exporters) > 0 {
+		go app.DeliverySender()
+	}
+
+	// Alert when the disk fills up
+	if config.diskAlert != "" {
+		threshold, err := ParseDiskThreshold(config.diskAlert)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go app.DiskMonitor(threshold)
+	}
+
+	// Alert when conversions back up, e.g. when the CPU is throttled
+	if config.transcode.alertAge > 0 {
+		go app.TranscodeMonitor(config.transcode.alertAge)
+	}
+
+	// Delete events past the retention limits or their own expiry
+	go app.RetentionSweeper()
+	go app.ArchiveBuilder()
+
+	// Weekly report by email
+	if config.reportSchedule != nil {
+		if app.reportNotifier() == nil {
+			log.Fatal("-report-schedule needs a mailto:// or mailtos:// URL in -notify-urls to send with")
+		}
+		t, err := loadReportTemplate(&config)
+		if err != nil {
+			log.Fatalf("Invalid report template: %s", err)
+		}
+		app.Report = t
+		go app.ReportScheduler()
+	}
+
+	// Escalation of alerts nobody acknowledged
+	if len(config.escalation) > 0 {
+		go app.EscalationScheduler()
+	}
+
+	// Snapshots of the cameras set up with the camera command
+	go app.SnapshotPoller()
+
+	// Nightly timelapse job
+	if config.timelapse {
+		go app.TimelapseScheduler()
+	}
 
 	// Our few routes
-	app.Router.GET("/", app.IndexHandler)
-	app.Router.POST("/event/new", app.NewEventHandler)
+	app.Routes()
 
-	// Handler for serving files in case we are not behind something else such as nginx
-	app.Router.ServeFiles("/data/*filepath", http.Dir(app.Config.dirs.data))
+	// Refuse to start with an API description that doesn't match the routes
+	if err := app.CheckAPISpec(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Wrap the router with our middleware
+	handler := app.Handler()
+
+	// On SIGUSR1 reopen the access log for logrotate and rotate our own log
+	if app.AccessLog != nil || logFile != nil {
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				if app.AccessLog != nil {
+					app.AccessLog.Reopen()
+				}
+				if logFile == nil {
+					continue
+				}
+				if err := logFile.Rotate(); err != nil {
+					log.Printf("Error rotating log file %s\n", config.logPath)
+					log.Println(err.Error())
+				}
+			}
+		}()
+	}
 
 	// Start HTTP server
-	log.Println("Starting")
-	log.Fatal(http.ListenAndServe(config.addr, app.Router))
+	mode, err := strconv.ParseUint(config.socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid -socket-mode %q, expected octal permissions such as 0660", config.socketMode)
+	}
+	listener, err := Listen(config.addr, os.FileMode(mode))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+
+	// Stop gracefully on SIGINT/SIGTERM: finish requests in flight, then the
+	// conversions, leaving queued events pending for the next start
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("Stopping")
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.stopTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Error waiting for requests to finish")
+			log.Println(err.Error())
+		}
+		app.Transcodes.Shutdown(config.stopTimeout)
+		close(stopped)
+	}()
+
+	log.Println("Starting on", listener.Addr())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("Stopped")
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The app logs every upload and migration, only -v needs to see that
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// Config with the flag defaults the app needs, everything stored under a
+// temporary directory. Tests change what they need before calling New.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	return &Config{
+		db:               filepath.Join(dir, "events.db"),
+		language:         "en",
+		secret:           "test",
+		shareTTL:         24 * time.Hour,
+		sessionTTL:       time.Hour,
+		uploadSkew:       5 * time.Minute,
+		incidentWindow:   2 * time.Minute,
+		preAcceptTimeout: 10 * time.Second,
+		preAcceptOnError: PreAcceptOnErrorAccept,
+		busyRetries:      3,
+		liveViewers:      2,
+		thumbFrame:       ThumbFrameScene,
+		thumbSize:        1 << 20,
+		dirs: dirs{
+			data:    filepath.Join(dir, "data"),
+			staging: filepath.Join(dir, "staging"),
+			thumbs:  filepath.Join(dir, "thumbs"),
+			tmpl:    "tmpl",
+		},
+		transcode: transcode{
+			ffmpegPath: "ffmpeg",
+			videoCodec: "h264",
+			crf:        -1,
+			workers:    1,
+		},
+	}
+}
+
+// App on a fresh database and data directory.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	return newTestAppWith(t, testConfig(t))
+}
+
+func newTestAppWith(t *testing.T, config *Config) *App {
+	t.Helper()
+	app := New(config)
+	t.Cleanup(func() { app.DB.Close() })
+	return app
+}
+
+// Server running the app's routes behind all of its middleware.
+func newTestServer(t *testing.T, app *App) *httptest.Server {
+	t.Helper()
+	app.Routes()
+	server := httptest.NewServer(app.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Stages a file as an upload would, named name with the given contents.
+func stageTestFile(t *testing.T, app *App, name, contents string) stagedFile {
+	t.Helper()
+	path, err := app.StageUpload(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stagedFile{Path: path, Name: name}
+}
+
+// Upload of a video and image staged like /event/new stages them.
+func stageTestUpload(t *testing.T, app *App, name string) eventUpload {
+	t.Helper()
+	return eventUpload{
+		Name:   name,
+		Videos: []stagedFile{stageTestFile(t, app, "clip.avi", "video of "+name)},
+		Images: []stagedFile{stageTestFile(t, app, "clip.jpg", "image of "+name)},
+	}
+}
+
+// Names of the files in a directory, sorted.
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Makes every insert into table fail, as a locked or broken database would.
+func failInserts(t *testing.T, app *App, table string) {
+	t.Helper()
+	sql_trigger := `CREATE TRIGGER fail_` + table + ` BEFORE INSERT ON ` + table + ` BEGIN SELECT RAISE(ABORT, 'injected failure'); END`
+	if _, err := app.DB.Exec(sql_trigger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventCount(t *testing.T, app *App) int {
+	t.Helper()
+	var count int
+	if err := app.DB.QueryRow(`SELECT count(*) FROM events`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// A failing store leaves no files behind, in the data directory or staging.
+func TestStoreEventFailureLeavesNoFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		camera string
+		inject func(t *testing.T, app *App)
+	}{
+		{"event insert", "", func(t *testing.T, app *App) { failInserts(t, app, "events") }},
+		{"media insert", "", func(t *testing.T, app *App) { failInserts(t, app, "media") }},
+		{"camera insert", "porch", func(t *testing.T, app *App) { failInserts(t, app, "cameras") }},
+		{"event size", "", func(t *testing.T, app *App) {
+			// The event's size is written in the same transaction, after the media
+			if _, err := app.DB.Exec(`CREATE TRIGGER fail_size BEFORE UPDATE OF size_bytes ON events BEGIN SELECT RAISE(ABORT, 'injected failure'); END`); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"data directory gone", "", func(t *testing.T, app *App) {
+			if err := os.RemoveAll(app.Config.dirs.data); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(t)
+			upload := stageTestUpload(t, app, "front door")
+			upload.Camera = test.camera
+			test.inject(t, app)
+
+			if _, err := app.StoreEvent(app.Logger, "", upload); err == nil {
+				t.Fatal("expected the store to fail")
+			}
+			if files := dirFiles(t, app.Config.dirs.data); len(files) != 0 {
+				t.Errorf("orphaned files in the data directory: %v", files)
+			}
+			if files := dirFiles(t, app.Config.dirs.staging); len(files) != 0 {
+				t.Errorf("files left in staging: %v", files)
+			}
+			if count := eventCount(t, app); count != 0 {
+				t.Errorf("%d events stored", count)
+			}
+		})
+	}
+}
+
+// Once the event is stored it stands, even when queueing its notifications
+// fails.
+func TestStoreEventStandsWhenNotifyingFails(t *testing.T) {
+	config := testConfig(t)
+	config.webhookURL = "http://127.0.0.1:1/hook"
+	app := newTestAppWith(t, config)
+	failInserts(t, app, "deliveries")
+
+	created, err := app.StoreEvent(app.Logger, "", stageTestUpload(t, app, "front door"))
+	if err != nil {
+		t.Fatalf("StoreEvent: %s", err)
+	}
+	event, err := app.FindEvent(created.Id)
+	if err != nil {
+		t.Fatalf("event is gone: %s", err)
+	}
+	for _, path := range []string{event.Video, event.Image} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("file of the event is gone: %s", err)
+		}
+	}
+	if files := dirFiles(t, app.Config.dirs.staging); len(files) != 0 {
+		t.Errorf("files left in staging: %v", files)
+	}
+}
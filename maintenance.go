@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Wraps a handler that changes data so it's refused while in maintenance mode.
+func (app *App) Writable(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if app.ReadOnly.Load() {
+			w.Header().Set("Retry-After", "300")
+			writeJSONError(w, http.StatusServiceUnavailable, "server is in maintenance mode, changes are not accepted right now")
+			return
+		}
+
+		next(w, r, p)
+	}
+}
+
+// Turns maintenance mode on or off. The enabled parameter sets the state
+// explicitly, without it the current state is flipped.
+func (app *App) MaintenanceHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	enabled := !app.ReadOnly.Load()
+	if v := r.FormValue("enabled"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "enabled", "enabled must be true or false")
+			return
+		}
+		enabled = b
+	}
+
+	detail := "disabled"
+	if enabled {
+		detail = "enabled"
+	}
+	if err := Audit(app.DB, actorOf(r), "maintenance", 0, r.RemoteAddr, detail); err != nil {
+		panic(err)
+	}
+
+	app.ReadOnly.Store(enabled)
+	if enabled {
+		app.Log(r).Printf("Maintenance mode enabled by %s\n", r.RemoteAddr)
+	} else {
+		app.Log(r).Printf("Maintenance mode disabled by %s\n", r.RemoteAddr)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"read_only": enabled})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Queued Matrix messages about an event. The image is read and uploaded when
+// they're sent.
+type matrixMessage struct {
+	Image string `json:"image"`
+	Text  string `json:"text"`
+}
+
+// Error response of the Matrix client-server API
+type matrixError struct {
+	Code         string `json:"errcode"`
+	Message      string `json:"error"`
+	RetryAfterMS int64  `json:"retry_after_ms"`
+}
+
+// Largest image uploaded with a Matrix alert, homeservers refuse more by default
+const matrixMaxImage = 50 << 20
+
+// Notifier posting alerts to a Matrix room
+type matrixNotifier struct {
+	notifierBase
+	homeserver string
+	token      string
+	room       string // Room ID such as !abc:example.org
+}
+
+// Where messages go, without the token.
+func (n matrixNotifier) String() string {
+	return strings.TrimRight(n.homeserver, "/") + "/" + n.room
+}
+
+// Builds the Matrix messages about an event.
+func (n matrixNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	text := app.T("alert.event_captured", event.Name, app.FormatTime(event.Time))
+	if camera != "" {
+		text += app.T("alert.by", camera)
+	}
+	if where := event.Where(); where != "" {
+		text += app.T("alert.near", where)
+	}
+	text += ". " + app.PublicURL(fmt.Sprintf("/event/%d", event.Id))
+	return json.Marshal(matrixMessage{Image: event.Image, Text: text})
+}
+
+// Uploads the event's image to the homeserver's media repository and sends it
+// to the room as an m.image, followed by the details as an m.text. Transaction
+// IDs are derived from the delivery, so a retry doesn't post either twice.
+func (n matrixNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	var message matrixMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, err
+	}
+
+	image, err := app.readAlertImage(message.Image, matrixMaxImage)
+	if err != nil {
+		return 0, err
+	}
+	if image != nil {
+		contentType := "application/octet-stream"
+		if media, ok := mediaTypes[strings.ToLower(filepath.Ext(message.Image))]; ok {
+			contentType = media.contentType
+		}
+		name := "snapshot" + filepath.Ext(message.Image)
+
+		var uploaded struct {
+			ContentURI string `json:"content_uri"`
+		}
+		status, err := n.request(http.MethodPost, "/_matrix/media/v3/upload?filename="+url.QueryEscape(name), contentType, image, &uploaded)
+		if err != nil {
+			return status, err
+		}
+		content := map[string]interface{}{
+			"msgtype": "m.image",
+			"body":    name,
+			"url":     uploaded.ContentURI,
+			"info":    map[string]interface{}{"mimetype": contentType, "size": len(image)},
+		}
+		if status, err := n.send(fmt.Sprintf("seccam-%d-image", id), content); err != nil {
+			return status, err
+		}
+	}
+
+	return n.send(fmt.Sprintf("seccam-%d-text", id), map[string]interface{}{"msgtype": "m.text", "body": message.Text})
+}
+
+// Sends an m.room.message to the room.
+func (n matrixNotifier) send(txnID string, content interface{}) (int, error) {
+	body, err := json.Marshal(content)
+	if err != nil {
+		return 0, err
+	}
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(n.room) + "/send/m.room.message/" + txnID
+	return n.request(http.MethodPut, path, "application/json", body, nil)
+}
+
+// Makes an authenticated request to the homeserver, decoding the response into
+// v. Rate limiting returns a rateLimitedError with the wait the homeserver
+// asked for, a rejected access token is logged as such since retrying won't
+// help until it's replaced.
+func (n matrixNotifier) request(method, path, contentType string, body []byte, v interface{}) (int, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(n.homeserver, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.token)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "seccam-web")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var matrixErr matrixError
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&matrixErr)
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			after := time.Duration(matrixErr.RetryAfterMS) * time.Millisecond
+			if after <= 0 {
+				after = time.Second
+			}
+			return resp.StatusCode, &rateLimitedError{after: after}
+		case matrixErr.Code == "M_UNKNOWN_TOKEN" || matrixErr.Code == "M_MISSING_TOKEN":
+			log.Printf("ERROR: the Matrix access token for %s has expired or was revoked, alerts can't be posted until it's replaced\n", n.Channel())
+		}
+		if matrixErr.Code != "" {
+			return resp.StatusCode, fmt.Errorf("matrix responded %s, %s: %s", resp.Status, matrixErr.Code, matrixErr.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("matrix responded %s", resp.Status)
+	}
+
+	if v != nil {
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(v); err != nil {
+			return resp.StatusCode, err
+		}
+	} else {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	}
+	return resp.StatusCode, nil
+}
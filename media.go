@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Kinds of media attached to an event
+const (
+	MediaVideo = "video"
+	MediaImage = "image"
+)
+
+// File attached to an event. The event's first video and image are also kept on
+// the event itself, the first image serves as its thumbnail.
+type Media struct {
+	Id      int64     `json:"id"`
+	EventId int64     `json:"-"`
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"` // Hex SHA-256 of the file
+	Created time.Time `json:"created_at"`
+}
+
+// Create the media table in our database.
+func CreateMediaTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS media(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		path TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		hash TEXT NOT NULL DEFAULT '',
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the size and hex SHA-256 of a file.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Attaches a file to an event.
+func addMedia(tx execer, eventID int64, kind, path string) error {
+	size, hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	sql_media := `INSERT INTO media(event_id, kind, path, size, hash) VALUES (?, ?, ?, ?, ?)`
+	_, err = tx.Exec(sql_media, eventID, kind, path, size, hash)
+	return err
+}
+
+// Points an event's media at a replacement file, e.g. a converted video.
+func replaceMedia(tx execer, eventID int64, oldPath, newPath string) error {
+	size, hash, err := hashFile(newPath)
+	if err != nil {
+		return err
+	}
+
+	sql_media := `UPDATE media SET path = ?, size = ?, hash = ? WHERE event_id = ? AND path = ?`
+	_, err = tx.Exec(sql_media, newPath, size, hash, eventID, oldPath)
+	return err
+}
+
+// Retrieves every file attached to an event, videos first and then images, each
+// in upload order.
+func (app *App) EventMedia(eventID int64) ([]*Media, error) {
+	sql_media := `
+	SELECT id, event_id, kind, path, size, hash, created FROM media
+	WHERE event_id = ? ORDER BY kind = 'image', id`
+	rows, err := app.DB.Query(sql_media, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	media := make([]*Media, 0)
+	for rows.Next() {
+		m := new(Media)
+		if err := rows.Scan(&m.Id, &m.EventId, &m.Kind, &m.Path, &m.Size, &m.Hash, &m.Created); err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+
+	return media, rows.Err()
+}
+
+// Fills in the size and hash of media carried over from before the media table,
+// they were migrated without either.
+func (app *App) BackfillMedia() {
+	rows, err := app.DB.Query(`SELECT id, path FROM media WHERE hash = ''`)
+	if err != nil {
+		log.Println("Error finding media to backfill")
+		log.Println(err.Error())
+		return
+	}
+	paths := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			break
+		}
+		paths[id] = path
+	}
+	rows.Close()
+
+	filled := 0
+	for id, path := range paths {
+		size, hash, err := hashFile(path)
+		if err != nil {
+			// Files can be long gone, leave those be
+			continue
+		}
+		if _, err := app.DB.Exec(`UPDATE media SET size = ?, hash = ? WHERE id = ?`, size, hash, id); err != nil {
+			log.Printf("Error backfilling media %d\n", id)
+			log.Println(err.Error())
+			return
+		}
+		filled++
+	}
+	if filled > 0 {
+		log.Printf("Backfilled size and hash of %d media files\n", filled)
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted media files start with a header of the magic, the ID of the key
+// they were encrypted with and a random nonce, followed by the file in chunks
+// of mediaChunk bytes, each sealed with AES-GCM on its own so files can be
+// read from anywhere (for ranges) without decrypting what comes before.
+const (
+	mediaMagic  = "SECCAMv1"
+	mediaKeyID  = 4
+	mediaHeader = len(mediaMagic) + mediaKeyID + 12
+	mediaChunk  = 64 << 10
+)
+
+var (
+	errMediaKey     = errors.New("encrypted with a different key")
+	errMediaCorrupt = errors.New("encrypted media is corrupt or truncated")
+)
+
+// Key media files are encrypted with
+type mediaCipher struct {
+	aead cipher.AEAD
+	id   [mediaKeyID]byte
+}
+
+// Reads a media key from a file holding 32 bytes as 64 hex characters, such as
+// the output of openssl rand -hex 32.
+func LoadMediaKey(path string) (*mediaCipher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must hold a 32 byte key as 64 hex characters", path)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &mediaCipher{aead: aead}
+	sum := sha256.Sum256(key)
+	copy(c.id[:], sum[:])
+	return c, nil
+}
+
+// Nonce and additional data of a chunk. Chunks are numbered into the file's
+// nonce and the last one is marked, so they can't be reordered or cut off.
+func chunkParams(header []byte, index uint32, last bool) ([]byte, []byte) {
+	nonce := append([]byte(nil), header[len(mediaMagic)+mediaKeyID:]...)
+	counter := binary.BigEndian.Uint32(nonce[8:]) ^ index
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+
+	aad := append(append([]byte(nil), header...), 0)
+	if last {
+		aad[len(aad)-1] = 1
+	}
+	return nonce, aad
+}
+
+// Encrypts src into dst.
+func (c *mediaCipher) seal(dst io.Writer, src io.Reader) error {
+	header := make([]byte, mediaHeader)
+	copy(header, mediaMagic)
+	copy(header[len(mediaMagic):], c.id[:])
+	if _, err := rand.Read(header[len(mediaMagic)+mediaKeyID:]); err != nil {
+		return err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	// Even an empty file gets a (last) chunk, so it can't pass for a cut off one
+	in := bufio.NewReaderSize(src, mediaChunk)
+	buf := make([]byte, mediaChunk)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < mediaChunk
+		if !last {
+			_, err := in.Peek(1)
+			last = err == io.EOF
+		}
+		nonce, aad := chunkParams(header, index, last)
+		if _, err := dst.Write(c.aead.Seal(nil, nonce, buf[:n], aad)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Encrypts the file at src into a new file at dst, which only appears once
+// complete.
+func (c *mediaCipher) sealFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeAtomic(dst, func(w io.Writer) error {
+		return c.seal(w, in)
+	})
+}
+
+// Writes a file through a temporary file next to it, moved into place once
+// write succeeded and it's synced.
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Decrypting reader of an encrypted media file, seekable for serving ranges
+type sealedReader struct {
+	f      *os.File
+	c      *mediaCipher
+	header []byte
+	chunks int64 // Number of chunks in the file
+	size   int64 // Size of the decrypted file
+	off    int64
+	index  int64 // Chunk held in plain, -1 for none
+	plain  []byte
+}
+
+// Reads the header of an encrypted media file, sealed is false for plaintext.
+func readMediaHeader(f io.ReaderAt) (header []byte, sealed bool, err error) {
+	header = make([]byte, mediaHeader)
+	n, err := f.ReadAt(header, 0)
+	if n < mediaHeader || !bytes.Equal(header[:len(mediaMagic)], []byte(mediaMagic)) {
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+	return header, true, nil
+}
+
+// Opens an encrypted media file for reading.
+func (c *mediaCipher) open(f *os.File, header []byte) (*sealedReader, error) {
+	if !bytes.Equal(header[len(mediaMagic):len(mediaMagic)+mediaKeyID], c.id[:]) {
+		return nil, errMediaKey
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := int64(c.aead.Overhead())
+	body := info.Size() - int64(mediaHeader)
+	sealed := mediaChunk + overhead
+	chunks := (body + sealed - 1) / sealed
+	if chunks == 0 || body-(chunks-1)*sealed < overhead {
+		return nil, errMediaCorrupt
+	}
+	return &sealedReader{
+		f:      f,
+		c:      c,
+		header: header,
+		chunks: chunks,
+		size:   body - chunks*overhead,
+		index:  -1,
+	}, nil
+}
+
+// Decrypts the chunk holding the current offset.
+func (r *sealedReader) load(index int64) error {
+	overhead := int64(r.c.aead.Overhead())
+	sealed := mediaChunk + overhead
+	buf := make([]byte, sealed)
+	n, err := r.f.ReadAt(buf, int64(mediaHeader)+index*sealed)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	nonce, aad := chunkParams(r.header, uint32(index), index == r.chunks-1)
+	plain, err := r.c.aead.Open(buf[:0], nonce, buf[:n], aad)
+	if err != nil {
+		return errMediaCorrupt
+	}
+	r.index, r.plain = index, plain
+	return nil
+}
+
+func (r *sealedReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	index := r.off / mediaChunk
+	if index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.off-index*mediaChunk:])
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *sealedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *sealedReader) Close() error {
+	return r.f.Close()
+}
+
+// Opens a media file for reading, decrypting it if it's encrypted. Files from
+// before encryption was turned on are read as they are.
+func (app *App) openMedia(path string) (io.ReadSeekCloser, error) {
+	return openMediaWith(app.MediaKey, path)
+}
+
+func openMediaWith(c *mediaCipher, path string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header, sealed, err := readMediaHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !sealed {
+		return f, nil
+	}
+	if c == nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is encrypted, -media-key-file is needed to read it", path)
+	}
+	r, err := c.open(f, header)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Size of a media file as it reads, decrypted if it's encrypted.
+func (app *App) mediaSize(path string) (int64, error) {
+	f, err := app.openMedia(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.Seek(0, io.SeekEnd)
+}
+
+// Serves a media file, decrypted. Headers set before, such as the content type,
+// are kept.
+func (app *App) serveMedia(w http.ResponseWriter, r *http.Request, path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := app.openMedia(path)
+	if err != nil {
+		app.Log(r).Printf("Error opening %s\n", path)
+		app.Log(r).Println(err.Error())
+		http.Error(w, "media unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	streamResponse(w)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// Returns the path of a decrypted copy of a media file for tools like ffmpeg
+// that read files themselves, and a function wiping the copy. Plaintext files
+// are used as they are. Copies go in the staging directory, where leftovers
+// from a crash are removed on the next start.
+func (app *App) plainCopy(path string) (string, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	_, sealed, err := readMediaHeader(f)
+	f.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	if !sealed {
+		return path, func() {}, nil
+	}
+
+	src, err := app.openMedia(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(app.Config.dirs.staging, "plain-*"+filepath.Ext(path))
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		wipeFile(tmp.Name())
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		wipeFile(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), func() { wipeFile(tmp.Name()) }, nil
+}
+
+// Runs write with a path to write a media file to, then encrypts what it wrote
+// into dst. Without a media key it writes dst directly. The plaintext goes in
+// the staging directory, named with the extension of dst for ffmpeg to go by,
+// and is wiped afterwards.
+func (app *App) sealedOutput(dst string, write func(path string) error) error {
+	if app.MediaKey == nil {
+		return write(dst)
+	}
+
+	tmp, err := os.CreateTemp(app.Config.dirs.staging, "plain-*"+filepath.Ext(dst))
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer wipeFile(tmp.Name())
+	if err := write(tmp.Name()); err != nil {
+		return err
+	}
+	return app.MediaKey.sealFile(tmp.Name(), dst)
+}
+
+// Moves a staged upload into the data directory, encrypting it on the way when
+// there's a media key.
+func (app *App) moveMedia(src, dst string) error {
+	if app.MediaKey == nil {
+		return os.Rename(src, dst)
+	}
+	if err := app.MediaKey.sealFile(src, dst); err != nil {
+		return err
+	}
+	wipeFile(src)
+	return nil
+}
+
+// Overwrites a file with zeros before removing it. This is best effort,
+// journaling and copy on write filesystems and SSDs may keep the old blocks.
+func wipeFile(path string) {
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		zeroFile(f)
+		f.Close()
+	}
+	os.Remove(path)
+}
+
+// Overwrites an open file with zeros.
+func zeroFile(f *os.File) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	zeros := make([]byte, 64<<10)
+	for left := info.Size(); left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return
+		}
+		left -= n
+	}
+	f.Sync()
+}
+
+// Encrypts every file in the data directory with the current -media-key-file,
+// to turn encryption on for existing media or move it to a new key:
+//
+//	media encrypt [--old-key-file=FILE]
+//
+// Plaintext files are encrypted, files encrypted with the old key re-encrypted
+// and those already on the current key left alone, so it can be run again after
+// being interrupted. Stop the server first. The cached thumbnails are dropped,
+// they're made again on request.
+func (app *App) MediaCommand(args []string) error {
+	if len(args) == 0 || args[0] != "encrypt" {
+		return fmt.Errorf("expected media encrypt")
+	}
+	cmd := flag.NewFlagSet("media encrypt", flag.ExitOnError)
+	oldKeyFile := cmd.String("old-key-file", "", "Key file the media was encrypted with before, to re-encrypt it with -media-key-file")
+	cmd.Parse(args[1:])
+
+	if app.MediaKey == nil {
+		return errors.New("-media-key-file is required")
+	}
+	var oldKey *mediaCipher
+	if *oldKeyFile != "" {
+		var err error
+		if oldKey, err = LoadMediaKey(*oldKeyFile); err != nil {
+			return err
+		}
+	}
+
+	encrypted, failed := 0, 0
+	err := filepath.WalkDir(app.Config.dirs.data, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		done, err := app.resealMedia(path, oldKey)
+		if err != nil {
+			log.Printf("Error encrypting %s\n", path)
+			log.Println(err.Error())
+			failed++
+		} else if done {
+			encrypted++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	app.Thumbs.Clear()
+	log.Printf("Encrypted %d files, %d failed\n", encrypted, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files couldn't be encrypted", failed)
+	}
+	return nil
+}
+
+// Encrypts a media file with the current key in place, decrypting it with
+// oldKey first if it was encrypted with that. The media rows of the file get
+// its new size and hash. Returns false for files already on the current key.
+func (app *App) resealMedia(path string, oldKey *mediaCipher) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	header, sealed, err := readMediaHeader(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	var from *mediaCipher
+	if sealed {
+		id := header[len(mediaMagic) : len(mediaMagic)+mediaKeyID]
+		switch {
+		case bytes.Equal(id, app.MediaKey.id[:]):
+			return false, nil
+		case oldKey != nil && bytes.Equal(id, oldKey.id[:]):
+			from = oldKey
+		default:
+			return false, errMediaKey
+		}
+	}
+
+	src, err := openMediaWith(from, path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	// The plaintext is kept open to be wiped once the encrypted file replaced it
+	var plain *os.File
+	if !sealed {
+		if plain, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+			return false, err
+		}
+		defer plain.Close()
+	}
+	if err := writeAtomic(path, func(w io.Writer) error {
+		return app.MediaKey.seal(w, src)
+	}); err != nil {
+		return false, err
+	}
+	if plain != nil {
+		zeroFile(plain)
+	}
+
+	return true, app.rehashMedia(path)
+}
+
+// Updates the size and hash of the media rows of a file that changed, along
+// with the sizes of their events.
+func (app *App) rehashMedia(path string) error {
+	size, hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE media SET size = ?, hash = ? WHERE path = ?`, size, hash, path); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT DISTINCT event_id FROM media WHERE path = ?`, path)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := setEventSize(tx, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Columns holding paths of files in the data directory
+var dataPathColumns = []struct{ table, column string }{
+	{"events", "video"},
+	{"events", "image"},
+	{"media", "path"},
+	{"timelapses", "video"},
+	{"exports", "path"},
+	{"trash", "path"},
+	{"archives", "path"},
+}
+
+// Most recent media files looked for on startup
+const dataDirSample = 20
+
+// Outcome of a data directory migration
+type dataMigration struct {
+	Copied  int   // Files copied this run
+	Skipped int   // Files copied by an earlier run
+	Missing int   // Files the database refers to that are gone, their paths are rewritten all the same
+	Removed int   // Originals removed with --move
+	Bytes   int64 // Copied this run
+}
+
+// Copies every file the database refers to from the data directory to
+// another one, then points the database at the copies:
+//
+//	migrate-data --to=DIR [--move]
+//
+// Files are copied under the same relative path and read back to check their
+// size and hash. Files a previous run copied are checked and skipped, so an
+// interrupted migration can be run again. Paths are only rewritten, all in one
+// transaction, once every file made it. With --move the originals are removed
+// after that. Stop the server first and start it with -data DIR afterwards.
+func (app *App) MigrateDataCommand(args []string) error {
+	cmd := flag.NewFlagSet("migrate-data", flag.ExitOnError)
+	to := cmd.String("to", "", "Directory to move the data to")
+	move := cmd.Bool("move", false, "Remove the originals once the database points at the copies")
+	cmd.Parse(args)
+
+	if *to == "" {
+		return errors.New("--to is required")
+	}
+	from := app.Config.dirs.data
+	if same, err := sameDir(from, *to); err != nil {
+		return err
+	} else if same {
+		return fmt.Errorf("%s is the data directory already", *to)
+	}
+	if err := os.MkdirAll(*to, 0775); err != nil {
+		return err
+	}
+
+	paths, err := app.dataPaths()
+	if err != nil {
+		return err
+	}
+
+	var result dataMigration
+	renames := make(map[string]string)
+	failed := 0
+	for _, path := range paths {
+		rel, ok := relativeTo(from, path)
+		if !ok {
+			// Already moved by an earlier run, or never in the data directory
+			continue
+		}
+		dst := filepath.Join(*to, rel)
+		renames[path] = dst
+
+		copied, n, err := copyVerified(path, dst)
+		switch {
+		case os.IsNotExist(err) && fileExists(dst):
+			// Moved by hand, or by an earlier run with --move
+			result.Skipped++
+		case os.IsNotExist(err):
+			result.Missing++
+		case err != nil:
+			log.Printf("Error copying %s\n", path)
+			log.Println(err.Error())
+			failed++
+		case copied:
+			result.Copied++
+			result.Bytes += n
+		default:
+			result.Skipped++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files couldn't be copied, nothing was changed in the database, run it again once that's fixed", failed)
+	}
+
+	if len(renames) > 0 {
+		if err := app.rewriteDataPaths(renames, *to); err != nil {
+			return fmt.Errorf("rewriting paths, the copies are kept: %w", err)
+		}
+	}
+
+	if *move {
+		if result.Removed, err = app.removeMigrated(from, *to); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Copied %d files (%s), %d copied before, %d missing, %d originals removed. Start with -data %s from now on.\n",
+		result.Copied, formatBytes(uint64(result.Bytes)), result.Skipped, result.Missing, result.Removed, *to)
+	return nil
+}
+
+// Every distinct path the database refers to.
+func (app *App) dataPaths() ([]string, error) {
+	var selects []string
+	for _, c := range dataPathColumns {
+		selects = append(selects, fmt.Sprintf(`SELECT %s FROM %s WHERE %s != ''`, c.column, c.table, c.column))
+	}
+	rows, err := app.DB.Query(strings.Join(selects, " UNION ") + " ORDER BY 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// Points every column referring to an old path at its new one, in a single
+// transaction.
+func (app *App) rewriteDataPaths(renames map[string]string, to string) error {
+	return app.retryBusy(func() error {
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, c := range dataPathColumns {
+			sql_rename := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, c.table, c.column, c.column)
+			for old, path := range renames {
+				if _, err := tx.Exec(sql_rename, path, old); err != nil {
+					return err
+				}
+			}
+		}
+		if err := Audit(tx, ActorMigration, "migrate data", 0, "", fmt.Sprintf("%d files to %s", len(renames), to)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// Removes the originals of the files the database now has in the new
+// directory, those that are still there and match their copy.
+func (app *App) removeMigrated(from, to string) (int, error) {
+	paths, err := app.dataPaths()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, path := range paths {
+		rel, ok := relativeTo(to, path)
+		if !ok {
+			continue
+		}
+		old := filepath.Join(from, rel)
+		if _, _, err := copyVerified(old, path); err != nil {
+			continue
+		}
+		if err := os.Remove(old); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Copies src to dst and reads dst back to check it has the size and hash src
+// has, returning whether it copied and how much. A dst matching src already
+// is left as it is. The copy goes under a temporary name first, so an
+// interrupted copy is never mistaken for a complete one.
+func copyVerified(src, dst string) (bool, int64, error) {
+	size, hash, err := hashFile(src)
+	if err != nil {
+		return false, 0, err
+	}
+	if dstSize, dstHash, err := hashFile(dst); err == nil && dstSize == size && dstHash == hash {
+		return false, 0, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return false, 0, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return false, 0, err
+	}
+	defer in.Close()
+	tmp := dst + ".migrating"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return false, 0, err
+	}
+	defer os.Remove(tmp)
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	if copySize, copyHash, err := hashFile(tmp); err != nil {
+		return false, 0, err
+	} else if copySize != size || copyHash != hash {
+		return false, 0, fmt.Errorf("copy of %s doesn't match it, %d bytes instead of %d", src, copySize, size)
+	}
+	return true, n, os.Rename(tmp, dst)
+}
+
+// Path relative to dir, false if it isn't under dir.
+func relativeTo(dir, path string) (string, bool) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// Whether two paths are the same directory.
+func sameDir(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return absA == absB, nil
+}
+
+// Whether there's a file at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Refuses to start when -data doesn't hold the files the database refers to,
+// such as when the data was moved elsewhere. Only the most recent media files
+// are looked at: some may be missing, but not all of them.
+func (app *App) checkDataDir() error {
+	rows, err := app.DB.Query(`SELECT path FROM media ORDER BY id DESC LIMIT ?`, dataDirSample)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	hint := "point -data at where the files are, or restore them"
+	if _, ok := relativeTo(app.Config.dirs.data, paths[0]); !ok {
+		hint = fmt.Sprintf("the database refers to another data directory, run migrate-data --to=%s with -data set to that one", app.Config.dirs.data)
+	}
+	return fmt.Errorf("none of the %d most recent media files exist (e.g. %s), %s", len(paths), paths[0], hint)
+}
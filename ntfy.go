@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Priority of ntfy messages from motion scores of at least Score
+type ntfyThreshold struct {
+	Score    float64
+	Priority int
+}
+
+// Queued ntfy message about an event. Links are only set with -base-url, ntfy
+// can't use relative ones.
+type ntfyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+	Click    string `json:"click,omitempty"`
+	Attach   string `json:"attach,omitempty"`
+}
+
+// Parses comma separated score=priority thresholds such as 0.3=4,0.6=5, sorted
+// by score.
+func parseNtfyThresholds(s string) ([]ntfyThreshold, error) {
+	var thresholds []ntfyThreshold
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		score, priority, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not score=priority", entry)
+		}
+		t := ntfyThreshold{}
+		var err error
+		if t.Score, err = strconv.ParseFloat(score, 64); err != nil || t.Score < 0 || t.Score > 1 {
+			return nil, fmt.Errorf("invalid score %q, expected 0-1", score)
+		}
+		if t.Priority, err = strconv.Atoi(priority); err != nil || t.Priority < 1 || t.Priority > 5 {
+			return nil, fmt.Errorf("invalid priority %q, expected 1-5", priority)
+		}
+		thresholds = append(thresholds, t)
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i].Score < thresholds[j].Score })
+	return thresholds, nil
+}
+
+// Notifier publishing alerts to an ntfy topic
+type ntfyNotifier struct {
+	notifierBase
+	server   string
+	topic    string
+	token    string // Access token, or
+	user     string // basic auth for self-hosted servers
+	password string
+	priority int
+}
+
+// Where messages go, without the credentials.
+func (n ntfyNotifier) String() string {
+	return strings.TrimRight(n.server, "/") + "/" + n.topic
+}
+
+// Builds the ntfy message about an event.
+func (n ntfyNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	message := ntfyMessage{
+		Title:    app.T("alert.title", event.Name),
+		Message:  app.T("alert.captured", app.FormatTime(event.Time)),
+		Priority: n.eventPriority(app, event),
+		Click:    app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id)),
+		Attach:   app.AbsoluteURL(app.MediaURL(event.Image)),
+	}
+	if camera != "" {
+		message.Message += app.T("alert.by", camera)
+	}
+	if where := event.Where(); where != "" {
+		message.Message += app.T("alert.near", where)
+	}
+	return json.Marshal(message)
+}
+
+// Priority of the message about an event, from the highest threshold of
+// -ntfy-score-priority its motion score reaches, the notifier's otherwise.
+func (n ntfyNotifier) eventPriority(app *App, event *Event) int {
+	priority := n.priority
+	if event.Score == nil {
+		return priority
+	}
+	for _, t := range app.Config.ntfyThresholds {
+		if *event.Score >= t.Score {
+			priority = t.Priority
+		}
+	}
+	return priority
+}
+
+// Publishes a queued message to the topic, the details as headers and the
+// message as the body.
+func (n ntfyNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	var message ntfyMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.String(), strings.NewReader(message.Message))
+	if err != nil {
+		return 0, err
+	}
+	// Headers only hold ASCII, ntfy decodes RFC 2047 encoded words
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", message.Title))
+	req.Header.Set("Priority", strconv.Itoa(message.Priority))
+	req.Header.Set("Tags", "rotating_light")
+	if message.Click != "" {
+		req.Header.Set("Click", message.Click)
+	}
+	if message.Attach != "" {
+		req.Header.Set("Attach", message.Attach)
+	}
+	switch {
+	case n.token != "":
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	case n.user != "":
+		req.SetBasicAuth(n.user, n.password)
+	}
+	req.Header.Set("User-Agent", "seccam-web")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("ntfy responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
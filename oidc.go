@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/oauth2"
+)
+
+// Cookies holding the state of a login in progress
+const (
+	oidcStateCookie = "seccam_oidc_state"
+	oidcNonceCookie = "seccam_oidc_nonce"
+	oidcNextCookie  = "seccam_oidc_next"
+)
+
+// OpenID Connect provider, discovered on first use so the server can start while
+// the provider is down
+type oidcLogin struct {
+	mu       sync.Mutex
+	provider *oidc.Provider
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Whether single sign on is configured.
+func (app *App) OIDCEnabled() bool {
+	return app.Config.oidcIssuer != ""
+}
+
+// Returns the provider's OAuth2 config and ID token verifier, discovering the
+// provider if we haven't yet.
+func (app *App) oidcClient(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	app.OIDC.mu.Lock()
+	defer app.OIDC.mu.Unlock()
+
+	if app.OIDC.provider == nil {
+		provider, err := oidc.NewProvider(ctx, app.Config.oidcIssuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		app.OIDC.provider = provider
+		app.OIDC.oauth = &oauth2.Config{
+			ClientID:     app.Config.oidcClientID,
+			ClientSecret: app.Config.oidcClientSecret,
+			RedirectURL:  app.Config.oidcRedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		}
+		app.OIDC.verifier = provider.Verifier(&oidc.Config{ClientID: app.Config.oidcClientID})
+	}
+
+	return app.OIDC.oauth, app.OIDC.verifier, nil
+}
+
+// Sets a short lived cookie for the duration of a login.
+func (app *App) setLoginCookie(w http.ResponseWriter, r *http.Request, name, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     app.URL("/login/oidc"),
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns a random hex string for state and nonce values.
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Starts the code flow, sending the user to the provider.
+func (app *App) OIDCLoginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !app.OIDCEnabled() {
+		app.RenderError(w, r, http.StatusNotFound, "Single sign on is not configured.")
+		return
+	}
+
+	oauth, _, err := app.oidcClient(r.Context())
+	if err != nil {
+		app.Log(r).Println("Error discovering OpenID Connect provider")
+		app.Log(r).Println(err.Error())
+		app.RenderError(w, r, http.StatusBadGateway, "The sign on provider can't be reached right now, try again later.")
+		return
+	}
+
+	state, nonce := randomString(), randomString()
+	app.setLoginCookie(w, r, oidcStateCookie, state)
+	app.setLoginCookie(w, r, oidcNonceCookie, nonce)
+	app.setLoginCookie(w, r, oidcNextCookie, r.FormValue("next"))
+
+	http.Redirect(w, r, oauth.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// Completes the code flow, validating the state, ID token and nonce before
+// starting the same session a local login would.
+func (app *App) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	logger := app.Log(r)
+	fail := func(message string, err error) {
+		logger.Println("Single sign on failed:", message)
+		if err != nil {
+			logger.Println(err.Error())
+		}
+		app.RenderError(w, r, http.StatusBadRequest, "Signing in failed: "+message+". Please try again.")
+	}
+
+	if !app.OIDCEnabled() {
+		app.RenderError(w, r, http.StatusNotFound, "Single sign on is not configured.")
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		fail("the provider refused ("+e+")", nil)
+		return
+	}
+
+	// The state must match the one we sent the user off with
+	state, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.Value), []byte(r.FormValue("state"))) != 1 {
+		fail("the login expired or didn't start here", err)
+		return
+	}
+
+	oauth, verifier, err := app.oidcClient(r.Context())
+	if err != nil {
+		fail("the provider can't be reached", err)
+		return
+	}
+
+	token, err := oauth.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		fail("the authorization code was rejected", err)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		fail("the provider returned no ID token", nil)
+		return
+	}
+	idToken, err := verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		fail("the ID token is invalid", err)
+		return
+	}
+	nonce, err := r.Cookie(oidcNonceCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(nonce.Value), []byte(idToken.Nonce)) != 1 {
+		fail("the ID token nonce doesn't match", err)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		fail("the ID token claims can't be read", err)
+		return
+	}
+
+	// Pick a name for the user and map their role
+	username := idToken.Subject
+	for _, claim := range []string{"preferred_username", "email"} {
+		if v, ok := claims[claim].(string); ok && v != "" {
+			username = v
+			break
+		}
+	}
+	role := RoleViewer
+	if claimHas(claims[app.Config.oidcRoleClaim], app.Config.oidcAdminValue) {
+		role = RoleAdmin
+	}
+
+	user, err := app.UpsertOIDCUser(idToken.Subject, username, role)
+	if err != nil {
+		fail("the account "+username+" can't be used here", err)
+		return
+	}
+
+	app.startSession(w, r, user)
+	logger.Printf("%s %s signed in with single sign on\n", user.Role, user.Username)
+
+	next := ""
+	if c, err := r.Cookie(oidcNextCookie); err == nil {
+		next = c.Value
+	}
+	for _, name := range []string{oidcStateCookie, oidcNonceCookie, oidcNextCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Path: app.URL("/login/oidc"), MaxAge: -1})
+	}
+	http.Redirect(w, r, app.URL(localRedirect(next)), http.StatusSeeOther)
+}
+
+// Whether a claim is, or contains, the given value.
+func claimHas(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Finds or creates the user for an OpenID Connect subject, keeping their role
+// in sync with the provider. Local users are never taken over.
+func (app *App) UpsertOIDCUser(subject, username, role string) (*User, error) {
+	user := new(User)
+	sql_user := `SELECT id, username, role, created FROM users WHERE subject = ?`
+	err := app.DB.QueryRow(sql_user, subject).Scan(&user.Id, &user.Username, &user.Role, &user.Created)
+	if err == sql.ErrNoRows {
+		sql_insert := `INSERT INTO users(username, hash, role, subject) VALUES (?, '', ?, ?)`
+		if _, err := app.DB.Exec(sql_insert, username, role, subject); err != nil {
+			return nil, err
+		}
+		return app.FindUser(username)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.Role != role {
+		if _, err := app.DB.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, user.Id); err != nil {
+			return nil, err
+		}
+		user.Role = role
+	}
+
+	return user, nil
+}
+
+// Restricts a redirect target to paths on this server.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/julienschmidt/httprouter"
+)
+
+// OpenAPI document describing the /api routes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// The parsed OpenAPI document and a router finding its operations
+type apiSpec struct {
+	doc    *openapi3.T
+	router routers.Router
+	routes []string // "METHOD /path" of every registered /api route
+}
+
+// Parses and validates the embedded OpenAPI document.
+func loadAPISpec() (*apiSpec, error) {
+	// Keep schema errors to a single line, they are returned to clients
+	openapi3.SchemaErrorDetailsDisabled = true
+
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(openapi3.NewLoader().Context); err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiSpec{doc: doc, router: router}, nil
+}
+
+// Registers an /api route, recording it so CheckAPISpec can compare it with the
+// OpenAPI document.
+func (app *App) APIRoute(method, path string, handle httprouter.Handle) {
+	app.APISpec.routes = append(app.APISpec.routes, method+" "+path)
+	app.Router.Handle(method, path, handle)
+}
+
+// Registers an /api route with a fixed segment where another route has a
+// wildcard, which the router can't hold side by side. It's routed through the
+// wildcard as routed, with the same number of segments, and anything but the
+// fixed segment there is not found.
+func (app *App) APIRouteShadowed(method, path, routed string, handle httprouter.Handle) {
+	fixed := make(map[string]string)
+	routedSegments := strings.Split(routed, "/")
+	for i, segment := range strings.Split(path, "/") {
+		if segment != routedSegments[i] && strings.HasPrefix(routedSegments[i], ":") {
+			fixed[routedSegments[i][1:]] = segment
+		}
+	}
+
+	app.APISpec.routes = append(app.APISpec.routes, method+" "+path)
+	app.Router.Handle(method, routed, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		for name, value := range fixed {
+			if p.ByName(name) != value {
+				writeJSONError(w, http.StatusNotFound, "not found")
+				return
+			}
+		}
+		handle(w, r, p)
+	})
+}
+
+var specParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// Makes sure the OpenAPI document and the registered /api routes describe the
+// same operations, so neither can drift without the other.
+func (app *App) CheckAPISpec() error {
+	documented := make(map[string]bool)
+	for path, item := range app.APISpec.doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented[method+" "+specParam.ReplaceAllString(path, ":$1")] = true
+		}
+	}
+
+	var problems []string
+	for _, route := range app.APISpec.routes {
+		if !documented[route] {
+			problems = append(problems, route+" is not documented")
+		}
+		delete(documented, route)
+	}
+	for route := range documented {
+		problems = append(problems, route+" is documented but not registered")
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("openapi.json is out of date: " + strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// Serves the OpenAPI document.
+func (app *App) OpenAPIHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// Middleware validating /api requests against the OpenAPI document. Requests with
+// unknown or invalid parameters or bodies get a 400 naming the part of the
+// document they broke. Paths and methods the document doesn't know are left to
+// the router.
+func (app *App) APIValidationMiddleware(next http.Handler) http.Handler {
+	options := &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, pathParams, err := app.APISpec.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		operation := "#/paths/" + escapePointer(route.Path) + "/" + strings.ToLower(r.Method)
+
+		// Bodies are read whole to validate them, so they're kept to a sane size
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBody)
+
+		// The validator ignores query parameters it doesn't know about
+		for name := range r.URL.Query() {
+			if paramIndex(route.Operation.Parameters, "query", name) < 0 && paramIndex(route.PathItem.Parameters, "query", name) < 0 {
+				writeAPIError(w, http.StatusBadRequest, apiError{
+					Code:    ErrInvalidField,
+					Message: fmt.Sprintf("unknown query parameter %q", name),
+					Field:   name,
+					Schema:  operation + "/parameters",
+				})
+				return
+			}
+		}
+
+		// Likewise form fields the body schema doesn't list
+		if name, pointer := unknownFormField(route, r); name != "" {
+			writeAPIError(w, http.StatusBadRequest, apiError{
+				Code:    ErrInvalidField,
+				Message: fmt.Sprintf("unknown form field %q", name),
+				Field:   name,
+				Schema:  pointer,
+			})
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			status, apiErr := specError(route, r, err)
+			writeAPIError(w, status, apiErr)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Describes why a request failed validation: a 415 for bodies of a type the
+// operation doesn't take, a 400 naming the missing or invalid field for
+// everything else.
+func specError(route *routers.Route, r *http.Request, err error) (int, apiError) {
+	apiErr := apiError{Code: ErrBadRequest, Message: err.Error(), Schema: specPointer(route, r, err)}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apiErr.Code = ErrTooLarge
+		apiErr.Message = fmt.Sprintf("request bodies may be at most %d bytes", tooLarge.Limit)
+		return http.StatusRequestEntityTooLarge, apiErr
+	}
+	if isTimeout(err) {
+		apiErr.Code = ErrTimeout
+		apiErr.Message = "the upload took longer than the server allows, see -upload-timeout"
+		return http.StatusRequestTimeout, apiErr
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return http.StatusBadRequest, apiErr
+	}
+	if reqErr.RequestBody != nil {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "" && reqErr.RequestBody.Content.Get(mediaType) == nil {
+			apiErr.Code = ErrContentType
+			return http.StatusUnsupportedMediaType, apiErr
+		}
+	}
+
+	var schemaErr *openapi3.SchemaError
+	switch {
+	case reqErr.Parameter != nil:
+		apiErr.Field = reqErr.Parameter.Name
+	case errors.As(err, &schemaErr) && len(schemaErr.JSONPointer()) > 0:
+		fields := schemaErr.JSONPointer()
+		apiErr.Field = fields[len(fields)-1]
+	default:
+		return http.StatusBadRequest, apiErr
+	}
+	apiErr.Code = ErrInvalidField
+	if errors.Is(err, openapi3filter.ErrInvalidRequired) || (schemaErr != nil && schemaErr.SchemaField == "required") {
+		apiErr.Code = ErrMissingField
+	}
+
+	return http.StatusBadRequest, apiErr
+}
+
+// Builds a JSON pointer into the OpenAPI document to the rule a request broke.
+func specPointer(route *routers.Route, r *http.Request, err error) string {
+	path := "#/paths/" + escapePointer(route.Path)
+	pointer := path + "/" + strings.ToLower(r.Method)
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return pointer
+	}
+	if param := reqErr.Parameter; param != nil {
+		if i := paramIndex(route.Operation.Parameters, param.In, param.Name); i >= 0 {
+			pointer += "/parameters/" + strconv.Itoa(i) + "/schema"
+		} else if i := paramIndex(route.PathItem.Parameters, param.In, param.Name); i >= 0 {
+			pointer = path + "/parameters/" + strconv.Itoa(i) + "/schema"
+		}
+	} else if reqErr.RequestBody != nil {
+		pointer += "/requestBody"
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && reqErr.RequestBody.Content.Get(mediaType) != nil {
+			pointer += "/content/" + escapePointer(mediaType) + "/schema"
+		}
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		fields := schemaErr.JSONPointer()
+		// Missing properties are reported at the property, required is a rule of
+		// the object holding it
+		if schemaErr.SchemaField == "required" && len(fields) > 0 {
+			fields = fields[:len(fields)-1]
+		}
+		for _, field := range fields {
+			pointer += "/properties/" + escapePointer(field)
+		}
+		if schemaErr.SchemaField != "" {
+			pointer += "/" + schemaErr.SchemaField
+		}
+	}
+
+	return pointer
+}
+
+// Finds a field in a form body that the operation's schema doesn't allow,
+// returning it with a pointer to the schema. The body is left readable.
+func unknownFormField(route *routers.Route, r *http.Request) (string, string) {
+	body := route.Operation.RequestBody
+	if body == nil || body.Value == nil {
+		return "", ""
+	}
+	const form = "application/x-www-form-urlencoded"
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	content := body.Value.Content.Get(form)
+	if mediaType != form || content == nil || content.Schema == nil || content.Schema.Value == nil {
+		return "", ""
+	}
+	schema := content.Schema.Value
+	if schema.AdditionalProperties.Has == nil || *schema.AdditionalProperties.Has {
+		return "", ""
+	}
+
+	data, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return "", ""
+	}
+	values, _ := url.ParseQuery(string(data))
+	for name := range values {
+		if _, ok := schema.Properties[name]; !ok {
+			pointer := "#/paths/" + escapePointer(route.Path) + "/" + strings.ToLower(r.Method) +
+				"/requestBody/content/" + escapePointer(form) + "/schema/additionalProperties"
+			return name, pointer
+		}
+	}
+
+	return "", ""
+}
+
+// Returns the index of the named parameter, -1 if there is none.
+func paramIndex(params openapi3.Parameters, in, name string) int {
+	for i, ref := range params {
+		if ref.Value != nil && ref.Value.In == in && ref.Value.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Escapes a JSON pointer reference token (RFC 6901).
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
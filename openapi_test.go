@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Every route the router holds as "METHOD /path". httprouter has no way to
+// list its routes, so its trees are walked, joining the path of every node on
+// the way to one with a handle.
+func routerRoutes(app *App) []string {
+	var routes []string
+	var walk func(method, prefix string, n reflect.Value)
+	walk = func(method, prefix string, n reflect.Value) {
+		n = n.Elem()
+		path := prefix + n.FieldByName("path").String()
+		if !n.FieldByName("handle").IsNil() {
+			routes = append(routes, method+" "+path)
+		}
+		children := n.FieldByName("children")
+		for i := 0; i < children.Len(); i++ {
+			walk(method, path, children.Index(i))
+		}
+	}
+
+	trees := reflect.ValueOf(app.Router).Elem().FieldByName("trees")
+	for _, method := range trees.MapKeys() {
+		walk(method.String(), "", trees.MapIndex(method))
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// Operations of the OpenAPI document as "METHOD /path", parameters written the
+// router's way (:id).
+func documentedRoutes(app *App) []string {
+	var routes []string
+	for path, item := range app.APISpec.doc.Paths.Map() {
+		for method := range item.Operations() {
+			routes = append(routes, method+" "+specParam.ReplaceAllString(path, ":$1"))
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// Whether the router's route serves a documented one, the same path with the
+// router's parameters matching anything. Shadowed routes are served through a
+// parameter where the document has a fixed segment.
+func routeServes(route, documented string) bool {
+	method, path, _ := strings.Cut(route, " ")
+	docMethod, docPath, _ := strings.Cut(documented, " ")
+	segments, docSegments := strings.Split(path, "/"), strings.Split(docPath, "/")
+	if method != docMethod || len(segments) != len(docSegments) {
+		return false
+	}
+	for i, segment := range segments {
+		if segment != docSegments[i] && !strings.HasPrefix(segment, ":") {
+			return false
+		}
+	}
+	return true
+}
+
+// The OpenAPI document describes every /api route the router holds and nothing
+// else, so neither can drift without the other.
+func TestAPISpecMatchesRouter(t *testing.T) {
+	app := newTestApp(t)
+	app.Routes()
+
+	if err := app.CheckAPISpec(); err != nil {
+		t.Error(err)
+	}
+
+	documented := documentedRoutes(app)
+	for _, route := range routerRoutes(app) {
+		if !strings.Contains(route, " /api/") {
+			continue
+		}
+		served := false
+		for _, doc := range documented {
+			served = served || routeServes(route, doc)
+		}
+		if !served {
+			t.Errorf("%s is routed but not documented in openapi.json", route)
+		}
+	}
+
+	// Documented operations have to reach a handler, parameters filled in
+	for _, route := range documented {
+		method, path, _ := strings.Cut(route, " ")
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = "1"
+			}
+		}
+		if handle, _, _ := app.Router.Lookup(method, strings.Join(segments, "/")); handle == nil {
+			t.Errorf("%s is documented in openapi.json but not routed", route)
+		}
+	}
+}
+
+// The walk finds routes however they were registered, so the test above can't
+// pass by not seeing them.
+func TestRouterRoutes(t *testing.T) {
+	app := newTestApp(t)
+	app.Routes()
+	routes := routerRoutes(app)
+
+	for _, want := range []string{
+		"GET /",
+		"GET /api/events",
+		"GET /api/events/:id",
+		"POST /event/new",
+		"GET /data/*filepath",
+		"PROPFIND /dav/*filepath",
+	} {
+		i := sort.SearchStrings(routes, want)
+		if i == len(routes) || routes[i] != want {
+			t.Errorf("%s is missing from the walked routes", want)
+		}
+	}
+}
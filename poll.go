@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest snapshot a poll downloads
+const snapshotMax = 10 << 20
+
+// Side of the grayscale grid snapshots are compared on, small enough that noise
+// and compression artifacts average out
+const (
+	diffWidth  = 32
+	diffHeight = 24
+)
+
+// Snapshot polling configuration of a camera
+type cameraPoll struct {
+	CameraId  int64
+	Name      string
+	URL       string
+	Interval  time.Duration
+	Threshold float64 // Difference (0-1) between snapshots that makes an event
+}
+
+// Retrieves the cameras that are polled for snapshots.
+func (app *App) CameraPolls() ([]cameraPoll, error) {
+	sql_polls := `SELECT id, name, poll_url, poll_interval, poll_threshold FROM cameras WHERE poll_url IS NOT NULL AND poll_interval > 0`
+	rows, err := app.DB.Query(sql_polls)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	polls := make([]cameraPoll, 0)
+	for rows.Next() {
+		var poll cameraPoll
+		var seconds int64
+		if err := rows.Scan(&poll.CameraId, &poll.Name, &poll.URL, &seconds, &poll.Threshold); err != nil {
+			return nil, err
+		}
+		poll.Interval = time.Duration(seconds) * time.Second
+		polls = append(polls, poll)
+	}
+
+	return polls, rows.Err()
+}
+
+// Starts polling a camera, adding it if it's new, or stops when url is empty.
+func (app *App) SetCameraPoll(name, url string, interval time.Duration, threshold float64) error {
+	id, err := app.CameraID(name)
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		_, err = app.DB.Exec(`UPDATE cameras SET poll_url = NULL, poll_interval = 0, poll_threshold = 0 WHERE id = ?`, id)
+		return err
+	}
+	sql_poll := `UPDATE cameras SET poll_url = ?, poll_interval = ?, poll_threshold = ?, last_error = NULL WHERE id = ?`
+	_, err = app.DB.Exec(sql_poll, url, int64(interval/time.Second), threshold, id)
+	return err
+}
+
+// Records the outcome of polling a camera, the error or when it last answered.
+func (app *App) setPollResult(id int64, pollErr error) {
+	var err error
+	if pollErr != nil {
+		_, err = app.DB.Exec(`UPDATE cameras SET last_error = ? WHERE id = ?`, pollErr.Error(), id)
+	} else {
+		_, err = app.DB.Exec(`UPDATE cameras SET last_error = NULL, last_seen = CURRENT_TIMESTAMP WHERE id = ?`, id)
+	}
+	if err != nil {
+		log.Printf("Error recording the poll of camera %d\n", id)
+		log.Println(err.Error())
+	}
+}
+
+// Runs a poller for every camera with a poll URL. The configuration is reread
+// every minute, so cameras set up with the camera command are picked up (and
+// changed or stopped ones restarted) without restarting the server.
+func (app *App) SnapshotPoller() {
+	running := make(map[int64]cameraPoll)
+	stops := make(map[int64]context.CancelFunc)
+	for ; ; time.Sleep(time.Minute) {
+		polls, err := app.CameraPolls()
+		if err != nil {
+			log.Println("Error loading the cameras to poll")
+			log.Println(err.Error())
+			continue
+		}
+
+		wanted := make(map[int64]bool)
+		for _, poll := range polls {
+			wanted[poll.CameraId] = true
+			if current, ok := running[poll.CameraId]; ok && current == poll {
+				continue
+			}
+			if stop, ok := stops[poll.CameraId]; ok {
+				stop()
+			}
+			ctx, stop := context.WithCancel(context.Background())
+			running[poll.CameraId], stops[poll.CameraId] = poll, stop
+			go app.pollCamera(ctx, poll)
+		}
+		for id, stop := range stops {
+			if !wanted[id] {
+				stop()
+				delete(running, id)
+				delete(stops, id)
+			}
+		}
+	}
+}
+
+// Polls a camera's snapshot until ctx is cancelled, creating an image only event
+// whenever the picture differs from the last one by at least the threshold.
+// Polls are spread out by starting at a random point of the first interval and
+// varying each interval by up to 10%. Failures are recorded as the camera's
+// last error, and once they've gone on for -camera-offline-after an alert is
+// sent, and another when the camera is back.
+func (app *App) pollCamera(ctx context.Context, poll cameraPoll) {
+	log.Printf("Polling camera %s every %s\n", poll.Name, poll.Interval)
+	timeout := poll.Interval
+	if timeout > 30*time.Second {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var previous []uint8
+	var failingSince time.Time
+	offline := false
+	wait := time.Duration(rand.Int63n(int64(poll.Interval)))
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped polling camera %s\n", poll.Name)
+			return
+		case <-time.After(wait):
+		}
+		wait = poll.Interval*9/10 + time.Duration(rand.Int63n(int64(poll.Interval/5)+1))
+
+		data, frame, err := fetchSnapshot(ctx, client, poll.URL)
+		if ctx.Err() != nil {
+			continue
+		}
+		app.setPollResult(poll.CameraId, err)
+		if err != nil {
+			log.Printf("Error polling camera %s\n", poll.Name)
+			log.Println(err.Error())
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+			if after := app.Config.offlineAfter; after > 0 && !offline && time.Since(failingSince) >= after {
+				offline = true
+				message := fmt.Sprintf("Seccam camera %s is offline since %s (%s).", poll.Name, failingSince.Format("15:04"), err)
+				log.Println(message)
+				app.SendText(app.Logger, message)
+			}
+			continue
+		}
+		if offline {
+			message := fmt.Sprintf("Seccam camera %s is back online.", poll.Name)
+			log.Println(message)
+			app.SendText(app.Logger, message)
+		}
+		failingSince, offline = time.Time{}, false
+
+		// The first snapshot is only something to compare the next one to
+		grid := grayGrid(frame)
+		if previous != nil && !app.ReadOnly.Load() {
+			if diff := gridDifference(previous, grid); diff >= poll.Threshold {
+				app.storeSnapshot(poll, data, diff)
+			}
+		}
+		previous = grid
+	}
+}
+
+// Downloads and decodes a camera snapshot.
+func fetchSnapshot(ctx context.Context, client *http.Client, url string) ([]byte, image.Image, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("snapshot responded %s", resp.Status)
+	}
+	if served := resp.Header.Get("Content-Type"); served != "" && !strings.HasPrefix(served, "image/") {
+		return nil, nil, fmt.Errorf("snapshot is served as %s, not as an image", served)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, snapshotMax+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > snapshotMax {
+		return nil, nil, fmt.Errorf("snapshot is larger than %d bytes", snapshotMax)
+	}
+	frame, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("snapshot can't be decoded: %w", err)
+	}
+
+	return data, frame, nil
+}
+
+// Shrinks an image to a grid of average brightness, for comparing snapshots.
+func grayGrid(img image.Image) []uint8 {
+	bounds := img.Bounds()
+	grid := make([]uint8, diffWidth*diffHeight)
+	if bounds.Empty() {
+		return grid
+	}
+
+	sums := make([]uint64, len(grid))
+	counts := make([]uint64, len(grid))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * diffHeight / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cell := row*diffWidth + (x-bounds.Min.X)*diffWidth/bounds.Dx()
+			r, g, b, _ := img.At(x, y).RGBA()
+			// Luma from 16 bit channels, scaled down to 8 bits
+			sums[cell] += (299*uint64(r) + 587*uint64(g) + 114*uint64(b)) / 1000 / 256
+			counts[cell]++
+		}
+	}
+	for i := range grid {
+		if counts[i] > 0 {
+			grid[i] = uint8(sums[i] / counts[i])
+		}
+	}
+
+	return grid
+}
+
+// Difference between two grids from 0 (the same) to 1 (black and white).
+func gridDifference(a, b []uint8) float64 {
+	var total int
+	for i := range a {
+		diff := int(a[i]) - int(b[i])
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	return float64(total) / float64(255*len(a))
+}
+
+// Creates an image only event from a snapshot, notifying as for any other event.
+func (app *App) storeSnapshot(poll cameraPoll, data []byte, diff float64) {
+	path, err := app.StageUpload(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Error staging snapshot of camera %s\n", poll.Name)
+		log.Println(err.Error())
+		return
+	}
+	meta, _ := json.Marshal(map[string]interface{}{"source": "snapshot", "difference": diff})
+	stamp := time.Now().UTC().Format("20060102-150405.000000")
+	upload := eventUpload{
+		Name:   poll.Name + " snapshot",
+		Camera: poll.Name,
+		Images: []stagedFile{{Path: path, Name: uploadName(stamp, http.DetectContentType(data))}},
+		Notify: true,
+		Meta:   meta,
+	}
+	if _, err := app.StoreEvent(app.Logger, "", upload); err != nil {
+		log.Printf("Error storing snapshot of camera %s\n", poll.Name)
+		log.Println(err.Error())
+	}
+}
+
+// Sets up snapshot polling of cameras:
+//
+//	camera poll [--interval=30s] [--threshold=0.05] <name> <url>
+//	camera unpoll <name>
+//	camera stream <name> [url]
+//	camera location [--latitude=<lat> --longitude=<lon>] <name> [text]
+//	camera list
+func (app *App) CameraCommand(args []string) error {
+	usage := errors.New("usage: camera poll [--interval=30s] [--threshold=0.05] <name> <url> | camera unpoll <name> | camera stream <name> [url] | camera location [--latitude=<lat> --longitude=<lon>] <name> [text] | camera list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "poll":
+		cmd := flag.NewFlagSet("camera poll", flag.ExitOnError)
+		interval := cmd.Duration("interval", 30*time.Second, "How often the snapshot is fetched")
+		threshold := cmd.Float64("threshold", 0.05, "Difference (0-1) from the last snapshot that creates an event")
+		cmd.Parse(args[1:])
+		if cmd.NArg() != 2 {
+			return usage
+		}
+		if *interval < time.Second {
+			return errors.New("--interval must be at least 1s")
+		}
+		if *threshold <= 0 || *threshold > 1 {
+			return errors.New("--threshold must be above 0 and at most 1")
+		}
+		if !strings.HasPrefix(cmd.Arg(1), "http://") && !strings.HasPrefix(cmd.Arg(1), "https://") {
+			return errors.New("the snapshot URL must be http or https")
+		}
+		if err := app.SetCameraPoll(cmd.Arg(0), cmd.Arg(1), *interval, *threshold); err != nil {
+			return err
+		}
+		fmt.Printf("Polling %s every %s\n", cmd.Arg(0), *interval)
+	case "unpoll":
+		if len(args) != 2 {
+			return usage
+		}
+		if err := app.SetCameraPoll(args[1], "", 0, 0); err != nil {
+			return err
+		}
+		fmt.Printf("Stopped polling %s\n", args[1])
+	case "stream":
+		if len(args) != 2 && len(args) != 3 {
+			return usage
+		}
+		url := ""
+		if len(args) == 3 {
+			url = args[2]
+			if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+				return errors.New("the stream URL must be http or https")
+			}
+		}
+		if err := app.SetCameraStream(args[1], url); err != nil {
+			return err
+		}
+		if url == "" {
+			fmt.Printf("Removed the live view of %s\n", args[1])
+		} else {
+			fmt.Printf("Set the live view of %s\n", args[1])
+		}
+	case "location":
+		cmd := flag.NewFlagSet("camera location", flag.ExitOnError)
+		latitude := cmd.String("latitude", "", "Latitude of the camera, with --longitude")
+		longitude := cmd.String("longitude", "", "Longitude of the camera, with --latitude")
+		cmd.Parse(args[1:])
+		if cmd.NArg() < 1 {
+			return usage
+		}
+		l := location{Text: strings.TrimSpace(strings.Join(cmd.Args()[1:], " "))}
+		var err error
+		if l.Latitude, err = parseCoordinate(*latitude); err != nil {
+			return errors.New("--latitude must be a number")
+		}
+		if l.Longitude, err = parseCoordinate(*longitude); err != nil {
+			return errors.New("--longitude must be a number")
+		}
+		if _, err := l.check(); err != nil {
+			return err
+		}
+		if err := app.SetCameraLocation(cmd.Arg(0), l); err != nil {
+			return err
+		}
+		if l.empty() {
+			fmt.Printf("Removed the location of %s\n", cmd.Arg(0))
+		} else {
+			fmt.Printf("Set the location of %s, new events inherit it\n", cmd.Arg(0))
+		}
+	case "list":
+		return app.listCameras()
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+// Prints every camera with the channels alerted about it, its polling
+// configuration and state.
+func (app *App) listCameras() error {
+	sql_cameras := `SELECT name, COALESCE(poll_url, ''), poll_interval, poll_threshold, last_seen, COALESCE(last_error, ''), location, latitude, longitude, notify_channels FROM cameras ORDER BY name`
+	rows, err := app.DB.Query(sql_cameras)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, url, lastError string
+		var seconds int64
+		var threshold float64
+		var lastSeen sql.NullTime
+		var text sql.NullString
+		var latitude, longitude sql.NullFloat64
+		var channels sql.NullString
+		if err := rows.Scan(&name, &url, &seconds, &threshold, &lastSeen, &lastError, &text, &latitude, &longitude, &channels); err != nil {
+			return err
+		}
+		place := location{Text: text.String}
+		if latitude.Valid && longitude.Valid {
+			place.Latitude, place.Longitude = &latitude.Float64, &longitude.Float64
+		}
+		if where := place.String(); where != "" {
+			name += "\t" + where
+		}
+		name += "\t" + describeChannels(app.effectiveChannels(&Camera{Channels: splitChannels(channels)}), channels.Valid)
+		if url == "" {
+			fmt.Println(name)
+			continue
+		}
+		seen := "never"
+		if lastSeen.Valid {
+			seen = lastSeen.Time.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\tevery %s\tthreshold %g\tlast seen %s\t%s\n", name, url, time.Duration(seconds)*time.Second, threshold, seen, lastError)
+	}
+
+	return rows.Err()
+}
+
+// Describes the channels a camera alerts, noting when it has none of its own.
+func describeChannels(channels []string, own bool) string {
+	switch {
+	case !own && len(channels) > 0:
+		return "alerts every channel (" + strings.Join(channels, ", ") + ")"
+	case !own:
+		return "alerts every channel"
+	case len(channels) == 0:
+		return "alerts no one"
+	}
+	return "alerts " + strings.Join(channels, ", ")
+}
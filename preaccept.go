@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What to do with uploads when -pre-accept-url can't be asked
+const (
+	PreAcceptOnErrorAccept = "accept"
+	PreAcceptOnErrorReject = "reject"
+)
+
+// Upload turned down by -pre-accept-url, StoreEvent returns it without storing
+// anything
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	if e.reason == "" {
+		return "the upload was rejected"
+	}
+	return "the upload was rejected: " + e.reason
+}
+
+// Answer of the pre-accept service, a 200 without a body accepts
+type preAcceptResponse struct {
+	Accept *bool  `json:"accept"`
+	Reason string `json:"reason"`
+}
+
+// Asks -pre-accept-url whether to keep an upload, returning a rejectedError if
+// it says no. A non-200 response turns the upload down too. When the service
+// can't be reached or answers with garbage -pre-accept-on-error decides.
+func (app *App) preAccept(logger *Logger, upload eventUpload) error {
+	err := app.askPreAccept(upload)
+	if rejected, ok := err.(*rejectedError); ok {
+		preAcceptRejected.Add(1)
+		logger.Printf("Upload %s rejected by -pre-accept-url: %s\n", upload.Name, rejected.reason)
+		return err
+	} else if err != nil {
+		preAcceptErrors.Add(1)
+		logger.Println("Error asking -pre-accept-url about upload", upload.Name)
+		logger.Println(err.Error())
+		if app.Config.preAcceptOnError == PreAcceptOnErrorReject {
+			preAcceptRejected.Add(1)
+			return &rejectedError{reason: "it couldn't be checked"}
+		}
+	}
+	return nil
+}
+
+func (app *App) askPreAccept(upload eventUpload) error {
+	body, contentType, err := preAcceptBody(upload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.preAcceptTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.Config.preAcceptURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "seccam-web")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+
+	var answer preAcceptResponse
+	if len(bytes.TrimSpace(data)) > 0 && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(data, &answer); err != nil && resp.StatusCode == http.StatusOK {
+			return fmt.Errorf("unreadable response: %v", err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		if answer.Reason == "" {
+			answer.Reason = "the service responded " + resp.Status
+		}
+		return &rejectedError{reason: answer.Reason}
+	}
+	if answer.Accept != nil && !*answer.Accept {
+		return &rejectedError{reason: answer.Reason}
+	}
+	return nil
+}
+
+// Builds the multipart body sent to -pre-accept-url: the upload's name, camera,
+// external ID and metadata as fields and its first image as image. Videos
+// aren't sent, they can be large.
+func preAcceptBody(upload eventUpload) (io.Reader, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fields := [][2]string{
+		{"name", upload.Name},
+		{"camera", upload.Camera},
+		{"external_id", upload.ExternalID},
+		{"metadata", string(upload.Meta)},
+		{"videos", fmt.Sprint(len(upload.Videos))},
+	}
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	image := upload.Images[0]
+	f, err := os.Open(image.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	part, err := mw.CreateFormFile("image", filepath.Base(image.Name))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return &buf, mw.FormDataContentType(), nil
+}
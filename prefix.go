@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Cleans up a -path-prefix value: "seccam/" and "/seccam" both become "/seccam",
+// "" and "/" mean no prefix.
+func normalizePathPrefix(prefix string) (string, error) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		return "", nil
+	}
+	if strings.ContainsAny(prefix, "?#%") {
+		return "", fmt.Errorf("invalid -path-prefix %q", prefix)
+	}
+	return prefix, nil
+}
+
+// Returns the path a browser reaches a route at, with the path prefix in front.
+// All links and redirects sent to clients go through this.
+func (app *App) URL(path string) string {
+	return app.Config.pathPrefix + path
+}
+
+// Returns the URL to hand out for a route: absolute when the base URL is
+// configured, otherwise just the prefixed path.
+func (app *App) PublicURL(path string) string {
+	if app.Config.baseURL != "" {
+		return app.AbsoluteURL(path)
+	}
+	return app.URL(path)
+}
+
+// Middleware removing the path prefix from requests so the routes and everything
+// after them see the same paths with or without one. Requests outside the prefix
+// get a 404, the prefix itself is redirected to the index.
+func (app *App) PathPrefixMiddleware(next http.Handler) http.Handler {
+	prefix := app.Config.pathPrefix
+	if prefix == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// Returns a shallow copy of a request with its path as the client sent it, the
+// path prefix in front, for checking signatures the client made over it.
+func (app *App) sentRequest(r *http.Request) *http.Request {
+	if app.Config.pathPrefix == "" {
+		return r
+	}
+	sent := r.WithContext(r.Context())
+	u := *r.URL
+	u.Path = app.URL(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = app.URL(u.RawPath)
+	}
+	sent.URL = &u
+	return sent
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/battleroid/seccam-web/signature"
+)
+
+// Behind -path-prefix cameras sign the path they send, prefix and all, as the
+// proxy passes it on unchanged.
+func TestSignedUploadUnderPathPrefix(t *testing.T) {
+	config := testConfig(t)
+	config.pathPrefix = "/seccam"
+	config.uploadSecret = "upload-secret"
+	app := newTestAppWith(t, config)
+	server := newTestServer(t, app)
+
+	tests := []struct {
+		name     string
+		signedAs string // Path the signature is made over
+		status   int
+	}{
+		{"prefixed path", "/seccam/event/new", http.StatusAccepted},
+		{"path without the prefix", "/event/new", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, contentType := multipartUpload(t, map[string]string{"name": "Front door"},
+				map[string]io.Reader{"video": strings.NewReader("video"), "image": strings.NewReader("image")})
+			data, _ := io.ReadAll(body)
+			req, err := http.NewRequest(http.MethodPost, server.URL+test.signedAs, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			if err := signature.Sign(req, []byte(config.uploadSecret)); err != nil {
+				t.Fatal(err)
+			}
+			req.URL.Path = "/seccam/event/new"
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.status {
+				data, _ := io.ReadAll(resp.Body)
+				t.Errorf("status %d (%s), expected %d", resp.StatusCode, data, test.status)
+			}
+		})
+	}
+}
+
+// The archive a client queued is found where Location points, prefix and all.
+func TestArchiveLocationUnderPathPrefix(t *testing.T) {
+	config := testConfig(t)
+	config.pathPrefix = "/seccam"
+	app := newTestAppWith(t, config)
+	server := newTestServer(t, app)
+	event := storeTestEvent(t, app, "front door")
+
+	body := fmt.Sprintf(`{"ids": [%d]}`, event.Id)
+	resp, err := http.Post(server.URL+"/seccam/api/archives", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(location, "/seccam/api/archives/") {
+		t.Fatalf("status %d with Location %q, expected %d under /seccam", resp.StatusCode, location, http.StatusAccepted)
+	}
+
+	resp, err = http.Get(server.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET %s answered %d, expected %d", location, resp.StatusCode, http.StatusOK)
+	}
+}
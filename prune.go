@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Selects the events pruned from the admin page, protected events and evidence
+// never are
+type pruneFilter struct {
+	Before   time.Time // Events from before this go
+	CameraId int64     // Only from this camera unless it's 0
+}
+
+// Returned when the events matching a prune changed since they were previewed
+var errPruneChanged = errors.New("the matching events changed since the preview")
+
+// What pruning with a filter would delete
+type prunePreview struct {
+	Count  int
+	Bytes  int64
+	Oldest time.Time
+	Newest time.Time
+}
+
+// SQL condition matching the filter's events and its arguments.
+func (f pruneFilter) where() (string, []interface{}) {
+	cond := `protected = 0 AND evidence_at IS NULL AND time < ? AND (? = 0 OR camera_id = ?)`
+	return cond, []interface{}{f.Before.UTC().Format("2006-01-02 15:04:05"), f.CameraId, f.CameraId}
+}
+
+// Description of the filter for the audit log.
+func (f pruneFilter) String() string {
+	s := "before " + f.Before.UTC().Format("2006-01-02")
+	if f.CameraId != 0 {
+		s += fmt.Sprintf(", camera %d", f.CameraId)
+	}
+	return s
+}
+
+// Counts the events the filter matches and the size of their media.
+func (app *App) PreviewPrune(f pruneFilter) (prunePreview, error) {
+	var preview prunePreview
+	cond, args := f.where()
+
+	sql_count := `
+	SELECT COUNT(*), COALESCE(SUM((SELECT SUM(size) FROM media WHERE event_id = events.id)), 0)
+	FROM events WHERE ` + cond
+	if err := app.DB.QueryRow(sql_count, args...).Scan(&preview.Count, &preview.Bytes); err != nil {
+		return preview, err
+	}
+	if preview.Count == 0 {
+		return preview, nil
+	}
+
+	sql_oldest := `SELECT time FROM events WHERE ` + cond + ` ORDER BY time LIMIT 1`
+	if err := app.DB.QueryRow(sql_oldest, args...).Scan(&preview.Oldest); err != nil {
+		return preview, err
+	}
+	sql_newest := `SELECT time FROM events WHERE ` + cond + ` ORDER BY time DESC LIMIT 1`
+	if err := app.DB.QueryRow(sql_newest, args...).Scan(&preview.Newest); err != nil {
+		return preview, err
+	}
+
+	return preview, nil
+}
+
+// Deletes every event the filter matches in one transaction, auditing each of
+// them along with the prune itself. Nothing is deleted unless the filter still
+// matches the expected number of events, so what goes is what was previewed.
+// Returns the number of events deleted.
+func (app *App) PruneEvents(f pruneFilter, expected int, actor, remoteAddr string) (int, error) {
+	preview, err := app.PreviewPrune(f)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cond, args := f.where()
+	rows, err := tx.Query(`SELECT id FROM events WHERE `+cond, args...)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) != expected {
+		return 0, errPruneChanged
+	}
+
+	events := make([]*Event, len(ids))
+	paths := make([][]string, len(ids))
+	for i, id := range ids {
+		if events[i], paths[i], err = deleteEvent(tx, id, actor, remoteAddr); err != nil {
+			return 0, err
+		}
+		if app.trashes(actor) {
+			if err := trashFiles(tx, events[i], paths[i], actor); err != nil {
+				return 0, err
+			}
+			paths[i] = nil
+		}
+	}
+	detail := fmt.Sprintf("%s: %d events, %d bytes", f, len(ids), preview.Bytes)
+	if err := Audit(tx, actor, "prune", 0, remoteAddr, detail); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for i, event := range events {
+		app.removeEventFiles(event, paths[i])
+	}
+
+	return len(ids), nil
+}
+
+// Reads the filter from the before (YYYY-MM-DD, UTC) and camera form fields,
+// returning what's wrong with them for the page if they're unusable.
+func (app *App) pruneFilterFrom(r *http.Request) (pruneFilter, string) {
+	var f pruneFilter
+	before, err := time.Parse("2006-01-02", r.FormValue("before"))
+	if err != nil {
+		return f, "Pick a date to delete events from before."
+	}
+	f.Before = before
+
+	if v := r.FormValue("camera"); v != "" && v != "0" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, "There is no such camera."
+		}
+		if _, err := app.FindCamera(id); err == sql.ErrNoRows {
+			return f, "There is no such camera."
+		} else if err != nil {
+			panic(err)
+		}
+		f.CameraId = id
+	}
+
+	return f, ""
+}
+
+// Context of the prune page
+type prunePage struct {
+	Cameras []*Camera
+	Before  string // Picked date, YYYY-MM-DD
+	Camera  int64
+	Preview *prunePreview // Nil until a date is picked
+	Size    string
+	Message string
+	Usage   storageStats // Per camera, to see where the space goes
+}
+
+// Builds the context of the prune page, with the current disk usage.
+func (app *App) newPrunePage() prunePage {
+	usage, err := app.StorageStats()
+	if err != nil {
+		panic(err)
+	}
+
+	return prunePage{Cameras: app.GetCameras(), Usage: usage}
+}
+
+// Renders the prune page, showing how much each camera takes up. With a date
+// picked it previews what would be deleted and asks for confirmation.
+func (app *App) PrunePageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	page := app.newPrunePage()
+	page.Before = r.FormValue("before")
+	if page.Before != "" {
+		f, problem := app.pruneFilterFrom(r)
+		if problem != "" {
+			page.Message = problem
+		} else {
+			preview, err := app.PreviewPrune(f)
+			if err != nil {
+				panic(err)
+			}
+			page.Camera = f.CameraId
+			page.Preview = &preview
+			page.Size = formatBytes(uint64(preview.Bytes))
+		}
+	}
+
+	t := app.Template(r, "prune")
+	t.ExecuteTemplate(w, t.Name(), page)
+}
+
+// Deletes the events confirmed on the prune page.
+func (app *App) PruneHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	f, problem := app.pruneFilterFrom(r)
+	if problem != "" {
+		app.RenderError(w, r, http.StatusBadRequest, problem)
+		return
+	}
+	expected, err := strconv.Atoi(r.FormValue("expected"))
+	if err != nil {
+		app.RenderError(w, r, http.StatusBadRequest, "Preview the events to delete first.")
+		return
+	}
+
+	deleted, err := app.PruneEvents(f, expected, actorOf(r), r.RemoteAddr)
+	if errors.Is(err, errPruneChanged) {
+		app.RenderError(w, r, http.StatusConflict, "Nothing was deleted, the matching events changed since the preview. Preview again and confirm.")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	app.Log(r).Printf("Pruned %d events %s\n", deleted, f)
+
+	page := app.newPrunePage()
+	page.Message = fmt.Sprintf("Deleted %d events from %s.", deleted, f)
+	t := app.Template(r, "prune")
+	t.ExecuteTemplate(w, t.Name(), page)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Publishes an event at a stable public link and returns its slug. Events that
+// are already public keep their slug, published again after being unpublished
+// they get a new one.
+func (app *App) PublishEvent(id int64, actor, remoteAddr string) (string, error) {
+	defer app.Cache.Clear()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	slug := base64.RawURLEncoding.EncodeToString(b)
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE events SET public = 1, public_slug = ? WHERE id = ? AND NOT public`, slug, id)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		// Already public, or no such event
+		var current sql.NullString
+		if err := tx.QueryRow(`SELECT public_slug FROM events WHERE id = ?`, id).Scan(&current); err != nil {
+			return "", err
+		}
+		return current.String, nil
+	}
+
+	if err := Audit(tx, actor, "publish", id, remoteAddr, ""); err != nil {
+		return "", err
+	}
+
+	return slug, tx.Commit()
+}
+
+// Takes an event's public link down, its slug stops working right away.
+func (app *App) UnpublishEvent(id int64, actor, remoteAddr string) error {
+	defer app.Cache.Clear()
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE events SET public = 0, public_slug = NULL WHERE id = ? AND public`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		// Not public, or no such event
+		var exists int
+		return tx.QueryRow(`SELECT 1 FROM events WHERE id = ?`, id).Scan(&exists)
+	}
+
+	if err := Audit(tx, actor, "unpublish", id, remoteAddr, ""); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Path of an event's public page, empty unless it's public.
+func (e *Event) PublicPath() string {
+	if !e.Public {
+		return ""
+	}
+	return "/p/" + e.PublicSlug
+}
+
+// Publishes an event, returning it with its public_url.
+func (app *App) APIPublishHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	slug, err := app.PublishEvent(event.Id, actorOf(r), r.RemoteAddr)
+	if err != nil {
+		panic(err)
+	}
+	if !event.Public {
+		app.Log(r).Printf("%s published event %d\n", actorOf(r), event.Id)
+	}
+
+	event.Public, event.PublicSlug = true, slug
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Unpublishes an event, its public link stops working at once.
+func (app *App) APIUnpublishHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	if err := app.UnpublishEvent(event.Id, actorOf(r), r.RemoteAddr); err != nil {
+		panic(err)
+	}
+	if event.Public {
+		app.Log(r).Printf("%s unpublished event %d\n", actorOf(r), event.Id)
+	}
+
+	event.Public, event.PublicSlug = false, ""
+	writeJSON(w, http.StatusOK, app.apiEvent(event))
+}
+
+// Resolves the public event of a slug, rendering a 404 and returning nil for
+// slugs that were never handed out or have been unpublished. The slug is looked
+// up on every request, nothing about it is cached.
+func (app *App) publicEvent(w http.ResponseWriter, r *http.Request, p httprouter.Params) *Event {
+	// Don't let the page or media outlive an unpublish in a shared cache
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	var id int64
+	err := app.DB.QueryRow(`SELECT id FROM events WHERE public AND public_slug = ?`, p.ByName("slug")).Scan(&id)
+	if err == nil {
+		var event *Event
+		if event, err = app.FindEvent(id); err == nil {
+			return event
+		}
+	}
+	if err == sql.ErrNoRows {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such public event.")
+		return nil
+	}
+	panic(err)
+}
+
+// Renders the public page of an event.
+func (app *App) PublicHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.publicEvent(w, r, p)
+	if event == nil {
+		return
+	}
+
+	context := struct {
+		*Event
+		Base string
+	}{
+		Event: event,
+		Base:  event.PublicPath(),
+	}
+	t := app.Template(r, "shared")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
+
+// Serves the video or image of a public event.
+func (app *App) PublicMediaHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.publicEvent(w, r, p)
+	if event == nil {
+		return
+	}
+
+	w = app.throttle(w, r)
+	switch p.ByName("media") {
+	case "video":
+		if event.Video == "" {
+			http.NotFound(w, r)
+			return
+		}
+		mediaHeaders(w, r, event.Video, event.downloadName())
+		app.serveMedia(w, r, event.Video)
+	case "image":
+		mediaHeaders(w, r, event.Image, event.downloadName())
+		app.serveMedia(w, r, event.Image)
+	default:
+		http.NotFound(w, r)
+	}
+}
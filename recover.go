@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// Middleware recovering from panics in handlers. The stack is logged with the
+// request ID and the client gets a 500, as JSON for /api routes and as the
+// error page for everything else. Panics over a busy database get a 503 with
+// Retry-After instead. http.ErrAbortHandler is left to net/http.
+func (app *App) RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			// A busy database isn't a bug, the client should back off and retry
+			if e, ok := err.(error); ok && isBusy(e) {
+				app.Log(r).Printf("Database busy serving %s %s: %v\n", r.Method, r.URL.Path, err)
+				busyRetryAfter(w)
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					writeJSONError(w, http.StatusServiceUnavailable, "the database is busy, try again later")
+					return
+				}
+				app.RenderError(w, r, http.StatusServiceUnavailable, "The server is busy, try again in a moment.")
+				return
+			}
+
+			panicsRecovered.Add(1)
+			logger := app.Log(r)
+			logger.Printf("Panic serving %s %s: %v\n", r.Method, r.URL.Path, err)
+			logger.Println(string(debug.Stack()))
+
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusInternalServerError, "internal server error, request "+RequestID(r.Context()))
+				return
+			}
+			app.RenderError(w, r, http.StatusInternalServerError, "Something went wrong on our end.")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
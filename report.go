@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// When the weekly report goes out, in local time
+type reportSchedule struct {
+	Day    time.Weekday
+	Hour   int
+	Minute int
+}
+
+// Statistics of a week shown by the report template
+type weeklyReport struct {
+	From, To time.Time
+	Total    int
+	Cameras  []string      // Columns of Days, "" for events without a camera
+	Days     []reportDay   // Every day of the week, oldest first
+	Hours    []reportHour  // The busiest hours of the day, busiest first
+	Growth   string        // Size of the week's new events
+	Top      []reportEvent // Highest motion scores, highest first
+	BaseURL  string        // Absolute link to the index, empty without -base-url
+}
+
+type reportDay struct {
+	Date   time.Time
+	Counts []int // Per camera, in the order of Cameras
+	Total  int
+}
+
+type reportHour struct {
+	Hour  int
+	Count int
+}
+
+type reportEvent struct {
+	*Event
+	Camera string
+	URL    string // Absolute link to the event, empty without -base-url
+	Thumb  string // Content-ID of its embedded thumbnail, empty without one
+}
+
+// Events with the highest motion score shown in the report
+const reportTopEvents = 5
+
+// Busiest hours of the day shown in the report
+const reportTopHours = 3
+
+// Parses a schedule such as "mon 08:00".
+func parseReportSchedule(s string) (reportSchedule, error) {
+	day, at, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return reportSchedule{}, fmt.Errorf("%q is not a weekday and time such as mon 08:00", s)
+	}
+
+	schedule := reportSchedule{Day: -1}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(day, d.String()) || strings.EqualFold(day, d.String()[:3]) {
+			schedule.Day = d
+		}
+	}
+	if schedule.Day < 0 {
+		return reportSchedule{}, fmt.Errorf("unknown weekday %q", day)
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(at))
+	if err != nil {
+		return reportSchedule{}, fmt.Errorf("invalid time %q, expected HH:MM", at)
+	}
+	schedule.Hour, schedule.Minute = t.Hour(), t.Minute()
+	return schedule, nil
+}
+
+// The latest time the report was due at, at or before now.
+func (s reportSchedule) last(now time.Time) time.Time {
+	due := time.Date(now.Year(), now.Month(), now.Day(), s.Hour, s.Minute, 0, 0, now.Location())
+	due = due.AddDate(0, 0, -int((now.Weekday()-s.Day+7)%7))
+	if due.After(now) {
+		due = due.AddDate(0, 0, -7)
+	}
+	return due
+}
+
+// Create the table recording the reports sent.
+func CreateReportTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS reports(
+		due_at TIMESTAMP PRIMARY KEY,
+		sent_at TIMESTAMP NOT NULL
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Sends the weekly report once it's due, checking every 10 minutes, except in
+// maintenance mode. Each week's report is recorded once sent, so restarts don't
+// send it again and a report missed while the server was down goes out when it
+// comes back.
+func (app *App) ReportScheduler() {
+	for ; ; time.Sleep(10 * time.Minute) {
+		if app.ReadOnly.Load() {
+			continue
+		}
+		due := app.Config.reportSchedule.last(time.Now())
+
+		var sent int
+		err := app.DB.QueryRow(`SELECT COUNT(*) FROM reports WHERE due_at = ?`, due.UTC()).Scan(&sent)
+		if err == nil && sent == 0 {
+			err = app.SendReport(due)
+		}
+		if err != nil {
+			log.Printf("Error sending the weekly report due %s\n", due.Format("2006-01-02 15:04"))
+			log.Println(err.Error())
+		}
+	}
+}
+
+// Emails the report of the week up to due and records it as sent.
+func (app *App) SendReport(due time.Time) error {
+	email := app.reportNotifier()
+	if email == nil {
+		return fmt.Errorf("no email notifier to send with")
+	}
+	to := app.Config.reportTo
+	if len(to) == 0 {
+		to = email.to
+	}
+
+	report, err := app.WeeklyReport(due.AddDate(0, 0, -7), due)
+	if err != nil {
+		return err
+	}
+
+	// Thumbnails are made like those of the index, and left out when they can't be
+	inline := make(map[string][]byte)
+	for i, top := range report.Top {
+		image, err := app.thumbnailBytes(top.Event)
+		if err != nil {
+			log.Printf("Error making the thumbnail of event %d for the weekly report\n", top.Id)
+			log.Println(err.Error())
+			continue
+		}
+		report.Top[i].Thumb = fmt.Sprintf("event-%d", top.Id)
+		inline[report.Top[i].Thumb] = image
+	}
+
+	var html bytes.Buffer
+	if err := app.Report.Execute(&html, report); err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("Seccam weekly report: %d events, %s to %s", report.Total, report.From.Format("Jan 2"), report.To.AddDate(0, 0, -1).Format("Jan 2"))
+	if err := email.smtp.send(email.from, to, buildHTMLMail(email.from, to, subject, html.String(), inline)); err != nil {
+		return err
+	}
+
+	log.Printf("Sent the weekly report to %s\n", strings.Join(to, ", "))
+	return app.retryBusy(func() error {
+		_, err := app.DB.Exec(`INSERT OR REPLACE INTO reports(due_at, sent_at) VALUES (?, ?)`, due.UTC(), time.Now().UTC())
+		return err
+	})
+}
+
+// The email notifier reports are sent with, the first of -notify-urls.
+func (app *App) reportNotifier() *emailNotifier {
+	for _, n := range app.Notifiers {
+		if email, ok := n.(emailNotifier); ok {
+			return &email
+		}
+	}
+	return nil
+}
+
+// Gathers the statistics of the events between from and to.
+func (app *App) WeeklyReport(from, to time.Time) (*weeklyReport, error) {
+	report := &weeklyReport{From: from, To: to, BaseURL: app.AbsoluteURL("/")}
+
+	sql_events := `
+	SELECT events.time, COALESCE(cameras.name, ''), COALESCE(events.size_bytes, 0) FROM events
+	LEFT JOIN cameras ON cameras.id = events.camera_id
+	WHERE events.time >= ? AND events.time < ?`
+	rows, err := app.DB.Query(sql_events, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string][]int) // Camera to count per day
+	hours := make([]int, 24)
+	var growth int64
+	for rows.Next() {
+		var t time.Time
+		var camera string
+		var size int64
+		if err := rows.Scan(&t, &camera, &size); err != nil {
+			return nil, err
+		}
+		t = t.In(from.Location())
+		day := 6
+		for day > 0 && t.Before(from.AddDate(0, 0, day)) {
+			day--
+		}
+		if counts[camera] == nil {
+			counts[camera] = make([]int, 7)
+		}
+		counts[camera][day]++
+		hours[t.Hour()]++
+		growth += size
+		report.Total++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for camera := range counts {
+		report.Cameras = append(report.Cameras, camera)
+	}
+	sort.Strings(report.Cameras)
+	for i := 0; i < 7; i++ {
+		day := reportDay{Date: from.AddDate(0, 0, i)}
+		for _, camera := range report.Cameras {
+			day.Counts = append(day.Counts, counts[camera][i])
+			day.Total += counts[camera][i]
+		}
+		report.Days = append(report.Days, day)
+	}
+
+	for hour, count := range hours {
+		if count > 0 {
+			report.Hours = append(report.Hours, reportHour{Hour: hour, Count: count})
+		}
+	}
+	sort.SliceStable(report.Hours, func(i, j int) bool { return report.Hours[i].Count > report.Hours[j].Count })
+	if len(report.Hours) > reportTopHours {
+		report.Hours = report.Hours[:reportTopHours]
+	}
+	report.Growth = formatBytes(uint64(growth))
+
+	sql_top := `
+	SELECT ` + eventColumns + ` FROM events
+	WHERE time >= ? AND time < ? AND score IS NOT NULL
+	ORDER BY score DESC LIMIT ?`
+	top, err := app.DB.Query(sql_top, from.UTC(), to.UTC(), reportTopEvents)
+	if err != nil {
+		return nil, err
+	}
+	defer top.Close()
+	for top.Next() {
+		event, err := scanEvent(top)
+		if err != nil {
+			return nil, err
+		}
+		report.Top = append(report.Top, reportEvent{
+			Event:  event,
+			Camera: app.cameraName(event),
+			URL:    app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id)),
+		})
+	}
+
+	return report, top.Err()
+}
+
+// Reads the JPEG thumbnail of an event, making it if it isn't cached.
+func (app *App) thumbnailBytes(event *Event) ([]byte, error) {
+	path, err := app.Thumbs.Get(event.Id, thumbJPEG, func(dst string) error {
+		return app.sealedOutput(dst, func(dst string) error {
+			return app.makeThumbnail(event, dst)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return app.readAlertImage(path, emailMaxImage)
+}
+
+// Parses the report template, from -report-template or the templates directory.
+func loadReportTemplate(config *Config) (*template.Template, error) {
+	path := config.reportTemplate
+	if path == "" {
+		path = filepath.Join(config.dirs.tmpl, "report.html")
+	}
+	funcs := template.FuncMap{
+		"cid": func(id string) template.URL {
+			return template.URL("cid:" + id)
+		},
+		"deref": func(score *float64) float64 {
+			return *score
+		},
+	}
+	return template.New(filepath.Base(path)).Funcs(funcs).ParseFiles(path)
+}
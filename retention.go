@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Age past which whole events are deleted: -retain or -retain-image, the
+// shorter if both are set, 0 for no limit.
+func (app *App) eventRetain() time.Duration {
+	retain, image := app.Config.retain, app.Config.retainImage
+	if retain == 0 || (image > 0 && image < retain) {
+		return image
+	}
+	return retain
+}
+
+// Deletes unprotected events that are past their own expiry, or without one are
+// older than -retain (or -retain-image) or not among the -retain-count most
+// recent events, whichever limits are set. Evidence is never deleted. Returns
+// the number of events deleted.
+func (app *App) ApplyRetention() (int, error) {
+	retain, count := app.eventRetain(), app.Config.retainCount
+
+	// An event goes if it breaks either limit, protected events and evidence
+	// count towards the most recent but are never deleted. Events with an expiry
+	// only go once it has passed.
+	sql_expired := `
+	SELECT id FROM events WHERE protected = 0 AND evidence_at IS NULL AND (
+		(expires_at IS NOT NULL AND expires_at < ?) OR
+		(expires_at IS NULL AND (
+			(? AND time < datetime('now', ?)) OR
+			(? AND id NOT IN (SELECT id FROM events ORDER BY time DESC, id DESC LIMIT ?))
+		))
+	)`
+	rows, err := app.DB.Query(sql_expired, time.Now().UTC(), retain > 0, fmt.Sprintf("-%d seconds", int64(retain.Seconds())), count > 0, count)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		err := app.DeleteEvent(id, ActorRetention, "")
+		if err == errProtected || err == errEvidence {
+			// Protected or kept as evidence since we looked
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// Drops the videos of unprotected events older than -retain-video, keeping the
+// rest of the event until it's deleted in turn. Evidence keeps its video, as do
+// events with their own expiry
+// keep their video until then, and events still being converted are left for a
+// later sweep. Returns the number of videos dropped.
+func (app *App) ExpireVideos() (int, error) {
+	if app.Config.retainVideo <= 0 {
+		return 0, nil
+	}
+
+	sql_expired := `
+	SELECT id FROM events
+	WHERE protected = 0 AND evidence_at IS NULL AND expires_at IS NULL AND video != '' AND status IN (?, ?) AND time < ?`
+	before := time.Now().Add(-app.Config.retainVideo).UTC()
+	rows, err := app.DB.Query(sql_expired, StatusDone, StatusFailed, before)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		if err := app.ExpireVideo(id, ActorRetention, ""); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	return expired, nil
+}
+
+// Deletes an event's video along with its small version, the event keeps its
+// images and notes that its video expired. The files go once the change has
+// committed.
+func (app *App) ExpireVideo(id int64, actor, remoteAddr string) error {
+	defer app.Cache.Clear()
+	var paths []string
+	err := app.retryBusy(func() error {
+		paths = nil
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var video string
+		if err := tx.QueryRow(`SELECT video FROM events WHERE id = ?`, id).Scan(&video); err != nil {
+			return err
+		}
+		paths = append(paths, video)
+		rows, err := tx.Query(`SELECT path FROM media WHERE event_id = ? AND kind IN (?, ?)`, id, MediaVideo, MediaVideoLow)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				rows.Close()
+				return err
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM media WHERE event_id = ? AND kind IN (?, ?)`, id, MediaVideo, MediaVideoLow); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE events SET video = '', video_expired = 1 WHERE id = ?`, id); err != nil {
+			return err
+		}
+		if err := setEventSize(tx, id); err != nil {
+			return err
+		}
+		if err := Audit(tx, actor, "expire video", id, remoteAddr, ""); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// Applies the retention limits, expiries and storage quota, empties the trash
+// and purges expired upload tokens on startup and every hour after, except in
+// maintenance mode.
+func (app *App) RetentionSweeper() {
+	for ; ; time.Sleep(time.Hour) {
+		if app.ReadOnly.Load() {
+			continue
+		}
+
+		deleted, err := app.ApplyRetention()
+		if err != nil {
+			log.Println("Error applying retention")
+			log.Println(err.Error())
+		} else if deleted > 0 {
+			log.Printf("Retention sweep deleted %d events\n", deleted)
+		}
+
+		expired, err := app.ExpireVideos()
+		if err != nil {
+			log.Println("Error expiring videos")
+			log.Println(err.Error())
+		} else if expired > 0 {
+			log.Printf("Retention sweep deleted the videos of %d events\n", expired)
+		}
+
+		if app.Config.trashRetain > 0 {
+			emptied, err := app.ExpireTrash()
+			if err != nil {
+				log.Println("Error emptying the trash")
+				log.Println(err.Error())
+			} else if emptied.Events > 0 {
+				log.Printf("Retention sweep emptied the trash of %d events, %d bytes\n", emptied.Events, emptied.Bytes)
+			}
+		}
+
+		freed, evicted, err := app.EnforceQuota()
+		if err != nil {
+			log.Println("Error enforcing the storage quota")
+			log.Println(err.Error())
+		}
+		if freed.Events > 0 {
+			log.Printf("Storage quota emptied the trash of %d events, %d bytes\n", freed.Events, freed.Bytes)
+		}
+		if evicted > 0 {
+			log.Printf("Storage quota deleted %d events\n", evicted)
+		}
+
+		purged, err := app.PurgeUploadTokens()
+		if err != nil {
+			log.Println("Error purging expired upload tokens")
+			log.Println(err.Error())
+		} else if purged > 0 {
+			log.Printf("Retention sweep purged %d expired upload tokens\n", purged)
+		}
+	}
+}
+
+// Returns when an event will be deleted, if that can be told: its own expiry or
+// the -retain limit. Protected events are never deleted, and -retain-count
+// depends on the events still to come.
+func (app *App) EffectiveExpiry(event *Event) (time.Time, bool) {
+	switch {
+	case event.Protected:
+		return time.Time{}, false
+	case event.ExpiresAt != nil:
+		return *event.ExpiresAt, true
+	case app.eventRetain() > 0:
+		return event.Time.Add(app.eventRetain()), true
+	}
+	return time.Time{}, false
+}
+
+// Returns when an event's video will be deleted under -retain-video, if before
+// the whole event is.
+func (app *App) VideoExpiry(event *Event) (time.Time, bool) {
+	if event.Video == "" || event.Protected || event.ExpiresAt != nil || app.Config.retainVideo <= 0 {
+		return time.Time{}, false
+	}
+	at := event.Time.Add(app.Config.retainVideo)
+	if expires, ok := app.EffectiveExpiry(event); ok && !at.Before(expires) {
+		return time.Time{}, false
+	}
+	return at, true
+}
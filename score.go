@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Estimates how much motion a clip has with ffmpeg's scene detection, the score
+// is the biggest change between two frames from 0 (none) to 1 (a new scene).
+// Clips without any change score 0.
+func (app *App) SceneScore(ctx context.Context, path string) (float64, error) {
+	cmd := exec.CommandContext(ctx, app.FFmpeg,
+		"-hide_banner", "-nostats",
+		"-i", path,
+		"-an",
+		"-vf", `select=gte(scene\,0),metadata=print:file=-`,
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, ffmpegError(err, stderr.Bytes())
+	}
+
+	// Every frame prints a "frame:N pts:..." line followed by its metadata
+	var score float64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		v, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "lavfi.scene_score=")
+		if !ok {
+			continue
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > score {
+			score = f
+		}
+	}
+
+	return score, nil
+}
+
+// Stores the motion score of an event.
+func (app *App) SetEventScore(id int64, score float64) error {
+	defer app.Cache.Clear()
+	_, err := app.DB.Exec(`UPDATE events SET score = ? WHERE id = ?`, score, id)
+	return err
+}
+
+// Whether notifying about a new event waits for its motion score.
+func (app *App) notifyAfterScore(event *Event) bool {
+	return app.Config.motionScore && app.Config.minScore > 0 && event.Status == StatusPending
+}
+
+// Scores the motion in an event's video, read from the plaintext copy at video,
+// before it's converted, then sends the notifications held back for the score.
+// Analysis failures are logged and notify as usual, cancelled analyses are
+// redone when the event is requeued.
+func (app *App) scoreEvent(ctx context.Context, logger *Logger, event *Event, video string) {
+	score, err := app.SceneScore(ctx, video)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logger.Printf("Error scoring the motion of event %d\n", event.Id)
+		logger.Println(err.Error())
+	} else if err := app.SetEventScore(event.Id, score); err != nil {
+		logger.Printf("Error saving the motion score of event %d\n", event.Id)
+		logger.Println(err.Error())
+	} else {
+		event.Score = &score
+		logger.Printf("Scored the motion of event %d at %.3f\n", event.Id, score)
+	}
+
+	if !app.notifyAfterScore(event) || event.Suppressed {
+		return
+	}
+	if event.Score != nil && *event.Score < app.Config.minScore {
+		logger.Printf("Not notifying about event %d, its motion score %.3f is below %.3f\n", event.Id, *event.Score, app.Config.minScore)
+		return
+	}
+	app.alertEvent(logger, event, app.cameraName(event))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"strings"
+)
+
+// Columns of events covered by search
+var searchColumns = []string{"name", "notes"}
+
+// Event matching a search, with the matching text highlighted
+type searchResult struct {
+	*Event
+	Snippet template.HTML
+}
+
+// Markers snippet() wraps matches in, swapped for <mark> once the text is escaped
+const (
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// Creates the full text index over events and the triggers keeping it in sync,
+// rebuilding it from the events table whenever it is new, its columns changed or
+// it missed writes. Returns false when sqlite was built without FTS5, search
+// then falls back to LIKE.
+func CreateSearchIndex(db *sql.DB) bool {
+	triggers := []string{"events_fts_insert", "events_fts_delete", "events_fts_update"}
+
+	if _, err := db.Exec(`CREATE VIRTUAL TABLE temp.fts5_probe USING fts5(x)`); err != nil {
+		// The triggers would fail every write to events without the module
+		for _, trigger := range triggers {
+			if _, err := db.Exec(`DROP TRIGGER IF EXISTS ` + trigger); err != nil {
+				panic(err)
+			}
+		}
+		return false
+	}
+	if _, err := db.Exec(`DROP TABLE temp.fts5_probe`); err != nil {
+		panic(err)
+	}
+
+	columns := strings.Join(searchColumns, ", ")
+	newValues := "new." + strings.Join(searchColumns, ", new.")
+	oldValues := "old." + strings.Join(searchColumns, ", old.")
+
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+
+	// Recreate the index if its definition changed
+	rebuild := false
+	sql_table := `CREATE VIRTUAL TABLE events_fts USING fts5(` + columns + `, content='events', content_rowid='id')`
+	var existing string
+	err = tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'events_fts'`).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	if existing != sql_table {
+		if _, err := tx.Exec(`DROP TABLE IF EXISTS events_fts`); err != nil {
+			panic(err)
+		}
+		if _, err := tx.Exec(sql_table); err != nil {
+			panic(err)
+		}
+		rebuild = true
+	}
+
+	// Any writes made while the triggers were missing aren't in the index
+	var count int
+	err = tx.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'events_fts_%'`).Scan(&count)
+	if err != nil {
+		panic(err)
+	}
+	if count != len(triggers) {
+		rebuild = true
+	}
+
+	// The triggers are always recreated so they follow searchColumns
+	sql_triggers := []string{
+		`CREATE TRIGGER events_fts_insert AFTER INSERT ON events BEGIN
+			INSERT INTO events_fts(rowid, ` + columns + `) VALUES (new.id, ` + newValues + `);
+		END`,
+		`CREATE TRIGGER events_fts_delete AFTER DELETE ON events BEGIN
+			INSERT INTO events_fts(events_fts, rowid, ` + columns + `) VALUES ('delete', old.id, ` + oldValues + `);
+		END`,
+		`CREATE TRIGGER events_fts_update AFTER UPDATE OF ` + columns + ` ON events BEGIN
+			INSERT INTO events_fts(events_fts, rowid, ` + columns + `) VALUES ('delete', old.id, ` + oldValues + `);
+			INSERT INTO events_fts(rowid, ` + columns + `) VALUES (new.id, ` + newValues + `);
+		END`,
+	}
+	for i, trigger := range triggers {
+		if _, err := tx.Exec(`DROP TRIGGER IF EXISTS ` + trigger); err != nil {
+			panic(err)
+		}
+		if _, err := tx.Exec(sql_triggers[i]); err != nil {
+			panic(err)
+		}
+	}
+
+	if rebuild {
+		if _, err := tx.Exec(`INSERT INTO events_fts(events_fts) VALUES ('rebuild')`); err != nil {
+			panic(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	if rebuild {
+		log.Println("Rebuilt search index")
+	}
+
+	return true
+}
+
+// Searches events, best matches first. Every word of the query has to match the
+// start of a word in the event, without FTS5 a substring match on any of the
+// search columns is used instead and results are newest first. Only events after
+// sinceID matching the filter are considered.
+func (app *App) SearchEvents(query string, filter eventFilter, sinceID int64, limit int) ([]*searchResult, error) {
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return []*searchResult{}, nil
+	}
+
+	var rows *sql.Rows
+	var err error
+	if app.FTS {
+		// Quote every term so nothing in it is taken as query syntax
+		for i, term := range terms {
+			terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+		}
+
+		cond, filterArgs := filter.where("events")
+		sql_search := `
+		SELECT ` + eventColumns + `, hits.snippet FROM events JOIN (
+			SELECT rowid, rank, snippet(events_fts, -1, char(2), char(3), '…', 12) AS snippet
+			FROM events_fts WHERE events_fts MATCH ?
+		) AS hits ON hits.rowid = events.id
+		WHERE events.id > ? AND ` + cond + `
+		ORDER BY hits.rank LIMIT ?`
+		args := append([]interface{}{strings.Join(terms, " "), sinceID}, filterArgs...)
+		rows, err = app.DB.Query(sql_search, append(args, limit)...)
+	} else {
+		var where []string
+		var args []interface{}
+		for _, term := range terms {
+			var alts []string
+			for _, column := range searchColumns {
+				alts = append(alts, column+` LIKE ? ESCAPE '\'`)
+				args = append(args, "%"+escapeLike(term)+"%")
+			}
+			where = append(where, "("+strings.Join(alts, " OR ")+")")
+		}
+		cond, filterArgs := filter.where("")
+		where = append(where, "id > ?", cond)
+		args = append(append(args, sinceID), filterArgs...)
+		args = append(args, limit)
+
+		sql_search := `SELECT ` + eventColumns + `, name FROM events WHERE ` + strings.Join(where, " AND ") + ` ORDER BY id DESC LIMIT ?`
+		rows, err = app.DB.Query(sql_search, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*searchResult, 0)
+	for rows.Next() {
+		var snippet string
+		event, err := scanEvent(extraScanner{row: rows, extra: []interface{}{&snippet}})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &searchResult{Event: event, Snippet: renderSnippet(snippet)})
+	}
+
+	return results, rows.Err()
+}
+
+// Escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Escapes a snippet for HTML, turning the match markers into <mark> elements.
+func renderSnippet(s string) template.HTML {
+	s = template.HTMLEscapeString(s)
+	s = strings.ReplaceAll(s, markStart, "<mark>")
+	s = strings.ReplaceAll(s, markEnd, "</mark>")
+	return template.HTML(s)
+}
+
+// Row scanner reading extra columns after the ones asked for
+type extraScanner struct {
+	row   interface{ Scan(...interface{}) error }
+	extra []interface{}
+}
+
+func (s extraScanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.extra...)...)
+}
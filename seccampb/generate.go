@@ -0,0 +1,5 @@
+// Package seccampb holds the protocol buffer and gRPC code for the seccam-web
+// ingestion service, generated from seccam.proto.
+package seccampb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative seccam.proto
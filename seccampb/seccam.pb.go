@@ -0,0 +1,568 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: seccam.proto
+
+package seccampb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CreateEventRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Part:
+	//
+	//	*CreateEventRequest_VideoChunk
+	//	*CreateEventRequest_Metadata
+	//	*CreateEventRequest_ImageChunk
+	Part          isCreateEventRequest_Part `protobuf_oneof:"part"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateEventRequest) Reset() {
+	*x = CreateEventRequest{}
+	mi := &file_seccam_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateEventRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateEventRequest) ProtoMessage() {}
+
+func (x *CreateEventRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_seccam_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateEventRequest.ProtoReflect.Descriptor instead.
+func (*CreateEventRequest) Descriptor() ([]byte, []int) {
+	return file_seccam_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CreateEventRequest) GetPart() isCreateEventRequest_Part {
+	if x != nil {
+		return x.Part
+	}
+	return nil
+}
+
+func (x *CreateEventRequest) GetVideoChunk() []byte {
+	if x != nil {
+		if x, ok := x.Part.(*CreateEventRequest_VideoChunk); ok {
+			return x.VideoChunk
+		}
+	}
+	return nil
+}
+
+func (x *CreateEventRequest) GetMetadata() *EventMetadata {
+	if x != nil {
+		if x, ok := x.Part.(*CreateEventRequest_Metadata); ok {
+			return x.Metadata
+		}
+	}
+	return nil
+}
+
+func (x *CreateEventRequest) GetImageChunk() []byte {
+	if x != nil {
+		if x, ok := x.Part.(*CreateEventRequest_ImageChunk); ok {
+			return x.ImageChunk
+		}
+	}
+	return nil
+}
+
+type isCreateEventRequest_Part interface {
+	isCreateEventRequest_Part()
+}
+
+type CreateEventRequest_VideoChunk struct {
+	VideoChunk []byte `protobuf:"bytes,1,opt,name=video_chunk,json=videoChunk,proto3,oneof"`
+}
+
+type CreateEventRequest_Metadata struct {
+	Metadata *EventMetadata `protobuf:"bytes,2,opt,name=metadata,proto3,oneof"`
+}
+
+type CreateEventRequest_ImageChunk struct {
+	ImageChunk []byte `protobuf:"bytes,3,opt,name=image_chunk,json=imageChunk,proto3,oneof"`
+}
+
+func (*CreateEventRequest_VideoChunk) isCreateEventRequest_Part() {}
+
+func (*CreateEventRequest_Metadata) isCreateEventRequest_Part() {}
+
+func (*CreateEventRequest_ImageChunk) isCreateEventRequest_Part() {}
+
+type EventMetadata struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// File names the video and image are stored under
+	VideoFilename string `protobuf:"bytes,2,opt,name=video_filename,json=videoFilename,proto3" json:"video_filename,omitempty"`
+	ImageFilename string `protobuf:"bytes,3,opt,name=image_filename,json=imageFilename,proto3" json:"image_filename,omitempty"`
+	// Skip the SMS notification for this event
+	SuppressNotification bool `protobuf:"varint,4,opt,name=suppress_notification,json=suppressNotification,proto3" json:"suppress_notification,omitempty"`
+	unknownFields        protoimpl.UnknownFields
+	sizeCache            protoimpl.SizeCache
+}
+
+func (x *EventMetadata) Reset() {
+	*x = EventMetadata{}
+	mi := &file_seccam_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EventMetadata) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EventMetadata) ProtoMessage() {}
+
+func (x *EventMetadata) ProtoReflect() protoreflect.Message {
+	mi := &file_seccam_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EventMetadata.ProtoReflect.Descriptor instead.
+func (*EventMetadata) Descriptor() ([]byte, []int) {
+	return file_seccam_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *EventMetadata) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *EventMetadata) GetVideoFilename() string {
+	if x != nil {
+		return x.VideoFilename
+	}
+	return ""
+}
+
+func (x *EventMetadata) GetImageFilename() string {
+	if x != nil {
+		return x.ImageFilename
+	}
+	return ""
+}
+
+func (x *EventMetadata) GetSuppressNotification() bool {
+	if x != nil {
+		return x.SuppressNotification
+	}
+	return false
+}
+
+type GetEventRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetEventRequest) Reset() {
+	*x = GetEventRequest{}
+	mi := &file_seccam_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetEventRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetEventRequest) ProtoMessage() {}
+
+func (x *GetEventRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_seccam_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetEventRequest.ProtoReflect.Descriptor instead.
+func (*GetEventRequest) Descriptor() ([]byte, []int) {
+	return file_seccam_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *GetEventRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type ListEventsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Number of events, 1 to 100. Defaults to 20 when unset.
+	Limit         int32 `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListEventsRequest) Reset() {
+	*x = ListEventsRequest{}
+	mi := &file_seccam_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListEventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListEventsRequest) ProtoMessage() {}
+
+func (x *ListEventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_seccam_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListEventsRequest.ProtoReflect.Descriptor instead.
+func (*ListEventsRequest) Descriptor() ([]byte, []int) {
+	return file_seccam_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListEventsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type ListEventsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Events        []*Event               `protobuf:"bytes,1,rep,name=events,proto3" json:"events,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListEventsResponse) Reset() {
+	*x = ListEventsResponse{}
+	mi := &file_seccam_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListEventsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListEventsResponse) ProtoMessage() {}
+
+func (x *ListEventsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_seccam_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListEventsResponse.ProtoReflect.Descriptor instead.
+func (*ListEventsResponse) Descriptor() ([]byte, []int) {
+	return file_seccam_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ListEventsResponse) GetEvents() []*Event {
+	if x != nil {
+		return x.Events
+	}
+	return nil
+}
+
+type Event struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Id               int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name             string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Time             *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	Video            string                 `protobuf:"bytes,4,opt,name=video,proto3" json:"video,omitempty"`
+	Image            string                 `protobuf:"bytes,5,opt,name=image,proto3" json:"image,omitempty"`
+	Status           string                 `protobuf:"bytes,6,opt,name=status,proto3" json:"status,omitempty"`
+	LastError        string                 `protobuf:"bytes,7,opt,name=last_error,json=lastError,proto3" json:"last_error,omitempty"`
+	NotifySuppressed bool                   `protobuf:"varint,8,opt,name=notify_suppressed,json=notifySuppressed,proto3" json:"notify_suppressed,omitempty"`
+	Protected        bool                   `protobuf:"varint,9,opt,name=protected,proto3" json:"protected,omitempty"`
+	VideoUrl         string                 `protobuf:"bytes,10,opt,name=video_url,json=videoUrl,proto3" json:"video_url,omitempty"`
+	ImageUrl         string                 `protobuf:"bytes,11,opt,name=image_url,json=imageUrl,proto3" json:"image_url,omitempty"`
+	Notes            string                 `protobuf:"bytes,12,opt,name=notes,proto3" json:"notes,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_seccam_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_seccam_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_seccam_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Event) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Event) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Event) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Event) GetVideo() string {
+	if x != nil {
+		return x.Video
+	}
+	return ""
+}
+
+func (x *Event) GetImage() string {
+	if x != nil {
+		return x.Image
+	}
+	return ""
+}
+
+func (x *Event) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Event) GetLastError() string {
+	if x != nil {
+		return x.LastError
+	}
+	return ""
+}
+
+func (x *Event) GetNotifySuppressed() bool {
+	if x != nil {
+		return x.NotifySuppressed
+	}
+	return false
+}
+
+func (x *Event) GetProtected() bool {
+	if x != nil {
+		return x.Protected
+	}
+	return false
+}
+
+func (x *Event) GetVideoUrl() string {
+	if x != nil {
+		return x.VideoUrl
+	}
+	return ""
+}
+
+func (x *Event) GetImageUrl() string {
+	if x != nil {
+		return x.ImageUrl
+	}
+	return ""
+}
+
+func (x *Event) GetNotes() string {
+	if x != nil {
+		return x.Notes
+	}
+	return ""
+}
+
+var File_seccam_proto protoreflect.FileDescriptor
+
+const file_seccam_proto_rawDesc = "" +
+	"\n" +
+	"\fseccam.proto\x12\tseccam.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x9a\x01\n" +
+	"\x12CreateEventRequest\x12!\n" +
+	"\vvideo_chunk\x18\x01 \x01(\fH\x00R\n" +
+	"videoChunk\x126\n" +
+	"\bmetadata\x18\x02 \x01(\v2\x18.seccam.v1.EventMetadataH\x00R\bmetadata\x12!\n" +
+	"\vimage_chunk\x18\x03 \x01(\fH\x00R\n" +
+	"imageChunkB\x06\n" +
+	"\x04part\"\xa6\x01\n" +
+	"\rEventMetadata\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12%\n" +
+	"\x0evideo_filename\x18\x02 \x01(\tR\rvideoFilename\x12%\n" +
+	"\x0eimage_filename\x18\x03 \x01(\tR\rimageFilename\x123\n" +
+	"\x15suppress_notification\x18\x04 \x01(\bR\x14suppressNotification\"!\n" +
+	"\x0fGetEventRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\")\n" +
+	"\x11ListEventsRequest\x12\x14\n" +
+	"\x05limit\x18\x01 \x01(\x05R\x05limit\">\n" +
+	"\x12ListEventsResponse\x12(\n" +
+	"\x06events\x18\x01 \x03(\v2\x10.seccam.v1.EventR\x06events\"\xd9\x02\n" +
+	"\x05Event\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12.\n" +
+	"\x04time\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x14\n" +
+	"\x05video\x18\x04 \x01(\tR\x05video\x12\x14\n" +
+	"\x05image\x18\x05 \x01(\tR\x05image\x12\x16\n" +
+	"\x06status\x18\x06 \x01(\tR\x06status\x12\x1d\n" +
+	"\n" +
+	"last_error\x18\a \x01(\tR\tlastError\x12+\n" +
+	"\x11notify_suppressed\x18\b \x01(\bR\x10notifySuppressed\x12\x1c\n" +
+	"\tprotected\x18\t \x01(\bR\tprotected\x12\x1b\n" +
+	"\tvideo_url\x18\n" +
+	" \x01(\tR\bvideoUrl\x12\x1b\n" +
+	"\timage_url\x18\v \x01(\tR\bimageUrl\x12\x14\n" +
+	"\x05notes\x18\f \x01(\tR\x05notes2\xcf\x01\n" +
+	"\x06Seccam\x12@\n" +
+	"\vCreateEvent\x12\x1d.seccam.v1.CreateEventRequest\x1a\x10.seccam.v1.Event(\x01\x128\n" +
+	"\bGetEvent\x12\x1a.seccam.v1.GetEventRequest\x1a\x10.seccam.v1.Event\x12I\n" +
+	"\n" +
+	"ListEvents\x12\x1c.seccam.v1.ListEventsRequest\x1a\x1d.seccam.v1.ListEventsResponseB+Z)github.com/battleroid/seccam-web/seccampbb\x06proto3"
+
+var (
+	file_seccam_proto_rawDescOnce sync.Once
+	file_seccam_proto_rawDescData []byte
+)
+
+func file_seccam_proto_rawDescGZIP() []byte {
+	file_seccam_proto_rawDescOnce.Do(func() {
+		file_seccam_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_seccam_proto_rawDesc), len(file_seccam_proto_rawDesc)))
+	})
+	return file_seccam_proto_rawDescData
+}
+
+var file_seccam_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_seccam_proto_goTypes = []any{
+	(*CreateEventRequest)(nil),    // 0: seccam.v1.CreateEventRequest
+	(*EventMetadata)(nil),         // 1: seccam.v1.EventMetadata
+	(*GetEventRequest)(nil),       // 2: seccam.v1.GetEventRequest
+	(*ListEventsRequest)(nil),     // 3: seccam.v1.ListEventsRequest
+	(*ListEventsResponse)(nil),    // 4: seccam.v1.ListEventsResponse
+	(*Event)(nil),                 // 5: seccam.v1.Event
+	(*timestamppb.Timestamp)(nil), // 6: google.protobuf.Timestamp
+}
+var file_seccam_proto_depIdxs = []int32{
+	1, // 0: seccam.v1.CreateEventRequest.metadata:type_name -> seccam.v1.EventMetadata
+	5, // 1: seccam.v1.ListEventsResponse.events:type_name -> seccam.v1.Event
+	6, // 2: seccam.v1.Event.time:type_name -> google.protobuf.Timestamp
+	0, // 3: seccam.v1.Seccam.CreateEvent:input_type -> seccam.v1.CreateEventRequest
+	2, // 4: seccam.v1.Seccam.GetEvent:input_type -> seccam.v1.GetEventRequest
+	3, // 5: seccam.v1.Seccam.ListEvents:input_type -> seccam.v1.ListEventsRequest
+	5, // 6: seccam.v1.Seccam.CreateEvent:output_type -> seccam.v1.Event
+	5, // 7: seccam.v1.Seccam.GetEvent:output_type -> seccam.v1.Event
+	4, // 8: seccam.v1.Seccam.ListEvents:output_type -> seccam.v1.ListEventsResponse
+	6, // [6:9] is the sub-list for method output_type
+	3, // [3:6] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_seccam_proto_init() }
+func file_seccam_proto_init() {
+	if File_seccam_proto != nil {
+		return
+	}
+	file_seccam_proto_msgTypes[0].OneofWrappers = []any{
+		(*CreateEventRequest_VideoChunk)(nil),
+		(*CreateEventRequest_Metadata)(nil),
+		(*CreateEventRequest_ImageChunk)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_seccam_proto_rawDesc), len(file_seccam_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_seccam_proto_goTypes,
+		DependencyIndexes: file_seccam_proto_depIdxs,
+		MessageInfos:      file_seccam_proto_msgTypes,
+	}.Build()
+	File_seccam_proto = out.File
+	file_seccam_proto_goTypes = nil
+	file_seccam_proto_depIdxs = nil
+}
@@ -0,0 +1,207 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: seccam.proto
+
+package seccampb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Seccam_CreateEvent_FullMethodName = "/seccam.v1.Seccam/CreateEvent"
+	Seccam_GetEvent_FullMethodName    = "/seccam.v1.Seccam/GetEvent"
+	Seccam_ListEvents_FullMethodName  = "/seccam.v1.Seccam/ListEvents"
+)
+
+// SeccamClient is the client API for Seccam service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Camera ingestion and event lookup. Every call must carry the camera's token
+// in an "authorization: Bearer <token>" metadata entry.
+type SeccamClient interface {
+	// Creates an event. The stream is the video in any number of video_chunk
+	// messages, then a single metadata message, then the image in any number of
+	// image_chunk messages.
+	CreateEvent(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[CreateEventRequest, Event], error)
+	// Returns a single event.
+	GetEvent(ctx context.Context, in *GetEventRequest, opts ...grpc.CallOption) (*Event, error)
+	// Lists the most recent events, newest first.
+	ListEvents(ctx context.Context, in *ListEventsRequest, opts ...grpc.CallOption) (*ListEventsResponse, error)
+}
+
+type seccamClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSeccamClient(cc grpc.ClientConnInterface) SeccamClient {
+	return &seccamClient{cc}
+}
+
+func (c *seccamClient) CreateEvent(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[CreateEventRequest, Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Seccam_ServiceDesc.Streams[0], Seccam_CreateEvent_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[CreateEventRequest, Event]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Seccam_CreateEventClient = grpc.ClientStreamingClient[CreateEventRequest, Event]
+
+func (c *seccamClient) GetEvent(ctx context.Context, in *GetEventRequest, opts ...grpc.CallOption) (*Event, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Event)
+	err := c.cc.Invoke(ctx, Seccam_GetEvent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *seccamClient) ListEvents(ctx context.Context, in *ListEventsRequest, opts ...grpc.CallOption) (*ListEventsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListEventsResponse)
+	err := c.cc.Invoke(ctx, Seccam_ListEvents_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SeccamServer is the server API for Seccam service.
+// All implementations must embed UnimplementedSeccamServer
+// for forward compatibility.
+//
+// Camera ingestion and event lookup. Every call must carry the camera's token
+// in an "authorization: Bearer <token>" metadata entry.
+type SeccamServer interface {
+	// Creates an event. The stream is the video in any number of video_chunk
+	// messages, then a single metadata message, then the image in any number of
+	// image_chunk messages.
+	CreateEvent(grpc.ClientStreamingServer[CreateEventRequest, Event]) error
+	// Returns a single event.
+	GetEvent(context.Context, *GetEventRequest) (*Event, error)
+	// Lists the most recent events, newest first.
+	ListEvents(context.Context, *ListEventsRequest) (*ListEventsResponse, error)
+	mustEmbedUnimplementedSeccamServer()
+}
+
+// UnimplementedSeccamServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSeccamServer struct{}
+
+func (UnimplementedSeccamServer) CreateEvent(grpc.ClientStreamingServer[CreateEventRequest, Event]) error {
+	return status.Error(codes.Unimplemented, "method CreateEvent not implemented")
+}
+func (UnimplementedSeccamServer) GetEvent(context.Context, *GetEventRequest) (*Event, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetEvent not implemented")
+}
+func (UnimplementedSeccamServer) ListEvents(context.Context, *ListEventsRequest) (*ListEventsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListEvents not implemented")
+}
+func (UnimplementedSeccamServer) mustEmbedUnimplementedSeccamServer() {}
+func (UnimplementedSeccamServer) testEmbeddedByValue()                {}
+
+// UnsafeSeccamServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SeccamServer will
+// result in compilation errors.
+type UnsafeSeccamServer interface {
+	mustEmbedUnimplementedSeccamServer()
+}
+
+func RegisterSeccamServer(s grpc.ServiceRegistrar, srv SeccamServer) {
+	// If the following call panics, it indicates UnimplementedSeccamServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Seccam_ServiceDesc, srv)
+}
+
+func _Seccam_CreateEvent_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SeccamServer).CreateEvent(&grpc.GenericServerStream[CreateEventRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Seccam_CreateEventServer = grpc.ClientStreamingServer[CreateEventRequest, Event]
+
+func _Seccam_GetEvent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetEventRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SeccamServer).GetEvent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Seccam_GetEvent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SeccamServer).GetEvent(ctx, req.(*GetEventRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Seccam_ListEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SeccamServer).ListEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Seccam_ListEvents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SeccamServer).ListEvents(ctx, req.(*ListEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Seccam_ServiceDesc is the grpc.ServiceDesc for Seccam service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Seccam_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "seccam.v1.Seccam",
+	HandlerType: (*SeccamServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetEvent",
+			Handler:    _Seccam_GetEvent_Handler,
+		},
+		{
+			MethodName: "ListEvents",
+			Handler:    _Seccam_ListEvents_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CreateEvent",
+			Handler:       _Seccam_CreateEvent_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "seccam.proto",
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const cspNonceKey contextKey = iota + 300
+
+// Content-Security-Policy sent with every page. The templates only use inline
+// styles and the one inline script carrying the request's nonce.
+var defaultCSP = []string{
+	"default-src 'self'",
+	"img-src 'self' data:",
+	"media-src 'self'",
+	"style-src 'self' 'unsafe-inline'",
+	"script-src 'self' 'nonce-{nonce}'",
+	"object-src 'none'",
+	"base-uri 'self'",
+	"form-action 'self'",
+	"frame-ancestors 'none'",
+}
+
+// Policy for uploaded files, which should never run anything even when opened
+// directly.
+const mediaCSP = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// Merges extra directives ("media-src *; img-src 'self' blob:") into the default
+// policy. Directives already in the default are replaced, new ones appended.
+func buildCSP(extra string) string {
+	directives := append([]string{}, defaultCSP...)
+	for _, directive := range strings.Split(extra, ";") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		name := strings.Fields(directive)[0]
+		replaced := false
+		for i, existing := range directives {
+			if strings.Fields(existing)[0] == name {
+				directives[i] = directive
+				replaced = true
+			}
+		}
+		if !replaced {
+			directives = append(directives, directive)
+		}
+	}
+
+	return strings.Join(directives, "; ")
+}
+
+// Returns the CSP nonce of the request the context belongs to.
+func CSPNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceKey).(string)
+	return nonce
+}
+
+// Middleware setting the security headers on every response. Every request gets
+// a fresh nonce for inline scripts. HSTS is sent for TLS requests and when the
+// base URL is https, as we're then behind a TLS terminating proxy.
+func (app *App) SecurityHeadersMiddleware(next http.Handler) http.Handler {
+	policy := buildCSP(app.Config.csp)
+	hsts := false
+	if u, err := url.Parse(app.Config.baseURL); err == nil && u.Scheme == "https" {
+		hsts = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newRequestID()
+		h := w.Header()
+		h.Set("Content-Security-Policy", strings.ReplaceAll(policy, "{nonce}", nonce))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "same-origin")
+		if hsts || r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey, nonce)))
+	})
+}
+
+// Type of a media file served and whether browsers can show it
+type mediaType struct {
+	contentType string
+	inline      bool
+}
+
+// Types of the files served, the system's MIME table may lack the video ones.
+// Browsers don't play AVI, Matroska or QuickTime (such as videos that failed
+// to convert), those are downloaded even though they're media.
+var mediaTypes = map[string]mediaType{
+	".mp4":  {"video/mp4", true},
+	".m4v":  {"video/mp4", true},
+	".webm": {"video/webm", true},
+	".avi":  {"video/x-msvideo", false},
+	".mkv":  {"video/x-matroska", false},
+	".mov":  {"video/quicktime", false},
+	".jpg":  {"image/jpeg", true},
+	".jpeg": {"image/jpeg", true},
+	".png":  {"image/png", true},
+	".gif":  {"image/gif", true},
+	".webp": {"image/webp", true},
+}
+
+// Sets the headers for serving an uploaded file. Videos and images browsers
+// show are sent inline unless the download parameter asks otherwise, anything
+// else (an HTML file uploaded as the "image") is sent as a download so it
+// can't be rendered on our origin. Downloads are named name, with the file's
+// extension, or after the file itself when name is empty.
+func mediaHeaders(w http.ResponseWriter, r *http.Request, path, name string) {
+	w.Header().Set("Content-Security-Policy", mediaCSP)
+
+	ext := strings.ToLower(filepath.Ext(path))
+	media, ok := mediaTypes[ext]
+	if !ok {
+		media = mediaType{contentType: "application/octet-stream"}
+	}
+	w.Header().Set("Content-Type", media.contentType)
+	if download, _ := strconv.ParseBool(r.FormValue("download")); media.inline && !download {
+		w.Header().Set("Content-Disposition", "inline")
+		return
+	}
+
+	if name == "" {
+		name = filepath.Base(path)
+	} else {
+		name += ext
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+}
+
+// Longest name a download is given, in characters, before the extension
+const downloadNameMax = 100
+
+// Name an event's files are downloaded under: its name and local time, made
+// safe for a file name.
+func (e *Event) downloadName() string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r) || r == utf8.RuneError:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, e.Name)
+	name = strings.Trim(strings.Join(strings.Fields(name), " "), ". ")
+	if runes := []rune(name); len(runes) > downloadNameMax {
+		name = strings.TrimSpace(string(runes[:downloadNameMax]))
+	}
+	if name == "" {
+		name = fmt.Sprintf("event-%d", e.Id)
+	}
+	return name + " " + e.Time.Local().Format("2006-01-02 15.04.05")
+}
+
+// Content-Disposition header naming the file. Names that aren't plain ASCII
+// are given RFC 5987 encoded in filename*, with an ASCII fallback in filename
+// for clients that don't know it.
+func contentDisposition(disposition, name string) string {
+	ascii := true
+	fallback := strings.Map(func(r rune) rune {
+		switch {
+		case r >= utf8.RuneSelf || r < ' ':
+			ascii = false
+			return '_'
+		case r == '"' || r == '\\':
+			return '_'
+		}
+		return r
+	}, name)
+	header := fmt.Sprintf(`%s; filename="%s"`, disposition, fallback)
+	if ascii {
+		return header
+	}
+
+	// RFC 5987 attr-char is letters, digits and !#$&+-.^_`|~, the rest is
+	// percent encoded as UTF-8
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if b < utf8.RuneSelf && (b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return header + "; filename*=UTF-8''" + encoded.String()
+}
+
+// Serves files from the data directory in case we are not behind something else
+// such as nginx. With a media key files are decrypted one by one instead, the
+// directory itself is never served then.
+func (app *App) DataHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w = app.throttle(w, r)
+	mediaHeaders(w, r, p.ByName("filepath"), "")
+
+	// Archives are only downloaded through the API
+	if name := path.Clean("/" + p.ByName("filepath")); strings.HasPrefix(name, "/"+archiveDirName+"/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if app.MediaKey != nil {
+		name := path.Clean("/" + p.ByName("filepath"))
+		app.serveMedia(w, r, filepath.Join(app.Config.dirs.data, filepath.FromSlash(name)))
+		return
+	}
+
+	r.URL.Path = p.ByName("filepath")
+	http.FileServer(http.Dir(app.Config.dirs.data)).ServeHTTP(w, r)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	errShareInvalid = errors.New("invalid share token")
+	errShareExpired = errors.New("share token expired")
+)
+
+// Creates a token granting access to an event's media until the given expiry. The
+// token is the event id and expiry followed by their HMAC, so it can be verified
+// without storing anything.
+func (app *App) ShareToken(id int64, expires time.Time) string {
+	return app.signToken("", id, expires)
+}
+
+// Verifies a share token and returns the event id it grants access to.
+// Tampered tokens return errShareInvalid, expired ones errShareExpired.
+func (app *App) VerifyShareToken(token string) (int64, error) {
+	return app.verifyToken("", token)
+}
+
+// Signs an event id and expiry into a token. The purpose is part of the HMAC,
+// so a token handed out for one purpose can't be used for another.
+func (app *App) signToken(purpose string, id int64, expires time.Time) string {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[:8], uint64(id))
+	binary.BigEndian.PutUint64(payload[8:], uint64(expires.Unix()))
+
+	mac := hmac.New(sha256.New, app.Secret)
+	mac.Write([]byte(purpose))
+	mac.Write(payload)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// Verifies a token signed for the purpose and returns its event id. Tampered
+// tokens return errShareInvalid, expired ones errShareExpired.
+func (app *App) verifyToken(purpose, token string) (int64, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return 0, errShareInvalid
+	}
+
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil || len(payload) != 16 {
+		return 0, errShareInvalid
+	}
+	sum, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return 0, errShareInvalid
+	}
+
+	// Check the signature before trusting anything in the payload
+	mac := hmac.New(sha256.New, app.Secret)
+	mac.Write([]byte(purpose))
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return 0, errShareInvalid
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[8:])), 0)
+	if time.Now().After(expires) {
+		return 0, errShareExpired
+	}
+
+	return int64(binary.BigEndian.Uint64(payload[:8])), nil
+}
+
+// Returns the path of a fresh share link for the event and when it expires.
+func (app *App) ShareLink(id int64) (string, time.Time) {
+	expires := time.Now().Add(app.Config.shareTTL).Truncate(time.Second)
+	return "/shared/" + app.ShareToken(id, expires), expires
+}
+
+// Creates a share link for an event.
+func (app *App) ShareHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	// Prefer an absolute link when we know our public address
+	link, expires := app.ShareLink(event.Id)
+	link = app.PublicURL(link)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"url":     link,
+		"expires": expires,
+	})
+}
+
+// Resolves the event a share token grants access to, writing a 403 for tampered
+// tokens or 410 for expired ones and returning nil.
+func (app *App) sharedEvent(w http.ResponseWriter, r *http.Request, p httprouter.Params) *Event {
+	id, err := app.VerifyShareToken(p.ByName("token"))
+	if err == errShareExpired {
+		app.RenderError(w, r, http.StatusGone, "This link has expired.")
+		return nil
+	} else if err != nil {
+		app.RenderError(w, r, http.StatusForbidden, "This link is invalid.")
+		return nil
+	}
+
+	event, err := app.FindEvent(id)
+	if err == sql.ErrNoRows {
+		app.RenderError(w, r, http.StatusNotFound, "The shared event no longer exists.")
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	return event
+}
+
+// Renders the page for a shared event.
+func (app *App) SharedHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.sharedEvent(w, r, p)
+	if event == nil {
+		return
+	}
+
+	context := struct {
+		*Event
+		Base string
+	}{
+		Event: event,
+		Base:  "/shared/" + p.ByName("token"),
+	}
+	t := app.Template(r, "shared")
+	t.ExecuteTemplate(w, t.Name(), context)
+}
+
+// Serves the video or image of a shared event.
+func (app *App) SharedMediaHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	event := app.sharedEvent(w, r, p)
+	if event == nil {
+		return
+	}
+
+	w = app.throttle(w, r)
+	switch p.ByName("media") {
+	case "video":
+		if event.Video == "" {
+			http.NotFound(w, r)
+			return
+		}
+		mediaHeaders(w, r, event.Video, event.downloadName())
+		app.serveMedia(w, r, event.Video)
+	case "image":
+		mediaHeaders(w, r, event.Image, event.downloadName())
+		app.serveMedia(w, r, event.Image)
+	default:
+		http.NotFound(w, r)
+	}
+}
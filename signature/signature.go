@@ -0,0 +1,143 @@
+// Package signature signs and verifies seccam-web upload requests.
+//
+// A signed request carries the time it was signed in the X-Seccam-Timestamp
+// header (unix seconds) and a hex encoded HMAC-SHA256 of the canonical string
+//
+//	timestamp + "\n" + method + "\n" + path + "\n" + content length
+//
+// keyed with the camera's secret in the X-Seccam-Signature header. Cameras
+// written in Go can sign their uploads with Sign:
+//
+//	req, _ := http.NewRequest("POST", "http://seccam/event/new", body)
+//	req.Header.Set("Content-Type", contentType)
+//	if err := signature.Sign(req, secret); err != nil {
+//		...
+//	}
+//
+// Webhooks sent by seccam-web are signed the same way, but over the body:
+//
+//	timestamp + "\n" + body
+//
+// Receivers check them with VerifyBody.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Seccam-Signature"
+	TimestampHeader = "X-Seccam-Timestamp"
+)
+
+var (
+	ErrMissing       = errors.New("signature: missing signature or timestamp")
+	ErrUnknownLength = errors.New("signature: request has no content length")
+	ErrExpired       = errors.New("signature: timestamp outside the allowed window")
+	ErrInvalid       = errors.New("signature: signature does not match")
+)
+
+// Canonical returns the string that gets signed for a request.
+func Canonical(timestamp, method, path string, contentLength int64) string {
+	return timestamp + "\n" + method + "\n" + path + "\n" + strconv.FormatInt(contentLength, 10)
+}
+
+// Compute returns the hex encoded signature of a request.
+func Compute(secret []byte, timestamp, method, path string, contentLength int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(Canonical(timestamp, method, path, contentLength)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign sets the timestamp and signature headers on req. The request's
+// ContentLength must be known, http.NewRequest sets it for bytes.Buffer,
+// bytes.Reader and strings.Reader bodies.
+func Sign(req *http.Request, secret []byte) error {
+	if req.ContentLength < 0 || (req.ContentLength == 0 && req.Body != nil && req.Body != http.NoBody) {
+		return ErrUnknownLength
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Compute(secret, timestamp, req.Method, req.URL.EscapedPath(), req.ContentLength))
+
+	return nil
+}
+
+// Verify checks the signature on a received request. Requests signed more than
+// skew before or after now are rejected so captured requests can't be replayed
+// later on.
+func Verify(req *http.Request, secret []byte, now time.Time, skew time.Duration) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	sig := req.Header.Get(SignatureHeader)
+	if timestamp == "" || sig == "" {
+		return ErrMissing
+	}
+	if req.ContentLength < 0 {
+		return ErrUnknownLength
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	signed := time.Unix(unix, 0)
+	if signed.Before(now.Add(-skew)) || signed.After(now.Add(skew)) {
+		return ErrExpired
+	}
+
+	given, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalid
+	}
+	expected, _ := hex.DecodeString(Compute(secret, timestamp, req.Method, req.URL.EscapedPath(), req.ContentLength))
+	if !hmac.Equal(given, expected) {
+		return ErrInvalid
+	}
+
+	return nil
+}
+
+// ComputeBody returns the hex encoded signature of a webhook body.
+func ComputeBody(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyBody checks the signature on a received webhook, given its headers and
+// body. Like Verify it rejects webhooks signed more than skew from now.
+func VerifyBody(header http.Header, body, secret []byte, now time.Time, skew time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+	sig := header.Get(SignatureHeader)
+	if timestamp == "" || sig == "" {
+		return ErrMissing
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	signed := time.Unix(unix, 0)
+	if signed.Before(now.Add(-skew)) || signed.After(now.Add(skew)) {
+		return ErrExpired
+	}
+
+	given, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalid
+	}
+	expected, _ := hex.DecodeString(ComputeBody(secret, timestamp, body))
+	if !hmac.Equal(given, expected) {
+		return ErrInvalid
+	}
+
+	return nil
+}
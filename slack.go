@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Notifier posting alerts to a Slack incoming webhook
+type slackNotifier struct {
+	notifierBase
+	webhook string
+}
+
+// Builds the Slack message about an event, linking to it when there's a
+// -base-url to link with.
+func (n slackNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	name := event.Name
+	if link := app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id)); link != "" {
+		name = fmt.Sprintf("<%s|%s>", link, event.Name)
+	}
+	text := app.T("alert.event_captured", name, app.FormatTime(event.Time))
+	if camera != "" {
+		text += app.T("alert.by", camera)
+	}
+	if where := event.Where(); where != "" {
+		text += app.T("alert.near", where)
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// Posts a queued message to the webhook.
+func (n slackNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, n.webhook, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "seccam-web")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("slack responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
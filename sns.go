@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Message published to the SNS topic for an event. Media URLs are absolute when
+// -base-url is set.
+type snsMessage struct {
+	EventId  int64     `json:"event_id"`
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	Camera   string    `json:"camera"`
+	Location string    `json:"location,omitempty"`
+	Lat      *float64  `json:"latitude,omitempty"`
+	Lon      *float64  `json:"longitude,omitempty"`
+	URL      string    `json:"url"`
+	VideoURL string    `json:"video_url"`
+	ImageURL string    `json:"image_url"`
+	AckURL   string    `json:"ack_url,omitempty"` // Acknowledges the alert, with -escalate
+}
+
+// Sets up the SNS client for a topic. The region defaults to the topic's,
+// credentials to the default AWS chain (environment, shared config, instance
+// role) unless a key is given.
+func NewSNSClient(topic, region, keyID, secretKey string) (*sns.Client, error) {
+	if region == "" {
+		// arn:aws:sns:<region>:<account>:<topic>
+		parts := strings.Split(topic, ":")
+		if len(parts) != 6 || parts[2] != "sns" {
+			return nil, fmt.Errorf("invalid SNS topic ARN %q", topic)
+		}
+		region = parts[3]
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if keyID != "" {
+		provider := credentials.NewStaticCredentialsProvider(keyID, secretKey, "")
+		opts = append(opts, awsconfig.WithCredentialsProvider(provider))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sns.NewFromConfig(cfg), nil
+}
+
+// Notifier publishing alerts to an SNS topic
+type snsNotifier struct {
+	notifierBase
+	client *sns.Client
+	topic  string
+}
+
+func newSNSNotifier(base notifierBase, topic, region, keyID, secretKey string) (snsNotifier, error) {
+	client, err := NewSNSClient(topic, region, keyID, secretKey)
+	return snsNotifier{base, client, topic}, err
+}
+
+// Builds the SNS message about an event.
+func (n snsNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	message := snsMessage{
+		EventId:  event.Id,
+		Name:     event.Name,
+		Time:     event.Time,
+		Camera:   camera,
+		Location: event.Location,
+		Lat:      event.Latitude,
+		Lon:      event.Longitude,
+		URL:      app.PublicURL(fmt.Sprintf("/event/%d", event.Id)),
+		ImageURL: app.PublicURL(app.MediaURL(event.Image)),
+	}
+	if event.Video != "" {
+		message.VideoURL = app.PublicURL(app.MediaURL(event.Video))
+	}
+	if len(app.Config.escalation) > 0 {
+		message.AckURL = app.PublicURL(app.AckLink(event.Id))
+	}
+	return json.Marshal(message)
+}
+
+// Publishes a queued message to the topic. The camera is also set as a message
+// attribute so subscription filter policies can use it.
+func (n snsNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	var message snsMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, err
+	}
+
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(n.topic),
+		Message:           aws.String(string(payload)),
+		MessageAttributes: map[string]types.MessageAttributeValue{},
+	}
+	if message.Camera != "" {
+		input.MessageAttributes["camera"] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(message.Camera),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := n.client.Publish(ctx, input); err != nil {
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) {
+			return respErr.HTTPStatusCode(), err
+		}
+		return 0, err
+	}
+
+	return 200, nil
+}
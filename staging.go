@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names tried for a file in the data directory before giving up
+const reserveAttempts = 16
+
+// Copies an uploaded file into a new temporary file in the staging directory and
+// returns its path. Nothing is left behind if the copy fails part way.
+func (app *App) StageUpload(src io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(app.Config.dirs.staging, "upload-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0775); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// Whether a file name sent by a camera names a file rather than a directory,
+// so the data directory is where its base name is stored.
+func validFilename(name string) bool {
+	base := filepath.Base(name)
+	return name != "" && base != "." && base != ".." && base != string(filepath.Separator)
+}
+
+// Claims a name for a file in the data directory by creating it, empty and
+// exclusively, so concurrent uploads with the same file name can't write to the
+// same file. While path is taken a random suffix goes before the extension,
+// clip.mp4 becoming clip-1a2b3c4d.mp4. The file returned is ours to replace
+// with a rename.
+func reservePath(path string) (string, error) {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 0; i < reserveAttempts; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+		if err == nil {
+			return path, f.Close()
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, stem+"-"+hex.EncodeToString(suffix)+ext)
+	}
+	return "", fmt.Errorf("no free name for %s after %d attempts", base, reserveAttempts)
+}
+
+// Removes staging files older than the given age, left behind by uploads that
+// were interrupted by a crash or restart.
+func SweepStaging(dir string, age time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error sweeping staging directory %s\n", dir)
+		log.Println(err.Error())
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || time.Since(info.ModTime()) < age {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err == nil {
+			log.Println("Removed stale staging file", path)
+		}
+	}
+}
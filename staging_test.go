@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A taken name gets a suffix before its extension, the free one is used as is.
+func TestReservePath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clip.mp4")
+
+	first, err := reservePath(path)
+	if err != nil || first != path {
+		t.Fatalf("reservePath = %s (%v), expected %s", first, err, path)
+	}
+	second, err := reservePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || !strings.HasPrefix(filepath.Base(second), "clip-") || filepath.Ext(second) != ".mp4" {
+		t.Errorf("second reservation is %s, expected clip-<suffix>.mp4", second)
+	}
+	if files := dirFiles(t, dir); len(files) != 2 {
+		t.Errorf("directory holds %v, expected both reservations", files)
+	}
+}
+
+// Uploads arriving at once with the same file names each keep their own files,
+// whole, and get an event each.
+func TestParallelUploads(t *testing.T) {
+	const uploads = 100
+	config := testConfig(t)
+	app := newTestAppWith(t, config)
+	server := newTestServer(t, app)
+
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, contentType := multipartUpload(t, map[string]string{"name": fmt.Sprintf("upload %d", i)}, map[string]io.Reader{
+				"video": strings.NewReader(fmt.Sprintf("video of upload %d", i)),
+				"image": strings.NewReader(fmt.Sprintf("image of upload %d", i)),
+			})
+			resp, err := http.Post(server.URL+"/event/new", contentType, body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("upload %d answered %d", i, resp.StatusCode)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if count := eventCount(t, app); count != uploads {
+		t.Errorf("%d events stored, expected %d", count, uploads)
+	}
+	files := dirFiles(t, config.dirs.data)
+	if len(files) != 2*uploads {
+		t.Errorf("data directory holds %d files, expected %d", len(files), 2*uploads)
+	}
+
+	// Every event's files hold what was uploaded for it
+	seen := make(map[string]bool)
+	for _, event := range app.queryEvents(`SELECT ` + eventColumns + ` FROM events`) {
+		for kind, path := range map[string]string{"video": event.Video, "image": event.Image} {
+			if seen[path] {
+				t.Errorf("%s is shared by more than one event", path)
+			}
+			seen[path] = true
+			want := kind + " of " + event.Name
+			if data, err := os.ReadFile(path); err != nil || string(data) != want {
+				t.Errorf("%s holds %q (%v), expected %q", path, data, err, want)
+			}
+		}
+	}
+}
+
+// File names sent by cameras only ever name a file in the data directory,
+// those naming a directory are refused.
+func TestStoreEventFileNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"clip.avi", true},
+		{"../clip.avi", true},
+		{"/etc/clip.avi", true},
+		{"..", false},
+		{".", false},
+		{"", false},
+		{"/", false},
+		{"clips/../..", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			app := newTestAppWith(t, config)
+			// ".." of the data directory reserves a name next to its parent
+			parent := filepath.Dir(filepath.Dir(config.dirs.data))
+			before := dirFiles(t, parent)
+			upload := stageTestUpload(t, app, "front door")
+			upload.Videos[0].Name = test.name
+
+			created, err := app.StoreEvent(app.Logger, "", upload)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("stored %s as %s, expected it to be refused", test.name, created.Video)
+				}
+				if files := dirFiles(t, config.dirs.staging); len(files) != 0 {
+					t.Errorf("files left in staging: %v", files)
+				}
+			} else if err != nil {
+				t.Fatalf("StoreEvent: %s", err)
+			} else if filepath.Dir(created.Video) != config.dirs.data {
+				t.Errorf("stored as %s, outside %s", created.Video, config.dirs.data)
+			}
+			if after := dirFiles(t, parent); len(after) != len(before) {
+				t.Errorf("%s went from %v to %v", parent, before, after)
+			}
+		})
+	}
+}
+
+// Multipart uploads with a file named after a directory are refused before
+// anything is stored.
+func TestUploadDirectoryFileName(t *testing.T) {
+	app := newTestApp(t)
+	server := newTestServer(t, app)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("name", "Front door")
+	for field, filename := range map[string]string{"video": "..", "image": "clip.jpg"} {
+		part, err := form.CreateFormFile(field, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(field))
+	}
+	form.Close()
+
+	resp, err := http.Post(server.URL+"/event/new", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, expected %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if apiErr := decodeAPIError(t, resp); apiErr.Code != ErrInvalidField || apiErr.Field != "video" {
+		t.Errorf("error %+v, expected code %s for video", apiErr, ErrInvalidField)
+	}
+	if count := eventCount(t, app); count != 0 {
+		t.Errorf("%d events stored", count)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Disk usage of one camera's events
+type cameraUsage struct {
+	CameraId int64  `json:"camera_id"` // 0 for events from before cameras were tracked
+	Name     string `json:"name"`
+	Events   int    `json:"events"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Disk usage of the events and of the filesystem holding them
+type storageStats struct {
+	Events    int            `json:"events"`
+	Bytes     int64          `json:"bytes"`   // Live events, not those in the trash
+	Unsized   int            `json:"unsized"` // Events whose size isn't known yet
+	Trashed   int            `json:"trash_events"`
+	Trash     int64          `json:"trash_bytes"` // Files of deleted events left in the trash
+	DiskFree  uint64         `json:"disk_free_bytes"`
+	DiskTotal uint64         `json:"disk_total_bytes"`
+	Archives  int64          `json:"archive_bytes"`  // Zips kept for download, see ArchiveBytes
+	Quota     int64          `json:"quota_bytes"`    // -storage-quota, 0 for none
+	Evidence  int64          `json:"evidence_bytes"` // Part of Bytes, not counted against the quota
+	Cameras   []*cameraUsage `json:"cameras"`
+}
+
+// Formatted sizes, for display.
+func (s storageStats) Size() string {
+	return formatBytes(uint64(s.Bytes))
+}
+
+func (s storageStats) TrashSize() string {
+	return formatBytes(uint64(s.Trash))
+}
+
+func (s storageStats) QuotaSize() string {
+	return formatBytes(uint64(s.Quota))
+}
+
+// Space counted against the quota: live events other than evidence, the trash
+// and archives.
+func (s storageStats) Used() string {
+	return formatBytes(uint64(s.Bytes - s.Evidence + s.Trash + s.Archives))
+}
+
+// Formatted size, for display.
+func (u *cameraUsage) Size() string {
+	return formatBytes(uint64(u.Bytes))
+}
+
+// Stores the size of an event as the total of its media, which hold the size of
+// every file as it was attached or replaced.
+func setEventSize(tx execer, id int64) error {
+	sql_size := `UPDATE events SET size_bytes = (SELECT COALESCE(SUM(size), 0) FROM media WHERE event_id = ?) WHERE id = ?`
+	_, err := tx.Exec(sql_size, id, id)
+	return err
+}
+
+// Fills in the size of events from before sizes were kept by looking at their
+// files once, in batches. Files that are gone count for nothing.
+func (app *App) BackfillEventSizes() {
+	var lastID int64
+	filled := 0
+	for {
+		rows, err := app.DB.Query(`SELECT id, video, image FROM events WHERE size_bytes IS NULL AND id > ? ORDER BY id LIMIT 500`, lastID)
+		if err != nil {
+			log.Println("Error finding events to backfill sizes of")
+			log.Println(err.Error())
+			return
+		}
+		paths := make(map[int64][]string)
+		ids := make([]int64, 0)
+		for rows.Next() {
+			var id int64
+			var video, image string
+			if err := rows.Scan(&id, &video, &image); err != nil {
+				break
+			}
+			paths[id] = []string{video, image}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			break
+		}
+		lastID = ids[len(ids)-1]
+
+		for _, id := range ids {
+			size, err := app.statEventFiles(id, paths[id])
+			if err == nil {
+				_, err = app.DB.Exec(`UPDATE events SET size_bytes = ? WHERE id = ?`, size, id)
+			}
+			if err != nil {
+				log.Printf("Error backfilling the size of event %d\n", id)
+				log.Println(err.Error())
+				return
+			}
+			filled++
+		}
+	}
+	if filled > 0 {
+		log.Printf("Backfilled the size of %d events\n", filled)
+	}
+}
+
+// Adds up the sizes of an event's files, counting each path once.
+func (app *App) statEventFiles(id int64, paths []string) (int64, error) {
+	rows, err := app.DB.Query(`SELECT path FROM media WHERE event_id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size, nil
+}
+
+// Totals the size of the events, overall and per camera with the biggest first.
+func (app *App) StorageStats() (storageStats, error) {
+	stats := storageStats{Cameras: make([]*cameraUsage, 0)}
+
+	sql_usage := `
+	SELECT events.camera_id, COALESCE(cameras.name, ''), COUNT(*), COALESCE(SUM(events.size_bytes), 0), COUNT(*) - COUNT(events.size_bytes)
+	FROM events LEFT JOIN cameras ON cameras.id = events.camera_id
+	GROUP BY events.camera_id ORDER BY 4 DESC`
+	rows, err := app.DB.Query(sql_usage)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		usage := new(cameraUsage)
+		var unsized int
+		if err := rows.Scan(&usage.CameraId, &usage.Name, &usage.Events, &usage.Bytes, &unsized); err != nil {
+			return stats, err
+		}
+		stats.Events += usage.Events
+		stats.Bytes += usage.Bytes
+		stats.Unsized += unsized
+		stats.Cameras = append(stats.Cameras, usage)
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	sql_evidence := `SELECT COALESCE(SUM(size_bytes), 0) FROM events WHERE evidence_at IS NOT NULL`
+	if err := app.DB.QueryRow(sql_evidence).Scan(&stats.Evidence); err != nil {
+		return stats, err
+	}
+	if stats.Archives, err = app.ArchiveBytes(); err != nil {
+		return stats, err
+	}
+	trash, err := app.TrashUsage()
+	if err != nil {
+		return stats, err
+	}
+	stats.Trashed, stats.Trash = trash.Events, trash.Bytes
+	stats.Quota = app.Config.storageQuota
+
+	// Free space is only informative, it's left at 0 if unavailable
+	stats.DiskFree, stats.DiskTotal, _ = DiskUsage(app.Config.dirs.data)
+
+	return stats, nil
+}
+
+// Response of the stats endpoint
+type apiStats struct {
+	storageStats
+	Transcodes transcodeStats `json:"transcodes"`
+}
+
+// Returns the disk usage of the events, in total and per camera, and how
+// conversions went over the last day. Kept in memory until events change, or
+// for a minute as the free space and conversions change on their own.
+func (app *App) APIStatsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	stats, err := app.Cache.Load("stats", func() (interface{}, error) {
+		stats, err := app.StorageStats()
+		if err != nil {
+			return nil, err
+		}
+		transcodes, err := app.TranscodeStats()
+		if err != nil {
+			return nil, err
+		}
+		return apiStats{stats, transcodes}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Security events forwarded to -syslog-addr, used as the MSGID of each message
+const (
+	SecurityAuthFailure    = "auth-failure"    // 401 responses, failed logins included, and gRPC calls with a bad token
+	SecurityForbidden      = "forbidden"       // 403 responses
+	SecurityDelete         = "delete"          // Events deleted through the API
+	SecurityAdmin          = "admin"           // Changes made through admin only routes
+	SecurityUploadRejected = "upload-rejected" // Uploads turned down by -pre-accept-url
+)
+
+// Severities of RFC 5424 we send with
+const (
+	syslogWarning = 4
+	syslogNotice  = 5
+)
+
+// Messages go out as security/authorization (auth), the APP-NAME is fixed
+const (
+	syslogFacility = 4
+	syslogAppName  = "seccam-web"
+)
+
+// Structured data ID of our parameters, 32473 being the enterprise number set
+// aside for examples and private use
+const syslogSDID = "seccam@32473"
+
+// Messages waiting to be sent, once full further ones are dropped
+const syslogQueueSize = 1024
+
+// Longest connecting to or writing to the syslog server may take
+const syslogTimeout = 5 * time.Second
+
+// A security relevant thing that happened, see the Security* kinds
+type securityEvent struct {
+	kind       string
+	severity   int
+	requestID  string
+	actor      string
+	remoteAddr string
+	message    string
+}
+
+// Sends security events to a syslog server as RFC 5424 messages from a
+// goroutine of its own, so a slow or unreachable server never holds up a
+// request. Safe for concurrent use.
+type syslogForwarder struct {
+	network  string // udp, tcp or unix
+	addr     string
+	hostname string
+	queue    chan []byte
+	conn     net.Conn
+	broken   bool // Sending failed, logged once until it works again
+}
+
+// Starts forwarding to addr, a URL such as udp://host:514, tcp://host:514 or
+// unix:///dev/log. A host and port alone mean UDP.
+func OpenSyslog(addr string) (*syslogForwarder, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -syslog-addr %q: %w", addr, err)
+	}
+
+	f := &syslogForwarder{network: u.Scheme, queue: make(chan []byte, syslogQueueSize)}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("invalid -syslog-addr %q, expected a host and port", addr)
+		}
+		f.addr = u.Host
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid -syslog-addr %q, expected a socket path", addr)
+		}
+		f.addr = u.Path
+	default:
+		return nil, fmt.Errorf("invalid -syslog-addr %q, expected udp://, tcp:// or unix://", addr)
+	}
+
+	f.hostname, _ = os.Hostname()
+	if f.hostname == "" {
+		f.hostname = "-"
+	}
+
+	go f.run()
+	return f, nil
+}
+
+// Queues an event without waiting, dropping it if the queue is full.
+func (f *syslogForwarder) Send(e securityEvent) {
+	select {
+	case f.queue <- f.format(e, time.Now()):
+	default:
+		syslogDropped.Add(1)
+	}
+}
+
+func (f *syslogForwarder) run() {
+	for msg := range f.queue {
+		err := f.write(msg)
+		if err != nil {
+			// A stream may have been closed by the other end since the last message,
+			// try again once on a new connection
+			err = f.write(msg)
+		}
+		if err != nil {
+			syslogErrors.Add(1)
+			if !f.broken {
+				log.Printf("Warning: cannot forward security events to %s://%s, dropping them until it works again\n", f.network, f.addr)
+				log.Println(err.Error())
+			}
+			f.broken = true
+			continue
+		}
+		if f.broken {
+			log.Printf("Forwarding security events to %s://%s again\n", f.network, f.addr)
+			f.broken = false
+		}
+	}
+}
+
+// Writes a message, connecting first if needed. Streams frame messages by
+// octet counting (RFC 6587), datagrams carry one each.
+func (f *syslogForwarder) write(msg []byte) error {
+	if f.conn == nil {
+		conn, err := f.dial()
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+
+	frame := msg
+	if f.stream() {
+		frame = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := f.conn.Write(frame); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Connects to the server. Unix sockets such as /dev/log usually take
+// datagrams, a stream is tried when they don't.
+func (f *syslogForwarder) dial() (net.Conn, error) {
+	if f.network == "unix" {
+		conn, err := net.DialTimeout("unixgram", f.addr, syslogTimeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialTimeout(f.network, f.addr, syslogTimeout)
+}
+
+func (f *syslogForwarder) stream() bool {
+	if f.conn == nil {
+		return false
+	}
+	network := f.conn.RemoteAddr().Network()
+	return network == "tcp" || network == "unix"
+}
+
+// Formats an event as an RFC 5424 message, with the request ID, actor and
+// remote address as structured data.
+func (f *syslogForwarder) format(e securityEvent, now time.Time) []byte {
+	sd := "[" + syslogSDID
+	params := [][2]string{
+		{"request_id", e.requestID},
+		{"actor", e.actor},
+		{"remote_addr", e.remoteAddr},
+	}
+	for _, param := range params {
+		if param[1] != "" {
+			sd += fmt.Sprintf(` %s="%s"`, param[0], escapeSDValue(param[1]))
+		}
+	}
+	sd += "]"
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		syslogFacility*8+e.severity,
+		now.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		f.hostname,
+		syslogAppName,
+		os.Getpid(),
+		e.kind,
+		sd,
+		e.message,
+	))
+}
+
+// Escapes the characters RFC 5424 doesn't allow as they are in a parameter
+// value.
+func escapeSDValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// Forwards a security event to -syslog-addr, if set.
+func (app *App) Security(e securityEvent) {
+	if app.Syslog != nil {
+		app.Syslog.Send(e)
+	}
+}
+
+// Forwards a security event about a request, tagged with its ID, the user
+// making it and where it came from.
+func (app *App) SecurityRequest(r *http.Request, kind string, severity int, format string, args ...interface{}) {
+	if app.Syslog == nil {
+		return
+	}
+	actor := ""
+	if note, ok := r.Context().Value(securityNoteKey{}).(*securityNote); ok {
+		actor = note.actor
+	}
+	app.Security(securityEvent{
+		kind:       kind,
+		severity:   severity,
+		requestID:  RequestID(r.Context()),
+		actor:      actor,
+		remoteAddr: r.RemoteAddr,
+		message:    fmt.Sprintf(format, args...),
+	})
+}
+
+type securityNoteKey struct{}
+
+// Who a request came from, filled in by the handlers once known so responses
+// forwarded by SyslogMiddleware can name them
+type securityNote struct {
+	actor string
+}
+
+// Records who a request came from for the security events about it, the user
+// it was signed in as or the username a login tried.
+func noteActor(r *http.Request, actor string) {
+	if note, ok := r.Context().Value(securityNoteKey{}).(*securityNote); ok {
+		note.actor = actor
+	}
+}
+
+// Middleware forwarding every 401 and 403 response to -syslog-addr.
+func (app *App) SyslogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), securityNoteKey{}, &securityNote{}))
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		kind := ""
+		switch sw.status {
+		case http.StatusUnauthorized:
+			kind = SecurityAuthFailure
+		case http.StatusForbidden:
+			kind = SecurityForbidden
+		default:
+			return
+		}
+		app.SecurityRequest(r, kind, syslogWarning, "%s %s answered %d %s", r.Method, r.URL.Path, sw.status, http.StatusText(sw.status))
+	})
+}
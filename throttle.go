@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Token bucket of bytes, refilled at rate per second up to burst. Reservations
+// may overdraw it, whoever reserved then waits for the debt to be paid off, so
+// everyone sharing a bucket gets through in turn.
+type byteBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int64) *byteBucket {
+	burst := float64(throttleChunk(rate))
+	return &byteBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Takes n bytes from the bucket, returning how long to wait before sending them.
+func (b *byteBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Bytes written at once under a rate, a tenth of a second's worth so the rate
+// holds over short spans too.
+func throttleChunk(rate int64) int {
+	chunk := rate / 10
+	if chunk < 512 {
+		chunk = 512
+	}
+	if chunk > 64<<10 {
+		chunk = 64 << 10
+	}
+	return int(chunk)
+}
+
+// Response writer sending the body no faster than its own bucket and the
+// shared one allow. It doesn't implement io.ReaderFrom, so sendfile can't go
+// around it.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	own   *byteBucket
+	total *byteBucket // Nil without an overall limit
+	chunk int
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > t.chunk {
+			n = t.chunk
+		}
+
+		var wait time.Duration
+		if t.own != nil {
+			wait = t.own.reserve(n)
+		}
+		if t.total != nil {
+			if w := t.total.reserve(n); w > wait {
+				wait = w
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-t.ctx.Done():
+				timer.Stop()
+				return written, t.ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		m, err := t.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// For http.ResponseController.
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Wraps the writer of a media response to keep to -media-rate-limit and
+// -media-rate-limit-total, returned as is without either. Only the body is
+// throttled, range requests are answered the same as otherwise.
+func (app *App) throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if app.Config.mediaRate <= 0 && app.MediaRate == nil {
+		return w
+	}
+
+	t := &throttledWriter{ResponseWriter: w, ctx: r.Context(), total: app.MediaRate}
+	rate := app.Config.mediaRateTotal
+	if app.Config.mediaRate > 0 {
+		t.own = newByteBucket(app.Config.mediaRate)
+		if rate <= 0 || app.Config.mediaRate < rate {
+			rate = app.Config.mediaRate
+		}
+	}
+	t.chunk = throttleChunk(rate)
+	return t
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Downloads take about as long as their limits allow: the bytes past the first
+// burst at the tightest rate that applies. Taking less would mean the limit
+// doesn't hold, taking far more that it throttles harder than asked.
+func TestThrottleRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		own       int64
+		total     int64
+		downloads int
+		size      int
+		expected  time.Duration
+	}{
+		// 20 KB burst, 80 KB left at 200 KB/s
+		{"own limit", 200_000, 0, 1, 100_000, 400 * time.Millisecond},
+		// 20 KB burst, 100 KB left between the two at 200 KB/s
+		{"total limit", 0, 200_000, 2, 60_000, 500 * time.Millisecond},
+		// Each held to its own 100 KB/s, well under the total
+		{"own under total", 100_000, 1_000_000, 2, 50_000, 400 * time.Millisecond},
+		// The total halves what each could have on its own
+		{"total under own", 200_000, 200_000, 2, 60_000, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.mediaRate, config.mediaRateTotal = test.own, test.total
+			app := newTestAppWith(t, config)
+			body := bytes.Repeat([]byte("x"), test.size)
+
+			var wg sync.WaitGroup
+			start := time.Now()
+			for i := 0; i < test.downloads; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					w := app.throttle(rec, httptest.NewRequest("GET", "/data/clip.mp4", nil))
+					if n, err := w.Write(body); err != nil || n != len(body) {
+						t.Errorf("wrote %d bytes (%v), expected %d", n, err, len(body))
+					}
+					if rec.Body.Len() != len(body) {
+						t.Errorf("%d bytes arrived, expected %d", rec.Body.Len(), len(body))
+					}
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+
+			if elapsed < test.expected*8/10 || elapsed > test.expected*2 {
+				t.Errorf("took %s, expected about %s", elapsed, test.expected)
+			}
+		})
+	}
+}
+
+// The bucket hands out its burst at once and then a wait in step with the
+// rate.
+func TestByteBucketReserve(t *testing.T) {
+	b := newByteBucket(10_000)
+	if wait := b.reserve(1000); wait != 0 {
+		t.Errorf("first reservation waits %s, expected none", wait)
+	}
+	wait := b.reserve(5000)
+	if wait < 490*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("overdrawing by 5000 bytes at 10000/s waits %s, expected 500ms", wait)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/image/draw"
+)
+
+// Width of the thumbnails, the height follows the aspect ratio
+const thumbWidth = 320
+
+// Ways of picking the video frame a thumbnail is made from, see grabFrame
+const (
+	ThumbFrameFirst  = "first"
+	ThumbFrameMiddle = "middle"
+	ThumbFrameScene  = "scene"
+)
+
+// Formats thumbnails are served in, by extension
+const (
+	thumbJPEG = ".jpg"
+	thumbWebP = ".webp"
+)
+
+// Thumbnails are made on first request and kept in a directory of their own,
+// named after their event and format. The least recently used are removed once the
+// directory grows past its size limit. Requests for a thumbnail being made wait
+// for it rather than making it again.
+type thumbCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Of *thumbEntry, most recently used first
+	entries map[thumbKey]*list.Element
+	making  map[thumbKey]*thumbCall
+}
+
+// Thumbnail of an event in one format
+type thumbKey struct {
+	id  int64
+	ext string
+}
+
+type thumbEntry struct {
+	key  thumbKey
+	size int64
+}
+
+// Thumbnail being made, done is closed once err is set
+type thumbCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Opens the cache in dir, picking up the thumbnails already in it.
+func newThumbCache(dir string, maxSize int64) (*thumbCache, error) {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	c := &thumbCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[thumbKey]*list.Element),
+		making:  make(map[thumbKey]*thumbCall),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		entry   *thumbEntry
+		modTime time.Time
+	}
+	var found []existing
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		id, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		info, statErr := file.Info()
+		if err != nil || statErr != nil || !info.Mode().IsRegular() || (ext != thumbJPEG && ext != thumbWebP) {
+			// Leftovers of thumbnails that weren't finished
+			if strings.HasPrefix(file.Name(), ".tmp-") {
+				os.Remove(filepath.Join(dir, file.Name()))
+			}
+			continue
+		}
+		found = append(found, existing{&thumbEntry{thumbKey{id, ext}, info.Size()}, info.ModTime()})
+	}
+
+	// Served thumbnails are touched, the newest were used last
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+	for _, f := range found {
+		c.entries[f.entry.key] = c.lru.PushBack(f.entry)
+		c.size += f.entry.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// Path of an event's thumbnail in the cache.
+func (c *thumbCache) path(key thumbKey) string {
+	return filepath.Join(c.dir, strconv.FormatInt(key.id, 10)+key.ext)
+}
+
+// Returns the path of an event's thumbnail in the format given by its extension,
+// making it with generate first if it isn't cached.
+func (c *thumbCache) Get(id int64, ext string, generate func(dst string) error) (string, error) {
+	key := thumbKey{id, ext}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		now := time.Now()
+		os.Chtimes(c.path(key), now, now)
+		return c.path(key), nil
+	}
+	if call, ok := c.making[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return c.path(key), call.err
+	}
+	call := &thumbCall{done: make(chan struct{})}
+	c.making[key] = call
+	c.mu.Unlock()
+
+	call.err = c.add(key, generate)
+
+	c.mu.Lock()
+	delete(c.making, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return c.path(key), call.err
+}
+
+// Makes a thumbnail into a temporary file and moves it into place. The
+// temporary file's name is reserved like the media's, nothing else writes to it.
+func (c *thumbCache) add(key thumbKey, generate func(dst string) error) error {
+	tmp, err := reservePath(filepath.Join(c.dir, fmt.Sprintf(".tmp-%d%s", key.id, key.ext)))
+	if err != nil {
+		return err
+	}
+	if err := generate(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path(key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = c.lru.PushFront(&thumbEntry{key, info.Size()})
+	c.size += info.Size()
+	c.evict()
+
+	return nil
+}
+
+// Removes the least recently used thumbnails until the cache fits. Must be
+// called with the lock held.
+func (c *thumbCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 1 {
+		el := c.lru.Back()
+		entry := el.Value.(*thumbEntry)
+		c.lru.Remove(el)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(c.path(entry.key))
+	}
+}
+
+// Drops every thumbnail, for when the media they were made from changed.
+func (c *thumbCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.entries {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		os.Remove(c.path(key))
+	}
+	c.size = 0
+}
+
+// Drops an event's thumbnails, for when the event is deleted.
+func (c *thumbCache) Remove(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ext := range []string{thumbJPEG, thumbWebP} {
+		key := thumbKey{id, ext}
+		if el, ok := c.entries[key]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			c.size -= el.Value.(*thumbEntry).size
+		}
+		os.Remove(c.path(key))
+	}
+}
+
+// Makes the thumbnail of an event at dst: its image scaled down, or a frame of
+// its video when the image can't be read.
+func (app *App) makeThumbnail(event *Event, dst string) error {
+	image, wipe, err := app.plainCopy(event.Image)
+	if err == nil {
+		err = resizeImage(image, dst, thumbWidth)
+		wipe()
+	}
+	if err == nil {
+		return nil
+	}
+	if app.FFmpeg == "" || event.Video == "" {
+		return err
+	}
+
+	video, wipe, err := app.plainCopy(event.Video)
+	if err != nil {
+		return err
+	}
+	defer wipe()
+	return app.videoFrame(video, dst)
+}
+
+// Writes the frame of a video picked by -thumb-frame to dst, falling back on the
+// first frame.
+func (app *App) videoFrame(src, dst string) error {
+	if app.Config.thumbFrame != ThumbFrameFirst {
+		err := app.grabFrame(src, dst, app.Config.thumbFrame)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error picking the %s frame of %s, using the first\n", app.Config.thumbFrame, src)
+		log.Println(err.Error())
+	}
+
+	return app.grabFrame(src, dst, ThumbFrameFirst)
+}
+
+// Writes a frame of the video at src as a JPEG thumbnail at dst, picked by the
+// strategy:
+//   - first grabs the frame a second in (or the first, for shorter clips)
+//   - middle grabs the frame halfway through, the duration comes from ffprobe
+//   - scene lets ffmpeg's thumbnail filter pick the most representative frame
+//     of the first few hundred, which skips the empty scenes clips often start on
+func (app *App) grabFrame(src, dst, strategy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	scale := fmt.Sprintf("scale=%d:-2", thumbWidth)
+	var args []string
+	switch strategy {
+	case ThumbFrameFirst:
+		args = []string{"-ss", "1", "-i", src, "-vf", scale}
+	case ThumbFrameMiddle:
+		duration, err := app.probeDuration(ctx, src)
+		if err != nil {
+			return err
+		}
+		args = []string{"-ss", strconv.FormatFloat(duration/2, 'f', 3, 64), "-i", src, "-vf", scale}
+	case ThumbFrameScene:
+		args = []string{"-i", src, "-vf", "thumbnail=300," + scale}
+	default:
+		return fmt.Errorf("unknown frame strategy %q", strategy)
+	}
+	args = append(args, "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-y", dst)
+
+	cmd := exec.CommandContext(ctx, app.FFmpeg, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return ffmpegError(err, out)
+	}
+
+	// Seeking past the end of a clip succeeds without writing anything
+	if info, err := os.Stat(dst); err != nil || info.Size() == 0 {
+		return fmt.Errorf("ffmpeg wrote no frame of %s", src)
+	}
+
+	return nil
+}
+
+// Makes the WebP thumbnail of an event at dst from its JPEG thumbnail, which is
+// made (and cached) first if need be.
+func (app *App) makeWebPThumbnail(event *Event, dst string) error {
+	cached, err := app.Thumbs.Get(event.Id, thumbJPEG, func(dst string) error {
+		return app.sealedOutput(dst, func(dst string) error {
+			return app.makeThumbnail(event, dst)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	src, wipe, err := app.plainCopy(cached)
+	if err != nil {
+		return err
+	}
+	defer wipe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, app.FFmpeg,
+		"-i", src,
+		"-c:v", "libwebp", "-quality", "75",
+		"-f", "webp",
+		"-y", dst,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return ffmpegError(err, out)
+	}
+
+	return nil
+}
+
+// Whether the Accept header of a request takes the given media type, leaving
+// out types refused with q=0.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+				continue
+			}
+			refused := false
+			for _, param := range params[1:] {
+				if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+					v, err := strconv.ParseFloat(q, 64)
+					refused = err == nil && v == 0
+				}
+			}
+			if !refused {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Writes the image at src scaled down to width (if it's wider) as a JPEG at dst.
+func resizeImage(src, dst string, width int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > width {
+		height := bounds.Dy() * width / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Serves an event's thumbnail, making it on first request. It's WebP when the
+// client accepts it and ffmpeg can encode it, JPEG otherwise.
+func (app *App) ThumbHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	event, err := app.FindEvent(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	// Thumbnails are cached encrypted like the media they're made from
+	ext, contentType, thumbnail := thumbJPEG, "image/jpeg", func(dst string) error {
+		return app.makeThumbnail(event, dst)
+	}
+	if app.WebP && accepts(r, "image/webp") {
+		ext, contentType, thumbnail = thumbWebP, "image/webp", func(dst string) error {
+			return app.makeWebPThumbnail(event, dst)
+		}
+	}
+	generate := func(dst string) error {
+		return app.sealedOutput(dst, thumbnail)
+	}
+
+	path, err := app.Thumbs.Get(event.Id, ext, generate)
+	if err != nil {
+		app.Log(r).Printf("Error making thumbnail of event %d\n", event.Id)
+		app.Log(r).Println(err.Error())
+		http.Error(w, "thumbnail unavailable", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Vary", "Accept")
+	app.serveMedia(w, r, path)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	_ "image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// App with the real ffmpeg and ffprobe, skipping the test without them.
+func newFFmpegTestApp(t *testing.T) *App {
+	t.Helper()
+	app := newTestApp(t)
+	if app.FFmpeg == "" || app.FFprobe == "" {
+		t.Skip("ffmpeg and ffprobe are needed")
+	}
+	return app
+}
+
+// Generates a tiny clip of a second and a half of black followed by two and a
+// half seconds of ffmpeg's moving test pattern, like a camera recording an
+// empty scene before the motion that triggered it.
+func generateClip(t *testing.T, app *App) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	cmd := exec.Command(app.FFmpeg,
+		"-f", "lavfi", "-i", "color=c=black:s=64x48:r=10:d=1.5",
+		"-f", "lavfi", "-i", "testsrc=s=64x48:r=10:d=2.5",
+		"-filter_complex", "[0:v][1:v]concat=n=2:v=1:a=0",
+		"-pix_fmt", "yuv420p", "-y", path,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generating the clip: %s\n%s", err, out)
+	}
+	return path
+}
+
+// Average brightness (0-255) of a JPEG.
+func brightness(t *testing.T, path string) float64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatalf("thumbnail doesn't decode: %s", err)
+	}
+
+	var sum float64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += float64(r+g+b) / 3 / 257
+		}
+	}
+	return sum / float64(bounds.Dx()*bounds.Dy())
+}
+
+// The first frame strategy lands on the empty start of the clip, middle and
+// scene on the motion.
+func TestGrabFrame(t *testing.T) {
+	app := newFFmpegTestApp(t)
+	clip := generateClip(t, app)
+
+	tests := []struct {
+		strategy string
+		black    bool
+	}{
+		{ThumbFrameFirst, true},
+		{ThumbFrameMiddle, false},
+		{ThumbFrameScene, false},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "thumb.jpg")
+			if err := app.grabFrame(clip, dst, test.strategy); err != nil {
+				t.Fatalf("grabFrame: %s", err)
+			}
+			if black := brightness(t, dst) < 10; black != test.black {
+				t.Errorf("frame picked is black: %t, expected %t", black, test.black)
+			}
+		})
+	}
+}
+
+// A strategy that fails falls back to the first frame.
+func TestVideoFrameFallback(t *testing.T) {
+	app := newFFmpegTestApp(t)
+	clip := generateClip(t, app)
+
+	// middle needs ffprobe for the duration
+	app.Config.thumbFrame = ThumbFrameMiddle
+	app.FFprobe = ""
+	dst := filepath.Join(t.TempDir(), "thumb.jpg")
+	if err := app.videoFrame(clip, dst); err != nil {
+		t.Fatalf("videoFrame: %s", err)
+	}
+	if brightness(t, dst) >= 10 {
+		t.Error("expected the first, black, frame")
+	}
+}
+
+// Clips too short to reach the frame wanted give an error instead of an empty
+// thumbnail.
+func TestGrabFrameShortClip(t *testing.T) {
+	app := newFFmpegTestApp(t)
+	clip := filepath.Join(t.TempDir(), "short.mp4")
+	cmd := exec.Command(app.FFmpeg, "-f", "lavfi", "-i", "testsrc=s=64x48:r=10:d=0.5", "-pix_fmt", "yuv420p", "-y", clip)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generating the clip: %s\n%s", err, out)
+	}
+
+	if err := app.grabFrame(clip, filepath.Join(t.TempDir(), "thumb.jpg"), ThumbFrameFirst); err == nil {
+		t.Error("expected an error seeking past the end")
+	}
+}
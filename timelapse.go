@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Timelapse information struct
+type Timelapse struct {
+	Id      int64
+	Date    string
+	Video   string
+	Frames  int
+	Created time.Time
+}
+
+// Create the timelapses table in our database.
+func CreateTimelapseTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS timelapses(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		date TEXT NOT NULL UNIQUE,
+		video TEXT NOT NULL,
+		frames INTEGER NOT NULL,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Builds a timelapse of the given day's event images in time order. Days without
+// any events are skipped without creating anything.
+func (app *App) CreateTimelapse(day time.Time) error {
+	date := day.Format("2006-01-02")
+
+	// Collect the day's images in order
+	sql_images := `SELECT image FROM events WHERE date(time) = ? ORDER BY time, id`
+	rows, err := app.DB.Query(sql_images, date)
+	if err != nil {
+		return err
+	}
+	images := make([]string, 0)
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err != nil {
+			rows.Close()
+			return err
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// Nothing happened today
+	if len(images) == 0 {
+		return nil
+	}
+
+	if app.FFmpeg == "" {
+		return errors.New("ffmpeg unavailable")
+	}
+
+	// Feed every image through ffmpeg's image2 pipe demuxer, the scale keeps the
+	// dimensions even as libx264 requires. Runs for a day done before get a name
+	// of their own, the earlier video stays until this one replaces it.
+	video, err := reservePath(filepath.Join(app.Config.dirs.data, fmt.Sprintf("timelapse-%s.mp4", date)))
+	if err != nil {
+		return err
+	}
+	frames := 0
+	err = app.sealedOutput(video, func(out string) error {
+		cmd := exec.Command(
+			app.FFmpeg,
+			"-f", "image2pipe",
+			"-framerate", strconv.Itoa(app.Config.timelapseFPS),
+			"-i", "-",
+			"-c:v", "libx264",
+			"-pix_fmt", "yuv420p",
+			"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+			"-y", out,
+		)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		for _, image := range images {
+			f, err := app.openMedia(image)
+			if err != nil {
+				log.Printf("Skipping missing timelapse frame %s\n", image)
+				continue
+			}
+			_, err = io.Copy(stdin, f)
+			f.Close()
+			if err != nil {
+				break
+			}
+			frames++
+		}
+		stdin.Close()
+
+		return cmd.Wait()
+	})
+	if err != nil {
+		os.Remove(video)
+		return err
+	}
+
+	// Record it, replacing any earlier run for the same day along with its video
+	var earlier string
+	sql_earlier := `SELECT video FROM timelapses WHERE date = ?`
+	if err := app.DB.QueryRow(sql_earlier, date).Scan(&earlier); err != nil && err != sql.ErrNoRows {
+		os.Remove(video)
+		return err
+	}
+	sql_timelapse := `
+	INSERT OR REPLACE INTO timelapses(
+		date,
+		video,
+		frames
+	) VALUES (?, ?, ?)`
+	if _, err := app.DB.Exec(sql_timelapse, date, video, frames); err != nil {
+		os.Remove(video)
+		return err
+	}
+	if earlier != "" && earlier != video {
+		os.Remove(earlier)
+	}
+
+	log.Println("Created timelapse", video)
+
+	return nil
+}
+
+// Retrieves the most recent timelapses.
+func (app *App) GetTimelapses(limit int) []*Timelapse {
+	sql_timelapses := `SELECT id, date, video, frames, created FROM timelapses ORDER BY date DESC LIMIT ?`
+	rows, err := app.DB.Query(sql_timelapses, limit)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	timelapses := make([]*Timelapse, 0)
+	for rows.Next() {
+		timelapse := new(Timelapse)
+		err := rows.Scan(
+			&timelapse.Id,
+			&timelapse.Date,
+			&timelapse.Video,
+			&timelapse.Frames,
+			&timelapse.Created,
+		)
+		if err != nil {
+			panic(err)
+		}
+		timelapses = append(timelapses, timelapse)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return timelapses
+}
+
+// Generates the previous day's timelapse shortly after every (UTC) midnight, event
+// times are stored in UTC so days are split the same way.
+func (app *App) TimelapseScheduler() {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(24*time.Hour + time.Minute)
+		time.Sleep(next.Sub(now))
+
+		day := next.AddDate(0, 0, -1)
+		if err := app.CreateTimelapse(day); err != nil {
+			log.Printf("Error creating timelapse for %s\n", day.Format("2006-01-02"))
+			log.Println(err.Error())
+		}
+	}
+}
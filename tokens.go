@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Longest an upload token may be valid for
+const uploadTokenMaxTTL = 7 * 24 * time.Hour
+
+// Reasons an upload token is refused
+var (
+	errTokenUnknown = errors.New("unknown upload token")
+	errTokenUsed    = errors.New("upload token already used")
+	errTokenExpired = errors.New("upload token expired")
+)
+
+// Single use upload token as handed out, the token itself is only known then
+type uploadToken struct {
+	Token   string    `json:"token"`
+	Camera  string    `json:"camera"`
+	Expires time.Time `json:"expires_at"`
+}
+
+// Create the upload tokens table in our database. Tokens are stored hashed like
+// sessions, and kept after use until they expire so reuse can be told apart
+// from a wrong token.
+func CreateUploadTokenTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS upload_tokens(
+		token TEXT PRIMARY KEY,
+		camera TEXT NOT NULL,
+		expires TIMESTAMP NOT NULL,
+		used TIMESTAMP,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Mints a single use upload token for a camera, valid for ttl.
+func (app *App) CreateUploadToken(camera string, ttl time.Duration) (*uploadToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := &uploadToken{
+		Token:   hex.EncodeToString(b),
+		Camera:  camera,
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+
+	sql_token := `INSERT INTO upload_tokens(token, camera, expires) VALUES (?, ?, ?)`
+	if _, err := app.DB.Exec(sql_token, hashToken(token.Token), camera, token.Expires); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Uses up an upload token, returning the camera it is bound to. Only one of any
+// number of concurrent uses succeeds.
+func (app *App) ConsumeUploadToken(token string) (string, error) {
+	now := time.Now().UTC()
+	hashed := hashToken(token)
+	res, err := app.DB.Exec(`UPDATE upload_tokens SET used = ? WHERE token = ? AND used IS NULL AND expires > ?`, now, hashed, now)
+	if err != nil {
+		return "", err
+	}
+
+	// Whether it worked or not, the row tells why
+	var camera string
+	var expires time.Time
+	var used sql.NullTime
+	err = app.DB.QueryRow(`SELECT camera, expires, used FROM upload_tokens WHERE token = ?`, hashed).Scan(&camera, &expires, &used)
+	if err == sql.ErrNoRows {
+		return "", errTokenUnknown
+	} else if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return camera, nil
+	}
+	if used.Valid {
+		return "", errTokenUsed
+	}
+	if !expires.After(now) {
+		return "", errTokenExpired
+	}
+	return "", errTokenUnknown
+}
+
+// Deletes upload tokens past their expiry, used or not.
+func (app *App) PurgeUploadTokens() (int64, error) {
+	res, err := app.DB.Exec(`DELETE FROM upload_tokens WHERE expires <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Upload token of a request, from the X-Upload-Token header or upload_token
+// form field.
+func requestUploadToken(r *http.Request) string {
+	if token := r.Header.Get("X-Upload-Token"); token != "" {
+		return token
+	}
+	return r.FormValue("upload_token")
+}
+
+// Checks and uses up the upload token of a request, returning the request with
+// the token's camera attached. Writes the error response and returns nil when
+// the token can't be used.
+func (app *App) useUploadToken(w http.ResponseWriter, r *http.Request, token string) *http.Request {
+	camera, err := app.ConsumeUploadToken(token)
+	code := ""
+	switch {
+	case err == nil:
+		return r.WithContext(context.WithValue(r.Context(), cameraKey, camera))
+	case errors.Is(err, errTokenUnknown):
+		code = ErrTokenUnknown
+	case errors.Is(err, errTokenUsed):
+		code = ErrTokenUsed
+	case errors.Is(err, errTokenExpired):
+		code = ErrTokenExpired
+	case isBusy(err):
+		busyRetryAfter(w)
+		writeJSONError(w, http.StatusServiceUnavailable, "the database is busy, try again later")
+		return nil
+	default:
+		panic(err)
+	}
+
+	app.Log(r).Printf("Rejected upload from %s: %s\n", r.RemoteAddr, err)
+	writeAPIError(w, http.StatusUnauthorized, apiError{Code: code, Message: err.Error()})
+	return nil
+}
+
+// Camera an upload comes from: the one its upload token is bound to, otherwise
+// the one it names.
+func uploadCamera(r *http.Request, named string) string {
+	if camera, ok := r.Context().Value(cameraKey).(string); ok {
+		return camera
+	}
+	return named
+}
+
+// Mints an upload token for the camera parameter, valid for ttl (default 1h).
+func (app *App) APICreateUploadTokenHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	camera := strings.TrimSpace(r.FormValue("camera"))
+	if camera == "" {
+		writeFieldError(w, ErrMissingField, "camera", "camera is required")
+		return
+	}
+	ttl := time.Hour
+	if value := r.FormValue("ttl"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 || ttl > uploadTokenMaxTTL {
+			writeFieldError(w, ErrInvalidField, "ttl", "ttl must be a duration such as 15m, at most "+uploadTokenMaxTTL.String())
+			return
+		}
+	}
+
+	token, err := app.CreateUploadToken(camera, ttl)
+	if err != nil {
+		panic(err)
+	}
+
+	app.Log(r).Printf("%s minted an upload token for camera %s, expiring %s\n", actorOf(r), camera, token.Expires.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, token)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event queued for conversion, along with the request that queued it
+type transcodeJob struct {
+	Id        int64
+	RequestID string
+	Variant   bool // Make the small download of the event instead of converting it
+
+	seq     uint64 // Set by Queue, along with queued
+	queued  time.Time
+	started time.Time // Set when a worker picks it up
+}
+
+// How long finished conversions are kept in the transcodes table
+const transcodeHistory = 30 * 24 * time.Hour
+
+// Time conversions took and waited in the queue, in seconds, from a few
+// seconds on a desktop to the many minutes of a throttled Pi
+var (
+	transcodeDuration = newHistogram("transcode_duration_seconds", "Time taken by a conversion", transcodeBuckets)
+	transcodeWait     = newHistogram("transcode_queue_wait_seconds", "Time a conversion waited for a worker", transcodeBuckets)
+	transcodeBuckets  = []float64{1, 5, 10, 20, 30, 60, 120, 300, 600, 1800}
+)
+
+// Conversions of the last day, for /api/stats
+type transcodeStats struct {
+	Jobs        int     `json:"jobs"`
+	Failed      int     `json:"failed"`
+	DurationP50 float64 `json:"duration_p50_seconds"`
+	DurationP95 float64 `json:"duration_p95_seconds"`
+	WaitP50     float64 `json:"wait_p50_seconds"`
+	WaitP95     float64 `json:"wait_p95_seconds"`
+}
+
+// Fixed number of workers converting queued events in the order they were queued.
+// Events only live in the queue in memory, the database keeps them pending so
+// anything still queued at shutdown is picked up again on the next start.
+type transcodePool struct {
+	jobs     chan transcodeJob
+	stopping chan struct{}
+	active   atomic.Int64
+	wg       sync.WaitGroup
+
+	// When each job waiting for a worker was queued, by sequence number,
+	// including those waiting for room in the queue
+	mu      sync.Mutex
+	waiting map[uint64]time.Time
+	seq     uint64
+
+	// Cancelled to kill running conversions when shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Creates a pool holding up to size queued events.
+func newTranscodePool(size int) *transcodePool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transcodePool{
+		jobs:     make(chan transcodeJob, size),
+		stopping: make(chan struct{}),
+		waiting:  make(map[uint64]time.Time),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Queues an event for conversion, waiting while the queue is full. Returns false
+// once shutting down, the event then stays pending until the next start.
+func (p *transcodePool) Queue(job transcodeJob) bool {
+	select {
+	case <-p.stopping:
+		return false
+	default:
+	}
+
+	p.mu.Lock()
+	p.seq++
+	job.seq, job.queued = p.seq, time.Now()
+	p.waiting[job.seq] = job.queued
+	p.mu.Unlock()
+
+	select {
+	case p.jobs <- job:
+		return true
+	case <-p.stopping:
+		p.taken(job)
+		return false
+	}
+}
+
+// Stops counting a job as waiting.
+func (p *transcodePool) taken(job transcodeJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, job.seq)
+}
+
+// Number of events waiting for a worker.
+func (p *transcodePool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.waiting)
+}
+
+// How long the event that was queued first has waited for a worker, zero
+// when none is waiting.
+func (p *transcodePool) Oldest() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldest time.Time
+	for _, queued := range p.waiting {
+		if oldest.IsZero() || queued.Before(oldest) {
+			oldest = queued
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// Number of conversions running right now.
+func (p *transcodePool) Active() int64 {
+	return p.active.Load()
+}
+
+// Starts the given number of workers converting events with app.
+func (p *transcodePool) Start(app *App, workers int) {
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-p.stopping:
+					return
+				case job := <-p.jobs:
+					// Both may have been ready, don't start anything new once stopping
+					select {
+					case <-p.stopping:
+						return
+					default:
+					}
+
+					p.taken(job)
+					job.started = time.Now()
+					p.active.Add(1)
+					if job.Variant {
+						app.makeVariant(p.ctx, job)
+					} else {
+						app.transcodeEvent(p.ctx, job)
+					}
+					p.active.Add(-1)
+				}
+			}
+		}()
+	}
+}
+
+// Stops taking new events and waits for running conversions to finish. Once
+// timeout passes they are killed and their events left pending.
+func (p *transcodePool) Shutdown(timeout time.Duration) {
+	close(p.stopping)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Conversions still running after %s, stopping them\n", timeout)
+		p.cancel()
+		<-done
+	}
+}
+
+// Queues every pending event for conversion, including ones that were being
+// converted when the server last stopped or crashed. Without ffmpeg they keep
+// their original video like new uploads do.
+func (app *App) RequeuePending() {
+	if app.FFmpeg == "" {
+		sql_unconverted := `UPDATE events SET status = ? WHERE status IN (?, ?)`
+		res, err := app.DB.Exec(sql_unconverted, StatusDone, StatusPending, StatusProcessing)
+		if err != nil {
+			log.Println("Error updating unconverted events")
+			log.Println(err.Error())
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("WARNING: %d events were waiting for conversion, keeping their original videos as ffmpeg is missing\n", n)
+		}
+		return
+	}
+
+	sql_interrupted := `UPDATE events SET status = ? WHERE status = ?`
+	if _, err := app.DB.Exec(sql_interrupted, StatusPending, StatusProcessing); err != nil {
+		log.Println("Error resetting interrupted conversions")
+		log.Println(err.Error())
+		return
+	}
+
+	rows, err := app.DB.Query(`SELECT id FROM events WHERE status = ? ORDER BY id`, StatusPending)
+	if err != nil {
+		log.Println("Error finding pending conversions")
+		log.Println(err.Error())
+		return
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Println("Error finding pending conversions")
+			log.Println(err.Error())
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		log.Printf("Queueing %d pending conversions\n", len(ids))
+	}
+	for _, id := range ids {
+		if !app.Transcodes.Queue(transcodeJob{Id: id}) {
+			return
+		}
+	}
+}
+
+// Updates the transcode status and last error of an event.
+func (app *App) SetEventStatus(id int64, status, lastError string) error {
+	defer app.Cache.Clear()
+	sql_status := `UPDATE events SET status = ?, last_error = ? WHERE id = ?`
+	_, err := app.DB.Exec(sql_status, status, lastError, id)
+	return err
+}
+
+// Marks an event's conversion as failed, logging if even that isn't possible.
+func (app *App) failTranscode(logger *Logger, id int64, cause error) {
+	if err := app.SetEventStatus(id, StatusFailed, cause.Error()); err != nil {
+		logger.Printf("Error recording failed conversion of event %d\n", id)
+		logger.Println(err.Error())
+	}
+}
+
+// Swaps an event's video for its converted version and marks it done.
+func (app *App) replaceVideo(id int64, oldPath, newPath string) error {
+	defer app.Cache.Clear()
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sql_video := `UPDATE events SET video = ?, status = ?, last_error = '' WHERE id = ?`
+	if _, err := tx.Exec(sql_video, newPath, StatusDone, id); err != nil {
+		return err
+	}
+	if err := replaceMedia(tx, id, oldPath, newPath); err != nil {
+		return err
+	}
+	if err := setEventSize(tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Converts a single queued event. On success the original video is removed and
+// the event points at the converted file, on failure the original is kept and the
+// error recorded on the event. Conversions cancelled through ctx are left pending.
+func (app *App) transcodeEvent(ctx context.Context, job transcodeJob) {
+	logger := app.Logger.With(job.RequestID)
+	event, err := app.FindEvent(job.Id)
+	if err != nil {
+		logger.Printf("Error finding event %d to convert\n", job.Id)
+		logger.Println(err.Error())
+		return
+	}
+
+	// Queued twice (by an upload and by RequeuePending), already converted
+	if event.Status != StatusPending {
+		return
+	}
+
+	if err := app.SetEventStatus(event.Id, StatusProcessing, ""); err != nil {
+		logger.Printf("Error starting conversion of event %d\n", event.Id)
+		logger.Println(err.Error())
+		return
+	}
+
+	// Encrypted videos are worked on in a decrypted copy, wiped afterwards
+	src, wipe, err := app.plainCopy(event.Video)
+	if err != nil {
+		logger.Printf("Error decrypting the video of event %d\n", event.Id)
+		logger.Println(err.Error())
+		app.failTranscode(logger, event.Id, err)
+		return
+	}
+	defer wipe()
+
+	// Score the original video first, notifications may be waiting on it
+	if app.Config.motionScore && event.Score == nil {
+		app.scoreEvent(ctx, logger, event, src)
+	}
+
+	// Re-encode video to something friendly for browsers, ffmpeg can't write
+	// over its input so uploads already in the target container get a suffix.
+	// The name is reserved like an upload's, another event's video may have it.
+	vPath := event.Video
+	newVideoPath := strings.TrimSuffix(vPath, filepath.Ext(vPath)) + app.Codec.ext
+	if newVideoPath == vPath {
+		newVideoPath = strings.TrimSuffix(vPath, filepath.Ext(vPath)) + "-" + app.Codec.name + app.Codec.ext
+	}
+	newVideoPath, err = reservePath(newVideoPath)
+	if err != nil {
+		logger.Printf("Error reserving a name for the converted video of event %d\n", event.Id)
+		logger.Println(err.Error())
+		app.failTranscode(logger, event.Id, err)
+		return
+	}
+	var audio bool
+	var audioErr error
+	err = app.sealedOutput(newVideoPath, func(dst string) error {
+		if err := app.Transcode(ctx, logger, src, dst, event.Name, event.Time); err != nil {
+			return err
+		}
+		audio, audioErr = app.probeAudio(ctx, dst)
+		return nil
+	})
+	if ctx.Err() == nil {
+		app.recordTranscode(logger, job, err != nil)
+	}
+	if err != nil {
+		os.Remove(newVideoPath)
+		if ctx.Err() != nil {
+			logger.Printf("Stopped converting event %d, it stays pending\n", event.Id)
+			if err := app.SetEventStatus(event.Id, StatusPending, ""); err != nil {
+				logger.Println(err.Error())
+			}
+			return
+		}
+		logger.Printf("Error converting %s to %s\n", vPath, newVideoPath)
+		logger.Println(err.Error())
+		app.failTranscode(logger, event.Id, err)
+		return
+	}
+
+	// Point the event and its media at the new video, if that fails the converted
+	// file is dropped and the event keeps the original
+	if err := app.replaceVideo(event.Id, vPath, newVideoPath); err != nil {
+		logger.Printf("Error saving converted video for event %d, keeping the original\n", event.Id)
+		logger.Println(err.Error())
+		os.Remove(newVideoPath)
+		app.failTranscode(logger, event.Id, err)
+		return
+	}
+
+	// Remove old video
+	os.Remove(vPath)
+
+	// Note whether the clip kept its sound, so it can be shown
+	if audioErr != nil {
+		logger.Printf("Error probing the sound of event %d\n", event.Id)
+		logger.Println(audioErr.Error())
+	} else if _, err := app.DB.Exec(`UPDATE events SET audio = ? WHERE id = ?`, audio, event.Id); err != nil {
+		logger.Printf("Error saving the sound of event %d\n", event.Id)
+		logger.Println(err.Error())
+	}
+
+	logger.Println("Converted video for event", event.Id)
+	if converted, err := app.FindEvent(event.Id); err == nil {
+		app.RunHooks(logger, HookTranscoded, converted, app.cameraName(converted))
+	}
+}
+
+// Create the table recording how long conversions waited and took.
+func CreateTranscodeTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS transcodes(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id INTEGER NOT NULL,
+		variant BOOLEAN NOT NULL DEFAULT 0,
+		queued TIMESTAMP NOT NULL,
+		wait_ms INTEGER NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		failed BOOLEAN NOT NULL DEFAULT 0,
+		finished TIMESTAMP NOT NULL
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS transcodes_finished ON transcodes(finished)`); err != nil {
+		panic(err)
+	}
+}
+
+// Records how long a finished conversion waited for a worker and took, in the
+// transcodes table and the histograms. Conversions older than
+// transcodeHistory are dropped on the way.
+func (app *App) recordTranscode(logger *Logger, job transcodeJob, failed bool) {
+	wait, took := job.started.Sub(job.queued), time.Since(job.started)
+	transcodeWait.Observe(wait.Seconds())
+	transcodeDuration.Observe(took.Seconds())
+
+	now := time.Now().UTC()
+	sql_transcode := `INSERT INTO transcodes(event_id, variant, queued, wait_ms, duration_ms, failed, finished) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := app.DB.Exec(sql_transcode, job.Id, job.Variant, job.queued.UTC(), wait.Milliseconds(), took.Milliseconds(), failed, now)
+	if err == nil {
+		_, err = app.DB.Exec(`DELETE FROM transcodes WHERE finished < ?`, now.Add(-transcodeHistory))
+	}
+	if err != nil {
+		logger.Printf("Error recording the conversion of event %d\n", job.Id)
+		logger.Println(err.Error())
+	}
+}
+
+// Counts the conversions of the last 24 hours, with the median and 95th
+// percentile of how long they took and waited.
+func (app *App) TranscodeStats() (transcodeStats, error) {
+	var stats transcodeStats
+	rows, err := app.DB.Query(`SELECT wait_ms, duration_ms, failed FROM transcodes WHERE finished >= ?`, time.Now().UTC().Add(-24*time.Hour))
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	var waits, durations []int64
+	for rows.Next() {
+		var wait, duration int64
+		var failed bool
+		if err := rows.Scan(&wait, &duration, &failed); err != nil {
+			return stats, err
+		}
+		waits = append(waits, wait)
+		durations = append(durations, duration)
+		if failed {
+			stats.Failed++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	stats.Jobs = len(durations)
+	stats.DurationP50, stats.DurationP95 = percentileSeconds(durations, 50), percentileSeconds(durations, 95)
+	stats.WaitP50, stats.WaitP95 = percentileSeconds(waits, 50), percentileSeconds(waits, 95)
+	return stats, nil
+}
+
+// Returns the nearest rank percentile of milliseconds in seconds, 0 without
+// any. Sorts ms.
+func percentileSeconds(ms []int64, percentile int) float64 {
+	if len(ms) == 0 {
+		return 0
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i] < ms[j] })
+	rank := (len(ms)*percentile + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return float64(ms[rank-1]) / 1000
+}
+
+// Checks the conversion queue every 30 seconds, sending an alert when the
+// event queued first has waited longer than maxAge and another once the queue
+// has caught up.
+func (app *App) TranscodeMonitor(maxAge time.Duration) {
+	backed := false
+	for ; ; time.Sleep(30 * time.Second) {
+		oldest := app.Transcodes.Oldest()
+		if (oldest > maxAge) == backed {
+			continue
+		}
+		backed = !backed
+
+		message := fmt.Sprintf("Seccam conversions are backed up: %d videos are queued, the oldest for %s.", app.Transcodes.Len(), oldest.Round(time.Second))
+		if !backed {
+			message = fmt.Sprintf("Seccam conversions caught up: %d videos are queued.", app.Transcodes.Len())
+		}
+		log.Println(message)
+		app.SendText(app.Logger, message)
+	}
+}
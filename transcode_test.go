@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stands in for ffmpeg by copying the input to the output, the last argument.
+const fakeFFmpegScript = `#!/bin/sh
+while [ $# -gt 1 ]; do
+	case "$1" in
+	-i) src="$2"; shift ;;
+	esac
+	shift
+done
+exec cp "$src" "$1"
+`
+
+// Path of a fake ffmpeg, for converting without the real one.
+func fakeFFmpeg(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Waits for an event to leave pending and processing, returning it as it is
+// then.
+func waitConverted(t *testing.T, app *App, id int64) *Event {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		event, err := app.FindEvent(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Status != StatusPending && event.Status != StatusProcessing {
+			return event
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("event %d is still %s", id, event.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A server crashing between storing events and converting them picks the
+// conversions up again on the next start: the one that was being converted
+// as well as the one still waiting.
+func TestRecoverConversionsAfterCrash(t *testing.T) {
+	config := testConfig(t)
+	ffmpeg := fakeFFmpeg(t)
+
+	// Store two events, the first of which was being converted at the crash
+	before := newTestAppWith(t, config)
+	before.FFmpeg = ffmpeg
+	var ids []int64
+	for _, name := range []string{"converting", "waiting"} {
+		created, err := before.StoreEvent(before.Logger, "", stageTestUpload(t, before, name))
+		if err != nil {
+			t.Fatalf("StoreEvent: %s", err)
+		}
+		if created.Status != StatusPending {
+			t.Fatalf("new event is %s, expected %s", created.Status, StatusPending)
+		}
+		ids = append(ids, created.Id)
+	}
+	if err := before.SetEventStatus(ids[0], StatusProcessing, ""); err != nil {
+		t.Fatal(err)
+	}
+	before.DB.Close()
+
+	// Start again on the same database and data directory
+	after := newTestAppWith(t, config)
+	after.FFmpeg = ffmpeg
+	after.Transcodes.Start(after, 1)
+	t.Cleanup(func() { after.Transcodes.Shutdown(5 * time.Second) })
+	after.RequeuePending()
+
+	for _, id := range ids {
+		event := waitConverted(t, after, id)
+		if event.Status != StatusDone {
+			t.Errorf("event %d is %s (%s), expected %s", id, event.Status, event.LastError, StatusDone)
+		}
+		if !strings.HasSuffix(event.Video, ".mp4") {
+			t.Errorf("event %d still points at %s", id, event.Video)
+		}
+		if data, err := os.ReadFile(event.Video); err != nil || string(data) != "video of "+event.Name {
+			t.Errorf("converted video of event %d holds %q (%v)", id, data, err)
+		}
+		media, err := after.EventMedia(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if media[0].Path != event.Video {
+			t.Errorf("media of event %d points at %s, expected %s", id, media[0].Path, event.Video)
+		}
+	}
+
+	// The originals went once converted
+	for _, name := range dirFiles(t, config.dirs.data) {
+		if strings.HasSuffix(name, ".avi") {
+			t.Errorf("original %s is still there", name)
+		}
+	}
+}
+
+// Without ffmpeg on the next start interrupted events keep their original
+// video rather than staying pending.
+func TestRecoverConversionsWithoutFFmpeg(t *testing.T) {
+	config := testConfig(t)
+	before := newTestAppWith(t, config)
+	before.FFmpeg = fakeFFmpeg(t)
+	created, err := before.StoreEvent(before.Logger, "", stageTestUpload(t, before, "front door"))
+	if err != nil {
+		t.Fatalf("StoreEvent: %s", err)
+	}
+	if err := before.SetEventStatus(created.Id, StatusProcessing, ""); err != nil {
+		t.Fatal(err)
+	}
+	before.DB.Close()
+
+	after := newTestAppWith(t, config)
+	after.RequeuePending()
+	event, err := after.FindEvent(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != StatusDone || event.Video != created.Video {
+		t.Errorf("event is %s with %s, expected %s with %s", event.Status, event.Video, StatusDone, created.Video)
+	}
+}
+
+// Converting to a name another event's video already has picks a free one
+// rather than writing over that video.
+func TestTranscodeKeepsOtherEventsVideo(t *testing.T) {
+	app := newTestApp(t)
+	app.FFmpeg = ""
+
+	// An upload already in the target container, stored as it is
+	upload := stageTestUpload(t, app, "mp4 upload")
+	upload.Videos[0].Name = "clip" + app.Codec.ext
+	kept, err := app.StoreEvent(app.Logger, "", upload)
+	if err != nil {
+		t.Fatalf("StoreEvent: %s", err)
+	}
+
+	app.FFmpeg = fakeFFmpeg(t)
+	app.Transcodes.Start(app, 1)
+	t.Cleanup(func() { app.Transcodes.Shutdown(5 * time.Second) })
+	created, err := app.StoreEvent(app.Logger, "", stageTestUpload(t, app, "avi upload"))
+	if err != nil {
+		t.Fatalf("StoreEvent: %s", err)
+	}
+	converted := waitConverted(t, app, created.Id)
+
+	if converted.Status != StatusDone || converted.Video == kept.Video || filepath.Ext(converted.Video) != app.Codec.ext {
+		t.Errorf("converted to %s (%s), expected a %s other than %s", converted.Video, converted.Status, app.Codec.ext, kept.Video)
+	}
+	for _, event := range []*Event{kept, converted} {
+		if data, err := os.ReadFile(event.Video); err != nil || string(data) != "video of "+event.Name {
+			t.Errorf("%s holds %q (%v), expected the video of %s", event.Video, data, err, event.Name)
+		}
+	}
+}
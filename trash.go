@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Files of deleted events kept until the trash is emptied. The events
+// themselves are gone, so nothing lists them, but their files still take up
+// space until then.
+func CreateTrashTable(db *sql.DB) {
+	sql_table := `
+	CREATE TABLE IF NOT EXISTS trash(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		path TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		actor TEXT NOT NULL,
+		deleted TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+
+	_, err := db.Exec(sql_table)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS trash_deleted ON trash(deleted)`); err != nil {
+		panic(err)
+	}
+}
+
+// Space the trash takes up
+type trashUsage struct {
+	Events int
+	Bytes  int64
+}
+
+// Whether events deleted by actor go to the trash. Only with -trash-retain,
+// and never for the server's own cleanups, which are there to free the space.
+func (app *App) trashes(actor string) bool {
+	return app.Config.trashRetain > 0 && actor != ActorRetention && actor != ActorQuota && actor != ActorCheck
+}
+
+// Keeps the files of an event deleted within tx in the trash instead of
+// removing them. Files that are already gone are left out.
+func trashFiles(tx *sql.Tx, event *Event, paths []string, actor string) error {
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		sql_trash := `INSERT INTO trash(event_id, name, path, size, actor, deleted) VALUES(?, ?, ?, ?, ?, ?)`
+		if _, err := tx.Exec(sql_trash, event.Id, event.Name, path, info.Size(), actor, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Totals the events in the trash and the size of their files.
+func (app *App) TrashUsage() (trashUsage, error) {
+	var usage trashUsage
+	err := app.DB.QueryRow(`SELECT COUNT(DISTINCT event_id), COALESCE(SUM(size), 0) FROM trash`).Scan(&usage.Events, &usage.Bytes)
+	return usage, err
+}
+
+// Removes the trashed files up to and including the trash row upTo, those of
+// the events deleted first, and audits it. Returns what was freed.
+func (app *App) EmptyTrash(upTo int64, actor, remoteAddr string) (trashUsage, error) {
+	defer app.Cache.Clear()
+	var freed trashUsage
+	var paths []string
+	err := app.retryBusy(func() error {
+		freed, paths = trashUsage{}, nil
+		tx, err := app.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		sql_freed := `SELECT COUNT(DISTINCT event_id), COALESCE(SUM(size), 0) FROM trash WHERE id <= ?`
+		if err := tx.QueryRow(sql_freed, upTo).Scan(&freed.Events, &freed.Bytes); err != nil {
+			return err
+		}
+		if freed.Events == 0 {
+			return nil
+		}
+		rows, err := tx.Query(`SELECT path FROM trash WHERE id <= ?`, upTo)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				rows.Close()
+				return err
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM trash WHERE id <= ?`, upTo); err != nil {
+			return err
+		}
+		detail := fmt.Sprintf("%d events, %d bytes", freed.Events, freed.Bytes)
+		if err := Audit(tx, actor, "empty trash", 0, remoteAddr, detail); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return trashUsage{}, err
+	}
+
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	return freed, nil
+}
+
+// Empties the trash of events deleted longer than -trash-retain ago.
+func (app *App) ExpireTrash() (trashUsage, error) {
+	var upTo sql.NullInt64
+	before := time.Now().Add(-app.Config.trashRetain).UTC()
+	if err := app.DB.QueryRow(`SELECT MAX(id) FROM trash WHERE deleted < ?`, before).Scan(&upTo); err != nil {
+		return trashUsage{}, err
+	}
+	if !upTo.Valid {
+		return trashUsage{}, nil
+	}
+	return app.EmptyTrash(upTo.Int64, ActorRetention, "")
+}
+
+// Brings the space taken up back under -storage-quota, counting live events
+// other than evidence, the trash and archives. The trash goes first, the events deleted first
+// first, and only then the oldest unprotected events, never evidence. Returns
+// what was emptied from the trash and the number of events deleted.
+func (app *App) EnforceQuota() (trashUsage, int, error) {
+	quota := app.Config.storageQuota
+	if quota <= 0 {
+		return trashUsage{}, 0, nil
+	}
+
+	var live int64
+	if err := app.DB.QueryRow(`SELECT COALESCE(SUM(size_bytes), 0) FROM events WHERE evidence_at IS NULL`).Scan(&live); err != nil {
+		return trashUsage{}, 0, err
+	}
+	trash, err := app.TrashUsage()
+	if err != nil {
+		return trashUsage{}, 0, err
+	}
+	archives, err := app.ArchiveBytes()
+	if err != nil {
+		return trashUsage{}, 0, err
+	}
+	excess := live + trash.Bytes + archives - quota
+	if excess <= 0 {
+		return trashUsage{}, 0, nil
+	}
+
+	// Empty as much of the trash as it takes, oldest first
+	var freed trashUsage
+	if trash.Bytes > 0 {
+		rows, err := app.DB.Query(`SELECT id, size FROM trash ORDER BY id`)
+		if err != nil {
+			return trashUsage{}, 0, err
+		}
+		var upTo, total int64
+		for total < excess && rows.Next() {
+			var size int64
+			if err := rows.Scan(&upTo, &size); err != nil {
+				rows.Close()
+				return trashUsage{}, 0, err
+			}
+			total += size
+		}
+		rows.Close()
+
+		if freed, err = app.EmptyTrash(upTo, ActorQuota, ""); err != nil {
+			return freed, 0, err
+		}
+		excess -= freed.Bytes
+	}
+	if excess <= 0 {
+		return freed, 0, nil
+	}
+
+	// Then the oldest events until there's room
+	rows, err := app.DB.Query(`SELECT id, COALESCE(size_bytes, 0) FROM events WHERE protected = 0 AND evidence_at IS NULL ORDER BY time, id`)
+	if err != nil {
+		return freed, 0, err
+	}
+	ids := make([]int64, 0)
+	for total := int64(0); total < excess && rows.Next(); {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return freed, 0, err
+		}
+		ids = append(ids, id)
+		total += size
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, id := range ids {
+		err := app.DeleteEvent(id, ActorQuota, "")
+		if err == errProtected || err == errEvidence || err == sql.ErrNoRows {
+			// Protected, kept as evidence or deleted since we looked
+			continue
+		} else if err != nil {
+			return freed, deleted, err
+		}
+		deleted++
+	}
+
+	return freed, deleted, nil
+}
+
+// Empties the whole trash from the prune page.
+func (app *App) EmptyTrashHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var upTo sql.NullInt64
+	if err := app.DB.QueryRow(`SELECT MAX(id) FROM trash`).Scan(&upTo); err != nil {
+		panic(err)
+	}
+	var freed trashUsage
+	if upTo.Valid {
+		var err error
+		if freed, err = app.EmptyTrash(upTo.Int64, actorOf(r), r.RemoteAddr); err != nil {
+			panic(err)
+		}
+	}
+	app.Log(r).Printf("Emptied the trash of %d events, %d bytes\n", freed.Events, freed.Bytes)
+
+	page := app.newPrunePage()
+	page.Message = fmt.Sprintf("Emptied the trash of %d events (%s).", freed.Events, formatBytes(uint64(freed.Bytes)))
+	t := app.Template(r, "prune")
+	t.ExecuteTemplate(w, t.Name(), page)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+// Evidence can't be deleted to make room, so it doesn't count against the
+// quota: ordinary events only go to get their own share back under it.
+func TestEnforceQuotaLeavesOutEvidence(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   int64
+		deleted int
+	}{
+		{"evidence alone over the quota", 500, 0},
+		{"ordinary events over the quota", 150, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.storageQuota = test.quota
+			app := newTestAppWith(t, config)
+
+			evidence := storeTestEvent(t, app, "break-in")
+			if _, err := app.SetEvidence(evidence.Id, true, "admin", ""); err != nil {
+				t.Fatal(err)
+			}
+			var ordinary []int64
+			for _, name := range []string{"front door", "porch"} {
+				ordinary = append(ordinary, storeTestEvent(t, app, name).Id)
+			}
+			for id, size := range map[int64]int{evidence.Id: 1000, ordinary[0]: 100, ordinary[1]: 100} {
+				if _, err := app.DB.Exec(`UPDATE events SET size_bytes = ? WHERE id = ?`, size, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stats, err := app.StorageStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Bytes != 1200 || stats.Evidence != 1000 || stats.Used() != formatBytes(200) {
+				t.Errorf("stats count %d bytes, %d of evidence, %s used", stats.Bytes, stats.Evidence, stats.Used())
+			}
+
+			_, deleted, err := app.EnforceQuota()
+			if err != nil {
+				t.Fatalf("EnforceQuota: %s", err)
+			}
+			if deleted != test.deleted {
+				t.Errorf("deleted %d events, expected %d", deleted, test.deleted)
+			}
+			if _, err := app.FindEvent(evidence.Id); err != nil {
+				t.Errorf("evidence is gone: %s", err)
+			}
+			// The oldest go first
+			for i, id := range ordinary {
+				_, err := app.FindEvent(id)
+				if gone := err != nil; gone != (i < test.deleted) {
+					t.Errorf("event %d gone: %t, expected %t", id, gone, i < test.deleted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sfreiberg/gotwilio"
+)
+
+// Error returned by the Twilio API
+type twilioError struct {
+	Status  int    `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *twilioError) Error() string {
+	return fmt.Sprintf("twilio error %d: %s", e.Code, e.Message)
+}
+
+// Turns the results of a gotwilio call into a single error.
+func twilioResult(_ *gotwilio.SmsResponse, exc *gotwilio.Exception, err error) error {
+	if err != nil {
+		return err
+	}
+	if exc != nil {
+		return &twilioError{Status: exc.Status, Code: exc.Code, Message: exc.Message}
+	}
+	return nil
+}
+
+// Outcome of the most recent Twilio call, reported by /healthz
+type twilioHealth struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (h *twilioHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checked = time.Now()
+	h.err = err
+}
+
+// Returns when Twilio was last used and the error it gave, if any.
+func (h *twilioHealth) get() (time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.checked, h.err
+}
+
+// Sliding window of the event alerts sent in the last hour, for -sms-budget
+type smsBudget struct {
+	mu         sync.Mutex
+	sent       []time.Time
+	suppressed int  // Alerts suppressed since the last one sent
+	noticeSent bool // Whether the budget reached message went out
+}
+
+// Outcome of taking an alert from the budget
+type smsAllowance struct {
+	send       bool
+	suppressed int       // Alerts suppressed before this one, when sending
+	notice     bool      // Whether to say the budget was reached, when not sending
+	until      time.Time // When the window frees up, when not sending
+}
+
+// Takes an alert from the budget of limit per hour.
+func (b *smsBudget) take(limit int, now time.Time) smsAllowance {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.sent) > 0 && now.Sub(b.sent[0]) >= time.Hour {
+		b.sent = b.sent[1:]
+	}
+
+	if len(b.sent) < limit {
+		allowance := smsAllowance{send: true, suppressed: b.suppressed}
+		b.sent = append(b.sent, now)
+		b.suppressed = 0
+		b.noticeSent = false
+		return allowance
+	}
+
+	b.suppressed++
+	allowance := smsAllowance{notice: !b.noticeSent, until: b.sent[0].Add(time.Hour)}
+	b.noticeSent = true
+	return allowance
+}
+
+// Notifier texting alerts to a number through Twilio. Alerts beyond -sms-budget
+// are suppressed, the next one sent says how many were.
+type twilioNotifier struct {
+	notifierBase
+	account twilio
+	budget  *smsBudget
+}
+
+// Queued text message
+type twilioMessage struct {
+	Message  string `json:"message"`
+	MediaURL string `json:"media_url,omitempty"`
+}
+
+func newTwilioNotifier(base notifierBase, account twilio) twilioNotifier {
+	return twilioNotifier{base, account, &smsBudget{}}
+}
+
+// Where messages go, the account's SID and the numbers.
+func twilioTarget(account twilio) string {
+	return fmt.Sprintf("twilio://%s:****@%s/%s", account.sid, account.from, account.to)
+}
+
+// Builds the text about an event in -language, primitive at the moment. With
+// a base URL configured a link to the event is included and the image attached
+// as MMS.
+func (n twilioNotifier) Payload(app *App, event *Event, camera string) ([]byte, error) {
+	message := twilioMessage{Message: app.T("alert.sms", app.FormatTime(event.Time))}
+	if where := event.Where(); where != "" {
+		message.Message = app.T("alert.sms_near", app.FormatTime(event.Time), where)
+	}
+	if app.Config.baseURL != "" {
+		message.Message += " " + app.AbsoluteURL(fmt.Sprintf("/event/%d", event.Id))
+		if len(app.Config.escalation) > 0 {
+			message.Message += " " + app.T("alert.acknowledge") + " " + app.AbsoluteURL(app.AckLink(event.Id))
+		}
+		message.MediaURL = app.AbsoluteURL(app.MediaURL(event.Image))
+	}
+
+	// Stay within -sms-budget, saying so once when it runs out
+	if limit := app.Config.smsBudget; limit > 0 {
+		allowance := n.budget.take(limit, time.Now())
+		if !allowance.send {
+			smsSuppressed.Add(1)
+			app.Logger.Printf("SMS budget of %d per hour reached, not alerting %s about event %d\n", limit, n.account.to, event.Id)
+			if !allowance.notice {
+				return nil, nil
+			}
+			message = twilioMessage{Message: app.T("alert.sms_budget_reached", limit, allowance.until.Format("15:04"))}
+		} else if allowance.suppressed > 0 {
+			message.Message += " " + app.T("alert.sms_suppressed", allowance.suppressed)
+		}
+	}
+
+	return json.Marshal(message)
+}
+
+// Sends a queued text.
+func (n twilioNotifier) Send(app *App, id int64, payload []byte) (int, error) {
+	var message twilioMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return 0, err
+	}
+
+	if err := app.sendTwilio(app.Logger, n.account, message.Message, message.MediaURL); err != nil {
+		var twilioErr *twilioError
+		if errors.As(err, &twilioErr) {
+			return twilioErr.Status, err
+		}
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+// Sends a message to the configured number, as an MMS when there is a media URL.
+// In dry run mode the message is only logged.
+func (app *App) sendMessage(logger *Logger, message, mediaURL string) error {
+	return app.sendMessageTo(logger, app.Config.twilio.to, message, mediaURL)
+}
+
+// Sends a message to the given number, like sendMessage.
+func (app *App) sendMessageTo(logger *Logger, to, message, mediaURL string) error {
+	account := app.Config.twilio
+	account.to = to
+	return app.sendTwilio(logger, account, message, mediaURL)
+}
+
+// Sends a message with a Twilio account to its to number.
+func (app *App) sendTwilio(logger *Logger, account twilio, message, mediaURL string) error {
+	to := account.to
+	if app.Config.notifyDryRun {
+		if mediaURL != "" {
+			logger.Printf("DRY RUN: not sending MMS to %s: %q with %s\n", to, message, mediaURL)
+		} else {
+			logger.Printf("DRY RUN: not sending SMS to %s: %q\n", to, message)
+		}
+		return nil
+	}
+
+	twilio := gotwilio.NewTwilioClient(account.sid, account.token)
+	var err error
+	if mediaURL != "" {
+		err = twilioResult(twilio.SendMMS(account.from, to, message, mediaURL, "", ""))
+	} else {
+		err = twilioResult(twilio.SendSMS(account.from, to, message, "", ""))
+	}
+	app.Twilio.record(err)
+
+	return err
+}
+
+// Checks the Twilio credentials by fetching the account they belong to. Nothing
+// is checked in dry run mode.
+func (app *App) CheckTwilio() error {
+	if app.Config.notifyDryRun {
+		app.Logger.Println("DRY RUN: not checking Twilio credentials")
+		return nil
+	}
+
+	err := app.checkTwilio()
+	app.Twilio.record(err)
+	return err
+}
+
+func (app *App) checkTwilio() error {
+	if app.Config.sid == "" || app.Config.token == "" {
+		return errors.New("twilio is not configured, -sid and -token are required")
+	}
+
+	twilio := gotwilio.NewTwilioClient(app.Config.sid, app.Config.token)
+	req, err := http.NewRequest("GET", twilio.BaseUrl+"/Accounts/"+url.PathEscape(app.Config.sid)+".json", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(app.Config.sid, app.Config.token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		twErr := &twilioError{Status: resp.StatusCode}
+		if json.NewDecoder(resp.Body).Decode(twErr) != nil || twErr.Message == "" {
+			twErr.Message = resp.Status
+		}
+		return twErr
+	}
+
+	return nil
+}
+
+// Checks the Twilio credentials and, with send=true, sends a test message to the
+// configured number. It is an MMS with the latest event's image when -base-url is
+// set, like real alerts.
+func (app *App) TestNotificationHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	logger := app.Log(r)
+
+	send := false
+	if v := r.FormValue("send"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeFieldError(w, ErrInvalidField, "send", "send must be true or false")
+			return
+		}
+		send = b
+	}
+
+	if err := app.CheckTwilio(); err != nil {
+		logger.Println("Error checking Twilio credentials")
+		logger.Println(err.Error())
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	credentials := "ok"
+	if app.Config.notifyDryRun {
+		credentials = "not checked, dry run"
+	}
+	if !send {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"credentials": credentials, "sent": false})
+		return
+	}
+
+	mediaURL := ""
+	if events := app.RecentEvents(1); app.Config.baseURL != "" && len(events) > 0 {
+		mediaURL = app.AbsoluteURL(app.MediaURL(events[0].Image))
+	}
+	if err := app.sendMessage(logger, "Seccam test notification.", mediaURL); err != nil {
+		logger.Printf("Error sending test notification to %s\n", app.Config.twilio.to)
+		logger.Println(err.Error())
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	logger.Printf("Sent test notification to %s\n", app.Config.twilio.to)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"credentials": credentials, "sent": !app.Config.notifyDryRun})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles, viewers may only look while admins can change things
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+// Compared against for unknown users so they take as long as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("seccam"), bcrypt.DefaultCost)
+
+// User information struct
+type User struct {
+	Id       int64
+	Username string
+	Role     string
+	Created  time.Time
+}
+
+// Create the users and sessions tables in our database.
+func CreateUserTables(db *sql.DB) {
+	sql_users := `
+	CREATE TABLE IF NOT EXISTS users(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`
+	sql_sessions := `
+	CREATE TABLE IF NOT EXISTS sessions(
+		token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		expires TIMESTAMP NOT NULL
+	)`
+
+	for _, stmt := range []string{sql_users, sql_sessions} {
+		if _, err := db.Exec(stmt); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Whether any users exist, logging in is only required once they do.
+func (app *App) HasUsers() bool {
+	var count int
+	if err := app.DB.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+// Adds a user with the given password and role.
+func (app *App) AddUser(username, password, role string) error {
+	if role != RoleAdmin && role != RoleViewer {
+		return fmt.Errorf("unknown role %q, expected %s or %s", role, RoleAdmin, RoleViewer)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	sql_user := `INSERT INTO users(username, hash, role) VALUES (?, ?, ?)`
+	_, err = app.DB.Exec(sql_user, username, string(hash), role)
+	return err
+}
+
+// Removes a user along with their sessions.
+func (app *App) RemoveUser(username string) error {
+	user, err := app.FindUser(username)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.DB.Exec(`DELETE FROM sessions WHERE user_id = ?`, user.Id); err != nil {
+		return err
+	}
+	_, err = app.DB.Exec(`DELETE FROM users WHERE id = ?`, user.Id)
+	return err
+}
+
+// Sets a new password for a user, signing them out everywhere.
+func (app *App) SetPassword(username, password string) error {
+	user, err := app.FindUser(username)
+	if err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.DB.Exec(`UPDATE users SET hash = ? WHERE id = ?`, string(hash), user.Id); err != nil {
+		return err
+	}
+	_, err = app.DB.Exec(`DELETE FROM sessions WHERE user_id = ?`, user.Id)
+	return err
+}
+
+// Looks up a user by name, returning sql.ErrNoRows if there is no such user.
+func (app *App) FindUser(username string) (*User, error) {
+	user := new(User)
+	sql_user := `SELECT id, username, role, created FROM users WHERE username = ?`
+	err := app.DB.QueryRow(sql_user, username).Scan(&user.Id, &user.Username, &user.Role, &user.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Checks a username and password, returning the user if they match. Users from
+// single sign on have no password and never match.
+func (app *App) CheckPassword(username, password string) (*User, error) {
+	var hash string
+	user := new(User)
+	sql_user := `SELECT id, username, role, created, hash FROM users WHERE username = ?`
+	err := app.DB.QueryRow(sql_user, username).Scan(&user.Id, &user.Username, &user.Role, &user.Created, &hash)
+	if err == sql.ErrNoRows {
+		// Spend the same time as a wrong password so usernames can't be probed
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errors.New("unknown user")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if hash == "" {
+		return nil, errors.New("user has no local password")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Lists every user.
+func (app *App) ListUsers() []*User {
+	rows, err := app.DB.Query(`SELECT id, username, role, created FROM users ORDER BY username`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		user := new(User)
+		if err := rows.Scan(&user.Id, &user.Username, &user.Role, &user.Created); err != nil {
+			panic(err)
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return users
+}
+
+// Prompts for a password on stderr and reads it from stdin.
+func readPassword() string {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "No password given")
+		os.Exit(1)
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Manages users from the command line:
+//
+//	user add <username> [admin|viewer]
+//	user remove <username>
+//	user passwd <username>
+//	user list
+func (app *App) UserCommand(args []string) error {
+	usage := errors.New("usage: user add <username> [admin|viewer] | user remove <username> | user passwd <username> | user list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		role := RoleViewer
+		if len(args) == 3 {
+			role = args[2]
+		}
+		if err := app.AddUser(args[1], readPassword(), role); err != nil {
+			return err
+		}
+		fmt.Printf("Added %s %s\n", role, args[1])
+	case args[0] == "remove" && len(args) == 2:
+		if err := app.RemoveUser(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", args[1])
+	case args[0] == "passwd" && len(args) == 2:
+		if err := app.SetPassword(args[1], readPassword()); err != nil {
+			return err
+		}
+		fmt.Printf("Changed password of %s\n", args[1])
+	case args[0] == "list" && len(args) == 1:
+		for _, user := range app.ListUsers() {
+			fmt.Printf("%s\t%s\t%s\n", user.Username, user.Role, user.Created.Format(time.RFC3339))
+		}
+	default:
+		return usage
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Kind of the media row of an event's small download, made on request
+const MediaVideoLow = "video_low"
+
+// How long a failed small version isn't tried again
+const variantRetryAfter = 10 * time.Minute
+
+// Small versions being made, one at a time per event, and recent failures
+type variantSet struct {
+	mu     sync.Mutex
+	making map[int64]bool
+	failed map[int64]time.Time
+}
+
+func newVariantSet() *variantSet {
+	return &variantSet{making: make(map[int64]bool), failed: make(map[int64]time.Time)}
+}
+
+// Claims making an event's small version, false when it's already being made
+// or failed recently. The error tells the two apart.
+func (v *variantSet) start(id int64) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if at, ok := v.failed[id]; ok && time.Since(at) < variantRetryAfter {
+		return false, errors.New("making the small version failed")
+	}
+	delete(v.failed, id)
+	if v.making[id] {
+		return false, nil
+	}
+	v.making[id] = true
+	return true, nil
+}
+
+// Releases an event's small version, noting whether it failed.
+func (v *variantSet) done(id int64, failed bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.making, id)
+	if failed {
+		v.failed[id] = time.Now()
+	}
+}
+
+// Path of an event's small version, stored as a media row of its own.
+func (app *App) variantPath(id int64) (string, error) {
+	var path string
+	err := app.DB.QueryRow(`SELECT path FROM media WHERE event_id = ? AND kind = ?`, id, MediaVideoLow).Scan(&path)
+	return path, err
+}
+
+// Serves an event's video. With quality=low it's a smaller re-encode made on
+// first request by the conversion workers, answered with a 202 and Retry-After
+// until it's ready.
+func (app *App) EventVideoHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such event.")
+		return
+	}
+	event, err := app.FindEvent(id)
+	if err == nil && event.VideoExpired {
+		app.RenderError(w, r, http.StatusGone, "The video expired and was deleted.")
+		return
+	} else if err == sql.ErrNoRows || (err == nil && event.Video == "") {
+		app.RenderError(w, r, http.StatusNotFound, "There is no such video.")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	switch r.FormValue("quality") {
+	case "", "full":
+		w = app.throttle(w, r)
+		mediaHeaders(w, r, event.Video, event.downloadName())
+		app.serveMedia(w, r, event.Video)
+		return
+	case "low":
+	default:
+		app.RenderError(w, r, http.StatusBadRequest, "The quality has to be full or low.")
+		return
+	}
+
+	path, err := app.variantPath(event.Id)
+	if err == nil {
+		if _, err := os.Stat(path); err == nil {
+			w = app.throttle(w, r)
+			mediaHeaders(w, r, path, event.downloadName()+" (small)")
+			w.Header().Set("Content-Disposition", contentDisposition("attachment", event.downloadName()+" (small)"+filepath.Ext(path)))
+			app.serveMedia(w, r, path)
+			return
+		}
+	} else if err != sql.ErrNoRows {
+		panic(err)
+	}
+	if app.FFmpeg == "" {
+		app.RenderError(w, r, http.StatusNotFound, "There is no small version without ffmpeg.")
+		return
+	}
+
+	started, err := app.Variants.start(event.Id)
+	if err != nil {
+		app.RenderError(w, r, http.StatusInternalServerError, "The small version couldn't be made, try again later.")
+		return
+	}
+	if started && !app.Transcodes.Queue(transcodeJob{Id: event.Id, RequestID: RequestID(r.Context()), Variant: true}) {
+		app.Variants.done(event.Id, false)
+		w.Header().Set("Retry-After", "30")
+		app.RenderError(w, r, http.StatusServiceUnavailable, "The server is shutting down, try again later.")
+		return
+	}
+
+	w.Header().Set("Retry-After", "5")
+	app.RenderError(w, r, http.StatusAccepted, "The small version is being made, try again in a moment.")
+}
+
+// Makes the small version of an event's video, about 480p at a lower quality,
+// and attaches it to the event so it counts towards its size and goes with it.
+func (app *App) makeVariant(ctx context.Context, job transcodeJob) {
+	logger := app.Logger.With(job.RequestID)
+	failed := true
+	defer func() { app.Variants.done(job.Id, failed) }()
+
+	event, err := app.FindEvent(job.Id)
+	if err == sql.ErrNoRows {
+		failed = false
+		return
+	} else if err != nil {
+		logger.Printf("Error finding event %d to make a small version of\n", job.Id)
+		logger.Println(err.Error())
+		return
+	}
+
+	src, wipe, err := app.plainCopy(event.Video)
+	if err != nil {
+		logger.Printf("Error reading the video of event %d\n", event.Id)
+		logger.Println(err.Error())
+		return
+	}
+	defer wipe()
+
+	dst, err := reservePath(strings.TrimSuffix(event.Video, filepath.Ext(event.Video)) + "-low" + app.Codec.ext)
+	if err != nil {
+		logger.Printf("Error reserving a name for the small version of event %d\n", event.Id)
+		logger.Println(err.Error())
+		return
+	}
+	err = app.sealedOutput(dst, func(out string) error {
+		return app.encodeVariant(ctx, src, out)
+	})
+	if ctx.Err() == nil {
+		app.recordTranscode(logger, job, err != nil)
+	}
+	if err != nil {
+		os.Remove(dst)
+		if ctx.Err() != nil {
+			failed = false
+			return
+		}
+		logger.Printf("Error making the small version of event %d\n", event.Id)
+		logger.Println(err.Error())
+		return
+	}
+
+	if err := app.attachVariant(event.Id, dst); err != nil {
+		os.Remove(dst)
+		if err == sql.ErrNoRows {
+			failed = false
+			return
+		}
+		logger.Printf("Error saving the small version of event %d\n", event.Id)
+		logger.Println(err.Error())
+		return
+	}
+
+	failed = false
+	logger.Println("Made the small version of event", event.Id)
+}
+
+// Re-encodes src at dst with the conversion codec, scaled down to 480 lines
+// (never up) and at a lower quality.
+func (app *App) encodeVariant(ctx context.Context, src, dst string) error {
+	crf := app.Codec.crf + 7
+	if crf > app.Codec.maxCRF {
+		crf = app.Codec.maxCRF
+	}
+	args := []string{"-i", src, "-c:v", app.Codec.encoder, "-crf", strconv.Itoa(crf)}
+	args = append(args, app.Codec.crfArgs...)
+	args = append(args, app.Codec.args...)
+	args = append(args, "-vf", "scale=-2:'min(480,ih)'")
+	if app.Config.stripAudio {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-b:a", "64k")
+	}
+	args = append(args, "-y", dst)
+
+	cmd := exec.CommandContext(ctx, app.FFmpeg, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return ffmpegError(err, out)
+	}
+	return nil
+}
+
+// Attaches a small version to its event, returning sql.ErrNoRows if the event
+// or its video was deleted in the meantime.
+func (app *App) attachVariant(id int64, path string) error {
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow(`SELECT 1 FROM events WHERE id = ? AND video != ''`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if err := addMedia(tx, id, MediaVideoLow, path); err != nil {
+		return err
+	}
+	if err := setEventSize(tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Build information, set when building with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%FT%TZ)"
+//
+// Builds without them fall back on what the Go toolchain recorded.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// Version, commit and build date of the running binary
+type buildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+	Go      string `json:"go"`
+}
+
+// Returns the build information, filling in the commit and date from the
+// module's VCS stamp when they weren't set.
+func Build() buildInfo {
+	build := buildInfo{Version: version, Commit: commit, Date: date, Go: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && build.Commit == "":
+				build.Commit = setting.Value
+			case setting.Key == "vcs.time" && build.Date == "":
+				build.Date = setting.Value
+			}
+		}
+	}
+
+	return build
+}
+
+// One line description, e.g. "seccam-web 1.4.0 (commit 3f2a1b9, built 2024-06-01T12:00:00Z, go1.22.3)".
+func (b buildInfo) String() string {
+	s := "seccam-web " + b.Version + " ("
+	if b.Commit != "" {
+		s += "commit " + b.Commit + ", "
+	}
+	if b.Date != "" {
+		s += "built " + b.Date + ", "
+	}
+	return s + b.Go + ")"
+}
+
+// Returns the build information as JSON.
+func (app *App) APIVersionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeJSON(w, http.StatusOK, Build())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/battleroid/seccam-web/signature"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Body of the webhooks sent
+type webhookPayload struct {
+	Type       string   `json:"type"`
+	Redelivery bool     `json:"redelivery"`        // Sent again by an admin
+	URL        string   `json:"url"`               // Event page, absolute with -base-url set
+	AckURL     string   `json:"ack_url,omitempty"` // Acknowledges the alert, with -escalate
+	Event      apiEvent `json:"event"`
+}
+
+// Queues a webhook about the event.
+func (app *App) QueueWebhook(event *Event, redelivery bool) (int64, error) {
+	body := webhookPayload{
+		Type:       "event.created",
+		Redelivery: redelivery,
+		URL:        app.PublicURL(fmt.Sprintf("/event/%d", event.Id)),
+		Event:      app.apiEvent(event),
+	}
+	if len(app.Config.escalation) > 0 {
+		body.AckURL = app.PublicURL(app.AckLink(event.Id))
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	return app.queueDelivery(ChannelWebhook, event.Id, payload)
+}
+
+// Posts a webhook, signed when -webhook-secret is set. Anything but a 2xx
+// response is an error, the status code is returned either way.
+func (app *App) postWebhook(id int64, payload []byte) (int, error) {
+	return app.postJSON(app.Config.webhookURL, id, payload)
+}
+
+// Posts a delivery's payload to target like a webhook.
+func (app *App) postJSON(target string, id int64, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "seccam-web")
+	req.Header.Set("X-Seccam-Delivery", strconv.FormatInt(id, 10))
+	if app.Config.webhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(signature.TimestampHeader, timestamp)
+		req.Header.Set(signature.SignatureHeader, signature.ComputeBody([]byte(app.Config.webhookSecret), timestamp, payload))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Lists the recent deliveries, webhooks and other channels, with their attempts.
+// limit (default 50, at most 500) sets how many.
+func (app *App) WebhooksHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeFieldError(w, ErrInvalidField, "limit", "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deliveries": app.GetDeliveries(limit),
+	})
+}
+
+// Sends the webhook for an event again, with the event as it is now.
+func (app *App) RedeliverHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if app.Config.webhookURL == "" {
+		writeJSONError(w, http.StatusConflict, "webhooks are not enabled")
+		return
+	}
+	event := app.apiLookupEvent(w, p)
+	if event == nil {
+		return
+	}
+
+	id, err := app.QueueWebhook(event, true)
+	if err != nil {
+		panic(err)
+	}
+	app.Log(r).Printf("Queued webhook redelivery %d of event %d\n", id, event.Id)
+
+	writeJSON(w, http.StatusAccepted, map[string]int64{"delivery_id": id})
+}